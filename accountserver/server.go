@@ -178,6 +178,11 @@ func (server *AccountServer) AccountGetHandler(writer http.ResponseWriter, reque
 		writer.Write([]byte(""))
 		return
 	}
+	format := common.ListingFormat(request.FormValue("format"), request.Header.Get("Accept"))
+	if format == "" {
+		srv.StandardResponse(writer, http.StatusNotAcceptable)
+		return
+	}
 	limit := int64(10000)
 	limitStr := request.FormValue("limit")
 	if limitStr != "" {
@@ -200,17 +205,6 @@ func (server *AccountServer) AccountGetHandler(writer http.ResponseWriter, reque
 		srv.StandardResponse(writer, http.StatusInternalServerError)
 		return
 	}
-	format := request.Form.Get("format")
-	if format == "" { /* TODO: real accept parsing */
-		accept := request.Header.Get("Accept")
-		if strings.Contains(accept, "application/json") {
-			format = "json"
-		} else if strings.Contains(accept, "application/xml") || strings.Contains(accept, "text/xml") {
-			format = "xml"
-		} else {
-			format = "text"
-		}
-	}
 	if format == "json" {
 		output, err := json.Marshal(containers)
 		if err != nil {
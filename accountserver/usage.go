@@ -0,0 +1,104 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package accountserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/RocFang/hummingbird/common/usage"
+)
+
+// usageRecords returns a storage record for each of the account's policies,
+// or none if the account's deleted.
+func usageRecords(db Account, now time.Time) ([]*usage.Record, error) {
+	if deleted, err := db.IsDeleted(); err != nil || deleted {
+		return nil, err
+	}
+	info, err := db.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := db.PolicyStats()
+	if err != nil {
+		return nil, err
+	}
+	if len(stats) == 0 {
+		// Databases from before policies were tracked only have totals.
+		stats = []*PolicyStat{{ContainerCount: info.ContainerCount, ObjectCount: info.ObjectCount, BytesUsed: info.BytesUsed}}
+	}
+	records := make([]*usage.Record, 0, len(stats))
+	for _, stat := range stats {
+		records = append(records, &usage.Record{
+			Kind:           usage.KindStorage,
+			Time:           now.Unix(),
+			Account:        info.Account,
+			Policy:         stat.StoragePolicyIndex,
+			ContainerCount: stat.ContainerCount,
+			ObjectCount:    stat.ObjectCount,
+			BytesUsed:      stat.BytesUsed,
+		})
+	}
+	return records, nil
+}
+
+// UsageSnapshot writes storage records for every account database on the
+// devices under deviceRoot. Databases that can't be read are skipped, and
+// counted in the error returned at the end.
+func UsageSnapshot(deviceRoot string, w *usage.LogWriter) error {
+	devices, err := ioutil.ReadDir(deviceRoot)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	var firstErr error
+	for _, device := range devices {
+		if !device.IsDir() {
+			continue
+		}
+		dbFiles, err := filepath.Glob(filepath.Join(deviceRoot, device.Name(), "accounts", "[0-9]*",
+			"[a-f0-9][a-f0-9][a-f0-9]", "????????????????????????????????", "*.db"))
+		if err != nil {
+			return err
+		}
+		for _, dbFile := range dbFiles {
+			if filepath.Base(dbFile) != filepath.Base(filepath.Dir(dbFile))+".db" {
+				continue
+			}
+			now := time.Now()
+			db, err := sqliteOpenAccount(dbFile)
+			if err == nil {
+				var records []*usage.Record
+				if records, err = usageRecords(db, now); err == nil {
+					err = w.Write(records, now)
+				}
+				db.Close()
+			}
+			if err != nil {
+				if failed == 0 {
+					firstErr = fmt.Errorf("%s: %v", dbFile, err)
+				}
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d account databases couldn't be snapshotted, the first: %v", failed, firstErr)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package accountserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/RocFang/hummingbird/common/usage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	devices := filepath.Join(dir, "devices")
+	create := func(device, account, hash string) Account {
+		dbFile := filepath.Join(devices, device, "accounts", "1", hash[29:32], hash, hash+".db")
+		require.Nil(t, os.MkdirAll(filepath.Dir(dbFile), 0777))
+		require.Nil(t, sqliteCreateAccount(dbFile, account, "200000000.00000", nil))
+		db, err := sqliteOpenAccount(dbFile)
+		require.Nil(t, err)
+		return db
+	}
+	db := create("sda", "AUTH_a", "00000000000000000000000000000abc")
+	require.Nil(t, db.PutContainer("c1", "200000001.00000", "0", 2, 100, 0))
+	require.Nil(t, db.PutContainer("c2", "200000001.00000", "0", 3, 1000, 1))
+	require.Nil(t, db.PutContainer("c3", "200000001.00000", "0", 1, 10, 1))
+	db.Close()
+	db = create("sdb", "AUTH_gone", "00000000000000000000000000000def")
+	require.Nil(t, db.Delete("200000001.00000"))
+	db.Close()
+	require.Nil(t, ioutil.WriteFile(filepath.Join(devices, "sda", "accounts", "1", "abc", "00000000000000000000000000000abc", "other.db"), nil, 0666))
+
+	logDir := filepath.Join(dir, "usage")
+	w, err := usage.NewLogWriter(logDir, "storage", 0)
+	require.Nil(t, err)
+	require.Nil(t, UsageSnapshot(devices, w))
+	require.Nil(t, w.Close())
+	logs, err := filepath.Glob(filepath.Join(logDir, "storage-*.log"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(logs))
+	f, err := os.Open(logs[0])
+	require.Nil(t, err)
+	defer f.Close()
+	var records []*usage.Record
+	require.Nil(t, usage.ReadLog(f, func(r *usage.Record) error {
+		require.Equal(t, usage.KindStorage, r.Kind)
+		require.NotEqual(t, int64(0), r.Time)
+		r.Time = 0
+		records = append(records, r)
+		return nil
+	}))
+	sort.Slice(records, func(i, j int) bool { return records[i].Policy < records[j].Policy })
+	require.Equal(t, []*usage.Record{
+		{Kind: usage.KindStorage, Account: "AUTH_a", Policy: 0, ContainerCount: 1, ObjectCount: 2, BytesUsed: 100},
+		{Kind: usage.KindStorage, Account: "AUTH_a", Policy: 1, ContainerCount: 2, ObjectCount: 4, BytesUsed: 1010},
+	}, records)
+
+	require.NotNil(t, UsageSnapshot(filepath.Join(dir, "nope"), w))
+}
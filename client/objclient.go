@@ -105,6 +105,12 @@ func (oc *standardObjectClient) putObject(ctx context.Context, account, containe
 	responsec := make(chan *http.Response)
 	devs, more := oc.objectRing.getWriteNodes(objectPartition)
 	objectReplicaCount := len(devs)
+	// A src that knows some headers only once it has been read to the end
+	// has them sent as trailers; the keys have to be there up front.
+	var trailer http.Header
+	if t, ok := src.(interface{ Trailer() http.Header }); ok {
+		trailer = t.Trailer()
+	}
 
 	devToRequest := func(index int, dev *ring.Device) (*http.Request, error) {
 		trp, wp := io.Pipe()
@@ -125,6 +131,7 @@ func (oc *standardObjectClient) putObject(ctx context.Context, account, containe
 		req.Header.Set("X-Container-Partition", strconv.FormatUint(containerPartition, 10))
 		addUpdateHeaders("X-Container", req.Header, containerDevices, index, objectReplicaCount)
 		req.Header.Set("Expect", "100-continue")
+		req.Trailer = trailer
 		return req, nil
 	}
 
@@ -199,7 +199,7 @@ func processControlCommand(serverCommand func(name string, args ...string) error
 	}
 
 	switch flag.Arg(1) {
-	case "proxy", "object", "object-replicator", "container", "container-replicator", "account", "account-replicator", "andrewd":
+	case "proxy", "object", "object-replicator", "object-expirer", "container", "container-replicator", "container-sync", "container-sharder", "container-reconciler", "container-lifecycle", "account", "account-replicator", "andrewd":
 		if err := serverCommand(flag.Arg(1), flag.Args()[2:]...); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
@@ -268,6 +268,17 @@ func Main() {
 		objectReplicatorFlags.PrintDefaults()
 	}
 
+	objectExpirerFlags := flag.NewFlagSet("object expirer", flag.ExitOnError)
+	objectExpirerFlags.String("c", findConfig("object"), "Config file/directory to use")
+	objectExpirerFlags.String("l", "stdout", "Log location")
+	objectExpirerFlags.String("e", "stderr", "Error log location")
+	objectExpirerFlags.Bool("once", false, "Run one pass of the expirer")
+	objectExpirerFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird object-expirer [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run object expirer")
+		objectExpirerFlags.PrintDefaults()
+	}
+
 	containerFlags := flag.NewFlagSet("container server", flag.ExitOnError)
 	containerFlags.String("c", findConfig("container"), "Config file/directory to use")
 	containerFlags.String("l", "stdout", "Log location")
@@ -289,6 +300,50 @@ func Main() {
 		containerReplicatorFlags.PrintDefaults()
 	}
 
+	containerSyncFlags := flag.NewFlagSet("container sync", flag.ExitOnError)
+	containerSyncFlags.String("c", findConfig("container"), "Config file/directory to use")
+	containerSyncFlags.String("l", "stdout", "Log location")
+	containerSyncFlags.String("e", "stderr", "Error log location")
+	containerSyncFlags.Bool("once", false, "Run one pass of container sync")
+	containerSyncFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird container-sync [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run container sync")
+		containerSyncFlags.PrintDefaults()
+	}
+
+	containerSharderFlags := flag.NewFlagSet("container sharder", flag.ExitOnError)
+	containerSharderFlags.String("c", findConfig("container"), "Config file/directory to use")
+	containerSharderFlags.String("l", "stdout", "Log location")
+	containerSharderFlags.String("e", "stderr", "Error log location")
+	containerSharderFlags.Bool("once", false, "Run one pass of the container sharder")
+	containerSharderFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird container-sharder [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run container sharder")
+		containerSharderFlags.PrintDefaults()
+	}
+
+	containerReconcilerFlags := flag.NewFlagSet("container reconciler", flag.ExitOnError)
+	containerReconcilerFlags.String("c", findConfig("container"), "Config file/directory to use")
+	containerReconcilerFlags.String("l", "stdout", "Log location")
+	containerReconcilerFlags.String("e", "stderr", "Error log location")
+	containerReconcilerFlags.Bool("once", false, "Run one pass of the container reconciler")
+	containerReconcilerFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird container-reconciler [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run container reconciler")
+		containerReconcilerFlags.PrintDefaults()
+	}
+
+	containerLifecycleFlags := flag.NewFlagSet("container lifecycle", flag.ExitOnError)
+	containerLifecycleFlags.String("c", findConfig("container"), "Config file/directory to use")
+	containerLifecycleFlags.String("l", "stdout", "Log location")
+	containerLifecycleFlags.String("e", "stderr", "Error log location")
+	containerLifecycleFlags.Bool("once", false, "Run one pass of the container lifecycle daemon")
+	containerLifecycleFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird container-lifecycle [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run container lifecycle daemon")
+		containerLifecycleFlags.PrintDefaults()
+	}
+
 	accountFlags := flag.NewFlagSet("account server", flag.ExitOnError)
 	accountFlags.String("c", findConfig("account"), "Config file/directory to use")
 	accountFlags.String("l", "stdout", "Log location")
@@ -328,6 +383,20 @@ func Main() {
 		fmt.Fprintf(os.Stderr, "    validate (validate ring)\n")
 		fmt.Fprintf(os.Stderr, "    write_ring (write the ring file)\n")
 		fmt.Fprintf(os.Stderr, "    pretend_min_part_hours_passed (reset min_part_hours)\n")
+		fmt.Fprintf(os.Stderr, "    simulate [-rounds <n>] [-recon] <change> ... (report what changes would do without saving them)\n")
+		fmt.Fprintf(os.Stderr, "      <change> is one of: add <device> <weight>, set_weight <id> <weight>, remove <id>\n")
+		fmt.Fprintf(os.Stderr, "    prepare_increase_partition_power (start increasing the partition power)\n")
+		fmt.Fprintf(os.Stderr, "    relink [-devices <dir>] [-device <name>] (link objects into the next partitions; run on each object server, <builder_file> may be the ring.gz)\n")
+		fmt.Fprintf(os.Stderr, "    increase_partition_power (double the partitions once every object server is relinked)\n")
+		fmt.Fprintf(os.Stderr, "    cleanup [-devices <dir>] [-device <name>] (remove objects from their old partitions; run on each object server, <builder_file> may be the ring.gz)\n")
+		fmt.Fprintf(os.Stderr, "    finish_increase_partition_power (finish once every object server is cleaned up)\n")
+		fmt.Fprintf(os.Stderr, "  relink and cleanup only touch the swift engine's objects directories; IndexDB (hec.db, repng.db) policies store objects by hash and aren't relinked, they pick up the new part power themselves\n")
+		fmt.Fprintf(os.Stderr, "hummingbird ring <composite_file> command\n")
+		fmt.Fprintf(os.Stderr, "  Composes component builders, e.g. one per region, into a single ring.  Commands are:\n")
+		fmt.Fprintf(os.Stderr, "    compose [-force] <builder_file> <builder_file> ... (compose the builders into the ring)\n")
+		fmt.Fprintf(os.Stderr, "    compose_info (display composite ring info)\n")
+		fmt.Fprintf(os.Stderr, "    compose_validate (validate the composed ring's dispersion)\n")
+		fmt.Fprintf(os.Stderr, "  <composite_file> is named like object.composite; the ring is written to object.ring.gz next to it\n")
 		fmt.Fprintf(os.Stderr, "  <device> is of the form: [r<region>]z<zone>[s<scheme>]-<ip>:<port>[R<r_ip>:<r_port>]/<device_name>_<meta>\n")
 		fmt.Fprintf(os.Stderr, "  <scheme> can be either http or https\n")
 		fmt.Fprintf(os.Stderr, "  <search_flags> is at least one of: -region, -zone, -scheme, -ip, -port, -replication-ip, replication-port, -device, -meta, -weight\n")
@@ -399,6 +468,29 @@ func Main() {
 		reconFlags.PrintDefaults()
 	}
 
+	usageSnapshotFlags := flag.NewFlagSet("usage snapshot", flag.ExitOnError)
+	usageSnapshotFlags.String("c", findConfig("account"), "Account server config file/directory to use")
+	usageSnapshotFlags.String("dir", "/var/log/hummingbird/usage", "Directory to write storage logs to")
+	usageSnapshotFlags.Int("keep-hours", 168, "Remove storage logs older than this, 0 to keep them all")
+	usageSnapshotFlags.Duration("interval", 0, "Take a snapshot this often instead of just once, e.g. 1h")
+	usageSnapshotFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird usage snapshot [ARGS]\n")
+		fmt.Fprintf(os.Stderr, "  Log what every account on this account server is storing\n")
+		usageSnapshotFlags.PrintDefaults()
+	}
+
+	usageAggregateFlags := flag.NewFlagSet("usage aggregate", flag.ExitOnError)
+	usageAggregateFlags.String("format", "csv", "Output format, csv or json (an object per line)")
+	usageAggregateFlags.String("o", "", "File to write to instead of stdout")
+	usageAggregateFlags.String("start", "", "First hour to report, like 2006-01-02T15, 2006-01-02 or RFC 3339; default is the first in the logs")
+	usageAggregateFlags.String("end", "", "Hour to report up to; default is after the last in the logs")
+	usageAggregateFlags.Duration("max-snapshot-age", 3*time.Hour, "Don't report storage from snapshots older than this")
+	usageAggregateFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird usage aggregate [ARGS] LOG_FILE...\n")
+		fmt.Fprintf(os.Stderr, "  Combine proxy transfer logs and account storage logs into hourly usage per account and policy\n")
+		usageAggregateFlags.PrintDefaults()
+	}
+
 	/* main flag parser, which doesn't do much */
 
 	flag.Usage = func() {
@@ -411,12 +503,14 @@ func Main() {
 		fmt.Fprintln(os.Stderr, "     hummingbird shutdown [daemon name] -- gracefully stop a server")
 		fmt.Fprintln(os.Stderr, "     hummingbird reload [daemon name]   -- alias for graceful-restart")
 		fmt.Fprintln(os.Stderr, "     hummingbird restart [daemon name]  -- stop then restart a server")
-		fmt.Fprintln(os.Stderr, "  The daemons are: object, proxy, object-replicator, andrewd, all, main")
+		fmt.Fprintln(os.Stderr, "  The daemons are: object, proxy, object-replicator, object-expirer, container-sync, container-sharder, container-reconciler, container-lifecycle, andrewd, all, main")
 		fmt.Fprintln(os.Stderr)
 		objectFlags.Usage()
 		fmt.Fprintln(os.Stderr)
 		objectReplicatorFlags.Usage()
 		fmt.Fprintln(os.Stderr)
+		objectExpirerFlags.Usage()
+		fmt.Fprintln(os.Stderr)
 		ringBuilderFlags.Usage()
 		fmt.Fprintln(os.Stderr)
 		proxyFlags.Usage()
@@ -458,6 +552,10 @@ func Main() {
 		objectInfoFlags.Usage()
 		fmt.Fprintln(os.Stderr)
 		reconFlags.Usage()
+		fmt.Fprintln(os.Stderr)
+		usageSnapshotFlags.Usage()
+		fmt.Fprintln(os.Stderr)
+		usageAggregateFlags.Usage()
 	}
 
 	flag.Parse()
@@ -489,6 +587,18 @@ func Main() {
 	case "container-replicator":
 		containerReplicatorFlags.Parse(flag.Args()[1:])
 		srv.RunServers(containerserver.NewReplicator, containerReplicatorFlags)
+	case "container-sync":
+		containerSyncFlags.Parse(flag.Args()[1:])
+		srv.RunServers(containerserver.NewContainerSync, containerSyncFlags)
+	case "container-sharder":
+		containerSharderFlags.Parse(flag.Args()[1:])
+		srv.RunServers(containerserver.NewContainerSharder, containerSharderFlags)
+	case "container-reconciler":
+		containerReconcilerFlags.Parse(flag.Args()[1:])
+		srv.RunServers(containerserver.NewContainerReconciler, containerReconcilerFlags)
+	case "container-lifecycle":
+		containerLifecycleFlags.Parse(flag.Args()[1:])
+		srv.RunServers(containerserver.NewContainerLifecycle, containerLifecycleFlags)
 	case "account":
 		accountFlags.Parse(flag.Args()[1:])
 		srv.RunServers(accountserver.NewServer, accountFlags)
@@ -501,6 +611,9 @@ func Main() {
 	case "object-replicator":
 		objectReplicatorFlags.Parse(flag.Args()[1:])
 		srv.RunServers(objectserver.NewReplicator, objectReplicatorFlags)
+	case "object-expirer":
+		objectExpirerFlags.Parse(flag.Args()[1:])
+		srv.RunServers(objectserver.NewExpirer, objectExpirerFlags)
 	case "bench":
 		bench.RunBench(flag.Args()[1:])
 	case "dbench":
@@ -532,6 +645,24 @@ func Main() {
 		if pass := tools.ReconClient(reconFlags, srv.DefaultConfigLoader{}); !pass {
 			os.Exit(1)
 		}
+	case "usage":
+		var err error
+		switch flag.Arg(1) {
+		case "snapshot":
+			usageSnapshotFlags.Parse(flag.Args()[2:])
+			err = tools.UsageSnapshot(usageSnapshotFlags)
+		case "aggregate":
+			usageAggregateFlags.Parse(flag.Args()[2:])
+			err = tools.UsageAggregate(usageAggregateFlags)
+		default:
+			usageSnapshotFlags.Usage()
+			usageAggregateFlags.Usage()
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "usage error:", err)
+			os.Exit(1)
+		}
 	case "init":
 		if err := initCommand(flag.Args()[1:]); err != nil {
 			fmt.Fprintln(os.Stderr, "init error:", err)
@@ -0,0 +1,265 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ChecksumHeaderPrefix starts the headers and metadata keys holding an
+// object's checksums, other than its ETag. The rest of the key is the
+// algorithm, like X-Object-Checksum-Sha256, and the value is lowercase hex.
+const ChecksumHeaderPrefix = "X-Object-Checksum-"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"crc32c": func() hash.Hash { return crc32.New(crc32cTable) },
+	"sha256": sha256.New,
+	"xxhash": func() hash.Hash { return NewXXHash64() },
+}
+
+// ChecksumHeader gives the header or metadata key for an algorithm's checksum.
+func ChecksumHeader(algorithm string) string {
+	return http.CanonicalHeaderKey(ChecksumHeaderPrefix + algorithm)
+}
+
+// ChecksumAlgorithm gives the algorithm of a checksum header or metadata key,
+// or "" if the key isn't one.
+func ChecksumAlgorithm(key string) string {
+	if len(key) <= len(ChecksumHeaderPrefix) || !strings.EqualFold(key[:len(ChecksumHeaderPrefix)], ChecksumHeaderPrefix) {
+		return ""
+	}
+	return strings.ToLower(key[len(ChecksumHeaderPrefix):])
+}
+
+// ValidChecksumAlgorithm says whether there's support for the algorithm.
+func ValidChecksumAlgorithm(algorithm string) bool {
+	_, ok := checksumAlgorithms[algorithm]
+	return ok
+}
+
+// ParseChecksumAlgorithms parses a comma separated list of algorithms, like
+// "crc32c, sha256".
+func ParseChecksumAlgorithms(value string) ([]string, error) {
+	var algorithms []string
+	for _, algorithm := range strings.Split(value, ",") {
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		if algorithm == "" {
+			continue
+		}
+		if !ValidChecksumAlgorithm(algorithm) {
+			return nil, fmt.Errorf("Unknown checksum algorithm %q", algorithm)
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, nil
+}
+
+// Checksums computes several checksums of whatever is written to it at once.
+type Checksums map[string]hash.Hash
+
+// NewChecksums returns Checksums for the algorithms, ignoring any unknown.
+func NewChecksums(algorithms ...string) Checksums {
+	c := Checksums{}
+	for _, algorithm := range algorithms {
+		if newHash, ok := checksumAlgorithms[algorithm]; ok {
+			c[algorithm] = newHash()
+		}
+	}
+	return c
+}
+
+// NewChecksumsFor returns Checksums for each algorithm that has a checksum in
+// the metadata, so they can be checked with Verify.
+func NewChecksumsFor(metadata map[string]string) Checksums {
+	var algorithms []string
+	for key := range metadata {
+		if algorithm := ChecksumAlgorithm(key); algorithm != "" {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return NewChecksums(algorithms...)
+}
+
+func (c Checksums) Write(p []byte) (int, error) {
+	for _, h := range c {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// Algorithms gives the sorted algorithms being computed.
+func (c Checksums) Algorithms() []string {
+	algorithms := make([]string, 0, len(c))
+	for algorithm := range c {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	return algorithms
+}
+
+// Headers gives the checksums so far, keyed by ChecksumHeader.
+func (c Checksums) Headers() map[string]string {
+	headers := make(map[string]string, len(c))
+	for algorithm, h := range c {
+		headers[ChecksumHeader(algorithm)] = hex.EncodeToString(h.Sum(nil))
+	}
+	return headers
+}
+
+// Verify compares the checksums so far to those in the metadata, returning an
+// error naming the first algorithm that doesn't match.
+func (c Checksums) Verify(metadata map[string]string) error {
+	for _, algorithm := range c.Algorithms() {
+		key := ChecksumHeader(algorithm)
+		expected, ok := metadata[key]
+		if !ok {
+			continue
+		}
+		if sum := hex.EncodeToString(c[algorithm].Sum(nil)); sum != strings.ToLower(expected) {
+			return fmt.Errorf("%s checksum %s does not match expected %s", algorithm, sum, expected)
+		}
+	}
+	return nil
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// XXHash64 is a streaming xxHash64 with a zero seed. Sum appends the hash
+// big endian, as the reference implementation prints it.
+type XXHash64 struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [32]byte
+	n              int
+}
+
+func NewXXHash64() *XXHash64 {
+	x := &XXHash64{}
+	x.Reset()
+	return x
+}
+
+func (x *XXHash64) Reset() {
+	// Variables, so the seeds may wrap around as they would at run time.
+	prime1, prime2 := xxPrime1, xxPrime2
+	x.v1 = prime1 + prime2
+	x.v2 = prime2
+	x.v3 = 0
+	x.v4 = -prime1
+	x.total = 0
+	x.n = 0
+}
+
+func (x *XXHash64) Size() int { return 8 }
+
+func (x *XXHash64) BlockSize() int { return 32 }
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (x *XXHash64) blocks(b []byte) []byte {
+	for ; len(b) >= 32; b = b[32:] {
+		x.v1 = xxRound(x.v1, binary.LittleEndian.Uint64(b[0:8]))
+		x.v2 = xxRound(x.v2, binary.LittleEndian.Uint64(b[8:16]))
+		x.v3 = xxRound(x.v3, binary.LittleEndian.Uint64(b[16:24]))
+		x.v4 = xxRound(x.v4, binary.LittleEndian.Uint64(b[24:32]))
+	}
+	return b
+}
+
+func (x *XXHash64) Write(b []byte) (int, error) {
+	l := len(b)
+	x.total += uint64(l)
+	if x.n+l < 32 {
+		x.n += copy(x.mem[x.n:], b)
+		return l, nil
+	}
+	if x.n > 0 {
+		c := copy(x.mem[x.n:], b)
+		x.blocks(x.mem[:])
+		b = b[c:]
+		x.n = 0
+	}
+	b = x.blocks(b)
+	x.n = copy(x.mem[:], b)
+	return l, nil
+}
+
+// Sum64 gives the hash of everything written so far.
+func (x *XXHash64) Sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v1, 1) + bits.RotateLeft64(x.v2, 7) + bits.RotateLeft64(x.v3, 12) + bits.RotateLeft64(x.v4, 18)
+		h = xxMergeRound(h, x.v1)
+		h = xxMergeRound(h, x.v2)
+		h = xxMergeRound(h, x.v3)
+		h = xxMergeRound(h, x.v4)
+	} else {
+		h = xxPrime5
+	}
+	h += x.total
+	b := x.mem[:x.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func (x *XXHash64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], x.Sum64())
+	return append(b, sum[:]...)
+}
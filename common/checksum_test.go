@@ -0,0 +1,82 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksums(t *testing.T) {
+	c := NewChecksums("crc32c", "sha256", "xxhash", "nope")
+	require.Equal(t, []string{"crc32c", "sha256", "xxhash"}, c.Algorithms())
+	c.Write([]byte("hello "))
+	c.Write([]byte("world"))
+	headers := c.Headers()
+	require.Equal(t, map[string]string{
+		"X-Object-Checksum-Crc32c": "c99465aa",
+		"X-Object-Checksum-Sha256": "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		"X-Object-Checksum-Xxhash": "45ab6734b21e6968",
+	}, headers)
+	require.Nil(t, c.Verify(headers))
+	require.Nil(t, c.Verify(map[string]string{"ETag": "whatever"}))
+	require.NotNil(t, c.Verify(map[string]string{"X-Object-Checksum-Crc32c": "00000000"}))
+
+	c = NewChecksumsFor(map[string]string{"X-Object-Checksum-Sha256": "x", "X-Object-Meta-Foo": "bar", "X-Object-Checksum-Md4": "x"})
+	require.Equal(t, []string{"sha256"}, c.Algorithms())
+}
+
+func TestParseChecksumAlgorithms(t *testing.T) {
+	algorithms, err := ParseChecksumAlgorithms(" CRC32C, sha256,,")
+	require.Nil(t, err)
+	require.Equal(t, []string{"crc32c", "sha256"}, algorithms)
+	algorithms, err = ParseChecksumAlgorithms("")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(algorithms))
+	_, err = ParseChecksumAlgorithms("crc32c,md4")
+	require.NotNil(t, err)
+	require.Equal(t, "sha256", ChecksumAlgorithm("x-object-checksum-SHA256"))
+	require.Equal(t, "", ChecksumAlgorithm("X-Object-Meta-Sha256"))
+	require.Equal(t, "", ChecksumAlgorithm("X-Object-Checksum-"))
+}
+
+func TestXXHash64(t *testing.T) {
+	require.Equal(t, uint64(0xef46db3751d8e999), NewXXHash64().Sum64())
+	// Writes of any size, straddling the 32 byte blocks, give the same hash.
+	data := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 10)
+	whole := NewXXHash64()
+	whole.Write(data)
+	for _, size := range []int{1, 3, 8, 31, 32, 33, 100} {
+		x := NewXXHash64()
+		for rest := data; len(rest) > 0; {
+			n := size
+			if n > len(rest) {
+				n = len(rest)
+			}
+			x.Write(rest[:n])
+			rest = rest[n:]
+		}
+		require.Equal(t, whole.Sum64(), x.Sum64(), fmt.Sprintf("size %d", size))
+	}
+	x := NewXXHash64()
+	x.Write([]byte("hello world"))
+	require.Equal(t, "45ab6734b21e6968", fmt.Sprintf("%x", x.Sum(nil)))
+	x.Reset()
+	require.Equal(t, uint64(0xef46db3751d8e999), x.Sum64())
+}
@@ -60,6 +60,23 @@ func (p Policy) GetDbSubDirs() (int, error) {
 	return subdirs, nil
 }
 
+// GetInlineThreshold returns the largest object size, in bytes, that index.db
+// based policies store directly in the database instead of in a file of its
+// own; 0 disables inline storage.
+func (p Policy) GetInlineThreshold() (int64, error) {
+	if p.Config["inline_threshold"] == "" {
+		return 0, nil
+	}
+	inlineThreshold, err := strconv.ParseInt(p.Config["inline_threshold"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Could not parse inline_threshold value %q: %s", p.Config["inline_threshold"], err)
+	}
+	if inlineThreshold < 0 {
+		inlineThreshold = 0
+	}
+	return inlineThreshold, nil
+}
+
 type PolicyList map[int]*Policy
 
 func (p PolicyList) Default() int {
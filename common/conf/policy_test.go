@@ -91,3 +91,14 @@ func TestNoPolicies(t *testing.T) {
 	require.Equal(t, policyList[0].Default, true)
 	require.Equal(t, policyList[0].Deprecated, false)
 }
+
+func TestGetInlineThreshold(t *testing.T) {
+	threshold, err := Policy{Config: map[string]string{}}.GetInlineThreshold()
+	require.Nil(t, err)
+	require.Equal(t, int64(0), threshold)
+	threshold, err = Policy{Config: map[string]string{"inline_threshold": "65536"}}.GetInlineThreshold()
+	require.Nil(t, err)
+	require.Equal(t, int64(65536), threshold)
+	_, err = Policy{Config: map[string]string{"inline_threshold": "big"}}.GetInlineThreshold()
+	require.NotNil(t, err)
+}
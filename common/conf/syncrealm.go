@@ -15,7 +15,13 @@
 
 package conf
 
-import "strings"
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
 
 type SyncRealm struct {
 	Name     string
@@ -27,27 +33,44 @@ type SyncRealm struct {
 type SyncRealmList map[string]SyncRealm
 
 func (l SyncRealmList) ValidateSyncTo(syncHeader string) bool {
+	_, _, err := l.SyncTo(syncHeader)
+	return err == nil
+}
+
+// SyncTo parses an X-Container-Sync-To value of the form
+// //realm/cluster/account/container and returns the realm along with the
+// URL of the remote container.
+func (l SyncRealmList) SyncTo(syncHeader string) (SyncRealm, string, error) {
 	if !strings.HasPrefix(syncHeader, "//") {
-		return false
+		return SyncRealm{}, "", fmt.Errorf("invalid sync-to %q", syncHeader)
 	}
 	parts := strings.Split(syncHeader[2:], "/")
 	if len(parts) < 4 {
-		return false
+		return SyncRealm{}, "", fmt.Errorf("invalid sync-to %q", syncHeader)
 	}
 	realm := parts[0]
 	cluster := parts[1]
 	account := parts[2]
 	container := parts[3]
 	if account == "" || container == "" {
-		return false
+		return SyncRealm{}, "", fmt.Errorf("invalid sync-to %q", syncHeader)
 	}
 	if l[realm].Key1 == "" {
-		return false
+		return SyncRealm{}, "", fmt.Errorf("unknown sync realm %q", realm)
 	}
-	if l[realm].Clusters[cluster] == "" {
-		return false
+	clusterURL := l[realm].Clusters[cluster]
+	if clusterURL == "" {
+		return SyncRealm{}, "", fmt.Errorf("unknown cluster %q in sync realm %q", cluster, realm)
 	}
-	return true
+	return l[realm], strings.TrimRight(clusterURL, "/") + "/" + account + "/" + container, nil
+}
+
+// SyncSignature returns the X-Container-Sync-Auth signature for a request,
+// given one of the realm's keys and the container's X-Container-Sync-Key.
+func SyncSignature(realmKey, method, path, timestamp, nonce, userKey string) string {
+	mac := hmac.New(sha1.New, []byte(realmKey))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n" + userKey))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 var syncRealmConfigLocations = []string{"/etc/hummingbird/container-sync-realms.conf", "/etc/swift/container-sync-realms.conf"}
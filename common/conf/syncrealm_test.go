@@ -0,0 +1,61 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSyncRealms(t *testing.T) {
+	tempFile, _ := ioutil.TempFile("", "INI")
+	tempFile.Write([]byte("[realm1]\nkey = key1\nkey2 = key2\ncluster_east = https://east.example.com/v1/\n"))
+	oldLocations := syncRealmConfigLocations
+	defer func() {
+		syncRealmConfigLocations = oldLocations
+		defer tempFile.Close()
+		defer os.Remove(tempFile.Name())
+	}()
+	syncRealmConfigLocations = []string{tempFile.Name()}
+	realms, err := GetSyncRealms()
+	require.Nil(t, err)
+	require.Equal(t, "key1", realms["realm1"].Key1)
+	require.Equal(t, "key2", realms["realm1"].Key2)
+	require.Equal(t, "https://east.example.com/v1/", realms["realm1"].Clusters["east"])
+}
+
+func TestSyncTo(t *testing.T) {
+	realms := SyncRealmList{"realm1": {Name: "realm1", Key1: "key1", Clusters: map[string]string{"east": "https://east.example.com/v1/"}}}
+	realm, remote, err := realms.SyncTo("//realm1/east/AUTH_a/c")
+	require.Nil(t, err)
+	require.Equal(t, "realm1", realm.Name)
+	require.Equal(t, "https://east.example.com/v1/AUTH_a/c", remote)
+	require.True(t, realms.ValidateSyncTo("//realm1/east/AUTH_a/c"))
+
+	for _, syncTo := range []string{"realm1/east/AUTH_a/c", "//realm1/east/AUTH_a", "//realm1/east//c", "//realm2/east/AUTH_a/c", "//realm1/west/AUTH_a/c"} {
+		_, _, err = realms.SyncTo(syncTo)
+		require.NotNil(t, err, syncTo)
+		require.False(t, realms.ValidateSyncTo(syncTo))
+	}
+}
+
+func TestSyncSignature(t *testing.T) {
+	require.Equal(t, "0e6c820dd4011308d01c9f99e865d8f4b2904bdb",
+		SyncSignature("realmkey", "PUT", "/v1/a/c/o", "1400000000.00000", "nonce", "userkey"))
+}
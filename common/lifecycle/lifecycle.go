@@ -0,0 +1,129 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package lifecycle holds container lifecycle rules, which expire objects
+// under a prefix some days after they were written, old versions some days
+// after they were replaced, and incomplete S3 multipart uploads some days
+// after they were started.
+//
+// Rules are kept in the container's X-Container-Sysmeta-Lifecycle as a JSON
+// list, like
+//
+//	[{"id": "logs", "prefix": "logs/", "expiration_days": 30,
+//	  "noncurrent_days": 7, "abort_upload_days": 1}]
+//
+// which is also the format of the X-Container-Lifecycle header clients use to
+// set them; s3api translates the ?lifecycle subresource's XML into the same
+// rules. The container-lifecycle daemon applies them.
+//
+// In a versioned container an expired object is archived into the versions
+// container before it's deleted. The daemon copies it without going through
+// the proxy, so it can't re-encrypt an object the encryption middleware wrote
+// under its archived name; expiration leaves encrypted objects in versioned
+// containers in place, counting them in the daemon's encrypted_skips metric,
+// and they have to be deleted through the proxy instead.
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// Sysmeta is the container sysmeta the rules are kept in.
+	Sysmeta = "X-Container-Sysmeta-Lifecycle"
+	// Header is the container header clients set and read the rules with.
+	Header = "X-Container-Lifecycle"
+	// MaxRules is the most rules a container can have.
+	MaxRules = 1000
+	// MaxIDLength is the longest a rule ID can be.
+	MaxIDLength = 255
+)
+
+// Rule is a single lifecycle rule. The days are 0 for actions the rule
+// doesn't take.
+type Rule struct {
+	ID       string `json:"id,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// ExpirationDays deletes objects this many days after they were written.
+	ExpirationDays int `json:"expiration_days,omitempty"`
+	// NoncurrentDays deletes old versions this many days after they were
+	// replaced or deleted.
+	NoncurrentDays int `json:"noncurrent_days,omitempty"`
+	// AbortUploadDays aborts incomplete S3 multipart uploads this many days
+	// after they were started.
+	AbortUploadDays int `json:"abort_upload_days,omitempty"`
+}
+
+// Matches reports whether the rule is enabled and applies to the object.
+func (r *Rule) Matches(name string) bool {
+	return !r.Disabled && strings.HasPrefix(name, r.Prefix)
+}
+
+// Due reports whether something that happened at t is more than days old at
+// now, for an action the rule takes.
+func Due(days int, t, now time.Time) bool {
+	return days > 0 && !t.After(now.Add(-time.Duration(days)*24*time.Hour))
+}
+
+// Validate checks the rules are ones that can be kept and applied.
+func Validate(rules []Rule) error {
+	if len(rules) == 0 {
+		return fmt.Errorf("No lifecycle rules")
+	}
+	if len(rules) > MaxRules {
+		return fmt.Errorf("More than %d lifecycle rules", MaxRules)
+	}
+	ids := map[string]bool{}
+	for i, rule := range rules {
+		if len(rule.ID) > MaxIDLength {
+			return fmt.Errorf("Lifecycle rule %d has an ID longer than %d", i, MaxIDLength)
+		}
+		if rule.ID != "" {
+			if ids[rule.ID] {
+				return fmt.Errorf("Lifecycle rule ID %q is used more than once", rule.ID)
+			}
+			ids[rule.ID] = true
+		}
+		if rule.ExpirationDays < 0 || rule.NoncurrentDays < 0 || rule.AbortUploadDays < 0 {
+			return fmt.Errorf("Lifecycle rule %d has negative days", i)
+		}
+		if rule.ExpirationDays == 0 && rule.NoncurrentDays == 0 && rule.AbortUploadDays == 0 {
+			return fmt.Errorf("Lifecycle rule %d has no actions", i)
+		}
+	}
+	return nil
+}
+
+// Parse reads and validates the rules in a sysmeta or header value.
+func Parse(value string) ([]Rule, error) {
+	var rules []Rule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("Invalid lifecycle rules: %v", err)
+	}
+	if err := Validate(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Format returns the rules as a sysmeta or header value.
+func Format(rules []Rule) string {
+	value, _ := json.Marshal(rules)
+	return string(value)
+}
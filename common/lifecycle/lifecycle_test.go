@@ -0,0 +1,65 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package lifecycle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	rules, err := Parse(`[{"id": "logs", "prefix": "logs/", "expiration_days": 30}, {"noncurrent_days": 7, "abort_upload_days": 1, "disabled": true}]`)
+	require.Nil(t, err)
+	require.Equal(t, []Rule{
+		{ID: "logs", Prefix: "logs/", ExpirationDays: 30},
+		{NoncurrentDays: 7, AbortUploadDays: 1, Disabled: true},
+	}, rules)
+	again, err := Parse(Format(rules))
+	require.Nil(t, err)
+	require.Equal(t, rules, again)
+
+	for _, value := range []string{
+		``,
+		`{}`,
+		`[]`,
+		`[{"prefix": "logs/"}]`,
+		`[{"expiration_days": -1}]`,
+		`[{"id": "a", "expiration_days": 1}, {"id": "a", "expiration_days": 2}]`,
+		`[{"expiration_days": "1"}]`,
+	} {
+		_, err := Parse(value)
+		require.NotNil(t, err, value)
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	rule := &Rule{Prefix: "logs/", ExpirationDays: 1}
+	require.True(t, rule.Matches("logs/a"))
+	require.False(t, rule.Matches("log"))
+	require.True(t, (&Rule{ExpirationDays: 1}).Matches("anything"))
+	rule.Disabled = true
+	require.False(t, rule.Matches("logs/a"))
+}
+
+func TestDue(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	require.True(t, Due(1, now.Add(-25*time.Hour), now))
+	require.True(t, Due(1, now.Add(-24*time.Hour), now))
+	require.False(t, Due(1, now.Add(-23*time.Hour), now))
+	require.False(t, Due(0, now.Add(-1000*time.Hour), now))
+}
@@ -9,4 +9,9 @@ const (
 	DefaultContainerReplicatorPort = DefaultContainerServerPort + 500
 	DefaultObjectServerPort        = 6000
 	DefaultObjectReplicatorPort    = DefaultObjectServerPort + 500
+	DefaultObjectExpirerPort       = 6004
+	DefaultContainerSyncPort       = 6005
+	DefaultContainerSharderPort    = 6006
+	DefaultContainerReconcilerPort = 6007
+	DefaultContainerLifecyclePort  = 6008
 )
@@ -122,6 +122,7 @@ type RingBuilderPickle struct {
 	LastPartGatherStart int64                   `pickle:"_last_part_gather_start"`
 	LastPartMovesEpoch  int64                   `pickle:"_last_part_moves_epoch"`
 	PartPower           int64                   `pickle:"part_power"`
+	NextPartPower       int64                   `pickle:"next_part_power"`
 	DevsChanged         bool                    `pickle:"devs_changed"`
 	Replicas            float64                 `pickle:"replicas"`
 	MinPartHours        int64                   `pickle:"min_part_hours"`
@@ -155,6 +156,7 @@ type RingBuilderDevice struct {
 
 type RingBuilder struct {
 	PartPower           int
+	NextPartPower       int
 	Replicas            float64
 	MinPartHours        int
 	Parts               int
@@ -250,6 +252,7 @@ func NewRingBuilderFromFile(builderPath string, debug bool) (*RingBuilder, error
 
 	builder := &RingBuilder{
 		PartPower:           int(rbp.PartPower),
+		NextPartPower:       int(rbp.NextPartPower),
 		Replicas:            rbp.Replicas,
 		MinPartHours:        int(rbp.MinPartHours),
 		Parts:               int(rbp.Parts),
@@ -293,6 +296,7 @@ func (b *RingBuilder) Save(builderPath string) error {
 	defer f.Close()
 	rbp := RingBuilderPickle{
 		PartPower:           int64(b.PartPower),
+		NextPartPower:       int64(b.NextPartPower),
 		Replicas:            b.Replicas,
 		MinPartHours:        int64(b.MinPartHours),
 		Parts:               int64(b.Parts),
@@ -1413,6 +1417,9 @@ func (b *RingBuilder) GetBalance() float64 {
 //
 // The proces doesn't always perfectly assign partitions (that'd take a lot more analysis and therefore a lot more time.  Because of this, it keeps rebalancing until the device skew (number of partitions a device wants compared to what it has) gets below 1% or doesn't change by more than 1% (only happens with a ring that can't be balanced no matter what).
 func (b *RingBuilder) Rebalance() (int, float64, int, error) {
+	if b.NextPartPower != 0 {
+		return 0, 0.0, 0, fmt.Errorf("Partition power increase to %d in progress; finish it before rebalancing.", b.NextPartPower)
+	}
 	numDevices := 0
 	for next, dev := devIterator(b.Devs); dev != nil; dev = next() {
 		// NOTE: original ringbuilder added a tiers thing, not sure if needed yet
@@ -1596,8 +1603,9 @@ func (b *RingBuilder) SetReplicas(newReplicaCount float64) {
 
 func (b *RingBuilder) GetRing() *hashRing {
 	data := ringData{
-		ReplicaCount: int(b.Replicas),
-		PartShift:    uint64(32 - b.PartPower),
+		ReplicaCount:  int(b.Replicas),
+		PartShift:     uint64(32 - b.PartPower),
+		NextPartPower: b.NextPartPower,
 	}
 	for i, dev := range b.Devs {
 		if dev != nil {
@@ -1631,6 +1639,75 @@ func (b *RingBuilder) GetRing() *hashRing {
 	return r
 }
 
+// PreparePartPowerIncrease marks the builder as about to move to the next
+// partition power. Rings written afterwards carry the next part power so
+// object servers link new writes into both partition layouts while the
+// relinker catches up the existing objects.
+func (b *RingBuilder) PreparePartPowerIncrease() error {
+	if b.NextPartPower != 0 {
+		return fmt.Errorf("Partition power increase to %d already in progress.", b.NextPartPower)
+	}
+	if b.DevsChanged {
+		return errors.New("Devices have changed since the last rebalance; rebalance before increasing the partition power.")
+	}
+	if len(b.replica2Part2Dev) == 0 {
+		return errors.New("Ring has no partition assignments; rebalance before increasing the partition power.")
+	}
+	if b.PartPower >= 32 {
+		return fmt.Errorf("Part Power must be at most 32 (would be %d)", b.PartPower+1)
+	}
+	b.NextPartPower = b.PartPower + 1
+	b.Version += 1
+	return nil
+}
+
+// IncreasePartPower doubles the number of partitions. Partition p becomes
+// partitions 2p and 2p+1 on the same devices, which is exactly where the
+// relinker placed the objects, so no data has to move between devices.
+func (b *RingBuilder) IncreasePartPower() error {
+	if b.NextPartPower == 0 {
+		return errors.New("No partition power increase prepared.")
+	}
+	if b.NextPartPower != b.PartPower+1 {
+		return fmt.Errorf("Partition power already increased to %d; finish the increase.", b.PartPower)
+	}
+	for i := range b.replica2Part2Dev {
+		part2Dev := make([]uint, 0, 2*len(b.replica2Part2Dev[i]))
+		for _, dev := range b.replica2Part2Dev[i] {
+			part2Dev = append(part2Dev, dev, dev)
+		}
+		b.replica2Part2Dev[i] = part2Dev
+	}
+	lastPartMoves := make([]byte, 0, 2*len(b.lastPartMoves))
+	for _, moved := range b.lastPartMoves {
+		lastPartMoves = append(lastPartMoves, moved, moved)
+	}
+	b.lastPartMoves = lastPartMoves
+	b.PartPower = b.NextPartPower
+	b.Parts *= 2
+	b.partMovedBitmap = make([]byte, maxInt(int(math.Exp2(float64(b.PartPower-3))), 1))
+	for next, dev := devIterator(b.Devs); dev != nil; dev = next() {
+		dev.Parts *= 2
+		dev.PartsWanted *= 2
+	}
+	b.Version += 1
+	return nil
+}
+
+// FinishPartPowerIncrease clears the pending increase once the relinked
+// objects have been cleaned up from their old partitions.
+func (b *RingBuilder) FinishPartPowerIncrease() error {
+	if b.NextPartPower == 0 {
+		return errors.New("No partition power increase in progress.")
+	}
+	if b.NextPartPower != b.PartPower {
+		return fmt.Errorf("Partition power has not been increased to %d yet.", b.NextPartPower)
+	}
+	b.NextPartPower = 0
+	b.Version += 1
+	return nil
+}
+
 // AddDev adds a device to the ring
 //
 // Note: This will not reblance the ring immediately as you may want to make multiple changes for a single rebalance
@@ -1860,6 +1937,76 @@ func WriteRing(builderPath string) error {
 	return r.Save(ringFile)
 }
 
+// saveBuilderAndRing writes the builder and its ring, along with backups of
+// both.
+func saveBuilderAndRing(builder *RingBuilder, builderPath string) error {
+	backupPath := path.Join(path.Dir(builderPath), "backups")
+	err := os.Mkdir(backupPath, 0777)
+	if err != nil {
+		e := err.(*os.PathError)
+		if e.Err != syscall.EEXIST {
+			return err
+		}
+	}
+	ts := time.Now().UnixNano()
+	if err = builder.Save(path.Join(backupPath, fmt.Sprintf("%d.%s", ts, path.Base(builderPath)))); err != nil {
+		return err
+	}
+	if err = builder.Save(builderPath); err != nil {
+		return err
+	}
+	ringFile := strings.TrimSuffix(builderPath, ".builder") + ".ring.gz"
+	r := builder.GetRing()
+	if err = r.Save(path.Join(backupPath, fmt.Sprintf("%d.%s", ts, path.Base(ringFile)))); err != nil {
+		return err
+	}
+	return r.Save(ringFile)
+}
+
+// PreparePartPowerIncrease sets the next part power and writes the ring.
+// Note that no locking is done here, you should call LockBuilderPath first.
+func PreparePartPowerIncrease(builderPath string) error {
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	if err != nil {
+		return err
+	}
+	if err = builder.PreparePartPowerIncrease(); err != nil {
+		return err
+	}
+	return saveBuilderAndRing(builder, builderPath)
+}
+
+// IncreasePartPower doubles the partitions and writes the ring. Every object
+// server must have been relinked first.
+// Note that no locking is done here, you should call LockBuilderPath first.
+func IncreasePartPower(builderPath string) error {
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	if err != nil {
+		return err
+	}
+	if err = builder.IncreasePartPower(); err != nil {
+		return err
+	}
+	if err = builder.Validate(); err != nil {
+		return err
+	}
+	return saveBuilderAndRing(builder, builderPath)
+}
+
+// FinishPartPowerIncrease clears the next part power and writes the ring.
+// Every object server must have been cleaned up first.
+// Note that no locking is done here, you should call LockBuilderPath first.
+func FinishPartPowerIncrease(builderPath string) error {
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	if err != nil {
+		return err
+	}
+	if err = builder.FinishPartPowerIncrease(); err != nil {
+		return err
+	}
+	return saveBuilderAndRing(builder, builderPath)
+}
+
 // Note that no locking is done here, you should call LockBuilderPath first.
 func PretendMinPartHoursPassed(builderPath string) error {
 	builder, err := NewRingBuilderFromFile(builderPath, false)
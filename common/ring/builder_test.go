@@ -0,0 +1,85 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartPowerIncrease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	builderPath := filepath.Join(dir, "object.builder")
+	require.Nil(t, CreateRing(builderPath, 4, 3, 0, false))
+	for i := int64(0); i < 4; i++ {
+		_, err = AddDevice(builderPath, -1, 0, i, "http", fmt.Sprintf("127.0.0.%d", i), 6000, "", 0, "sda", 1, false)
+		require.Nil(t, err)
+	}
+	require.NotNil(t, PreparePartPowerIncrease(builderPath))
+	_, _, _, err = Rebalance(builderPath, false, false, true)
+	require.Nil(t, err)
+	require.NotNil(t, IncreasePartPower(builderPath))
+	require.NotNil(t, FinishPartPowerIncrease(builderPath))
+	oldRing, err := LoadRingMD5(filepath.Join(dir, "object.ring.gz"), "prefix", "suffix")
+	require.Nil(t, err)
+
+	require.Nil(t, PreparePartPowerIncrease(builderPath))
+	require.NotNil(t, PreparePartPowerIncrease(builderPath))
+	_, _, _, err = Rebalance(builderPath, false, false, true)
+	require.NotNil(t, err)
+	r, err := LoadRingMD5(filepath.Join(dir, "object.ring.gz"), "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, 5, NextPartPower(r))
+	require.Equal(t, uint64(16), r.PartitionCount())
+
+	require.Nil(t, IncreasePartPower(builderPath))
+	require.NotNil(t, IncreasePartPower(builderPath))
+	r, err = LoadRingMD5(filepath.Join(dir, "object.ring.gz"), "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, 5, NextPartPower(r))
+	require.Equal(t, uint64(32), r.PartitionCount())
+	for part := uint64(0); part < 32; part++ {
+		require.Equal(t, oldRing.GetNodes(part/2), r.GetNodes(part))
+	}
+	hsh := "d41d8cd98f00b204e9800998ecf8427e"
+	oldPart, err := oldRing.PartitionForHash(hsh)
+	require.Nil(t, err)
+	newPart, err := r.PartitionForHash(hsh)
+	require.Nil(t, err)
+	require.Equal(t, oldPart, newPart/2)
+	part, err := PartitionForHashPower(hsh, 5)
+	require.Nil(t, err)
+	require.Equal(t, newPart, part)
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	require.Nil(t, err)
+	require.Nil(t, builder.Validate())
+	require.Equal(t, 5, builder.PartPower)
+	require.Equal(t, 32, builder.Parts)
+
+	require.Nil(t, FinishPartPowerIncrease(builderPath))
+	r, err = LoadRingMD5(filepath.Join(dir, "object.ring.gz"), "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, 0, NextPartPower(r))
+	_, _, _, err = Rebalance(builderPath, false, false, true)
+	require.Nil(t, err)
+}
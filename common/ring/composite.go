@@ -0,0 +1,333 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A composite ring is built from several component ring builders, usually
+// one per region, that are each balanced on their own. Composing puts the
+// components' replicas side by side, so every partition gets exactly each
+// component's replica count in that component's regions no matter how the
+// components are rebalanced.
+//
+// Device ids in the composite ring are the component's device id plus the
+// component's offset, so they only stay stable while no component other than
+// the last one grows its device list.
+
+// CompositeRingComponent records one component builder of a composite ring.
+type CompositeRingComponent struct {
+	BuilderFile string `json:"builder_file"`
+	Version     int    `json:"version"`
+	Replicas    int    `json:"replicas"`
+	Regions     []int  `json:"regions"`
+	DevOffset   int    `json:"dev_offset"`
+	DevCount    int    `json:"dev_count"`
+}
+
+// CompositeRing is the metadata kept alongside a composite ring, used to
+// validate the ring and to check later compositions against it.
+type CompositeRing struct {
+	Version     int                       `json:"version"`
+	ComposeTime int64                     `json:"compose_time"`
+	PartPower   int                       `json:"part_power"`
+	Replicas    int                       `json:"replicas"`
+	Components  []*CompositeRingComponent `json:"components"`
+}
+
+// LoadCompositeRing reads composite ring metadata from the given file.
+func LoadCompositeRing(compositePath string) (*CompositeRing, error) {
+	data, err := ioutil.ReadFile(compositePath)
+	if err != nil {
+		return nil, err
+	}
+	cr := &CompositeRing{}
+	if err = json.Unmarshal(data, cr); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", compositePath, err)
+	}
+	return cr, nil
+}
+
+// Save writes the composite ring metadata to the given file.
+func (cr *CompositeRing) Save(compositePath string) error {
+	data, err := json.MarshalIndent(cr, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(compositePath, append(data, '\n'), 0644)
+}
+
+// builderRegions gives the sorted regions of a builder's devices.
+func builderRegions(b *RingBuilder) []int {
+	seen := map[int]bool{}
+	regions := []int{}
+	for next, dev := devIterator(b.Devs); dev != nil; dev = next() {
+		if !seen[int(dev.Region)] {
+			seen[int(dev.Region)] = true
+			regions = append(regions, int(dev.Region))
+		}
+	}
+	sort.Ints(regions)
+	return regions
+}
+
+// ComposeRings builds a composite ring from the component builders. If
+// previous is not nil the composition is checked against it, see
+// CheckComposition.
+func ComposeRings(builderFiles []string, builders []*RingBuilder, previous *CompositeRing) (*hashRing, *CompositeRing, error) {
+	if len(builders) < 2 {
+		return nil, nil, errors.New("A composite ring needs at least two component builders.")
+	}
+	if len(builderFiles) != len(builders) {
+		return nil, nil, errors.New("Each component builder needs a file name.")
+	}
+	cr := &CompositeRing{PartPower: builders[0].PartPower, ComposeTime: time.Now().Unix()}
+	if previous != nil {
+		cr.Version = previous.Version
+	}
+	cr.Version++
+	regionOwner := map[int]int{}
+	devKeys := map[string]int{}
+	offset := 0
+	for i, b := range builders {
+		if b.PartPower != cr.PartPower {
+			return nil, nil, fmt.Errorf("Component %s has part power %d, not %d.", builderFiles[i], b.PartPower, cr.PartPower)
+		}
+		if b.NextPartPower != 0 {
+			return nil, nil, fmt.Errorf("Component %s has a partition power increase in progress.", builderFiles[i])
+		}
+		if b.Replicas != math.Trunc(b.Replicas) {
+			return nil, nil, fmt.Errorf("Component %s has a fractional replica count %f.", builderFiles[i], b.Replicas)
+		}
+		if b.DevsChanged {
+			return nil, nil, fmt.Errorf("Component %s has device changes that have not been rebalanced.", builderFiles[i])
+		}
+		if err := b.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("Component %s is not valid: %v", builderFiles[i], err)
+		}
+		component := &CompositeRingComponent{
+			BuilderFile: builderFiles[i],
+			Version:     b.Version,
+			Replicas:    int(b.Replicas),
+			Regions:     builderRegions(b),
+			DevOffset:   offset,
+			DevCount:    len(b.Devs),
+		}
+		for _, region := range component.Regions {
+			if owner, ok := regionOwner[region]; ok {
+				return nil, nil, fmt.Errorf("Region %d is in both %s and %s.", region, builderFiles[owner], builderFiles[i])
+			}
+			regionOwner[region] = i
+		}
+		for next, dev := devIterator(b.Devs); dev != nil; dev = next() {
+			key := fmt.Sprintf("%s:%d/%s", dev.Ip, dev.Port, dev.Device)
+			if owner, ok := devKeys[key]; ok {
+				return nil, nil, fmt.Errorf("Device %s is in both %s and %s.", key, builderFiles[owner], builderFiles[i])
+			}
+			devKeys[key] = i
+		}
+		cr.Replicas += component.Replicas
+		cr.Components = append(cr.Components, component)
+		offset += len(b.Devs)
+	}
+	if offset > int(NONE_DEV) {
+		return nil, nil, fmt.Errorf("Composite ring would have %d devices; at most %d are supported.", offset, NONE_DEV)
+	}
+	if previous != nil {
+		if err := cr.CheckComposition(previous); err != nil {
+			return nil, nil, err
+		}
+	}
+	data := ringData{
+		ReplicaCount: cr.Replicas,
+		PartShift:    uint64(32 - cr.PartPower),
+	}
+	for i, b := range builders {
+		r := b.GetRing()
+		for _, dev := range r.getData().Devs {
+			if dev != nil {
+				dev.Id += cr.Components[i].DevOffset
+			}
+			data.Devs = append(data.Devs, dev)
+		}
+		for _, part2devId := range r.getData().replica2part2devId {
+			row := make([]uint16, len(part2devId))
+			for part, devId := range part2devId {
+				row[part] = devId + uint16(cr.Components[i].DevOffset)
+			}
+			data.replica2part2devId = append(data.replica2part2devId, row)
+		}
+	}
+	r := &hashRing{}
+	r.data.Store(&data)
+	if err := cr.Validate(r); err != nil {
+		return nil, nil, err
+	}
+	return r, cr, nil
+}
+
+// CheckComposition makes sure a new composition can replace the previous
+// one: the same components in the same order, none of them older than
+// before, and no device ids shifted by a component growing.
+func (cr *CompositeRing) CheckComposition(previous *CompositeRing) error {
+	if len(cr.Components) != len(previous.Components) {
+		return fmt.Errorf("Composite ring had %d components, not %d.", len(previous.Components), len(cr.Components))
+	}
+	if cr.PartPower != previous.PartPower {
+		return fmt.Errorf("Composite ring had part power %d, not %d.", previous.PartPower, cr.PartPower)
+	}
+	for i, component := range cr.Components {
+		prev := previous.Components[i]
+		if path.Base(component.BuilderFile) != path.Base(prev.BuilderFile) {
+			return fmt.Errorf("Component %d was %s, not %s.", i, prev.BuilderFile, component.BuilderFile)
+		}
+		if component.Version < prev.Version {
+			return fmt.Errorf("Component %s is version %d, older than the composed version %d.", component.BuilderFile, component.Version, prev.Version)
+		}
+		if component.DevOffset != prev.DevOffset {
+			return fmt.Errorf("Device ids of component %s would move from offset %d to %d.", component.BuilderFile, prev.DevOffset, component.DevOffset)
+		}
+	}
+	return nil
+}
+
+// Validate checks that every partition of the composed ring has exactly each
+// component's replica count on distinct devices in that component's regions.
+func (cr *CompositeRing) Validate(r Ring) error {
+	if r.ReplicaCount() != uint64(cr.Replicas) {
+		return fmt.Errorf("Ring has %d replicas, not %d.", r.ReplicaCount(), cr.Replicas)
+	}
+	if r.PartitionCount() != uint64(1)<<uint(cr.PartPower) {
+		return fmt.Errorf("Ring has %d partitions, not %d.", r.PartitionCount(), uint64(1)<<uint(cr.PartPower))
+	}
+	regionComponent := map[int]int{}
+	for i, component := range cr.Components {
+		for _, region := range component.Regions {
+			regionComponent[region] = i
+		}
+	}
+	counts := make([]int, len(cr.Components))
+	for part := uint64(0); part < r.PartitionCount(); part++ {
+		for i := range counts {
+			counts[i] = 0
+		}
+		used := map[int]bool{}
+		for _, dev := range r.GetNodes(part) {
+			if dev == nil {
+				return fmt.Errorf("Partition %d has a replica on no device.", part)
+			}
+			if used[dev.Id] {
+				return fmt.Errorf("Partition %d has more than one replica on device %d.", part, dev.Id)
+			}
+			used[dev.Id] = true
+			i, ok := regionComponent[dev.Region]
+			if !ok {
+				return fmt.Errorf("Partition %d has a replica in region %d, which is in no component.", part, dev.Region)
+			}
+			counts[i]++
+		}
+		for i, component := range cr.Components {
+			if counts[i] != component.Replicas {
+				return fmt.Errorf("Partition %d has %d replicas in %s, not %d.", part, counts[i], component.BuilderFile, component.Replicas)
+			}
+		}
+	}
+	return nil
+}
+
+// compositeRingFile gives the ring file for a composite metadata file.
+func compositeRingFile(compositePath string) string {
+	return strings.TrimSuffix(compositePath, ".composite") + ".ring.gz"
+}
+
+// Compose composes the builders into the ring next to compositePath, saving
+// backups of the composite metadata and the ring. Unless force is set the
+// composition has to be compatible with the existing one, if any.
+// Note that no locking is done here, you should call LockBuilderPath first.
+func Compose(compositePath string, builderFiles []string, force bool) (*CompositeRing, error) {
+	builders := make([]*RingBuilder, len(builderFiles))
+	for i, builderFile := range builderFiles {
+		var err error
+		if builders[i], err = NewRingBuilderFromFile(builderFile, false); err != nil {
+			return nil, fmt.Errorf("Error loading %s: %v", builderFile, err)
+		}
+	}
+	previous, err := LoadCompositeRing(compositePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		previous = nil
+	}
+	var r *hashRing
+	var cr *CompositeRing
+	if force || previous == nil {
+		r, cr, err = ComposeRings(builderFiles, builders, nil)
+		if err == nil && previous != nil {
+			cr.Version = previous.Version + 1
+		}
+	} else {
+		r, cr, err = ComposeRings(builderFiles, builders, previous)
+	}
+	if err != nil {
+		return nil, err
+	}
+	backupPath := path.Join(path.Dir(compositePath), "backups")
+	err = os.Mkdir(backupPath, 0777)
+	if err != nil {
+		e := err.(*os.PathError)
+		if e.Err != syscall.EEXIST {
+			return nil, err
+		}
+	}
+	ts := time.Now().UnixNano()
+	if err = cr.Save(path.Join(backupPath, fmt.Sprintf("%d.%s", ts, path.Base(compositePath)))); err != nil {
+		return nil, err
+	}
+	if err = cr.Save(compositePath); err != nil {
+		return nil, err
+	}
+	ringFile := compositeRingFile(compositePath)
+	if err = r.Save(path.Join(backupPath, fmt.Sprintf("%d.%s", ts, path.Base(ringFile)))); err != nil {
+		return nil, err
+	}
+	return cr, r.Save(ringFile)
+}
+
+// ValidateComposite checks the ring next to compositePath against its
+// composite metadata.
+func ValidateComposite(compositePath string) error {
+	cr, err := LoadCompositeRing(compositePath)
+	if err != nil {
+		return err
+	}
+	r, err := LoadRingMD5(compositeRingFile(compositePath), "", "")
+	if err != nil {
+		return err
+	}
+	return cr.Validate(r)
+}
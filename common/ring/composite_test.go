@@ -0,0 +1,130 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeComponent(t *testing.T, builderPath string, partPower int, replicas float64, region int64, devs int) {
+	require.Nil(t, CreateRing(builderPath, partPower, replicas, 0, false))
+	for i := 0; i < devs; i++ {
+		_, err := AddDevice(builderPath, -1, region, int64(i), "http", fmt.Sprintf("127.0.%d.%d", region, i), 6000, "", 0, "sda", 1, false)
+		require.Nil(t, err)
+	}
+	_, _, _, err := Rebalance(builderPath, false, false, true)
+	require.Nil(t, err)
+}
+
+func TestCompose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	r1 := filepath.Join(dir, "r1.builder")
+	r2 := filepath.Join(dir, "r2.builder")
+	makeComponent(t, r1, 6, 2, 1, 4)
+	makeComponent(t, r2, 6, 1, 2, 3)
+	compositePath := filepath.Join(dir, "object.composite")
+
+	cr, err := Compose(compositePath, []string{r1, r2}, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, cr.Version)
+	require.Equal(t, 3, cr.Replicas)
+	require.Equal(t, []int{1}, cr.Components[0].Regions)
+	require.Equal(t, 4, cr.Components[1].DevOffset)
+	require.Nil(t, ValidateComposite(compositePath))
+	r, err := LoadRingMD5(filepath.Join(dir, "object.ring.gz"), "", "")
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), r.ReplicaCount())
+	require.Equal(t, 7, len(r.AllDevices()))
+	for part := uint64(0); part < r.PartitionCount(); part++ {
+		regions := map[int]int{}
+		for _, dev := range r.GetNodes(part) {
+			regions[dev.Region]++
+		}
+		require.Equal(t, map[int]int{1: 2, 2: 1}, regions)
+	}
+
+	// Growing the last component keeps every device id.
+	_, err = AddDevice(r2, -1, 2, 3, "http", "127.0.2.3", 6000, "", 0, "sda", 1, false)
+	require.Nil(t, err)
+	_, _, _, err = Rebalance(r2, false, false, true)
+	require.Nil(t, err)
+	cr, err = Compose(compositePath, []string{r1, r2}, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, cr.Version)
+
+	// Growing an earlier one would shift the later components' ids.
+	_, err = AddDevice(r1, -1, 1, 4, "http", "127.0.1.4", 6000, "", 0, "sda", 1, false)
+	require.Nil(t, err)
+	_, _, _, err = Rebalance(r1, false, false, true)
+	require.Nil(t, err)
+	_, err = Compose(compositePath, []string{r1, r2}, false)
+	require.NotNil(t, err)
+	_, err = Compose(compositePath, []string{r2, r1}, false)
+	require.NotNil(t, err)
+	cr, err = Compose(compositePath, []string{r1, r2}, true)
+	require.Nil(t, err)
+	require.Equal(t, 3, cr.Version)
+	require.Equal(t, 5, cr.Components[1].DevOffset)
+	require.Nil(t, ValidateComposite(compositePath))
+
+	// The composed ring no longer matching its metadata is caught.
+	cr.Components[0].Replicas = 1
+	require.Nil(t, cr.Save(compositePath))
+	require.NotNil(t, ValidateComposite(compositePath))
+}
+
+func TestComposeRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	r1 := filepath.Join(dir, "r1.builder")
+	r1b := filepath.Join(dir, "r1b.builder")
+	r2 := filepath.Join(dir, "r2.builder")
+	r3 := filepath.Join(dir, "r3.builder")
+	makeComponent(t, r1, 6, 2, 1, 3)
+	makeComponent(t, r1b, 6, 1, 1, 3)
+	makeComponent(t, r2, 5, 1, 2, 3)
+	makeComponent(t, r3, 6, 1, 3, 3)
+	compositePath := filepath.Join(dir, "object.composite")
+
+	_, err = Compose(compositePath, []string{r1}, false)
+	require.NotNil(t, err)
+	// Same region in two components.
+	_, err = Compose(compositePath, []string{r1, r1b}, false)
+	require.NotNil(t, err)
+	// Different part powers.
+	_, err = Compose(compositePath, []string{r1, r2}, false)
+	require.NotNil(t, err)
+	// Unrebalanced changes.
+	_, err = AddDevice(r3, -1, 3, 3, "http", "127.0.3.3", 6000, "", 0, "sda", 1, false)
+	require.Nil(t, err)
+	_, err = Compose(compositePath, []string{r1, r3}, false)
+	require.NotNil(t, err)
+	require.False(t, fileExists(compositePath))
+}
+
+func fileExists(pth string) bool {
+	_, err := os.Stat(pth)
+	return err == nil
+}
@@ -19,16 +19,21 @@ import (
 	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/RocFang/hummingbird/common"
@@ -41,9 +46,13 @@ const (
 	jsonFlag    = 2
 	opGet       = byte(0x00)
 	opSet       = byte(0x01)
+	opAdd       = byte(0x02)
 	opDelete    = byte(0x04)
 	opIncrement = byte(0x05)
 	opDecrement = byte(0x06)
+	opNoop      = byte(0x0a)
+	opGetKQ     = byte(0x0d)
+	opSASLAuth  = byte(0x21)
 	confSection = "filter:cache"
 )
 
@@ -56,6 +65,13 @@ type MemcacheRing interface {
 	Incr(ctx context.Context, key string, delta int64, timeout int) (int64, error)
 	Set(ctx context.Context, key string, value interface{}, timeout int) error
 	SetMulti(ctx context.Context, serverKey string, values map[string]interface{}, timeout int) error
+	// GetStructuredCAS is GetStructured that also gives the value's CAS
+	// token, for a later SetCAS.
+	GetStructuredCAS(ctx context.Context, key string, val interface{}) (uint64, error)
+	// SetCAS stores the value only if it has not changed since its CAS token
+	// was read, or with a cas of 0 only if there is no value yet. It returns
+	// CASConflict if the value was changed or added in the meantime.
+	SetCAS(ctx context.Context, key string, value interface{}, cas uint64, timeout int) error
 }
 
 type tracingMemcacheRing struct {
@@ -161,16 +177,51 @@ func (r *tracingMemcacheRing) SetMulti(ctx context.Context, serverKey string, va
 	return err
 }
 
+func (r *tracingMemcacheRing) GetStructuredCAS(ctx context.Context, key string, val interface{}) (uint64, error) {
+	mcSpan := r.tracer.StartSpan("Memcache GetStructuredCAS", opentracing.ChildOf(r.getSpanContext(ctx)))
+	r.addKey(mcSpan, key)
+	defer mcSpan.Finish()
+	cas, err := r.MemcacheRing.GetStructuredCAS(ctx, key, val)
+	r.addError(mcSpan, err)
+	return cas, err
+}
+
+func (r *tracingMemcacheRing) SetCAS(ctx context.Context, key string, value interface{}, cas uint64, timeout int) error {
+	mcSpan := r.tracer.StartSpan("Memcache SetCAS", opentracing.ChildOf(r.getSpanContext(ctx)))
+	r.addKey(mcSpan, key)
+	defer mcSpan.Finish()
+	err := r.MemcacheRing.SetCAS(ctx, key, value, cas, timeout)
+	if err == CASConflict {
+		mcSpan.SetTag("CASConflict", true)
+	} else {
+		r.addError(mcSpan, err)
+	}
+	return err
+}
+
+// memcacheRingData is the set of servers a memcacheRing hashes keys to. It is
+// replaced as a whole when the servers are reloaded.
+type memcacheRingData struct {
+	ring       map[string]string
+	serverKeys []string
+	servers    map[string]*server
+	tries      int64
+}
+
 type memcacheRing struct {
-	ring                        map[string]string
-	serverKeys                  []string
-	servers                     map[string]*server
+	data                        atomic.Value
+	dataLock                    sync.Mutex
 	connTimeout                 int64
 	responseTimeout             int64
 	maxFreeConnectionsPerServer int64
 	tries                       int64
 	nodeWeight                  int64
 	tracing                     bool
+	tlsConfig                   *tls.Config
+	saslUsername                string
+	saslPassword                string
+	serversFile                 string
+	serversMtime                time.Time
 }
 
 func NewMemcacheRing(confPath string) (*memcacheRing, error) {
@@ -181,57 +232,190 @@ func NewMemcacheRing(confPath string) (*memcacheRing, error) {
 	return NewMemcacheRingFromConfig(config)
 }
 
+// NewMemcacheRingFromConfig builds a memcache ring from the filter:cache
+// section. If memcache_servers_file is set the servers are read from that
+// file instead of memcache_servers, and the file is checked for changes every
+// memcache_servers_reload_interval seconds.
 func NewMemcacheRingFromConfig(config conf.Config) (*memcacheRing, error) {
 	ring := &memcacheRing{}
-	ring.ring = make(map[string]string)
-	ring.serverKeys = make([]string, 0)
-	ring.servers = make(map[string]*server)
-
 	ring.maxFreeConnectionsPerServer = config.GetInt(confSection, "max_free_connections_per_server", 100)
 	ring.connTimeout = config.GetInt(confSection, "conn_timeout", 100)
 	ring.responseTimeout = config.GetInt(confSection, "response_timeout", 100)
 	ring.nodeWeight = config.GetInt(confSection, "node_weight", 50)
 	ring.tries = config.GetInt(confSection, "tries", 5)
-	for _, s := range strings.Split(config.GetDefault(confSection, "memcache_servers", ""), ",") {
-		err := ring.addServer(s)
+	ring.saslUsername = config.GetDefault(confSection, "sasl_username", "")
+	ring.saslPassword = config.GetDefault(confSection, "sasl_password", "")
+	if config.GetBool(confSection, "tls_enabled", false) {
+		var err error
+		ring.tlsConfig, err = newMemcacheTLSConfig(
+			config.GetDefault(confSection, "tls_cafile", ""),
+			config.GetDefault(confSection, "tls_certfile", ""),
+			config.GetDefault(confSection, "tls_keyfile", ""))
 		if err != nil {
 			return nil, err
 		}
 	}
-	if len(ring.servers) == 0 {
-		ring.addServer("127.0.0.1:11211")
+	servers := strings.Split(config.GetDefault(confSection, "memcache_servers", ""), ",")
+	ring.serversFile = config.GetDefault(confSection, "memcache_servers_file", "")
+	if ring.serversFile != "" {
+		fi, err := os.Stat(ring.serversFile)
+		if err != nil {
+			return nil, err
+		}
+		if servers, err = readServersFile(ring.serversFile); err != nil {
+			return nil, err
+		}
+		ring.serversMtime = fi.ModTime()
 	}
-	ring.sortServerKeys()
-	if int64(len(ring.servers)) < ring.tries {
-		ring.tries = int64(len(ring.servers))
+	if err := ring.SetServers(servers); err != nil {
+		return nil, err
+	}
+	if ring.serversFile != "" {
+		go ring.reloader(time.Duration(config.GetInt(confSection, "memcache_servers_reload_interval", 15)) * time.Second)
 	}
 	return ring, nil
 }
 
+func newMemcacheTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		var err error
+		if tlsConf, err = common.NewClientTLSConfig(certFile, keyFile); err != nil {
+			return nil, err
+		}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load memcache CA file %s: %v", caFile, err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in memcache CA file %s", caFile)
+		}
+	}
+	return tlsConf, nil
+}
+
+// readServersFile reads a memcache servers file, which lists the servers one
+// per line or separated by commas. Blank lines and lines starting with # are
+// ignored.
+func readServersFile(serversFile string) ([]string, error) {
+	data, err := ioutil.ReadFile(serversFile)
+	if err != nil {
+		return nil, err
+	}
+	servers := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		servers = append(servers, strings.Split(line, ",")...)
+	}
+	return servers, nil
+}
+
+func (ring *memcacheRing) reloader(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		ring.reloadServersFile()
+	}
+}
+
+// reloadServersFile sets the ring's servers from its servers file if the file
+// has changed since it was last read.
+func (ring *memcacheRing) reloadServersFile() error {
+	fi, err := os.Stat(ring.serversFile)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime() == ring.serversMtime {
+		return nil
+	}
+	servers, err := readServersFile(ring.serversFile)
+	if err != nil {
+		return err
+	}
+	if err = ring.SetServers(servers); err != nil {
+		return err
+	}
+	ring.serversMtime = fi.ModTime()
+	return nil
+}
+
 func hashKey(s string) string {
 	h := md5.New()
 	io.WriteString(h, s)
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func (ring *memcacheRing) addServer(serverString string) error {
-	server, err := newServer(serverString, ring.connTimeout, ring.responseTimeout, ring.maxFreeConnectionsPerServer)
-	if err != nil {
-		return err
+func (ring *memcacheRing) getData() *memcacheRingData {
+	data, _ := ring.data.Load().(*memcacheRingData)
+	return data
+}
+
+// SetServers replaces the ring's servers. Each server keeps the same points
+// on the ring whatever other servers there are, so only keys that hashed to
+// a removed server, or now hash to an added one, move. Servers that stay keep
+// their connections.
+func (ring *memcacheRing) SetServers(serverStrings []string) error {
+	ring.dataLock.Lock()
+	defer ring.dataLock.Unlock()
+	old := ring.getData()
+	data := &memcacheRingData{ring: make(map[string]string), servers: make(map[string]*server)}
+	for _, serverString := range serverStrings {
+		if serverString = strings.TrimSpace(serverString); serverString != "" {
+			if err := ring.addServer(data, old, serverString); err != nil {
+				return err
+			}
+		}
 	}
-	ring.servers[serverString] = server
-	for i := 0; int64(i) < ring.nodeWeight; i++ {
-		ring.ring[hashKey(fmt.Sprintf("%s-%d", serverString, i))] = serverString
+	if len(data.servers) == 0 {
+		if err := ring.addServer(data, old, "127.0.0.1:11211"); err != nil {
+			return err
+		}
+	}
+	data.serverKeys = make([]string, 0, len(data.ring))
+	for k := range data.ring {
+		data.serverKeys = append(data.serverKeys, k)
+	}
+	sort.Strings(data.serverKeys)
+	data.tries = ring.tries
+	if int64(len(data.servers)) < data.tries {
+		data.tries = int64(len(data.servers))
+	}
+	ring.data.Store(data)
+	if old != nil {
+		for serverString, s := range old.servers {
+			if _, ok := data.servers[serverString]; !ok {
+				s.close()
+			}
+		}
 	}
 	return nil
 }
 
-func (ring *memcacheRing) sortServerKeys() {
-	ring.serverKeys = make([]string, 0)
-	for k := range ring.ring {
-		ring.serverKeys = append(ring.serverKeys, k)
+func (ring *memcacheRing) addServer(data *memcacheRingData, old *memcacheRingData, serverString string) error {
+	if _, ok := data.servers[serverString]; ok {
+		return nil
+	}
+	if old != nil && old.servers[serverString] != nil {
+		data.servers[serverString] = old.servers[serverString]
+	} else {
+		server, err := newServer(serverString, ring.connTimeout, ring.responseTimeout, ring.maxFreeConnectionsPerServer)
+		if err != nil {
+			return err
+		}
+		server.tlsConfig = ring.tlsConfig
+		server.saslUsername = ring.saslUsername
+		server.saslPassword = ring.saslPassword
+		data.servers[serverString] = server
+	}
+	for i := 0; int64(i) < ring.nodeWeight; i++ {
+		data.ring[hashKey(fmt.Sprintf("%s-%d", serverString, i))] = serverString
 	}
-	sort.Strings(ring.serverKeys)
+	return nil
 }
 
 func (ring *memcacheRing) Decr(ctx context.Context, key string, delta int64, timeout int) (int64, error) {
@@ -250,21 +434,37 @@ func (ring *memcacheRing) Delete(ctx context.Context, key string) error {
 }
 
 func (ring *memcacheRing) GetStructured(ctx context.Context, key string, val interface{}) error {
+	_, err := ring.GetStructuredCAS(ctx, key, val)
+	return err
+}
+
+func (ring *memcacheRing) GetStructuredCAS(ctx context.Context, key string, val interface{}) (uint64, error) {
+	type Return struct {
+		cas uint64
+	}
+	ret := &Return{}
 	fn := func(conn *connection) error {
-		value, extras, err := conn.roundTripPacket(opGet, hashKey(key), nil, nil)
+		if err := conn.sendPacket(opGet, hashKey(key), nil, nil); err != nil {
+			return err
+		}
+		resp, err := conn.receive()
 		if err != nil {
 			return err
 		}
-		flags := binary.BigEndian.Uint32(extras[0:4])
+		if err = resp.err(); err != nil {
+			return err
+		}
+		flags := binary.BigEndian.Uint32(resp.extras[0:4])
 		if flags&jsonFlag == 0 {
 			return errors.New("Not json data")
 		}
-		if err := json.Unmarshal(value, val); err != nil {
+		if err := json.Unmarshal(resp.value, val); err != nil {
 			return err
 		}
+		ret.cas = resp.cas
 		return nil
 	}
-	return ring.loop(key, fn)
+	return ret.cas, ring.loop(key, fn)
 }
 
 func (ring *memcacheRing) Get(ctx context.Context, key string) (interface{}, error) {
@@ -283,13 +483,16 @@ func (ring *memcacheRing) Get(ctx context.Context, key string) (interface{}, err
 				return err
 			}
 		} else {
-			ret.value = value
+			ret.value = append([]byte(nil), value...)
 		}
 		return nil
 	}
 	return ret.value, ring.loop(key, fn)
 }
 
+// GetMulti sends a quiet get for each key followed by a no-op, so the server
+// only answers for the keys it has and the no-op marks the end of the
+// answers.
 func (ring *memcacheRing) GetMulti(ctx context.Context, serverKey string, keys []string) (map[string]interface{}, error) {
 	type Return struct {
 		value map[string]interface{}
@@ -297,31 +500,47 @@ func (ring *memcacheRing) GetMulti(ctx context.Context, serverKey string, keys [
 	ret := &Return{}
 	fn := func(conn *connection) error {
 		ret.value = make(map[string]interface{})
+		hashedKeys := make(map[string]string, len(keys))
 		for _, key := range keys {
-			if err := conn.sendPacket(opGet, hashKey(key), nil, nil); err != nil {
+			hashedKeys[hashKey(key)] = key
+			if err := conn.writePacket(opGetKQ, hashKey(key), nil, nil, 0); err != nil {
 				return err
 			}
 		}
-		for _, key := range keys {
-			value, extras, err := conn.receivePacket()
+		if err := conn.sendPacket(opNoop, "", nil, nil); err != nil {
+			return err
+		}
+		var respErr error
+		for {
+			resp, err := conn.receive()
 			if err != nil {
-				if err == CacheMiss {
-					continue
-				}
 				return err
 			}
-			flags := binary.BigEndian.Uint32(extras[0:4])
+			if resp.opcode == opNoop {
+				return respErr
+			}
+			if err = resp.err(); err != nil {
+				if err != CacheMiss {
+					respErr = err
+				}
+				continue
+			}
+			key, ok := hashedKeys[string(resp.key)]
+			if !ok {
+				continue
+			}
+			flags := binary.BigEndian.Uint32(resp.extras[0:4])
 			if flags&jsonFlag != 0 {
 				var v interface{}
-				if err := json.Unmarshal(value, &v); err != nil {
-					return err
+				if err := json.Unmarshal(resp.value, &v); err != nil {
+					respErr = err
+					continue
 				}
 				ret.value[key] = v
 			} else {
-				ret.value[key] = value
+				ret.value[key] = append([]byte(nil), resp.value...)
 			}
 		}
-		return nil
 	}
 	return ret.value, ring.loop(serverKey, fn)
 }
@@ -368,6 +587,34 @@ func (ring *memcacheRing) Set(ctx context.Context, key string, value interface{}
 	return ring.loop(key, fn)
 }
 
+func (ring *memcacheRing) SetCAS(ctx context.Context, key string, value interface{}, cas uint64, timeout int) error {
+	serl, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[0:4], uint32(jsonFlag))
+	binary.BigEndian.PutUint32(extras[4:8], uint32(timeout))
+	op := opSet
+	if cas == 0 {
+		op = opAdd
+	}
+	fn := func(conn *connection) error {
+		if err := conn.writePacket(op, hashKey(key), serl, extras, cas); err != nil {
+			return err
+		}
+		if err := conn.flush(); err != nil {
+			return err
+		}
+		resp, err := conn.receive()
+		if err != nil {
+			return err
+		}
+		return resp.err()
+	}
+	return ring.loop(key, fn)
+}
+
 func (ring *memcacheRing) SetMulti(ctx context.Context, serverKey string, values map[string]interface{}, timeout int) error {
 	fn := func(conn *connection) error {
 		for key, value := range values {
@@ -393,34 +640,34 @@ func (ring *memcacheRing) SetMulti(ctx context.Context, serverKey string, values
 }
 
 type serverIterator struct {
-	ring    *memcacheRing
+	data    *memcacheRingData
 	key     string
 	current int
 	servers []string
 }
 
 func (ring *memcacheRing) newServerIterator(key string) *serverIterator {
-	return &serverIterator{ring, hashKey(key), -1, make([]string, 0)}
+	return &serverIterator{ring.getData(), hashKey(key), -1, make([]string, 0)}
 }
 
 func (it *serverIterator) next() bool {
-	return int64(len(it.servers)) < it.ring.tries
+	return int64(len(it.servers)) < it.data.tries
 }
 
 func (it *serverIterator) value() *server {
-	if int64(len(it.servers)) > it.ring.tries {
+	if int64(len(it.servers)) > it.data.tries {
 		panic("serverIterator.Value() called when there are no more tries left")
 	}
 	if it.current == -1 {
-		it.current = sort.SearchStrings(it.ring.serverKeys, it.key) % len(it.ring.serverKeys)
+		it.current = sort.SearchStrings(it.data.serverKeys, it.key) % len(it.data.serverKeys)
 	} else {
-		for common.StringInSlice(it.ring.ring[it.ring.serverKeys[it.current]], it.servers) {
-			it.current = (it.current + 1) % len(it.ring.serverKeys)
+		for common.StringInSlice(it.data.ring[it.data.serverKeys[it.current]], it.servers) {
+			it.current = (it.current + 1) % len(it.data.serverKeys)
 		}
 	}
-	serverString := it.ring.ring[it.ring.serverKeys[it.current]]
+	serverString := it.data.ring[it.data.serverKeys[it.current]]
 	it.servers = append(it.servers, serverString)
-	return it.ring.servers[serverString]
+	return it.data.servers[serverString]
 }
 
 var noServersError = errors.New("no memcache servers in ring")
@@ -439,7 +686,7 @@ func (ring *memcacheRing) loop(key string, fn func(*connection) error) error {
 		server.releaseConnection(conn, err)
 		if err == nil {
 			return nil
-		} else if err == CacheMiss {
+		} else if err == CacheMiss || err == CASConflict {
 			return err
 		}
 	}
@@ -454,6 +701,10 @@ type server struct {
 	requestTimeout     time.Duration
 	maxFreeConnections int64
 	connections        []*connection
+	tlsConfig          *tls.Config
+	saslUsername       string
+	saslPassword       string
+	closed             bool
 }
 
 func newServer(serverString string, connTimeout int64, requestTimeout int64, maxFreeConnections int64) (*server, error) {
@@ -502,14 +753,24 @@ func (s *server) getConnection() (*connection, error) {
 	if conn != nil {
 		return conn, nil
 	}
-	return newConnection(s.serverString, s.connTimeout, s.requestTimeout)
+	conn, err := newConnection(s.serverString, s.connTimeout, s.requestTimeout, s.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if s.saslUsername != "" {
+		if err = conn.authenticate(s.saslUsername, s.saslPassword); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
 func (s *server) releaseConnection(conn *connection, err error) {
-	if err == nil || err == CacheMiss {
+	if err == nil || err == CacheMiss || err == CASConflict {
 		s.lock.Lock()
 		defer s.lock.Unlock()
-		if int64(len(s.connections)) < s.maxFreeConnections {
+		if !s.closed && int64(len(s.connections)) < s.maxFreeConnections {
 			s.connections = append(s.connections, conn)
 			return
 		}
@@ -517,8 +778,23 @@ func (s *server) releaseConnection(conn *connection, err error) {
 	conn.close()
 }
 
+// close closes the server's free connections once it is no longer in the
+// ring; connections still in use are closed when they are released.
+func (s *server) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for _, conn := range s.connections {
+		conn.close()
+	}
+	s.connections = nil
+}
+
 var CacheMiss = fmt.Errorf("Server cache miss")
 
+// CASConflict is returned by SetCAS when the value changed since it was read.
+var CASConflict = fmt.Errorf("Server cache value changed")
+
 type connection struct {
 	conn       net.Conn
 	rw         *bufio.ReadWriter
@@ -526,7 +802,7 @@ type connection struct {
 	packetBuf  []byte
 }
 
-func newConnection(address string, connTimeout time.Duration, requestTimeout time.Duration) (*connection, error) {
+func newConnection(address string, connTimeout time.Duration, requestTimeout time.Duration, tlsConfig *tls.Config) (*connection, error) {
 	domain := "tcp"
 	if strings.Contains(address, "/") {
 		domain = "unix"
@@ -540,6 +816,19 @@ func newConnection(address string, connTimeout time.Duration, requestTimeout tim
 	if c, ok := conn.(*net.TCPConn); ok {
 		c.SetNoDelay(true)
 	}
+	if tlsConfig != nil && domain == "tcp" {
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(connTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
 	return &connection{
 		conn:       conn,
 		rw:         bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
@@ -548,36 +837,82 @@ func newConnection(address string, connTimeout time.Duration, requestTimeout tim
 	}, nil
 }
 
+// authenticate does a SASL PLAIN authentication on a new connection.
+func (c *connection) authenticate(username, password string) error {
+	_, _, err := c.roundTripPacket(opSASLAuth, "PLAIN", []byte("\x00"+username+"\x00"+password), nil)
+	if err != nil {
+		return fmt.Errorf("Memcache SASL authentication failed: %v", err)
+	}
+	return nil
+}
+
 func (c *connection) close() error {
 	return c.conn.Close()
 }
 
-func (c *connection) receivePacket() ([]byte, []byte, error) {
+// response is a received packet. Its key, extras and value point into the
+// connection's buffer, so they are only valid until the next receive.
+type response struct {
+	opcode byte
+	status uint16
+	cas    uint64
+	key    []byte
+	extras []byte
+	value  []byte
+}
+
+func (r *response) err() error {
+	switch r.status {
+	case 0:
+		return nil
+	case 1:
+		return CacheMiss
+	case 2, 5:
+		return CASConflict
+	default:
+		return fmt.Errorf("Error response from memcache: %d", r.status)
+	}
+}
+
+func (c *connection) receive() (*response, error) {
 	packet := c.packetBuf[0:24]
 	if _, err := io.ReadFull(c.rw, packet); err != nil {
 		c.close()
-		return nil, nil, err
+		return nil, err
 	}
-	keyLen := binary.BigEndian.Uint16(packet[2:4])
-	extrasLen := packet[4]
-	status := binary.BigEndian.Uint16(packet[6:8])
+	resp := &response{opcode: packet[1]}
+	keyLen := int(binary.BigEndian.Uint16(packet[2:4]))
+	extrasLen := int(packet[4])
+	resp.status = binary.BigEndian.Uint16(packet[6:8])
 	bodyLen := int(binary.BigEndian.Uint32(packet[8:12]))
+	resp.cas = binary.BigEndian.Uint64(packet[16:24])
+	if extrasLen+keyLen > bodyLen {
+		c.close()
+		return nil, fmt.Errorf("Invalid response from memcache")
+	}
 	for cap(c.packetBuf) < bodyLen {
-		c.packetBuf = append(c.packetBuf, ' ')
+		c.packetBuf = append(c.packetBuf[:cap(c.packetBuf)], ' ')
 	}
 	body := c.packetBuf[0:bodyLen]
 	if _, err := io.ReadFull(c.rw, body); err != nil {
 		c.close()
+		return nil, err
+	}
+	resp.extras = body[0:extrasLen]
+	resp.key = body[extrasLen : extrasLen+keyLen]
+	resp.value = body[extrasLen+keyLen:]
+	return resp, nil
+}
+
+func (c *connection) receivePacket() ([]byte, []byte, error) {
+	resp, err := c.receive()
+	if err != nil {
 		return nil, nil, err
 	}
-	switch status {
-	case 0:
-		return body[int(keyLen)+int(extrasLen) : int(bodyLen)], body[int(keyLen):int(extrasLen)], nil
-	case 1:
-		return nil, nil, CacheMiss
-	default:
-		return nil, nil, fmt.Errorf("Error response from memcache: %d", status)
+	if err = resp.err(); err != nil {
+		return nil, nil, err
 	}
+	return resp.value, resp.extras, nil
 }
 
 func (c *connection) roundTripPacket(opcode byte, hashKey string, value []byte, extras []byte) ([]byte, []byte, error) {
@@ -588,6 +923,14 @@ func (c *connection) roundTripPacket(opcode byte, hashKey string, value []byte,
 }
 
 func (c *connection) sendPacket(opcode byte, hashKey string, value []byte, extras []byte) error {
+	if err := c.writePacket(opcode, hashKey, value, extras, 0); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// writePacket buffers a packet without sending it; see flush.
+func (c *connection) writePacket(opcode byte, hashKey string, value []byte, extras []byte, cas uint64) error {
 	key := []byte(hashKey)
 	c.conn.SetDeadline(time.Now().Add(c.reqTimeout))
 	packet := c.packetBuf[0:24]
@@ -596,9 +939,17 @@ func (c *connection) sendPacket(opcode byte, hashKey string, value []byte, extra
 	packet[6], packet[7] = 0, 0
 	binary.BigEndian.PutUint32(packet[8:12], uint32(len(key)+len(value)+len(extras)))
 	packet[12], packet[13], packet[14], packet[15] = 0, 0, 0, 0
-	packet[16], packet[17], packet[18], packet[19], packet[20], packet[21], packet[22], packet[23] = 0, 0, 0, 0, 0, 0, 0, 0
+	binary.BigEndian.PutUint64(packet[16:24], cas)
 	packet = append(append(append(packet, extras...), key...), value...)
-	if _, err := c.rw.Write(packet); err != nil || c.rw.Flush() != nil {
+	if _, err := c.rw.Write(packet); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+func (c *connection) flush() error {
+	if err := c.rw.Flush(); err != nil {
 		c.close()
 		return err
 	}
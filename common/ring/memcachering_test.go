@@ -18,16 +18,22 @@ package ring
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/RocFang/hummingbird/common/conf"
 	ini "github.com/vaughan0/go-ini"
@@ -312,7 +318,7 @@ func testConnectionLimits(t *testing.T, ring *memcacheRing) {
 	}
 	wg.Wait()
 	// verify connections per server are less than the limit
-	for _, server := range ring.servers {
+	for _, server := range ring.getData().servers {
 		assert.True(t, server.connectionCount() <= 3)
 	}
 }
@@ -361,3 +367,246 @@ func testExpiration(t *testing.T, ring *memcacheRing) {
 		}
 	}
 }
+
+// fakeMemcached is a minimal binary protocol memcached for testing.
+type fakeMemcached struct {
+	listener net.Listener
+	lock     sync.Mutex
+	items    map[string]*fakeMemcachedItem
+	cas      uint64
+	password string
+}
+
+type fakeMemcachedItem struct {
+	flags []byte
+	value []byte
+	cas   uint64
+}
+
+func newFakeMemcached(t *testing.T, password string) *fakeMemcached {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	f := &fakeMemcached{listener: listener, items: map[string]*fakeMemcachedItem{}, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	authed := f.password == ""
+	for {
+		header := make([]byte, 24)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		opcode := header[1]
+		keyLen := int(binary.BigEndian.Uint16(header[2:4]))
+		extrasLen := int(header[4])
+		body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		cas := binary.BigEndian.Uint64(header[16:24])
+		extras, key, value := body[:extrasLen], string(body[extrasLen:extrasLen+keyLen]), body[extrasLen+keyLen:]
+		reply := func(status uint16, extras []byte, key string, value []byte, cas uint64) {
+			resp := make([]byte, 24)
+			resp[0], resp[1], resp[4] = 0x81, opcode, byte(len(extras))
+			binary.BigEndian.PutUint16(resp[2:4], uint16(len(key)))
+			binary.BigEndian.PutUint16(resp[6:8], status)
+			binary.BigEndian.PutUint32(resp[8:12], uint32(len(extras)+len(key)+len(value)))
+			binary.BigEndian.PutUint64(resp[16:24], cas)
+			conn.Write(append(append(append(resp, extras...), key...), value...))
+		}
+		if opcode == opSASLAuth {
+			if string(value) == "\x00user\x00"+f.password {
+				authed = true
+				reply(0, nil, "", nil, 0)
+			} else {
+				reply(0x20, nil, "", nil, 0)
+			}
+			continue
+		}
+		if !authed {
+			reply(0x20, nil, "", nil, 0)
+			continue
+		}
+		f.lock.Lock()
+		item := f.items[key]
+		switch opcode {
+		case opGet, opGetKQ:
+			if item == nil {
+				if opcode == opGet {
+					reply(1, nil, "", nil, 0)
+				}
+			} else if opcode == opGet {
+				reply(0, item.flags, "", item.value, item.cas)
+			} else {
+				reply(0, item.flags, key, item.value, item.cas)
+			}
+		case opSet, opAdd:
+			if (opcode == opAdd && item != nil) || (cas != 0 && item != nil && item.cas != cas) {
+				reply(2, nil, "", nil, 0)
+			} else if cas != 0 && item == nil {
+				reply(1, nil, "", nil, 0)
+			} else {
+				f.cas++
+				f.items[key] = &fakeMemcachedItem{flags: append([]byte(nil), extras[0:4]...), value: append([]byte(nil), value...), cas: f.cas}
+				reply(0, nil, "", nil, f.cas)
+			}
+		case opDelete:
+			delete(f.items, key)
+			reply(0, nil, "", nil, 0)
+		case opNoop:
+			reply(0, nil, "", nil, 0)
+		default:
+			reply(0x81, nil, "", nil, 0)
+		}
+		f.lock.Unlock()
+	}
+}
+
+func fakeMemcachedRing(t *testing.T, settings map[string]string) *memcacheRing {
+	iniFile := conf.Config{File: make(ini.File)}
+	section := iniFile.Section(confSection)
+	for k, v := range settings {
+		section[k] = v
+	}
+	ring, err := NewMemcacheRingFromConfig(iniFile)
+	require.Nil(t, err)
+	return ring
+}
+
+func TestMemcacheGetMultiQuiet(t *testing.T) {
+	f := newFakeMemcached(t, "")
+	defer f.listener.Close()
+	ring := fakeMemcachedRing(t, map[string]string{"memcache_servers": f.listener.Addr().String()})
+	ctx := context.Background()
+	require.Nil(t, ring.SetMulti(ctx, "multi", map[string]interface{}{"key1": "value1", "key3": map[string]interface{}{"a": 1.0}}, 0))
+	values, err := ring.GetMulti(ctx, "multi", []string{"key1", "key2", "key3"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"key1": "value1", "key3": map[string]interface{}{"a": 1.0}}, values)
+	// The connection is still usable afterwards.
+	v, err := ring.Get(ctx, "key1")
+	require.Nil(t, err)
+	require.Equal(t, "value1", v)
+}
+
+func TestMemcacheCAS(t *testing.T) {
+	f := newFakeMemcached(t, "")
+	defer f.listener.Close()
+	ring := fakeMemcachedRing(t, map[string]string{"memcache_servers": f.listener.Addr().String()})
+	ctx := context.Background()
+	var val int
+	_, err := ring.GetStructuredCAS(ctx, "counter", &val)
+	require.Equal(t, CacheMiss, err)
+	require.Nil(t, ring.SetCAS(ctx, "counter", 1, 0, 0))
+	require.Equal(t, CASConflict, ring.SetCAS(ctx, "counter", 1, 0, 0))
+	cas, err := ring.GetStructuredCAS(ctx, "counter", &val)
+	require.Nil(t, err)
+	require.Equal(t, 1, val)
+	require.NotEqual(t, uint64(0), cas)
+	require.Nil(t, ring.SetCAS(ctx, "counter", 2, cas, 0))
+	require.Equal(t, CASConflict, ring.SetCAS(ctx, "counter", 3, cas, 0))
+	_, err = ring.GetStructuredCAS(ctx, "counter", &val)
+	require.Nil(t, err)
+	require.Equal(t, 2, val)
+	require.Nil(t, ring.Delete(ctx, "counter"))
+	require.Equal(t, CacheMiss, ring.SetCAS(ctx, "counter", 3, cas, 0))
+}
+
+func TestMemcacheSASL(t *testing.T) {
+	f := newFakeMemcached(t, "secret")
+	defer f.listener.Close()
+	ctx := context.Background()
+	ring := fakeMemcachedRing(t, map[string]string{"memcache_servers": f.listener.Addr().String(), "sasl_username": "user", "sasl_password": "secret"})
+	require.Nil(t, ring.Set(ctx, "key", "value", 0))
+	v, err := ring.Get(ctx, "key")
+	require.Nil(t, err)
+	require.Equal(t, "value", v)
+	ring = fakeMemcachedRing(t, map[string]string{"memcache_servers": f.listener.Addr().String(), "sasl_username": "user", "sasl_password": "wrong"})
+	require.NotNil(t, ring.Set(ctx, "key", "value", 0))
+}
+
+func TestMemcacheTLSConfig(t *testing.T) {
+	iniFile := conf.Config{File: make(ini.File)}
+	section := iniFile.Section(confSection)
+	section["tls_enabled"] = "true"
+	section["tls_cafile"] = "/nonexistent/ca.pem"
+	_, err := NewMemcacheRingFromConfig(iniFile)
+	require.NotNil(t, err)
+	delete(section, "tls_cafile")
+	ring, err := NewMemcacheRingFromConfig(iniFile)
+	require.Nil(t, err)
+	require.NotNil(t, ring.tlsConfig)
+	for _, server := range ring.getData().servers {
+		require.Equal(t, ring.tlsConfig, server.tlsConfig)
+	}
+}
+
+func memcacheRingServerFor(ring *memcacheRing, key string) string {
+	it := ring.newServerIterator(key)
+	return it.value().serverString
+}
+
+func TestMemcacheSetServersMovesFewKeys(t *testing.T) {
+	servers := []string{}
+	for i := 0; i < 10; i++ {
+		servers = append(servers, fmt.Sprintf("127.0.0.1:%d", 20000+i))
+	}
+	ring := fakeMemcachedRing(t, map[string]string{"memcache_servers": strings.Join(servers, ",")})
+	before := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before[key] = memcacheRingServerFor(ring, key)
+	}
+	kept := ring.getData().servers[servers[0]]
+
+	// Adding a server only moves keys to it.
+	require.Nil(t, ring.SetServers(append(servers, "127.0.0.1:20010")))
+	require.True(t, kept == ring.getData().servers[servers[0]])
+	moved := 0
+	for key, server := range before {
+		if now := memcacheRingServerFor(ring, key); now != server {
+			require.Equal(t, "127.0.0.1:20010", now)
+			moved++
+		}
+	}
+	require.True(t, moved > 0 && moved < 200, moved)
+
+	// Removing a server only moves the keys it had.
+	require.Nil(t, ring.SetServers(servers[1:]))
+	require.Equal(t, int64(5), ring.getData().tries)
+	for key, server := range before {
+		if server != servers[0] {
+			require.Equal(t, server, memcacheRingServerFor(ring, key))
+		}
+	}
+	require.True(t, kept.closed)
+}
+
+func TestMemcacheServersFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	serversFile := filepath.Join(dir, "memcache_servers")
+	require.Nil(t, ioutil.WriteFile(serversFile, []byte("# servers\n127.0.0.1:20000\n\n127.0.0.1:20001,127.0.0.1:20002\n"), 0644))
+	ring := fakeMemcachedRing(t, map[string]string{"memcache_servers": "127.0.0.1:11211", "memcache_servers_file": serversFile})
+	require.Equal(t, 3, len(ring.getData().servers))
+	require.NotNil(t, ring.getData().servers["127.0.0.1:20001"])
+
+	require.Nil(t, ioutil.WriteFile(serversFile, []byte("127.0.0.1:20000\n127.0.0.1:20003\n"), 0644))
+	mtime := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(serversFile, mtime, mtime))
+	require.Nil(t, ring.reloadServersFile())
+	require.Equal(t, 2, len(ring.getData().servers))
+	require.NotNil(t, ring.getData().servers["127.0.0.1:20003"])
+	require.Nil(t, ring.getData().servers["127.0.0.1:20001"])
+}
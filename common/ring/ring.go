@@ -78,6 +78,7 @@ type ringData struct {
 	Devs                                []*Device `json:"devs"`
 	ReplicaCount                        int       `json:"replica_count"`
 	PartShift                           uint64    `json:"part_shift"`
+	NextPartPower                       int       `json:"next_part_power,omitempty"`
 	replica2part2devId                  [][]uint16
 	regionCount, zoneCount, ipPortCount int
 	md5                                 string
@@ -177,6 +178,36 @@ func (r *hashRing) PartitionForHash(hsh string) (uint64, error) {
 	return hshi >> r.getData().PartShift, nil
 }
 
+// NextPartPower returns the partition power the ring is being increased to,
+// or 0 if no increase is in progress.
+func (r *hashRing) NextPartPower() int {
+	return r.getData().NextPartPower
+}
+
+// NextPartPower returns the partition power r is being increased to, or 0 if
+// no increase is in progress or r can't tell.
+func NextPartPower(r Ring) int {
+	if npr, ok := r.(interface {
+		NextPartPower() int
+	}); ok {
+		return npr.NextPartPower()
+	}
+	return 0
+}
+
+// PartitionForHashPower is like PartitionForHash but for the given partition
+// power rather than a ring's.
+func PartitionForHashPower(hsh string, partPower uint) (uint64, error) {
+	if len(hsh) < 8 || partPower < 1 || partPower > 32 {
+		return 0, fmt.Errorf("invalid hash %q or part power %d", hsh, partPower)
+	}
+	hshi, err := strconv.ParseUint(hsh[:8], 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return hshi >> (32 - partPower), nil
+}
+
 func (r *hashRing) LocalDevices(localPort int) (devs []*Device, err error) {
 	d := r.getData()
 	var localIPs = make(map[string]bool)
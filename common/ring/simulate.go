@@ -0,0 +1,226 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"fmt"
+	"math"
+)
+
+// SimulatedChange is one proposed change to a ring builder: Op is "add",
+// "set_weight" or "remove". Add uses Dev; the others use DevId, and
+// set_weight uses Weight.
+type SimulatedChange struct {
+	Op     string             `json:"op"`
+	Dev    *RingBuilderDevice `json:"dev,omitempty"`
+	DevId  int64              `json:"dev_id"`
+	Weight float64            `json:"weight"`
+}
+
+// PartMoves counts partition replicas moving onto and off of something.
+type PartMoves struct {
+	In  int `json:"in"`
+	Out int `json:"out"`
+}
+
+// SimulationRound is the outcome of one rebalance of a simulation.
+type SimulationRound struct {
+	Moved      int     `json:"moved"`
+	Removed    int     `json:"removed"`
+	Balance    float64 `json:"balance"`
+	Dispersion float64 `json:"dispersion"`
+}
+
+// SimulationReport is what a set of changes would do to a ring once it has
+// been rebalanced until nothing more moves, waiting min_part_hours between
+// rebalances.
+type SimulationReport struct {
+	Rounds        []*SimulationRound    `json:"rounds"`
+	MinPartHours  int                   `json:"min_part_hours"`
+	Moved         int                   `json:"moved"`
+	MovedByDevice map[int64]*PartMoves  `json:"moved_by_device"`
+	MovedByZone   map[string]*PartMoves `json:"moved_by_zone"`
+	MovedByRegion map[int64]*PartMoves  `json:"moved_by_region"`
+	Balance       float64               `json:"balance"`
+	Dispersion    float64               `json:"dispersion"`
+	BytesToMove   int64                 `json:"bytes_to_move"`
+	BytesUnknown  int                   `json:"bytes_unknown"`
+	Converged     bool                  `json:"converged"`
+	// Devices has every device before or after the changes, by id.
+	Devices map[int64]*RingBuilderDevice `json:"-"`
+}
+
+// GetDispersion gives the percentage of partitions that have more replicas
+// in some tier than that tier should hold at most.
+func (b *RingBuilder) GetDispersion() float64 {
+	if len(b.replica2Part2Dev) == 0 || b.Parts == 0 {
+		return 0
+	}
+	for next, dev := devIterator(b.Devs); dev != nil; dev = next() {
+		dev.tiers = b.tiersForDev(dev)
+	}
+	maxReplicas := b.buildMaxReplicasByTier()
+	atRisk := 0
+	for part := 0; part < b.Parts; part++ {
+		counts := map[string]int{}
+		risky := false
+		for _, dev := range b.devsForPart(part) {
+			if dev == nil {
+				continue
+			}
+			for _, tier := range dev.tiers {
+				counts[tier]++
+				if max, ok := maxReplicas[tier]; ok && float64(counts[tier]) > math.Ceil(max) {
+					risky = true
+				}
+			}
+		}
+		if risky {
+			atRisk++
+		}
+	}
+	return 100 * float64(atRisk) / float64(b.Parts)
+}
+
+// applyChange makes a SimulatedChange to the builder.
+func (b *RingBuilder) applyChange(change *SimulatedChange) error {
+	switch change.Op {
+	case "add":
+		if change.Dev == nil {
+			return fmt.Errorf("No device to add")
+		}
+		_, err := b.AddDev(change.Dev)
+		return err
+	case "set_weight", "remove":
+		if change.DevId < 0 || change.DevId >= int64(len(b.Devs)) || b.Devs[change.DevId] == nil {
+			return fmt.Errorf("No device with id %d", change.DevId)
+		}
+		if change.Op == "remove" {
+			b.RemoveDev(change.DevId, false)
+			return nil
+		}
+		return b.SetDevWeight(change.DevId, change.Weight)
+	}
+	return fmt.Errorf("Unknown change %q", change.Op)
+}
+
+func copyReplica2Part2Dev(r2p2d [][]uint) [][]uint {
+	c := make([][]uint, len(r2p2d))
+	for i := range r2p2d {
+		c[i] = make([]uint, len(r2p2d[i]))
+		copy(c[i], r2p2d[i])
+	}
+	return c
+}
+
+// countMoves gives how many partition replicas are assigned differently.
+func countMoves(before, after [][]uint, fn func(from, to uint)) int {
+	moved := 0
+	for replica := range after {
+		for part, to := range after[replica] {
+			from := NONE_DEV
+			if replica < len(before) && part < len(before[replica]) {
+				from = before[replica][part]
+			}
+			if from != to {
+				moved++
+				if fn != nil {
+					fn(from, to)
+				}
+			}
+		}
+	}
+	return moved
+}
+
+// Simulate applies the changes to the builder and rebalances it, pretending
+// min_part_hours have passed before each rebalance, until nothing more moves
+// or maxRounds is reached. bytesPerPart gives the estimated size of a partition
+// replica by device id, used to estimate how much data would move. The
+// builder is left changed, so it should not be saved afterwards.
+func (b *RingBuilder) Simulate(changes []*SimulatedChange, maxRounds int, bytesPerPart map[int64]float64) (*SimulationReport, error) {
+	report := &SimulationReport{
+		MinPartHours:  b.MinPartHours,
+		MovedByDevice: map[int64]*PartMoves{},
+		MovedByZone:   map[string]*PartMoves{},
+		MovedByRegion: map[int64]*PartMoves{},
+		Devices:       map[int64]*RingBuilderDevice{},
+	}
+	for next, dev := devIterator(b.Devs); dev != nil; dev = next() {
+		report.Devices[dev.Id] = dev
+	}
+	for _, change := range changes {
+		if err := b.applyChange(change); err != nil {
+			return nil, err
+		}
+	}
+	for next, dev := devIterator(b.Devs); dev != nil; dev = next() {
+		report.Devices[dev.Id] = dev
+	}
+	original := copyReplica2Part2Dev(b.replica2Part2Dev)
+	for round := 0; round < maxRounds; round++ {
+		b.PretendMinPartHoursPassed()
+		before := copyReplica2Part2Dev(b.replica2Part2Dev)
+		_, balance, removed, err := b.Rebalance()
+		if err != nil {
+			return nil, err
+		}
+		moved := countMoves(before, b.replica2Part2Dev, nil)
+		if moved == 0 && removed == 0 {
+			report.Converged = true
+			break
+		}
+		report.Rounds = append(report.Rounds, &SimulationRound{
+			Moved:      moved,
+			Removed:    removed,
+			Balance:    balance,
+			Dispersion: b.GetDispersion(),
+		})
+	}
+	moves := func(m map[int64]*PartMoves, key int64) *PartMoves {
+		if m[key] == nil {
+			m[key] = &PartMoves{}
+		}
+		return m[key]
+	}
+	zoneMoves := func(dev *RingBuilderDevice) *PartMoves {
+		key := fmt.Sprintf("r%dz%d", dev.Region, dev.Zone)
+		if report.MovedByZone[key] == nil {
+			report.MovedByZone[key] = &PartMoves{}
+		}
+		return report.MovedByZone[key]
+	}
+	report.Moved = countMoves(original, b.replica2Part2Dev, func(from, to uint) {
+		if dev := report.Devices[int64(from)]; from != NONE_DEV && dev != nil {
+			moves(report.MovedByDevice, dev.Id).Out++
+			moves(report.MovedByRegion, dev.Region).Out++
+			zoneMoves(dev).Out++
+			if size, ok := bytesPerPart[dev.Id]; ok {
+				report.BytesToMove += int64(size)
+			} else {
+				report.BytesUnknown++
+			}
+		}
+		if dev := report.Devices[int64(to)]; to != NONE_DEV && dev != nil {
+			moves(report.MovedByDevice, dev.Id).In++
+			moves(report.MovedByRegion, dev.Region).In++
+			zoneMoves(dev).In++
+		}
+	})
+	report.Balance = b.GetBalance()
+	report.Dispersion = b.GetDispersion()
+	return report, nil
+}
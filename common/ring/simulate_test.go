@@ -0,0 +1,68 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	builderPath := filepath.Join(dir, "object.builder")
+	makeComponent(t, builderPath, 8, 3, 1, 4)
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	require.Nil(t, err)
+	version := builder.Version
+	parts := map[int64]int64{}
+	for _, dev := range builder.Devs {
+		parts[dev.Id] = dev.Parts
+	}
+
+	report, err := builder.Simulate([]*SimulatedChange{
+		{Op: "add", Dev: &RingBuilderDevice{Id: -1, Region: 1, Zone: 4, Scheme: "http", Ip: "127.0.1.4", Port: 6000, Device: "sda", Weight: 1}},
+		{Op: "remove", DevId: 0},
+	}, 10, map[int64]float64{0: 100})
+	require.Nil(t, err)
+	require.True(t, report.Converged)
+	require.True(t, len(report.Rounds) >= 1)
+	require.Equal(t, int(parts[0]), report.MovedByDevice[0].Out)
+	require.Equal(t, 0, report.MovedByDevice[0].In)
+	require.Equal(t, int(parts[0]), report.MovedByDevice[4].In)
+	require.Equal(t, int(parts[0]), report.MovedByZone["r1z4"].In)
+	require.Equal(t, report.Moved, report.MovedByRegion[1].In)
+	require.Equal(t, report.Moved, report.MovedByRegion[1].Out)
+	require.Equal(t, int64(100*parts[0]), report.BytesToMove)
+	require.Equal(t, report.Moved-int(parts[0]), report.BytesUnknown)
+	require.Equal(t, 0.0, report.Dispersion)
+
+	// Nothing was saved.
+	builder, err = NewRingBuilderFromFile(builderPath, false)
+	require.Nil(t, err)
+	require.Equal(t, version, builder.Version)
+	require.Equal(t, 4, len(builder.Devs))
+
+	_, err = builder.Simulate([]*SimulatedChange{{Op: "set_weight", DevId: 9, Weight: 2}}, 10, nil)
+	require.NotNil(t, err)
+	_, err = builder.Simulate([]*SimulatedChange{{Op: "explode"}}, 10, nil)
+	require.NotNil(t, err)
+}
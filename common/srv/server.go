@@ -89,7 +89,8 @@ var responseBodies = map[int]string{
 
 type customWriter struct {
 	http.ResponseWriter
-	f func(w http.ResponseWriter, status int) int
+	f           func(w http.ResponseWriter, status int) int
+	wroteHeader bool
 }
 
 type IpPort struct {
@@ -99,14 +100,25 @@ type IpPort struct {
 }
 
 func (w *customWriter) WriteHeader(status int) {
+	w.wroteHeader = true
 	w.ResponseWriter.WriteHeader(w.f(w.ResponseWriter, status))
 }
 
+// Write sends the implicit 200 of a response written without WriteHeader
+// through WriteHeader, so the function sees every response.
+func (w *customWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
 func (w *customWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return w.ResponseWriter.(http.Hijacker).Hijack()
 }
 
-// NewCustomWriter creates an http.ResponseWriter wrapper that calls your function on WriteHeader.
+// NewCustomWriter creates an http.ResponseWriter wrapper that calls your function on WriteHeader, or on the first Write
+// if the header wasn't written.
 func NewCustomWriter(w http.ResponseWriter, f func(w http.ResponseWriter, status int) int) http.ResponseWriter {
 	return &customWriter{ResponseWriter: w, f: f}
 }
@@ -198,6 +198,27 @@ func (mr *FakeMemcacheRing) SetMulti(ctx context.Context, serverKey string, valu
 	return nil
 }
 
+func (mr *FakeMemcacheRing) GetStructuredCAS(ctx context.Context, key string, val interface{}) (uint64, error) {
+	v, ok := mr.MockGetStructured[key]
+	if !ok {
+		return 0, ring.CacheMiss
+	}
+	return 1, json.Unmarshal(v, val)
+}
+
+// SetCAS also stores the value for later GetStructuredCAS calls.
+func (mr *FakeMemcacheRing) SetCAS(ctx context.Context, key string, value interface{}, cas uint64, timeout int) error {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if mr.MockGetStructured == nil {
+		mr.MockGetStructured = map[string][]byte{}
+	}
+	mr.MockGetStructured[key] = v
+	return mr.Set(ctx, key, value, timeout)
+}
+
 type MockResponseWriter struct {
 	SaveHeader *http.Header
 	StatusMap  map[string]int
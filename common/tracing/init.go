@@ -17,6 +17,8 @@ package tracing
 
 import (
 	"io"
+	"io/ioutil"
+	"strings"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
@@ -26,8 +28,25 @@ import (
 	"github.com/RocFang/hummingbird/common/srv"
 )
 
-// Init creates a new instance of Jaeger tracer.
+// Init creates a new tracer as configured by the tracing section: a Jaeger
+// tracer by default, or with exporter = otlp an OpenTelemetry tracer that
+// propagates W3C trace context and sends spans to otlp_endpoint.
 func Init(serviceName string, logger srv.LowLevelLogger, section conf.Section) (opentracing.Tracer, io.Closer, error) {
+	if strings.ToLower(section.GetDefault("exporter", "jaeger")) == "otlp" {
+		if section.GetBool("disabled", false) {
+			return opentracing.NoopTracer{}, ioutil.NopCloser(nil), nil
+		}
+		tracer := newOtelTracer(
+			serviceName,
+			logger,
+			section.GetDefault("otlp_endpoint", "http://localhost:4318/v1/traces"),
+			parseOtlpHeaders(section.GetDefault("otlp_headers", "")),
+			section.GetDefault("sampler_type", "const"),
+			section.GetFloat("sampler_param", 1),
+			section.GetBool("reporter_log_spans", false),
+		)
+		return tracer, tracer, nil
+	}
 	cfg := config.Configuration{
 		Disabled: section.GetBool("disabled", false),
 		Sampler: &config.SamplerConfig{
@@ -0,0 +1,655 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"go.uber.org/zap"
+
+	"github.com/RocFang/hummingbird/common/srv"
+)
+
+// The OpenTelemetry tracer implements the opentracing API used throughout
+// hummingbird, propagating W3C trace context (traceparent, tracestate and
+// baggage headers) and exporting finished spans to an OTLP/HTTP collector as
+// JSON.
+//
+// It is written here rather than built on the OpenTelemetry Go SDK because the
+// SDK needs a far newer Go than the 1.12 hummingbird builds with, and everything
+// here is instrumented with opentracing, so the SDK would also need its
+// opentracing bridge in front of it. Only the small part of OTLP the exporter
+// needs is implemented: spans with attributes, events and status, batched and
+// posted as OTLP/JSON. When hummingbird moves to a Go the SDK supports, this
+// should be replaced with the SDK and its bridge.
+
+const (
+	otelMaxQueue  = 2048
+	otelMaxBatch  = 512
+	otelFlushTime = 1 * time.Second
+	// OTLP span kinds and status codes.
+	otelKindInternal = 1
+	otelKindServer   = 2
+	otelKindClient   = 3
+	otelKindProducer = 4
+	otelKindConsumer = 5
+	otelStatusError  = 2
+)
+
+type otelSpanContext struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	sampled    bool
+	traceState string
+	baggage    map[string]string
+}
+
+func (c *otelSpanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range c.baggage {
+		if !handler(k, v) {
+			return
+		}
+	}
+}
+
+// traceParent formats the context as a W3C traceparent header.
+func (c *otelSpanContext) traceParent() string {
+	flags := "00"
+	if c.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(c.traceID[:]) + "-" + hex.EncodeToString(c.spanID[:]) + "-" + flags
+}
+
+// parseTraceParent parses a W3C traceparent header.
+func parseTraceParent(value string) (*otelSpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return nil, opentracing.ErrSpanContextCorrupted
+	}
+	c := &otelSpanContext{}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, opentracing.ErrSpanContextCorrupted
+	}
+	if _, err := hex.Decode(c.traceID[:], []byte(parts[1])); err != nil || c.traceID == [16]byte{} {
+		return nil, opentracing.ErrSpanContextCorrupted
+	}
+	if _, err := hex.Decode(c.spanID[:], []byte(parts[2])); err != nil || c.spanID == [8]byte{} {
+		return nil, opentracing.ErrSpanContextCorrupted
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, opentracing.ErrSpanContextCorrupted
+	}
+	c.sampled = flags[0]&1 == 1
+	return c, nil
+}
+
+type otelEvent struct {
+	time   time.Time
+	fields []log.Field
+}
+
+type otelSpan struct {
+	tracer    *otelTracer
+	lock      sync.Mutex
+	context   *otelSpanContext
+	parentID  [8]byte
+	name      string
+	startTime time.Time
+	endTime   time.Time
+	tags      map[string]interface{}
+	events    []otelEvent
+	finished  bool
+}
+
+func (s *otelSpan) Finish() {
+	s.FinishWithOptions(opentracing.FinishOptions{})
+}
+
+func (s *otelSpan) FinishWithOptions(opts opentracing.FinishOptions) {
+	s.lock.Lock()
+	if s.finished {
+		s.lock.Unlock()
+		return
+	}
+	s.finished = true
+	s.endTime = opts.FinishTime
+	if s.endTime.IsZero() {
+		s.endTime = time.Now()
+	}
+	for _, record := range opts.LogRecords {
+		s.events = append(s.events, otelEvent{time: record.Timestamp, fields: record.Fields})
+	}
+	for _, data := range opts.BulkLogData {
+		record := data.ToLogRecord()
+		s.events = append(s.events, otelEvent{time: record.Timestamp, fields: record.Fields})
+	}
+	s.lock.Unlock()
+	if s.context.sampled {
+		s.tracer.report(s)
+	}
+}
+
+func (s *otelSpan) Context() opentracing.SpanContext {
+	return s.context
+}
+
+func (s *otelSpan) SetOperationName(operationName string) opentracing.Span {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.name = operationName
+	return s
+}
+
+func (s *otelSpan) SetTag(key string, value interface{}) opentracing.Span {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tags[key] = value
+	return s
+}
+
+func (s *otelSpan) LogFields(fields ...log.Field) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, otelEvent{time: time.Now(), fields: fields})
+}
+
+func (s *otelSpan) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := log.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		fields = []log.Field{log.Error(err), log.String("function", "LogKV")}
+	}
+	s.LogFields(fields...)
+}
+
+func (s *otelSpan) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	baggage := make(map[string]string, len(s.context.baggage)+1)
+	for k, v := range s.context.baggage {
+		baggage[k] = v
+	}
+	baggage[restrictedKey] = value
+	c := *s.context
+	c.baggage = baggage
+	s.context = &c
+	return s
+}
+
+func (s *otelSpan) BaggageItem(restrictedKey string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.context.baggage[restrictedKey]
+}
+
+func (s *otelSpan) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+func (s *otelSpan) LogEvent(event string) {
+	s.Log(opentracing.LogData{Event: event})
+}
+
+func (s *otelSpan) LogEventWithPayload(event string, payload interface{}) {
+	s.Log(opentracing.LogData{Event: event, Payload: payload})
+}
+
+func (s *otelSpan) Log(data opentracing.LogData) {
+	record := data.ToLogRecord()
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.events = append(s.events, otelEvent{time: record.Timestamp, fields: record.Fields})
+}
+
+type otelTracer struct {
+	serviceName string
+	endpoint    string
+	headers     map[string]string
+	samplerType string
+	samplerRate float64
+	logSpans    bool
+	client      *http.Client
+	logger      srv.LowLevelLogger
+	lock        sync.Mutex
+	queue       []*otelSpan
+	dropped     int
+	flush       chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+}
+
+func newOtelTracer(serviceName string, logger srv.LowLevelLogger, endpoint string, headers map[string]string, samplerType string, samplerRate float64, logSpans bool) *otelTracer {
+	t := &otelTracer{
+		serviceName: serviceName,
+		endpoint:    endpoint,
+		headers:     headers,
+		samplerType: samplerType,
+		samplerRate: samplerRate,
+		logSpans:    logSpans,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		logger:      logger,
+		flush:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.exporter()
+	return t
+}
+
+func newOtelID(b []byte) {
+	for {
+		if _, err := rand.Read(b); err != nil {
+			binary.BigEndian.PutUint64(b[len(b)-8:], uint64(time.Now().UnixNano()))
+		}
+		for _, c := range b {
+			if c != 0 {
+				return
+			}
+		}
+	}
+}
+
+// sample decides whether a new trace is sampled, along the lines of the
+// Jaeger const and probabilistic samplers.
+func (t *otelTracer) sample(traceID [16]byte) bool {
+	switch t.samplerType {
+	case "probabilistic", "traceidratio":
+		if t.samplerRate >= 1 {
+			return true
+		}
+		return float64(binary.BigEndian.Uint64(traceID[8:])>>1) < t.samplerRate*float64(math.MaxInt64)
+	default:
+		return t.samplerRate != 0
+	}
+}
+
+func (t *otelTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	sso := opentracing.StartSpanOptions{}
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+	s := &otelSpan{tracer: t, name: operationName, startTime: sso.StartTime, tags: map[string]interface{}{}}
+	if s.startTime.IsZero() {
+		s.startTime = time.Now()
+	}
+	for k, v := range sso.Tags {
+		s.tags[k] = v
+	}
+	var parent *otelSpanContext
+	for _, ref := range sso.References {
+		if c, ok := ref.ReferencedContext.(*otelSpanContext); ok {
+			if parent == nil || ref.Type == opentracing.ChildOfRef {
+				parent = c
+			}
+		}
+	}
+	s.context = &otelSpanContext{}
+	newOtelID(s.context.spanID[:])
+	if parent != nil {
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.context.traceState = parent.traceState
+		s.context.baggage = parent.baggage
+		s.parentID = parent.spanID
+	} else {
+		newOtelID(s.context.traceID[:])
+		s.context.sampled = t.sample(s.context.traceID)
+	}
+	return s
+}
+
+func (t *otelTracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	c, ok := sm.(*otelSpanContext)
+	if !ok {
+		return opentracing.ErrInvalidSpanContext
+	}
+	if format != opentracing.TextMap && format != opentracing.HTTPHeaders {
+		return opentracing.ErrUnsupportedFormat
+	}
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+	writer.Set("traceparent", c.traceParent())
+	if c.traceState != "" {
+		writer.Set("tracestate", c.traceState)
+	}
+	if len(c.baggage) > 0 {
+		items := make([]string, 0, len(c.baggage))
+		for k, v := range c.baggage {
+			items = append(items, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+		writer.Set("baggage", strings.Join(items, ","))
+	}
+	return nil
+}
+
+func (t *otelTracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	if format != opentracing.TextMap && format != opentracing.HTTPHeaders {
+		return nil, opentracing.ErrUnsupportedFormat
+	}
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return nil, opentracing.ErrInvalidCarrier
+	}
+	var traceParent, traceState, baggage string
+	err := reader.ForeachKey(func(key, val string) error {
+		switch strings.ToLower(key) {
+		case "traceparent":
+			traceParent = val
+		case "tracestate":
+			traceState = val
+		case "baggage":
+			baggage = val
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if traceParent == "" {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+	c, err := parseTraceParent(traceParent)
+	if err != nil {
+		return nil, err
+	}
+	c.traceState = traceState
+	for _, item := range strings.Split(baggage, ",") {
+		if i := strings.Index(item, "="); i > 0 {
+			// Properties after a ; are not kept.
+			k, _ := url.QueryUnescape(strings.TrimSpace(item[:i]))
+			v, _ := url.QueryUnescape(strings.TrimSpace(strings.SplitN(item[i+1:], ";", 2)[0]))
+			if c.baggage == nil {
+				c.baggage = map[string]string{}
+			}
+			c.baggage[k] = v
+		}
+	}
+	return c, nil
+}
+
+func (t *otelTracer) report(s *otelSpan) {
+	if t.logSpans {
+		t.logger.Info("Reporting span", zap.String("name", s.name), zap.String("traceparent", s.context.traceParent()))
+	}
+	t.lock.Lock()
+	if len(t.queue) >= otelMaxQueue {
+		t.dropped++
+	} else {
+		t.queue = append(t.queue, s)
+	}
+	full := len(t.queue) >= otelMaxBatch
+	t.lock.Unlock()
+	if full {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *otelTracer) exporter() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(otelFlushTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flush:
+		case <-t.done:
+			t.export()
+			return
+		}
+		t.export()
+	}
+}
+
+// export sends the queued spans to the collector, a batch at a time.
+func (t *otelTracer) export() {
+	for {
+		t.lock.Lock()
+		batch := t.queue
+		if len(batch) > otelMaxBatch {
+			batch = batch[:otelMaxBatch]
+		}
+		t.queue = t.queue[len(batch):]
+		dropped := t.dropped
+		t.dropped = 0
+		t.lock.Unlock()
+		if dropped > 0 {
+			t.logger.Error("Dropped spans; the OTLP export queue was full", zap.Int("dropped", dropped))
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.send(batch); err != nil {
+			t.logger.Error("Error exporting spans", zap.String("endpoint", t.endpoint), zap.Int("spans", len(batch)), zap.Error(err))
+		}
+	}
+}
+
+func (t *otelTracer) send(batch []*otelSpan) error {
+	body, err := json.Marshal(t.exportRequest(batch))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector responded %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close exports any spans still queued and stops the exporter.
+func (t *otelTracer) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	t.wg.Wait()
+	return nil
+}
+
+// The types below are the JSON encoding of an OTLP ExportTraceServiceRequest.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func otlpValue(value interface{}) otlpAnyValue {
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case bool:
+		v.BoolValue = &value
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		i := fmt.Sprint(value)
+		v.IntValue = &i
+	case float32:
+		f := float64(value)
+		v.DoubleValue = &f
+	case float64:
+		v.DoubleValue = &value
+	case error:
+		s := value.Error()
+		v.StringValue = &s
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return v
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (t *otelTracer) exportRequest(batch []*otelSpan) *otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.lock.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.context.traceID[:]),
+			SpanID:            hex.EncodeToString(s.context.spanID[:]),
+			TraceState:        s.context.traceState,
+			Name:              s.name,
+			Kind:              otelKindInternal,
+			StartTimeUnixNano: otlpTime(s.startTime),
+			EndTimeUnixNano:   otlpTime(s.endTime),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.tags {
+			switch k {
+			case "span.kind":
+				switch fmt.Sprint(v) {
+				case "server":
+					span.Kind = otelKindServer
+				case "client":
+					span.Kind = otelKindClient
+				case "producer":
+					span.Kind = otelKindProducer
+				case "consumer":
+					span.Kind = otelKindConsumer
+				}
+				continue
+			case "error":
+				if b, ok := v.(bool); ok && b {
+					span.Status.Code = otelStatusError
+				}
+			}
+			span.Attributes = append(span.Attributes, otlpKeyValue{Key: k, Value: otlpValue(v)})
+		}
+		for _, e := range s.events {
+			event := otlpEvent{TimeUnixNano: otlpTime(e.time), Name: "log"}
+			for _, f := range e.fields {
+				if f.Key() == "event" {
+					event.Name = fmt.Sprint(f.Value())
+				}
+				event.Attributes = append(event.Attributes, otlpKeyValue{Key: f.Key(), Value: otlpValue(f.Value())})
+			}
+			span.Events = append(span.Events, event)
+		}
+		s.lock.Unlock()
+		spans = append(spans, span)
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpValue(t.serviceName)}}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "hummingbird"}, Spans: spans}},
+	}}}
+}
+
+// parseOtlpHeaders parses headers given as comma separated key=value pairs,
+// like OTEL_EXPORTER_OTLP_HEADERS.
+func parseOtlpHeaders(value string) map[string]string {
+	headers := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		if i := strings.Index(item, "="); i > 0 {
+			k, _ := url.QueryUnescape(strings.TrimSpace(item[:i]))
+			v, _ := url.QueryUnescape(strings.TrimSpace(item[i+1:]))
+			headers[k] = v
+		}
+	}
+	return headers
+}
+
+var _ opentracing.Tracer = &otelTracer{}
+var _ opentracing.Span = &otelSpan{}
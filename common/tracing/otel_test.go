@@ -0,0 +1,133 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/RocFang/hummingbird/common/conf"
+)
+
+func TestOtelTracerExportsSpans(t *testing.T) {
+	var lock sync.Mutex
+	var requests []*otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.Equal(t, "secret", r.Header.Get("Api-Key"))
+		req := &otlpRequest{}
+		require.Nil(t, json.NewDecoder(r.Body).Decode(req))
+		lock.Lock()
+		requests = append(requests, req)
+		lock.Unlock()
+	}))
+	defer collector.Close()
+	config, err := conf.StringConfig("[tracing]\nexporter = otlp\notlp_endpoint = " + collector.URL + "\notlp_headers = Api-Key=secret\n")
+	require.Nil(t, err)
+	tracer, closer, err := Init("proxyserver", zap.NewNop(), config.GetSection("tracing"))
+	require.Nil(t, err)
+
+	parent := tracer.StartSpan("GET", ext.SpanKindRPCServer)
+	parent.SetBaggageItem("user", "tester")
+	header := http.Header{}
+	require.Nil(t, tracer.Inject(parent.Context(), opentracing.TextMap, opentracing.HTTPHeadersCarrier(header)))
+	require.Regexp(t, "^00-[0-9a-f]{32}-[0-9a-f]{16}-01$", header.Get("Traceparent"))
+	require.Equal(t, "user=tester", header.Get("Baggage"))
+
+	remote, err := tracer.Extract(opentracing.TextMap, opentracing.HTTPHeadersCarrier(header))
+	require.Nil(t, err)
+	child := tracer.StartSpan("HTTP GET", opentracing.ChildOf(remote))
+	require.Equal(t, "tester", child.BaggageItem("user"))
+	child.SetTag("error", true)
+	child.SetTag("http.status_code", 500)
+	child.Finish()
+	parent.Finish()
+	require.Nil(t, closer.Close())
+
+	spans := map[string]otlpSpan{}
+	for _, req := range requests {
+		require.Equal(t, "service.name", req.ResourceSpans[0].Resource.Attributes[0].Key)
+		require.Equal(t, "proxyserver", *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+		for _, span := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+			spans[span.Name] = span
+		}
+	}
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, spans["GET"].TraceID, spans["HTTP GET"].TraceID)
+	require.Equal(t, spans["GET"].SpanID, spans["HTTP GET"].ParentSpanID)
+	require.Equal(t, "", spans["GET"].ParentSpanID)
+	require.Equal(t, otelKindServer, spans["GET"].Kind)
+	require.Equal(t, otelStatusError, spans["HTTP GET"].Status.Code)
+	found := false
+	for _, attr := range spans["HTTP GET"].Attributes {
+		if attr.Key == "http.status_code" {
+			require.Equal(t, "500", *attr.Value.IntValue)
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestOtelTracerSampling(t *testing.T) {
+	tracer := newOtelTracer("test", zap.NewNop(), "http://127.0.0.1:1/v1/traces", nil, "const", 0, false)
+	defer tracer.Close()
+	span := tracer.StartSpan("unsampled")
+	header := http.Header{}
+	require.Nil(t, tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)))
+	require.Regexp(t, "-00$", header.Get("Traceparent"))
+	span.Finish()
+	require.Equal(t, 0, len(tracer.queue))
+
+	// A sampled parent's decision is followed.
+	header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	header.Set("Tracestate", "vendor=value")
+	remote, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	require.Nil(t, err)
+	span = tracer.StartSpan("sampled", opentracing.ChildOf(remote))
+	require.True(t, span.Context().(*otelSpanContext).sampled)
+	require.Equal(t, "vendor=value", span.Context().(*otelSpanContext).traceState)
+}
+
+func TestParseTraceParent(t *testing.T) {
+	c, err := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Nil(t, err)
+	require.True(t, c.sampled)
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", c.traceParent())
+	for _, value := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		_, err := parseTraceParent(value)
+		require.Equal(t, opentracing.ErrSpanContextCorrupted, err, value)
+	}
+	// Later versions may add fields.
+	_, err = parseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	require.Nil(t, err)
+	_, err = (&otelTracer{}).Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(http.Header{}))
+	require.Equal(t, opentracing.ErrSpanContextNotFound, err)
+}
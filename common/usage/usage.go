@@ -0,0 +1,161 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package usage holds the logs used for usage accounting. Proxies log the
+// requests and bytes transferred for each account and storage policy every
+// so often, account servers log snapshots of what each account is storing,
+// and "hummingbird usage aggregate" combines the two into hourly records for
+// billing.
+//
+// The logs are a JSON record per line, in files named <prefix>-YYYYMMDDHH.log
+// for the hour (UTC) they were written in, so they can be shipped and cleaned
+// up a file at a time.
+package usage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// KindTransfer records are the requests and bytes a proxy saw for an
+	// account and policy in the period starting at the record's Time.
+	KindTransfer = "transfer"
+	// KindStorage records are what an account had stored in a policy at the
+	// record's Time.
+	KindStorage = "storage"
+)
+
+const logTimeFormat = "2006010215"
+
+// Record is a line of a usage log. Policy is -1 for requests that aren't to
+// any storage policy, like account requests.
+type Record struct {
+	Kind           string           `json:"kind"`
+	Time           int64            `json:"time"`
+	Account        string           `json:"account"`
+	Policy         int              `json:"policy"`
+	Requests       map[string]int64 `json:"requests,omitempty"`
+	BytesIn        int64            `json:"bytes_in,omitempty"`
+	BytesOut       int64            `json:"bytes_out,omitempty"`
+	ContainerCount int64            `json:"container_count,omitempty"`
+	ObjectCount    int64            `json:"object_count,omitempty"`
+	BytesUsed      int64            `json:"bytes_used,omitempty"`
+}
+
+// LogWriter appends records to hourly log files in a directory, removing
+// files older than keep, if it's not zero.
+type LogWriter struct {
+	dir    string
+	prefix string
+	keep   time.Duration
+	lock   sync.Mutex
+	hour   string
+	file   *os.File
+}
+
+func NewLogWriter(dir, prefix string, keep time.Duration) (*LogWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LogWriter{dir: dir, prefix: prefix, keep: keep}, nil
+}
+
+// Write appends the records, as of now, in a single write so logs from more
+// than one process don't get interleaved mid-line.
+func (w *LogWriter) Write(records []*Record, now time.Time) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if hour := now.UTC().Format(logTimeFormat); hour != w.hour || w.file == nil {
+		if w.file != nil {
+			w.file.Close()
+			w.file = nil
+		}
+		file, err := os.OpenFile(filepath.Join(w.dir, fmt.Sprintf("%s-%s.log", w.prefix, hour)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		w.file = file
+		w.hour = hour
+		w.cleanup(now)
+	}
+	_, err := w.file.Write(buf.Bytes())
+	return err
+}
+
+// cleanup removes the writer's log files from before now-keep.
+func (w *LogWriter) cleanup(now time.Time) {
+	if w.keep <= 0 {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(w.dir, w.prefix+"-*.log"))
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		hour := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), w.prefix+"-"), ".log")
+		if t, err := time.Parse(logTimeFormat, hour); err == nil && t.Add(time.Hour).Before(now.Add(-w.keep)) {
+			os.Remove(name)
+		}
+	}
+}
+
+func (w *LogWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// ReadLog calls fn with each record in a usage log.
+func ReadLog(r io.Reader, fn func(*Record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
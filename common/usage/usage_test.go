@@ -0,0 +1,74 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package usage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	w, err := NewLogWriter(dir, "transfer", 2*time.Hour)
+	require.Nil(t, err)
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 4; i++ {
+		now := start.Add(time.Duration(i) * time.Hour)
+		require.Nil(t, w.Write([]*Record{
+			{Kind: KindTransfer, Time: now.Unix(), Account: "AUTH_a", Requests: map[string]int64{"GET": int64(i)}},
+			{Kind: KindTransfer, Time: now.Unix(), Account: "AUTH_b", Policy: 1, BytesIn: 10},
+		}, now))
+	}
+	require.Nil(t, w.Close())
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.Nil(t, err)
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	require.Equal(t, []string{"transfer-2017071403.log", "transfer-2017071404.log", "transfer-2017071405.log"}, names)
+
+	f, err := os.Open(filepath.Join(dir, "transfer-2017071405.log"))
+	require.Nil(t, err)
+	defer f.Close()
+	var records []*Record
+	require.Nil(t, ReadLog(f, func(r *Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	require.Equal(t, []*Record{
+		{Kind: KindTransfer, Time: 1500010800, Account: "AUTH_a", Requests: map[string]int64{"GET": 3}},
+		{Kind: KindTransfer, Time: 1500010800, Account: "AUTH_b", Policy: 1, BytesIn: 10},
+	}, records)
+}
+
+func TestReadLogBadLine(t *testing.T) {
+	count := 0
+	err := ReadLog(strings.NewReader("{\"kind\":\"storage\"}\n\n{nope\n"), func(r *Record) error {
+		count++
+		return nil
+	})
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "line 3:"))
+	require.Equal(t, 1, count)
+}
@@ -26,6 +26,7 @@ import (
 	"math/rand"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -462,6 +463,141 @@ func ParseContentTypeForSlo(contentType string, listedSize int64) (string, int64
 	return contentType, listedSize, nil
 }
 
+// ParseContentTypeForSymlink removes the symlink_target parameters the proxy
+// adds to a symlink's listed content type, returning the target path and, for
+// static links, the target's etag and size.
+func ParseContentTypeForSymlink(contentType string) (string, string, string, int64, error) {
+	if !strings.Contains(contentType, ";") || !strings.Contains(contentType, "symlink_target") {
+		return contentType, "", "", 0, nil
+	}
+	contentTypeCleaned, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", "", "", 0, err
+	}
+	target, etag := params["symlink_target"], params["symlink_target_etag"]
+	var size int64
+	if v, ok := params["symlink_target_bytes"]; ok {
+		if size, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return "", "", "", 0, err
+		}
+	}
+	delete(params, "symlink_target")
+	delete(params, "symlink_target_etag")
+	delete(params, "symlink_target_bytes")
+	return mime.FormatMediaType(contentTypeCleaned, params), target, etag, size, nil
+}
+
+// contentTypeMetaParam starts the parameter ContentTypeWithMeta adds to a
+// listed content type.
+const contentTypeMetaParam = "; swift_meta=\""
+
+// ContentTypeWithMeta adds an object's user metadata, keyed by name without
+// the X-Object-Meta- prefix, to the content type the object server sends in
+// container updates, so listings can include it.
+func ContentTypeWithMeta(contentType string, meta map[string]string) string {
+	if len(meta) == 0 {
+		return contentType
+	}
+	values := url.Values{}
+	for k, v := range meta {
+		values.Set(strings.ToLower(k), v)
+	}
+	return contentType + contentTypeMetaParam + values.Encode() + "\""
+}
+
+// ParseContentTypeForMeta removes the user metadata ContentTypeWithMeta adds
+// to a listed content type, returning it.
+func ParseContentTypeForMeta(contentType string) (string, map[string]string, error) {
+	i := strings.LastIndex(contentType, contentTypeMetaParam)
+	if i < 0 {
+		return contentType, nil, nil
+	}
+	rest := contentType[i+len(contentTypeMetaParam):]
+	end := strings.Index(rest, "\"")
+	if end < 0 {
+		return "", nil, fmt.Errorf("Unterminated swift_meta in content type")
+	}
+	values, err := url.ParseQuery(rest[:end])
+	if err != nil {
+		return "", nil, err
+	}
+	meta := make(map[string]string, len(values))
+	for k, v := range values {
+		meta[k] = v[0]
+	}
+	return contentType[:i] + rest[end+1:], meta, nil
+}
+
+// listingContentTypes are the content types account and container listings
+// can be served as, in order of preference, with their formats.
+var listingContentTypes = []struct {
+	contentType string
+	format      string
+}{
+	{"text/plain", "text"},
+	{"application/json", "json"},
+	{"application/xml", "xml"},
+	{"text/xml", "xml"},
+}
+
+// acceptQuality returns the quality the Accept header gives contentType, and
+// the position in the header of the media range that gave it.
+func acceptQuality(contentType, accept string) (float64, int) {
+	quality, position, specificity := 0.0, -1, 0
+	for i, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		s := 0
+		switch {
+		case name == contentType:
+			s = 3
+		case name == contentType[:strings.Index(contentType, "/")]+"/*":
+			s = 2
+		case name == "*/*" || name == "*":
+			s = 1
+		}
+		if s <= specificity {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil && v >= 0 && v <= 1 {
+					q = v
+				}
+			}
+		}
+		quality, position, specificity = q, i, s
+	}
+	return quality, position
+}
+
+// ListingFormat returns the format, "text", "json" or "xml", to serve an
+// account or container listing in, from its format query parameter if it has
+// one, or its Accept header. It returns "" if the client accepts none of them.
+func ListingFormat(format, accept string) string {
+	switch strings.ToLower(format) {
+	case "json":
+		return "json"
+	case "xml":
+		return "xml"
+	case "":
+	default:
+		return "text"
+	}
+	if strings.TrimSpace(accept) == "" {
+		return "text"
+	}
+	best, bestQuality, bestPosition := "", 0.0, 0
+	for _, offer := range listingContentTypes {
+		quality, position := acceptQuality(offer.contentType, accept)
+		if quality > bestQuality || (quality == bestQuality && quality > 0 && position < bestPosition) {
+			best, bestQuality, bestPosition = offer.format, quality, position
+		}
+	}
+	return best
+}
+
 func SliceFromCSV(csv string) []string {
 	s := []string{}
 	for _, val := range strings.Split(csv, ",") {
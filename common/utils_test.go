@@ -310,6 +310,74 @@ func TestParseContentTypeForSlo(t *testing.T) {
 	require.NotNil(t, err)
 }
 
+func TestParseContentTypeForSymlink(t *testing.T) {
+	ct, target, etag, size, err := ParseContentTypeForSymlink("text/html")
+	require.Nil(t, err)
+	require.Equal(t, "text/html", ct)
+	require.Equal(t, "", target)
+
+	ct, target, etag, size, err = ParseContentTypeForSymlink(`application/symlink;symlink_target="a/c/o"`)
+	require.Nil(t, err)
+	require.Equal(t, "application/symlink", ct)
+	require.Equal(t, "a/c/o", target)
+	require.Equal(t, "", etag)
+
+	ct, target, etag, size, err = ParseContentTypeForSymlink(`text/plain; charset=utf-8; symlink_target="a/c/o"; symlink_target_etag=abc; symlink_target_bytes=12`)
+	require.Nil(t, err)
+	require.Equal(t, "text/plain; charset=utf-8", ct)
+	require.Equal(t, "a/c/o", target)
+	require.Equal(t, "abc", etag)
+	require.Equal(t, int64(12), size)
+
+	_, _, _, _, err = ParseContentTypeForSymlink(`text/plain;symlink_target="a/c/o";symlink_target_bytes=moo`)
+	require.NotNil(t, err)
+}
+
+func TestContentTypeMeta(t *testing.T) {
+	ct, meta, err := ParseContentTypeForMeta("text/html")
+	require.Nil(t, err)
+	require.Equal(t, "text/html", ct)
+	require.Nil(t, meta)
+
+	require.Equal(t, "text/html", ContentTypeWithMeta("text/html", nil))
+	withMeta := ContentTypeWithMeta("text/plain; charset=utf-8", map[string]string{"Color": "blue", "Note": `a "b"; c`})
+	ct, meta, err = ParseContentTypeForMeta(withMeta)
+	require.Nil(t, err)
+	require.Equal(t, "text/plain; charset=utf-8", ct)
+	require.Equal(t, map[string]string{"color": "blue", "note": `a "b"; c`}, meta)
+
+	ct, meta, err = ParseContentTypeForMeta(`application/symlink` + withMeta[len("text/plain; charset=utf-8"):] + `; symlink_target="a/c/o"`)
+	require.Nil(t, err)
+	require.Equal(t, `application/symlink; symlink_target="a/c/o"`, ct)
+	require.Equal(t, "blue", meta["color"])
+
+	_, _, err = ParseContentTypeForMeta(`text/plain; swift_meta="a=b`)
+	require.NotNil(t, err)
+}
+
+func TestListingFormat(t *testing.T) {
+	var tests = []struct {
+		format, accept, expected string
+	}{
+		{"", "", "text"},
+		{"json", "application/xml", "json"},
+		{"XML", "", "xml"},
+		{"plain", "application/json", "text"},
+		{"", "*/*", "text"},
+		{"", "application/json", "json"},
+		{"", "application/json;q=0.5, application/xml", "xml"},
+		{"", "text/xml, application/json", "xml"},
+		{"", "application/*", "json"},
+		{"", "text/*;q=0.2, application/json;q=0.1", "text"},
+		{"", "application/json;q=0, */*;q=0.1", "text"},
+		{"", "image/png", ""},
+		{"", "text/plain;q=0, application/json;q=0, application/xml;q=0, text/xml;q=0", ""},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, ListingFormat(test.format, test.accept), test.accept)
+	}
+}
+
 func TestSliceFromCSV(t *testing.T) {
 	var tests = []struct {
 		s        string   // input
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -56,9 +57,11 @@ type ContainerInfo struct {
 	XContainerSyncPoint1    string              `json:"-"`
 	XContainerSyncPoint2    string              `json:"-"`
 	StoragePolicyIndex      int                 `json:"storage_policy_index"`
+	ReconcilerSyncPoint     int64               `json:"-"`
 	RawMetadata             string              `json:"metadata"`
 	Metadata                map[string][]string `json:"-"`
 	MaxRow                  int64               `json:"max_row"`
+	ShardingState           string              `json:"-"`
 	invalid                 bool
 	updated                 time.Time
 	// This row isn't populated by GetInfo, it only exists for the times this is
@@ -67,13 +70,20 @@ type ContainerInfo struct {
 }
 
 // ObjectListingRecord is the struct used for serializing objects in json and xml container listings.
+// The symlink fields, storage policy and user metadata are only listed when the listing's include
+// parameter asks for them, and user metadata only in json.
 type ObjectListingRecord struct {
-	XMLName      xml.Name `xml:"object" json:"-"`
-	Name         string   `xml:"name" json:"name"`
-	LastModified string   `xml:"last_modified" json:"last_modified"`
-	Size         int64    `xml:"bytes" json:"bytes"`
-	ContentType  string   `xml:"content_type" json:"content_type"`
-	ETag         string   `xml:"hash" json:"hash"`
+	XMLName       xml.Name          `xml:"object" json:"-"`
+	Name          string            `xml:"name" json:"name"`
+	LastModified  string            `xml:"last_modified" json:"last_modified"`
+	Size          int64             `xml:"bytes" json:"bytes"`
+	ContentType   string            `xml:"content_type" json:"content_type"`
+	ETag          string            `xml:"hash" json:"hash"`
+	SymlinkPath   string            `xml:"symlink_path,omitempty" json:"symlink_path,omitempty"`
+	SymlinkEtag   string            `xml:"symlink_etag,omitempty" json:"symlink_etag,omitempty"`
+	SymlinkBytes  int64             `xml:"symlink_bytes,omitempty" json:"symlink_bytes,omitempty"`
+	StoragePolicy string            `xml:"storage_policy,omitempty" json:"storage_policy,omitempty"`
+	Meta          map[string]string `xml:"-" json:"meta,omitempty"`
 }
 
 // SubdirListingRecord is the struct used for serializing subdirs in json and xml container listings.
@@ -102,6 +112,61 @@ type SyncRecord struct {
 	RemoteID  string `json:"remote_id"`
 }
 
+// Shard range states, in the order a range moves through them while its container is being sharded.
+const (
+	ShardRangeFound   = 10
+	ShardRangeCreated = 20
+	ShardRangeActive  = 30
+)
+
+// Container sharding states, as reported in X-Backend-Sharding-State.
+const (
+	ShardingStateUnsharded = "unsharded"
+	ShardingStateSharding  = "sharding"
+	ShardingStateSharded   = "sharded"
+)
+
+// ShardRange represents a row in the shard_range table: a namespace of object names whose listings live in a shard container.
+type ShardRange struct {
+	Name           string `json:"name"`
+	Timestamp      string `json:"timestamp"`
+	Lower          string `json:"lower"`
+	Upper          string `json:"upper"`
+	ObjectCount    int64  `json:"object_count"`
+	BytesUsed      int64  `json:"bytes_used"`
+	MetaTimestamp  string `json:"meta_timestamp"`
+	Deleted        int    `json:"deleted"`
+	State          int    `json:"state"`
+	StateTimestamp string `json:"state_timestamp"`
+}
+
+// Includes returns true if the object name falls in the range, which is exclusive of Lower and inclusive of Upper.
+// An empty Upper is unbounded.
+func (s *ShardRange) Includes(name string) bool {
+	return name > s.Lower && (s.Upper == "" || name <= s.Upper)
+}
+
+// Overlaps returns true if any names between marker and endMarker could fall in the range.
+func (s *ShardRange) Overlaps(marker, endMarker string) bool {
+	return (s.Upper == "" || marker < s.Upper) && (endMarker == "" || s.Lower < endMarker)
+}
+
+// Account returns the account of the shard container.
+func (s *ShardRange) Account() string {
+	if i := strings.Index(s.Name, "/"); i >= 0 {
+		return s.Name[:i]
+	}
+	return ""
+}
+
+// Container returns the name of the shard container.
+func (s *ShardRange) Container() string {
+	if i := strings.Index(s.Name, "/"); i >= 0 {
+		return s.Name[i+1:]
+	}
+	return s.Name
+}
+
 // Container is the interface implemented by a container.
 type Container interface {
 	// GetInfo returns the ContainerInfo struct for the container.
@@ -126,6 +191,10 @@ type Container interface {
 	Close() error
 	// removeall's database directory
 	Remove() error
+	// GetShardRanges returns the container's shard ranges that haven't been deleted, ordered by their upper bounds.
+	GetShardRanges() ([]*ShardRange, error)
+	// MergeShardRanges merges shard ranges into the container.
+	MergeShardRanges(ranges []*ShardRange) error
 }
 
 // ReplicableContainer is a container that also implements the replication API.
@@ -153,6 +222,18 @@ type ReplicableContainer interface {
 	RingHash() string
 	// Reported records the information as having been reported to an account database.
 	Reported(putTimestamp, deleteTimestamp string, objectCount, bytesUsed int64) error
+	// SetSyncPoints records the container sync progress through the object table.
+	SetSyncPoints(point1, point2 int64) error
+	// ObjectsInRange returns up to limit object records, including tombstones, with names after marker that fall in the range (lower, upper].
+	ObjectsInRange(lower, upper, marker string, limit int) ([]*ObjectRecord, error)
+	// RemoveObjects removes the object records, if they haven't been replaced since, without leaving tombstones.
+	RemoveObjects(records []*ObjectRecord) error
+	// ShardBoundaries returns the object names that split the container's listing into ranges of size objects.
+	ShardBoundaries(size int) ([]string, error)
+	// ReconcilePolicy adopts another replica's storage policy if it should win out over the local one, returning true if it did.
+	ReconcilePolicy(policyIndex int, statusChangedAt string, deleted bool) (bool, error)
+	// SetReconcilerSyncPoint records how far the object table has been checked for misplaced objects.
+	SetReconcilerSyncPoint(point int64) error
 }
 
 // ContainerEngine is the interface of an object that creates and returns containers.
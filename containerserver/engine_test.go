@@ -100,3 +100,20 @@ func TestOpenCount(t *testing.T) {
 	}
 	require.Equal(t, 0, l.OpenCount())
 }
+
+func TestShardRangeIncludes(t *testing.T) {
+	sr := &ShardRange{Name: ".shards_a/c-1", Lower: "b", Upper: "d"}
+	require.False(t, sr.Includes("b"))
+	require.True(t, sr.Includes("c"))
+	require.True(t, sr.Includes("d"))
+	require.False(t, sr.Includes("e"))
+	require.True(t, sr.Overlaps("", ""))
+	require.True(t, sr.Overlaps("a", "c"))
+	require.False(t, sr.Overlaps("d", ""))
+	require.False(t, sr.Overlaps("", "b"))
+	require.Equal(t, ".shards_a", sr.Account())
+	require.Equal(t, "c-1", sr.Container())
+	last := &ShardRange{Lower: "d"}
+	require.True(t, last.Includes("zzz"))
+	require.False(t, last.Includes("d"))
+}
@@ -138,6 +138,14 @@ func (server *ContainerServer) ContainerReplicateHandler(writer http.ResponseWri
 			status := server.replicateMergeSyncs(request, vars, records)
 			srv.StandardResponse(writer, status)
 		}
+	case "merge_shard_ranges":
+		var ranges []*ShardRange
+		if err := extractArgs(&ranges); err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+		} else {
+			status := server.replicateMergeShardRanges(request, vars, ranges)
+			srv.StandardResponse(writer, status)
+		}
 	case "sync":
 		var maxRow int64
 		var hash, id, createdAt, putTimestamp, deleteTimestamp, metadata string
@@ -188,6 +196,17 @@ func (server *ContainerServer) replicateRsyncThenMerge(request *http.Request, va
 			return http.StatusInternalServerError
 		}
 	}
+	if ranges, err := localDb.GetShardRanges(); err != nil {
+		srv.GetLogger(request).Error("Error fetching shard ranges.",
+			zap.String("containerFile", containerFile),
+			zap.Error(err))
+		return http.StatusInternalServerError
+	} else if err := tmpDb.MergeShardRanges(ranges); err != nil {
+		srv.GetLogger(request).Error("Error merging shard ranges.",
+			zap.String("tmpContainerFile", tmpContainerFile),
+			zap.Error(err))
+		return http.StatusInternalServerError
+	}
 	if err := tmpDb.NewID(); err != nil {
 		srv.GetLogger(request).Error("Error blessing new container db",
 			zap.String("containerFile", containerFile), zap.Error(err))
@@ -251,6 +270,21 @@ func (server *ContainerServer) replicateMergeItems(request *http.Request, vars m
 	return http.StatusAccepted
 }
 
+func (server *ContainerServer) replicateMergeShardRanges(request *http.Request, vars map[string]string, ranges []*ShardRange) int {
+	db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
+	if err != nil {
+		return http.StatusNotFound
+	}
+	defer server.containerEngine.Return(db)
+	if err := db.MergeShardRanges(ranges); err != nil {
+		srv.GetLogger(request).Error("Error merging shard ranges.",
+			zap.String("RingHash", db.RingHash()),
+			zap.Error(err))
+		return http.StatusInternalServerError
+	}
+	return http.StatusAccepted
+}
+
 func (server *ContainerServer) replicateMergeSyncs(request *http.Request, vars map[string]string, records []*SyncRecord) int {
 	db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
 	if err != nil {
@@ -185,6 +185,38 @@ func (f fakeDatabase) Reported(putTimestamp, deleteTimestamp string, objectCount
 	return errors.New("")
 }
 
+func (f fakeDatabase) SetSyncPoints(point1, point2 int64) error {
+	return errors.New("")
+}
+
+func (f fakeDatabase) GetShardRanges() ([]*ShardRange, error) {
+	return nil, errors.New("")
+}
+
+func (f fakeDatabase) MergeShardRanges(ranges []*ShardRange) error {
+	return errors.New("")
+}
+
+func (f fakeDatabase) ObjectsInRange(lower, upper, marker string, limit int) ([]*ObjectRecord, error) {
+	return nil, errors.New("")
+}
+
+func (f fakeDatabase) RemoveObjects(records []*ObjectRecord) error {
+	return errors.New("")
+}
+
+func (f fakeDatabase) ShardBoundaries(size int) ([]string, error) {
+	return nil, errors.New("")
+}
+
+func (f fakeDatabase) ReconcilePolicy(policyIndex int, statusChangedAt string, deleted bool) (bool, error) {
+	return false, errors.New("")
+}
+
+func (f fakeDatabase) SetReconcilerSyncPoint(point int64) error {
+	return errors.New("")
+}
+
 type fakeContainerEngine struct{}
 
 func (fakeContainerEngine) OpenCount() int {
@@ -0,0 +1,647 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/fs"
+	"github.com/RocFang/hummingbird/common/lifecycle"
+	"github.com/RocFang/hummingbird/common/ring"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/RocFang/hummingbird/middleware"
+	"github.com/justinas/alice"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uber-go/tally"
+	promreporter "github.com/uber-go/tally/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// The sysmeta key versioned_writes keeps a container's versions container in.
+	versionsLocationHeader = "X-Container-Sysmeta-Versions-Location"
+	// The content type of versioned_writes' delete markers.
+	versionsDeleteMarker = "application/x-deleted;swift_versions_deleted=1"
+)
+
+// s3api names multipart upload parts <uploadId>-<key>/<part number>.
+var lifecyclePartName = regexp.MustCompile(`/[0-9]{8}$`)
+
+// Headers copied along with X-Object-Meta-* when archiving an expired object.
+var lifecycleObjectHeaders = []string{"Content-Length", "Content-Type", "Content-Encoding", "Content-Disposition", "Etag", "X-Delete-At", "X-Static-Large-Object", "X-Object-Manifest"}
+
+// The encryption middleware's sysmeta. Its keys are derived from the object's
+// path, so an encrypted object copied to another name can never be read again.
+var lifecycleCryptoPrefixes = []string{"X-Object-Sysmeta-Crypto-", "X-Object-Transient-Sysmeta-Crypto-"}
+
+// ContainerLifecycle applies the lifecycle rules of containers that have them.
+// The first primary node of a container lists it and deletes the objects its
+// rules have expired, archiving them first if the container is versioned;
+// deletes old versions from the container's versions container; and aborts
+// stale multipart uploads in its "+segments" container.
+type ContainerLifecycle struct {
+	logger         srv.LowLevelLogger
+	logLevel       zap.AtomicLevel
+	bindIp         string
+	port           int
+	certFile       string
+	keyFile        string
+	deviceRoot     string
+	checkMounts    bool
+	reconCachePath string
+	interval       time.Duration
+	serverPort     int
+	Ring           ring.Ring
+	hClient        client.RequestClient
+	pdc            client.ProxyClient
+	metricsScope   tally.Scope
+	metricsCloser  io.Closer
+	expired        int64
+	noncurrent     int64
+	aborted        int64
+	failures       int64
+}
+
+func (l *ContainerLifecycle) Type() string {
+	return "container-lifecycle"
+}
+
+func (l *ContainerLifecycle) Background(flags *flag.FlagSet) chan struct{} {
+	once := false
+	if f := flags.Lookup("once"); f != nil {
+		once = f.Value.(flag.Getter).Get() == true
+	}
+	if once {
+		ch := make(chan struct{})
+		go func() {
+			defer close(ch)
+			l.Run()
+		}()
+		return ch
+	}
+	go l.RunForever()
+	return nil
+}
+
+func (l *ContainerLifecycle) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
+	l.metricsScope, l.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
+		Prefix:         metricsPrefix,
+		Tags:           map[string]string{},
+		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
+		Separator:      promreporter.DefaultSeparator,
+	}, time.Second)
+	commonHandlers := alice.New(
+		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
+		l.LogRequest,
+		middleware.RecoverHandler,
+		middleware.ValidateRequest,
+	)
+	router := srv.NewRouter()
+	router.Get("/metrics", prometheus.Handler())
+	router.Get("/loglevel", l.logLevel)
+	router.Put("/loglevel", l.logLevel)
+	router.Get("/healthcheck", commonHandlers.ThenFunc(l.HealthcheckHandler))
+	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
+	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
+	return alice.New(middleware.Metrics(l.metricsScope)).Then(router)
+}
+
+func (l *ContainerLifecycle) Finalize() {
+	if l.metricsCloser != nil {
+		l.metricsCloser.Close()
+	}
+	if l.pdc != nil {
+		l.pdc.Close()
+	}
+}
+
+func (l *ContainerLifecycle) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Length", "2")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("OK"))
+}
+
+func (l *ContainerLifecycle) LogRequest(next http.Handler) http.Handler {
+	return srv.LogRequest(l.logger, next)
+}
+
+// versionedObjectName is the name versioned_writes gives a version of obj in
+// the versions container.
+func versionedObjectName(obj, timestamp string) string {
+	return fmt.Sprintf("%03x%s/%s", len(obj), obj, timestamp)
+}
+
+// versionedObject returns the name of the object a version in a versions
+// container is of.
+func versionedObject(name string) (string, bool) {
+	if len(name) < 3 {
+		return "", false
+	}
+	length, err := strconv.ParseInt(name[:3], 16, 64)
+	if err != nil || int64(len(name)) < 3+length+1 || name[3+length] != '/' {
+		return "", false
+	}
+	return name[3 : 3+length], true
+}
+
+// listingTime returns a listing record's last modified time and timestamp.
+func listingTime(record *ObjectListingRecord) (time.Time, string, error) {
+	t, err := time.ParseInLocation("2006-01-02T15:04:05.999999", record.LastModified, common.GMT)
+	if err != nil {
+		return t, "", err
+	}
+	return t, common.CanonicalTimestampFromTime(t), nil
+}
+
+// listing pages through a JSON container listing, passing each record to f
+// until f returns false. Containers that don't exist have no records.
+func (l *ContainerLifecycle) listing(account, container, prefix string, f func(record *ObjectListingRecord) bool) error {
+	marker := ""
+	for {
+		options := map[string]string{"format": "json", "marker": marker, "prefix": prefix}
+		resp := l.hClient.GetContainerRaw(context.Background(), account, container, options, http.Header{})
+		if resp.StatusCode == http.StatusNotFound {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return nil
+		}
+		if resp.StatusCode/100 != 2 {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("listing %s/%s returned %d", account, container, resp.StatusCode)
+		}
+		var records []*ObjectListingRecord
+		err := json.NewDecoder(resp.Body).Decode(&records)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("listing %s/%s: %v", account, container, err)
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		for _, record := range records {
+			if !f(record) {
+				return nil
+			}
+		}
+		marker = records[len(records)-1].Name
+	}
+}
+
+// deleteObject deletes an object written at timestamp, returning false if
+// that failed. The delete is timestamped just after the object, so it loses
+// to anything written since the listing.
+func (l *ContainerLifecycle) deleteObject(account, container, obj, timestamp string) bool {
+	ts, err := offsetTimestamp(timestamp, 1)
+	if err != nil {
+		return false
+	}
+	resp := l.hClient.DeleteObject(context.Background(), account, container, obj, http.Header{"X-Timestamp": {ts}})
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	// A 409 means the object has been written again since.
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusConflict {
+		l.logger.Error("Error deleting object", zap.String("account", account), zap.String("container", container),
+			zap.String("object", obj), zap.Int("status", resp.StatusCode))
+		return false
+	}
+	return true
+}
+
+// archiveObject copies an expired object into the versions container and
+// leaves a delete marker after it, as versioned_writes does in history mode,
+// returning the timestamp of the copy it archived. Encrypted objects are left
+// in place, since only the proxy can re-encrypt them under the archived name.
+func (l *ContainerLifecycle) archiveObject(account, container, versions, obj, timestamp string) (string, bool) {
+	logger := l.logger.With(zap.String("account", account), zap.String("container", container), zap.String("object", obj))
+	resp := l.hClient.GetObject(context.Background(), account, container, obj, http.Header{})
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", true
+	}
+	if resp.StatusCode/100 != 2 {
+		logger.Error("Error getting object to archive", zap.Int("status", resp.StatusCode))
+		return "", false
+	}
+	objTimestamp, err := common.StandardizeTimestamp(resp.Header.Get("X-Timestamp"))
+	if err != nil || objTimestamp == "" {
+		logger.Error("Invalid object timestamp", zap.String("timestamp", resp.Header.Get("X-Timestamp")))
+		return "", false
+	}
+	if objTimestamp > timestamp {
+		// Written again since the listing, so it isn't expired after all.
+		return "", true
+	}
+	for k := range resp.Header {
+		for _, prefix := range lifecycleCryptoPrefixes {
+			if strings.HasPrefix(k, prefix) {
+				logger.Warn("Not archiving encrypted object", zap.String("versions", versions))
+				l.metricsScope.Counter("encrypted_skips").Inc(1)
+				return "", true
+			}
+		}
+	}
+	headers := http.Header{}
+	for k := range resp.Header {
+		if strings.HasPrefix(k, "X-Object-Meta-") || strings.HasPrefix(k, "X-Object-Sysmeta-") || common.StringInSlice(k, lifecycleObjectHeaders) {
+			headers.Set(k, resp.Header.Get(k))
+		}
+	}
+	put := l.hClient.PutObject(context.Background(), account, versions, versionedObjectName(obj, objTimestamp), headers, resp.Body)
+	io.Copy(ioutil.Discard, put.Body)
+	put.Body.Close()
+	if put.StatusCode/100 != 2 {
+		logger.Error("Error archiving object", zap.String("versions", versions), zap.Int("status", put.StatusCode))
+		return "", false
+	}
+	put = l.hClient.PutObject(context.Background(), account, versions, versionedObjectName(obj, common.GetTimestamp()),
+		http.Header{"Content-Type": {versionsDeleteMarker}, "Content-Length": {"0"}}, nil)
+	io.Copy(ioutil.Discard, put.Body)
+	put.Body.Close()
+	if put.StatusCode/100 != 2 {
+		logger.Error("Error writing delete marker", zap.String("versions", versions), zap.Int("status", put.StatusCode))
+		return "", false
+	}
+	return objTimestamp, true
+}
+
+func (l *ContainerLifecycle) failed() {
+	atomic.AddInt64(&l.failures, 1)
+	l.metricsScope.Counter("failures").Inc(1)
+}
+
+// expireObjects deletes the container's objects its rules have expired.
+func (l *ContainerLifecycle) expireObjects(account, container, versions string, rules []lifecycle.Rule, now time.Time) error {
+	return l.listing(account, container, "", func(record *ObjectListingRecord) bool {
+		modified, timestamp, err := listingTime(record)
+		if err != nil {
+			return true
+		}
+		for i := range rules {
+			if !rules[i].Matches(record.Name) || !lifecycle.Due(rules[i].ExpirationDays, modified, now) {
+				continue
+			}
+			if versions != "" {
+				archived, ok := l.archiveObject(account, container, versions, record.Name, timestamp)
+				if !ok {
+					l.failed()
+					break
+				}
+				if archived == "" {
+					break
+				}
+				timestamp = archived
+			}
+			if !l.deleteObject(account, container, record.Name, timestamp) {
+				l.failed()
+				break
+			}
+			atomic.AddInt64(&l.expired, 1)
+			l.metricsScope.Counter("expired").Inc(1)
+			break
+		}
+		return true
+	})
+}
+
+// expireVersions deletes versions the rules have expired from the versions
+// container. A version stopped being current when it was archived, which is
+// when it was written to the versions container.
+func (l *ContainerLifecycle) expireVersions(account, versions string, rules []lifecycle.Rule, now time.Time) error {
+	return l.listing(account, versions, "", func(record *ObjectListingRecord) bool {
+		obj, ok := versionedObject(record.Name)
+		if !ok {
+			return true
+		}
+		modified, timestamp, err := listingTime(record)
+		if err != nil {
+			return true
+		}
+		for i := range rules {
+			if !rules[i].Matches(obj) || !lifecycle.Due(rules[i].NoncurrentDays, modified, now) {
+				continue
+			}
+			if !l.deleteObject(account, versions, record.Name, timestamp) {
+				l.failed()
+				break
+			}
+			atomic.AddInt64(&l.noncurrent, 1)
+			l.metricsScope.Counter("noncurrent").Inc(1)
+			break
+		}
+		return true
+	})
+}
+
+// uploadCompleted reports whether the multipart upload with the marker object
+// name in container's "+segments" container was completed, leaving its parts
+// in use by the SLO manifest of the upload's key. Completing an upload deletes
+// its marker, but uploads completed before it did still have them.
+func (l *ContainerLifecycle) uploadCompleted(account, container, name string) (bool, error) {
+	key := name[strings.Index(name, "-")+1:]
+	resp := l.hClient.GetObject(context.Background(), account, container, key, http.Header{})
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return false, fmt.Errorf("getting %s/%s/%s returned %d", account, container, key, resp.StatusCode)
+	}
+	if !common.LooksTrue(resp.Header.Get("X-Static-Large-Object")) {
+		return false, nil
+	}
+	var manifest []struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return false, fmt.Errorf("manifest %s/%s/%s: %v", account, container, key, err)
+	}
+	prefix := "/" + container + "+segments/" + name + "/"
+	for _, seg := range manifest {
+		segName, err := url.PathUnescape(seg.Name)
+		if err != nil {
+			segName = seg.Name
+		}
+		if strings.HasPrefix(segName, prefix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// abortUploads aborts the multipart uploads the rules have expired. Each
+// upload is a marker object named <uploadId>-<key> in the "+segments"
+// container, with its parts under <uploadId>-<key>/. Uploads that were
+// completed are left alone.
+func (l *ContainerLifecycle) abortUploads(account, container string, rules []lifecycle.Rule, now time.Time) error {
+	segments := container + "+segments"
+	type upload struct {
+		name      string
+		timestamp string
+	}
+	var uploads []upload
+	if err := l.listing(account, segments, "", func(record *ObjectListingRecord) bool {
+		dash := strings.Index(record.Name, "-")
+		if dash < 0 || lifecyclePartName.MatchString(record.Name) {
+			return true
+		}
+		modified, timestamp, err := listingTime(record)
+		if err != nil {
+			return true
+		}
+		for i := range rules {
+			if rules[i].Matches(record.Name[dash+1:]) && lifecycle.Due(rules[i].AbortUploadDays, modified, now) {
+				uploads = append(uploads, upload{name: record.Name, timestamp: timestamp})
+				break
+			}
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, u := range uploads {
+		completed, err := l.uploadCompleted(account, container, u.name)
+		if err != nil {
+			l.logger.Error("Error checking multipart upload", zap.String("account", account),
+				zap.String("container", segments), zap.String("object", u.name), zap.Error(err))
+			l.failed()
+			continue
+		}
+		if completed {
+			continue
+		}
+		// Delete the parts first, so a failure doesn't leave parts behind
+		// without their upload.
+		ok := true
+		if err := l.listing(account, segments, u.name+"/", func(record *ObjectListingRecord) bool {
+			if !lifecyclePartName.MatchString(record.Name) || strings.Contains(record.Name[len(u.name)+1:], "/") {
+				return true
+			}
+			_, timestamp, err := listingTime(record)
+			if err != nil || !l.deleteObject(account, segments, record.Name, timestamp) {
+				ok = false
+				return false
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		if !ok || !l.deleteObject(account, segments, u.name, u.timestamp) {
+			l.failed()
+			continue
+		}
+		atomic.AddInt64(&l.aborted, 1)
+		l.metricsScope.Counter("aborted").Inc(1)
+	}
+	return nil
+}
+
+// applyRules applies a container's lifecycle rules.
+func (l *ContainerLifecycle) applyRules(account, container, versions string, rules []lifecycle.Rule, now time.Time) {
+	logger := l.logger.With(zap.String("account", account), zap.String("container", container))
+	var expiration, noncurrent, abort bool
+	for _, rule := range rules {
+		if !rule.Disabled {
+			expiration = expiration || rule.ExpirationDays > 0
+			noncurrent = noncurrent || rule.NoncurrentDays > 0
+			abort = abort || rule.AbortUploadDays > 0
+		}
+	}
+	if expiration {
+		if err := l.expireObjects(account, container, versions, rules, now); err != nil {
+			logger.Error("Error expiring objects", zap.Error(err))
+			l.failed()
+		}
+	}
+	if noncurrent && versions != "" {
+		if err := l.expireVersions(account, versions, rules, now); err != nil {
+			logger.Error("Error expiring old versions", zap.String("versions", versions), zap.Error(err))
+			l.failed()
+		}
+	}
+	if abort {
+		if err := l.abortUploads(account, container, rules, now); err != nil {
+			logger.Error("Error aborting multipart uploads", zap.Error(err))
+			l.failed()
+		}
+	}
+}
+
+// lifecycleContainer applies the lifecycle rules of the container at
+// containerFile, if it has any and this is its first primary node.
+func (l *ContainerLifecycle) lifecycleContainer(dev *ring.Device, containerFile string, now time.Time) bool {
+	db, err := sqliteOpenContainer(containerFile)
+	if err != nil {
+		l.logger.Error("Error opening container", zap.String("file", containerFile), zap.Error(err))
+		return false
+	}
+	defer db.Close()
+	if deleted, err := db.IsDeleted(); err != nil || deleted {
+		return false
+	}
+	metadata, err := db.GetMetadata()
+	if err != nil {
+		l.logger.Error("Error getting container metadata", zap.String("file", containerFile), zap.Error(err))
+		return false
+	}
+	if metadata[lifecycle.Sysmeta] == "" || metadata[shardRootHeader] != "" {
+		return false
+	}
+	partition, err := l.Ring.PartitionForHash(db.RingHash())
+	if err != nil {
+		l.logger.Error("Error getting partition for container", zap.String("file", containerFile), zap.Error(err))
+		return false
+	}
+	if nodes := l.Ring.GetNodes(partition); len(nodes) == 0 || nodes[0].Id != dev.Id {
+		return false
+	}
+	info, err := db.GetInfo()
+	if err != nil {
+		l.logger.Error("Error getting container info", zap.String("file", containerFile), zap.Error(err))
+		return false
+	}
+	rules, err := lifecycle.Parse(metadata[lifecycle.Sysmeta])
+	if err != nil {
+		l.logger.Error("Invalid lifecycle rules", zap.String("account", info.Account), zap.String("container", info.Container), zap.Error(err))
+		return false
+	}
+	versions := ""
+	if location, err := url.QueryUnescape(metadata[versionsLocationHeader]); err == nil {
+		versions = strings.Split(location, "/")[0]
+	}
+	l.applyRules(info.Account, info.Container, versions, rules, now)
+	return true
+}
+
+// Run a single lifecycle pass over the local devices.
+func (l *ContainerLifecycle) Run() {
+	start := time.Now()
+	atomic.StoreInt64(&l.expired, 0)
+	atomic.StoreInt64(&l.noncurrent, 0)
+	atomic.StoreInt64(&l.aborted, 0)
+	atomic.StoreInt64(&l.failures, 0)
+	l.metricsScope.Counter("passes").Inc(1)
+	devices, err := l.Ring.LocalDevices(l.serverPort)
+	if err != nil {
+		l.logger.Error("Error getting local devices from ring", zap.Error(err))
+		return
+	}
+	containers := 0
+	for _, dev := range devices {
+		devicePath := filepath.Join(l.deviceRoot, dev.Device)
+		if mount, err := fs.IsMount(devicePath); l.checkMounts && (err != nil || !mount) {
+			l.logger.Error("Device not mounted", zap.String("device", dev.Device))
+			continue
+		}
+		filepath.Walk(filepath.Join(devicePath, "containers"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.HasSuffix(path, ".db") && l.lifecycleContainer(dev, path, start) {
+				containers++
+			}
+			return nil
+		})
+	}
+	l.logger.Info("Container lifecycle pass complete",
+		zap.Int("containers", containers),
+		zap.Int64("expired", atomic.LoadInt64(&l.expired)),
+		zap.Int64("noncurrent", atomic.LoadInt64(&l.noncurrent)),
+		zap.Int64("aborted", atomic.LoadInt64(&l.aborted)),
+		zap.Int64("failures", atomic.LoadInt64(&l.failures)),
+		zap.Duration("elapsed", time.Since(start)))
+	if err := middleware.DumpReconCache(l.reconCachePath, "container",
+		map[string]interface{}{
+			"container_lifecycle_pass": float64(time.Since(start)) / float64(time.Second),
+			"lifecycle_deletes":        atomic.LoadInt64(&l.expired) + atomic.LoadInt64(&l.noncurrent),
+			"lifecycle_aborts":         atomic.LoadInt64(&l.aborted),
+			"lifecycle_failures":       atomic.LoadInt64(&l.failures),
+		}); err != nil {
+		l.logger.Error("Error saving container lifecycle recon data", zap.Error(err))
+	}
+}
+
+// Run lifecycle passes in a loop until forever.
+func (l *ContainerLifecycle) RunForever() {
+	for {
+		start := time.Now()
+		l.Run()
+		if elapsed := time.Since(start); elapsed < l.interval {
+			time.Sleep(l.interval - elapsed)
+		}
+	}
+}
+
+func NewContainerLifecycle(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader) (ipPort *srv.IpPort, server srv.Server, logger srv.LowLevelLogger, err error) {
+	if !serverconf.HasSection("container-lifecycle") {
+		return ipPort, nil, nil, fmt.Errorf("Unable to find container-lifecycle config section")
+	}
+	hashPathPrefix, hashPathSuffix, err := cnf.GetHashPrefixAndSuffix()
+	if err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Unable to get hash prefix and suffix: %s", err)
+	}
+	containerRing, err := cnf.GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error loading container ring: %s", err)
+	}
+	logLevelString := serverconf.GetDefault("container-lifecycle", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	certFile := serverconf.GetDefault("container-lifecycle", "cert_file", "")
+	keyFile := serverconf.GetDefault("container-lifecycle", "key_file", "")
+	cl := &ContainerLifecycle{
+		logLevel:       logLevel,
+		bindIp:         serverconf.GetDefault("container-lifecycle", "bind_ip", "0.0.0.0"),
+		port:           int(serverconf.GetInt("container-lifecycle", "bind_port", common.DefaultContainerLifecyclePort)),
+		certFile:       certFile,
+		keyFile:        keyFile,
+		deviceRoot:     serverconf.GetDefault("container-lifecycle", "devices", "/srv/node"),
+		checkMounts:    serverconf.GetBool("container-lifecycle", "mount_check", true),
+		reconCachePath: serverconf.GetDefault("container-lifecycle", "recon_cache_path", "/var/cache/swift"),
+		interval:       time.Duration(serverconf.GetInt("container-lifecycle", "interval", 3600)) * time.Second,
+		serverPort:     int(serverconf.GetInt("container-replicator", "bind_port", common.DefaultContainerReplicatorPort)),
+		Ring:           containerRing,
+		metricsScope:   tally.NoopScope,
+	}
+	if cl.logger, err = srv.SetupLogger("container-lifecycle", &logLevel, flags); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	policies, err := cnf.GetPolicies()
+	if err != nil {
+		return ipPort, nil, nil, err
+	}
+	if cl.pdc, err = client.NewProxyClient(policies, cnf, cl.logger, certFile, keyFile, "", "", "", serverconf); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Could not make client: %v", err)
+	}
+	cl.hClient = cl.pdc.NewRequestClient(nil, nil, cl.logger)
+	cl.hClient.SetUserAgent("container-lifecycle")
+	ipPort = &srv.IpPort{Ip: cl.bindIp, Port: cl.port, CertFile: certFile, KeyFile: keyFile}
+	return ipPort, cl, cl.logger, nil
+}
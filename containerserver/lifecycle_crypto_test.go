@@ -0,0 +1,81 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/containerserver"
+	"github.com/RocFang/hummingbird/proxyserver/middleware"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// storedObject keeps the headers, trailers included, and body of the last
+// object PUT to it, as an object server would.
+type storedObject struct {
+	header http.Header
+	body   []byte
+}
+
+func (s *storedObject) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.body, _ = ioutil.ReadAll(request.Body)
+	s.header = http.Header{}
+	for k, v := range request.Header {
+		s.header[k] = v
+	}
+	if t, ok := request.Body.(interface{ Trailer() http.Header }); ok {
+		for k := range t.Trailer() {
+			s.header.Set(k, t.Trailer().Get(k))
+		}
+	}
+	writer.WriteHeader(http.StatusCreated)
+}
+
+func TestLifecycleEncryptedObjectNotArchived(t *testing.T) {
+	config, err := conf.StringConfig("[filter:keymaster]\nencryption_root_secret = MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n")
+	require.Nil(t, err)
+	keymaster, err := middleware.NewKeymaster(config.GetSection("filter:keymaster"), tally.NoopScope)
+	require.Nil(t, err)
+	encryption, err := middleware.NewEncryption(config.GetSection("filter:encryption"), tally.NoopScope)
+	require.Nil(t, err)
+	stored := &storedObject{}
+	handler := keymaster(encryption(stored))
+	r := httptest.NewRequest("PUT", "/v1/a/c/o", bytes.NewReader([]byte("some plaintext data")))
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &middleware.ProxyContext{Logger: zap.NewNop()}))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.NotEqual(t, []byte("some plaintext data"), stored.body)
+
+	// The archived copy couldn't be decrypted under its new name, so the
+	// object is neither archived nor deleted.
+	puts, deletes := containerserver.ExpireVersionedObject(stored.header, stored.body)
+	require.Empty(t, puts)
+	require.Empty(t, deletes)
+
+	puts, deletes = containerserver.ExpireVersionedObject(http.Header{"Content-Type": {"text/plain"}}, []byte("some plaintext data"))
+	require.Equal(t, 2, len(puts))
+	require.Equal(t, 1, len(deletes))
+}
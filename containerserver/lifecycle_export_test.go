@@ -0,0 +1,50 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/lifecycle"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// ExpireVersionedObject runs an expiration rule over a versioned container
+// holding a single day-old object stored with the given headers and body,
+// returning the objects written and deleted. The tests that build objects
+// with the proxy middleware live outside the package, since the middleware
+// imports it.
+func ExpireVersionedObject(header http.Header, body []byte) (puts []string, deletes []string) {
+	now := time.Unix(1500000000, 0)
+	old := now.Add(-48 * time.Hour)
+	obj := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(body))}
+	for k, v := range header {
+		obj.Header[k] = v
+	}
+	obj.Header.Set("X-Timestamp", common.CanonicalTimestampFromTime(old))
+	c := &lifecycleTestClient{
+		listings: map[string][]*ObjectListingRecord{"a/c": {lifecycleRecord("o", old)}},
+		objects:  map[string]*http.Response{"a/c/o": obj},
+	}
+	l := &ContainerLifecycle{logger: zap.NewNop(), hClient: c, metricsScope: tally.NoopScope}
+	l.applyRules("a", "c", "vc", []lifecycle.Rule{{ExpirationDays: 1}}, now)
+	return c.puts, c.deletes
+}
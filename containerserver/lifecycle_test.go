@@ -0,0 +1,178 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/lifecycle"
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/nectar/nectarutil"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// lifecycleTestClient keeps listings of objects by "account/container" and
+// records the objects written and deleted.
+type lifecycleTestClient struct {
+	client.RequestClient
+	listings map[string][]*ObjectListingRecord
+	objects  map[string]*http.Response
+	puts     []string
+	deletes  []string
+}
+
+func (c *lifecycleTestClient) GetContainerRaw(ctx context.Context, account string, container string, options map[string]string, headers http.Header) *http.Response {
+	records, ok := c.listings[account+"/"+container]
+	if !ok {
+		return nectarutil.ResponseStub(http.StatusNotFound, "")
+	}
+	listing := []*ObjectListingRecord{}
+	for _, record := range records {
+		if record.Name > options["marker"] && strings.HasPrefix(record.Name, options["prefix"]) {
+			listing = append(listing, record)
+		}
+	}
+	sort.Slice(listing, func(i, j int) bool { return listing[i].Name < listing[j].Name })
+	body, _ := json.Marshal(listing)
+	return nectarutil.ResponseStub(http.StatusOK, string(body))
+}
+
+func (c *lifecycleTestClient) GetObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response {
+	if resp, ok := c.objects[account+"/"+container+"/"+obj]; ok {
+		return resp
+	}
+	return nectarutil.ResponseStub(http.StatusNotFound, "")
+}
+
+func (c *lifecycleTestClient) PutObject(ctx context.Context, account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	c.puts = append(c.puts, account+"/"+container+"/"+obj+" "+headers.Get("Content-Type"))
+	return nectarutil.ResponseStub(http.StatusCreated, "")
+}
+
+func (c *lifecycleTestClient) DeleteObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response {
+	c.deletes = append(c.deletes, account+"/"+container+"/"+obj+" "+headers.Get("X-Timestamp"))
+	return nectarutil.ResponseStub(http.StatusNoContent, "")
+}
+
+func lifecycleRecord(name string, modified time.Time) *ObjectListingRecord {
+	return &ObjectListingRecord{Name: name, LastModified: modified.In(common.GMT).Format("2006-01-02T15:04:05.000000")}
+}
+
+func TestVersionedObject(t *testing.T) {
+	name := versionedObjectName("a/b", "1500000000.00000")
+	require.Equal(t, "003a/b/1500000000.00000", name)
+	obj, ok := versionedObject(name)
+	require.True(t, ok)
+	require.Equal(t, "a/b", obj)
+	for _, name := range []string{"", "zz", "xyzabc/1", "010short/1", "003abc1"} {
+		_, ok := versionedObject(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestLifecycleApplyRules(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	old := now.Add(-48 * time.Hour)
+	recent := now.Add(-time.Hour)
+	c := &lifecycleTestClient{listings: map[string][]*ObjectListingRecord{
+		"a/c": {
+			lifecycleRecord("logs/old", old),
+			lifecycleRecord("logs/new", recent),
+			lifecycleRecord("other", old),
+		},
+		"a/c+segments": {
+			lifecycleRecord("abc-logs/upload", old),
+			lifecycleRecord("abc-logs/upload/00000001", old),
+			lifecycleRecord("def-logs/fresh", recent),
+			lifecycleRecord("ghi-logs/done", old),
+			lifecycleRecord("ghi-logs/done/00000001", old),
+			lifecycleRecord("123-other", old),
+		},
+	}}
+	// ghi-logs/done was completed, so its parts are in use.
+	manifest := nectarutil.ResponseStub(http.StatusOK, `[{"name":"/c%2Bsegments/ghi-logs/done/00000001","bytes":5}]`)
+	manifest.Header.Set("X-Static-Large-Object", "True")
+	c.objects = map[string]*http.Response{"a/c/logs/done": manifest}
+	l := &ContainerLifecycle{logger: zap.NewNop(), hClient: c, metricsScope: tally.NoopScope}
+	rules := []lifecycle.Rule{{Prefix: "logs/", ExpirationDays: 1, AbortUploadDays: 1}}
+	l.applyRules("a", "c", "", rules, now)
+	ts := common.CanonicalTimestampFromTime(old)
+	deleted, err := offsetTimestamp(ts, 1)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"a/c/logs/old " + deleted,
+		"a/c+segments/abc-logs/upload/00000001 " + deleted,
+		"a/c+segments/abc-logs/upload " + deleted,
+	}, c.deletes)
+	require.Equal(t, int64(1), l.expired)
+	require.Equal(t, int64(1), l.aborted)
+	require.Equal(t, int64(0), l.failures)
+
+	rules[0].Disabled = true
+	c.deletes = nil
+	l.applyRules("a", "c", "", rules, now)
+	require.Empty(t, c.deletes)
+}
+
+func TestLifecycleApplyRulesVersioned(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	old := now.Add(-48 * time.Hour)
+	ts := common.CanonicalTimestampFromTime(old)
+	obj := nectarutil.ResponseStub(http.StatusOK, "hello")
+	obj.Header.Set("X-Timestamp", ts)
+	obj.Header.Set("Content-Type", "text/plain")
+	obj.Header.Set("X-Object-Meta-Color", "blue")
+	c := &lifecycleTestClient{
+		listings: map[string][]*ObjectListingRecord{
+			"a/c":  {lifecycleRecord("o", old)},
+			"a/vc": {lifecycleRecord(versionedObjectName("o", ts), old), lifecycleRecord(versionedObjectName("p", ts), old)},
+		},
+		objects: map[string]*http.Response{"a/c/o": obj},
+	}
+	l := &ContainerLifecycle{logger: zap.NewNop(), hClient: c, metricsScope: tally.NoopScope}
+	l.applyRules("a", "c", "vc", []lifecycle.Rule{{Prefix: "o", ExpirationDays: 1, NoncurrentDays: 1}}, now)
+	require.Equal(t, 2, len(c.puts))
+	require.Equal(t, "a/vc/"+versionedObjectName("o", ts)+" text/plain", c.puts[0])
+	require.True(t, strings.HasPrefix(c.puts[1], "a/vc/001o/"))
+	require.True(t, strings.HasSuffix(c.puts[1], " "+versionsDeleteMarker))
+	deleted, err := offsetTimestamp(ts, 1)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"a/c/o " + deleted,
+		"a/vc/" + versionedObjectName("o", ts) + " " + deleted,
+	}, c.deletes)
+	require.Equal(t, int64(1), l.expired)
+	require.Equal(t, int64(1), l.noncurrent)
+
+	// Objects written again since the listing are left alone.
+	newer := nectarutil.ResponseStub(http.StatusOK, "")
+	newer.Header.Set("X-Timestamp", common.CanonicalTimestampFromTime(now))
+	c.objects["a/c/o"] = newer
+	c.puts, c.deletes = nil, nil
+	l.applyRules("a", "c", "vc", []lifecycle.Rule{{ExpirationDays: 1}}, now)
+	require.Empty(t, c.puts)
+	require.Empty(t, c.deletes)
+}
@@ -0,0 +1,559 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/RocFang/hummingbird/middleware"
+	"github.com/justinas/alice"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uber-go/tally"
+	promreporter "github.com/uber-go/tally/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// The account holding the queue of objects found in a storage policy other than their container's.
+const misplacedObjectsAccount = ".misplaced_objects"
+
+// Queue containers each hold an hour of misplaced object timestamps.
+const misplacedContainerDivisor = 3600
+
+const (
+	misplacedPut    = "application/x-put"
+	misplacedDelete = "application/x-delete"
+)
+
+// misplacedQueueContainer returns the queue container for an object row's timestamp.
+func misplacedQueueContainer(timestamp string) string {
+	ts, err := strconv.ParseFloat(strings.SplitN(timestamp, "_", 2)[0], 64)
+	if err != nil {
+		ts = 0
+	}
+	return strconv.FormatInt(int64(ts)/misplacedContainerDivisor*misplacedContainerDivisor, 10)
+}
+
+// misplacedQueueObject names a queue entry as <policy>:/<account>/<container>/<obj>.
+func misplacedQueueObject(policyIndex int, account, container, obj string) string {
+	return fmt.Sprintf("%d:/%s/%s/%s", policyIndex, account, container, obj)
+}
+
+// offsetTimestamp returns the timestamp with its offset increased, which sorts after the timestamp itself while
+// staying older than any later request.
+func offsetTimestamp(timestamp string, offset int64) (string, error) {
+	ts, err := common.StandardizeTimestamp(timestamp)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(ts, "_", 2)
+	if len(parts) == 2 {
+		existing, err := strconv.ParseInt(parts[1], 16, 64)
+		if err != nil {
+			return "", err
+		}
+		offset += existing
+	}
+	return fmt.Sprintf("%s_%016x", parts[0], offset), nil
+}
+
+// reconcilerTask is a single entry from the .misplaced_objects queue.
+type reconcilerTask struct {
+	queueContainer string
+	queueObject    string
+	policyIndex    int
+	timestamp      string
+	delete         bool
+	account        string
+	container      string
+	obj            string
+}
+
+type reconcilerListingRecord struct {
+	Name        string `json:"name"`
+	Hash        string `json:"hash"`
+	ContentType string `json:"content_type"`
+}
+
+// parseReconcilerTask reads a queue entry.  The object's timestamp is kept in the entry's etag, since listings
+// only give last modified times.
+func parseReconcilerTask(queueContainer string, record *reconcilerListingRecord) (*reconcilerTask, error) {
+	colon := strings.Index(record.Name, ":")
+	if colon < 0 {
+		return nil, fmt.Errorf("invalid misplaced object entry %q", record.Name)
+	}
+	policyIndex, err := strconv.Atoi(record.Name[:colon])
+	if err != nil {
+		return nil, fmt.Errorf("invalid misplaced object entry %q: %v", record.Name, err)
+	}
+	parts := strings.SplitN(record.Name[colon+1:], "/", 4)
+	if len(parts) != 4 || parts[0] != "" || parts[1] == "" || parts[2] == "" || parts[3] == "" {
+		return nil, fmt.Errorf("invalid misplaced object entry %q", record.Name)
+	}
+	timestamp, err := common.StandardizeTimestamp(record.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid misplaced object entry timestamp %q: %v", record.Hash, err)
+	}
+	return &reconcilerTask{
+		queueContainer: queueContainer,
+		queueObject:    record.Name,
+		policyIndex:    policyIndex,
+		timestamp:      timestamp,
+		delete:         record.ContentType == misplacedDelete,
+		account:        parts[1],
+		container:      parts[2],
+		obj:            parts[3],
+	}, nil
+}
+
+// ContainerReconciler moves objects that landed in the wrong storage policy into their container's policy.  That
+// happens when replicas of a container are created with different policies while they can't reach each other; the
+// replicator settles on one policy and queues any rows from the others in the .misplaced_objects account.  The
+// reconciler copies each queued object into the right policy under its original timestamp, then tombstones the
+// old copy.  The queue can be split across several reconcilers with the processes and process settings.
+type ContainerReconciler struct {
+	logger         srv.LowLevelLogger
+	logLevel       zap.AtomicLevel
+	bindIp         string
+	port           int
+	certFile       string
+	keyFile        string
+	reconCachePath string
+	interval       time.Duration
+	processes      uint64
+	process        uint64
+	client         common.HTTPClient
+	pdc            client.ProxyClient
+	metricsScope   tally.Scope
+	metricsCloser  io.Closer
+	moved          int64
+	deletes        int64
+	skips          int64
+	failures       int64
+}
+
+func (r *ContainerReconciler) Type() string {
+	return "container-reconciler"
+}
+
+func (r *ContainerReconciler) Background(flags *flag.FlagSet) chan struct{} {
+	once := false
+	if f := flags.Lookup("once"); f != nil {
+		once = f.Value.(flag.Getter).Get() == true
+	}
+	if once {
+		ch := make(chan struct{})
+		go func() {
+			defer close(ch)
+			r.Run()
+		}()
+		return ch
+	}
+	go r.RunForever()
+	return nil
+}
+
+func (r *ContainerReconciler) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
+	r.metricsScope, r.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
+		Prefix:         metricsPrefix,
+		Tags:           map[string]string{},
+		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
+		Separator:      promreporter.DefaultSeparator,
+	}, time.Second)
+	commonHandlers := alice.New(
+		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
+		r.LogRequest,
+		middleware.RecoverHandler,
+		middleware.ValidateRequest,
+	)
+	router := srv.NewRouter()
+	router.Get("/metrics", prometheus.Handler())
+	router.Get("/loglevel", r.logLevel)
+	router.Put("/loglevel", r.logLevel)
+	router.Get("/healthcheck", commonHandlers.ThenFunc(r.HealthcheckHandler))
+	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
+	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
+	return alice.New(middleware.Metrics(r.metricsScope)).Then(router)
+}
+
+func (r *ContainerReconciler) Finalize() {
+	if r.metricsCloser != nil {
+		r.metricsCloser.Close()
+	}
+	if r.pdc != nil {
+		r.pdc.Close()
+	}
+}
+
+func (r *ContainerReconciler) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Length", "2")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("OK"))
+}
+
+func (r *ContainerReconciler) LogRequest(next http.Handler) http.Handler {
+	return srv.LogRequest(r.logger, next)
+}
+
+// ownsTask reports whether this reconciler process is responsible for the entry.
+func (r *ContainerReconciler) ownsTask(task *reconcilerTask) bool {
+	if r.processes <= 1 {
+		return true
+	}
+	h := md5.Sum([]byte(task.account + "/" + task.container + "/" + task.obj))
+	return binary.BigEndian.Uint64(h[:8])%r.processes == r.process
+}
+
+// policyClient returns a request client that sends object requests for the container to the given policy,
+// whatever the container's own policy is.
+func (r *ContainerReconciler) policyClient(account, container string, policyIndex int) client.RequestClient {
+	lc := map[string]*client.ContainerInfo{
+		fmt.Sprintf("container/%s/%s", account, container): {StoragePolicyIndex: policyIndex},
+	}
+	return r.pdc.NewRequestClient(nil, lc, r.logger)
+}
+
+// listing pages through a JSON account or container listing of the .misplaced_objects account, passing each
+// record to f until f returns false.
+func (r *ContainerReconciler) listing(container string, f func(record *reconcilerListingRecord) bool) error {
+	hClient := r.pdc.NewRequestClient(nil, nil, r.logger)
+	marker := ""
+	for {
+		options := map[string]string{"format": "json", "marker": marker}
+		var resp *http.Response
+		if container == "" {
+			resp = hClient.GetAccountRaw(context.Background(), misplacedObjectsAccount, options, http.Header{})
+		} else {
+			resp = hClient.GetContainerRaw(context.Background(), misplacedObjectsAccount, container, options, http.Header{})
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return nil
+		}
+		if resp.StatusCode/100 != 2 {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("listing %s/%s returned %d", misplacedObjectsAccount, container, resp.StatusCode)
+		}
+		var records []*reconcilerListingRecord
+		err := json.NewDecoder(resp.Body).Decode(&records)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("listing %s/%s: %v", misplacedObjectsAccount, container, err)
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		for _, record := range records {
+			if !f(record) {
+				return nil
+			}
+		}
+		marker = records[len(records)-1].Name
+	}
+}
+
+// deleteQueueEntry removes the task's entry from the .misplaced_objects container listing on each of the
+// container's nodes.
+func (r *ContainerReconciler) deleteQueueEntry(task *reconcilerTask) bool {
+	containerRing := r.pdc.NewRequestClient(nil, nil, r.logger).ContainerRing()
+	partition := containerRing.GetPartition(misplacedObjectsAccount, task.queueContainer, "")
+	successes := uint64(0)
+	for _, node := range containerRing.GetNodes(partition) {
+		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", node.Scheme, node.Ip, node.Port, node.Device, partition,
+			common.Urlencode(misplacedObjectsAccount), common.Urlencode(task.queueContainer), common.Urlencode(task.queueObject))
+		req, err := http.NewRequest("DELETE", url, nil)
+		if err != nil {
+			r.logger.Error("creating reconciler queue delete request", zap.Error(err))
+			continue
+		}
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("User-Agent", "container-reconciler")
+		resp, err := r.client.Do(req)
+		if err != nil {
+			r.logger.Error("deleting reconciler queue entry", zap.String("url", url), zap.Error(err))
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusNotFound {
+			successes++
+		}
+	}
+	return successes >= (containerRing.ReplicaCount()/2)+1
+}
+
+// headTimestamp returns the X-Timestamp of the object in the client's policy, or "" if it isn't there.
+func headTimestamp(hClient client.RequestClient, task *reconcilerTask) (string, error) {
+	resp := hClient.HeadObject(context.Background(), task.account, task.container, task.obj, http.Header{})
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	} else if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("HEAD returned %d", resp.StatusCode)
+	}
+	return common.StandardizeTimestamp(resp.Header.Get("X-Timestamp"))
+}
+
+// reconcile carries out a queued misplaced object, returning false if it should be retried.  Puts are copied into
+// the container's policy with an offset of two past their timestamp, and the old copy is tombstoned with an offset
+// of one, so the tombstone's own queue entry never undoes the copy.
+func (r *ContainerReconciler) reconcile(task *reconcilerTask) bool {
+	logger := r.logger.With(zap.String("account", task.account), zap.String("container", task.container),
+		zap.String("object", task.obj), zap.Int("policy", task.policyIndex))
+	ci, err := r.pdc.NewRequestClient(nil, nil, r.logger).GetContainerInfo(context.Background(), task.account, task.container)
+	if err != nil {
+		// Without a container there's no telling where the object belongs.
+		logger.Debug("Unable to get container policy", zap.Error(err))
+		return false
+	}
+	if ci.StoragePolicyIndex == task.policyIndex {
+		// The container settled on the policy the object is already in.
+		atomic.AddInt64(&r.skips, 1)
+		r.metricsScope.Counter("skips").Inc(1)
+		return true
+	}
+	src := r.policyClient(task.account, task.container, task.policyIndex)
+	dst := r.policyClient(task.account, task.container, ci.StoragePolicyIndex)
+	dstTimestamp, err := headTimestamp(dst, task)
+	if err != nil {
+		logger.Error("Error checking object in container policy", zap.Error(err))
+		return false
+	}
+	if task.delete {
+		if dstTimestamp != "" && dstTimestamp < task.timestamp {
+			resp := dst.DeleteObject(context.Background(), task.account, task.container, task.obj, http.Header{"X-Timestamp": {task.timestamp}})
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusConflict {
+				logger.Error("Error deleting object in container policy", zap.Int("status", resp.StatusCode))
+				return false
+			}
+		}
+		atomic.AddInt64(&r.deletes, 1)
+		r.metricsScope.Counter("deletes").Inc(1)
+		return true
+	}
+	resp := src.GetObject(context.Background(), task.account, task.container, task.obj, http.Header{})
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// It's already been moved or deleted.
+		atomic.AddInt64(&r.skips, 1)
+		r.metricsScope.Counter("skips").Inc(1)
+		return true
+	}
+	if resp.StatusCode/100 != 2 {
+		logger.Error("Error getting misplaced object", zap.Int("status", resp.StatusCode))
+		return false
+	}
+	srcTimestamp, err := common.StandardizeTimestamp(resp.Header.Get("X-Timestamp"))
+	if err != nil || srcTimestamp < task.timestamp {
+		// The object hasn't made it to the object servers yet.
+		logger.Debug("Misplaced object older than its queue entry", zap.String("timestamp", srcTimestamp), zap.String("queued", task.timestamp))
+		return false
+	}
+	if dstTimestamp < srcTimestamp {
+		putTimestamp, err := offsetTimestamp(srcTimestamp, 2)
+		if err != nil {
+			logger.Error("Invalid misplaced object timestamp", zap.String("timestamp", srcTimestamp), zap.Error(err))
+			return false
+		}
+		headers := http.Header{"Etag": {resp.Header.Get("Etag")}, "X-Timestamp": {putTimestamp}}
+		for k := range resp.Header {
+			if strings.HasPrefix(k, "X-Object-Meta-") || strings.HasPrefix(k, "X-Object-Sysmeta-") || common.StringInSlice(k, syncObjectHeaders) {
+				headers.Set(k, resp.Header.Get(k))
+			}
+		}
+		var body io.Reader = resp.Body
+		if resp.ContentLength == 0 {
+			body = nil
+		}
+		putResp := dst.PutObject(context.Background(), task.account, task.container, task.obj, headers, body)
+		io.Copy(ioutil.Discard, putResp.Body)
+		putResp.Body.Close()
+		// A 409 means the container's policy already has something newer.
+		if putResp.StatusCode/100 != 2 && putResp.StatusCode != http.StatusConflict {
+			logger.Error("Error copying misplaced object", zap.Int("status", putResp.StatusCode))
+			return false
+		}
+	}
+	deleteTimestamp, err := offsetTimestamp(srcTimestamp, 1)
+	if err != nil {
+		logger.Error("Invalid misplaced object timestamp", zap.String("timestamp", srcTimestamp), zap.Error(err))
+		return false
+	}
+	delResp := src.DeleteObject(context.Background(), task.account, task.container, task.obj, http.Header{"X-Timestamp": {deleteTimestamp}})
+	io.Copy(ioutil.Discard, delResp.Body)
+	delResp.Body.Close()
+	if delResp.StatusCode/100 != 2 && delResp.StatusCode != http.StatusNotFound && delResp.StatusCode != http.StatusConflict {
+		logger.Error("Error removing misplaced object", zap.Int("status", delResp.StatusCode))
+		return false
+	}
+	atomic.AddInt64(&r.moved, 1)
+	r.metricsScope.Counter("moved").Inc(1)
+	return true
+}
+
+// Run a single pass over the .misplaced_objects queue.
+func (r *ContainerReconciler) Run() {
+	start := time.Now()
+	atomic.StoreInt64(&r.moved, 0)
+	atomic.StoreInt64(&r.deletes, 0)
+	atomic.StoreInt64(&r.skips, 0)
+	atomic.StoreInt64(&r.failures, 0)
+	r.metricsScope.Counter("passes").Inc(1)
+
+	var containers []string
+	if err := r.listing("", func(record *reconcilerListingRecord) bool {
+		containers = append(containers, record.Name)
+		return true
+	}); err != nil {
+		r.logger.Error("Error listing reconciler containers", zap.Error(err))
+		return
+	}
+	for _, container := range containers {
+		if err := r.listing(container, func(record *reconcilerListingRecord) bool {
+			task, err := parseReconcilerTask(container, record)
+			if err != nil {
+				r.logger.Error("Skipping reconciler entry", zap.String("container", container), zap.Error(err))
+				return true
+			}
+			if !r.ownsTask(task) {
+				return true
+			}
+			if !r.reconcile(task) {
+				atomic.AddInt64(&r.failures, 1)
+				r.metricsScope.Counter("failures").Inc(1)
+			} else if !r.deleteQueueEntry(task) {
+				r.logger.Error("Error removing reconciler queue entry", zap.String("entry", task.queueObject))
+				atomic.AddInt64(&r.failures, 1)
+				r.metricsScope.Counter("failures").Inc(1)
+			}
+			return true
+		}); err != nil {
+			r.logger.Error("Error listing reconciler container", zap.String("container", container), zap.Error(err))
+		}
+	}
+
+	// Containers still holding entries, including ones owned by other processes, refuse the delete with a 409.
+	hClient := r.pdc.NewRequestClient(nil, nil, r.logger)
+	for _, container := range containers {
+		resp := hClient.DeleteContainer(context.Background(), misplacedObjectsAccount, container, http.Header{"X-Timestamp": {common.GetTimestamp()}})
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	r.logger.Info("Container reconciler pass complete",
+		zap.Int64("moved", atomic.LoadInt64(&r.moved)),
+		zap.Int64("deletes", atomic.LoadInt64(&r.deletes)),
+		zap.Int64("skips", atomic.LoadInt64(&r.skips)),
+		zap.Int64("failures", atomic.LoadInt64(&r.failures)),
+		zap.Duration("elapsed", time.Since(start)))
+	if err := middleware.DumpReconCache(r.reconCachePath, "container",
+		map[string]interface{}{
+			"container_reconciler_pass": float64(time.Since(start)) / float64(time.Second),
+			"reconciled_last_pass":      atomic.LoadInt64(&r.moved) + atomic.LoadInt64(&r.deletes),
+			"reconciler_failures":       atomic.LoadInt64(&r.failures),
+		}); err != nil {
+		r.logger.Error("Error saving container reconciler recon data", zap.Error(err))
+	}
+}
+
+// Run reconciler passes in a loop until forever.
+func (r *ContainerReconciler) RunForever() {
+	for {
+		start := time.Now()
+		r.Run()
+		if elapsed := time.Since(start); elapsed < r.interval {
+			time.Sleep(r.interval - elapsed)
+		}
+	}
+}
+
+func NewContainerReconciler(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader) (ipPort *srv.IpPort, server srv.Server, logger srv.LowLevelLogger, err error) {
+	if !serverconf.HasSection("container-reconciler") {
+		return ipPort, nil, nil, fmt.Errorf("Unable to find container-reconciler config section")
+	}
+	logLevelString := serverconf.GetDefault("container-reconciler", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	certFile := serverconf.GetDefault("container-reconciler", "cert_file", "")
+	keyFile := serverconf.GetDefault("container-reconciler", "key_file", "")
+	cr := &ContainerReconciler{
+		logLevel:       logLevel,
+		bindIp:         serverconf.GetDefault("container-reconciler", "bind_ip", "0.0.0.0"),
+		port:           int(serverconf.GetInt("container-reconciler", "bind_port", common.DefaultContainerReconcilerPort)),
+		certFile:       certFile,
+		keyFile:        keyFile,
+		reconCachePath: serverconf.GetDefault("container-reconciler", "recon_cache_path", "/var/cache/swift"),
+		interval:       time.Duration(serverconf.GetInt("container-reconciler", "interval", 300)) * time.Second,
+		processes:      uint64(serverconf.GetInt("container-reconciler", "processes", 0)),
+		process:        uint64(serverconf.GetInt("container-reconciler", "process", 0)),
+		metricsScope:   tally.NoopScope,
+	}
+	if cr.processes > 0 && cr.process >= cr.processes {
+		return ipPort, nil, nil, fmt.Errorf("container-reconciler process %d must be less than processes %d", cr.process, cr.processes)
+	}
+	if cr.logger, err = srv.SetupLogger("container-reconciler", &logLevel, flags); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: 100,
+		MaxIdleConns:        0,
+	}
+	if certFile != "" && keyFile != "" {
+		tlsConf, err := common.NewClientTLSConfig(certFile, keyFile)
+		if err != nil {
+			return ipPort, nil, nil, fmt.Errorf("Error getting TLS config: %v", err)
+		}
+		transport.TLSClientConfig = tlsConf
+		if err = http2.ConfigureTransport(transport); err != nil {
+			return ipPort, nil, nil, fmt.Errorf("Error setting up http2: %v", err)
+		}
+	}
+	cr.client = &http.Client{
+		Timeout:   time.Second * 60,
+		Transport: transport,
+	}
+	policies, err := cnf.GetPolicies()
+	if err != nil {
+		return ipPort, nil, nil, err
+	}
+	if cr.pdc, err = client.NewProxyClient(policies, cnf, cr.logger, certFile, keyFile, "", "", "", serverconf); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Could not make client: %v", err)
+	}
+	cr.pdc.NewRequestClient(nil, nil, cr.logger).SetUserAgent("container-reconciler")
+	ipPort = &srv.IpPort{Ip: cr.bindIp, Port: cr.port, CertFile: certFile, KeyFile: keyFile}
+	return ipPort, cr, cr.logger, nil
+}
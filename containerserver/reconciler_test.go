@@ -0,0 +1,60 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMisplacedQueueNames(t *testing.T) {
+	require.Equal(t, "1399996800", misplacedQueueContainer("1400000000.12345"))
+	require.Equal(t, "1399996800", misplacedQueueContainer("1399996800.00000_0000000000000001"))
+	require.Equal(t, "1:/a/c/o/with/slashes", misplacedQueueObject(1, "a", "c", "o/with/slashes"))
+}
+
+func TestParseReconcilerTask(t *testing.T) {
+	task, err := parseReconcilerTask("1399996800", &reconcilerListingRecord{
+		Name: "2:/a/c/o/p", Hash: "1400000000.12345", ContentType: misplacedDelete,
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, task.policyIndex)
+	require.Equal(t, "a", task.account)
+	require.Equal(t, "c", task.container)
+	require.Equal(t, "o/p", task.obj)
+	require.Equal(t, "1400000000.12345", task.timestamp)
+	require.True(t, task.delete)
+	for _, name := range []string{"a/c/o", "x:/a/c/o", "1:/a/c", "1:a/c/o", "1:/a//o"} {
+		_, err = parseReconcilerTask("1399996800", &reconcilerListingRecord{Name: name, Hash: "1400000000.12345"})
+		require.NotNil(t, err, name)
+	}
+	_, err = parseReconcilerTask("1399996800", &reconcilerListingRecord{Name: "1:/a/c/o", Hash: "d41d8cd98f00b204e9800998ecf8427e"})
+	require.NotNil(t, err)
+}
+
+func TestOffsetTimestamp(t *testing.T) {
+	ts, err := offsetTimestamp("1400000000.12345", 2)
+	require.Nil(t, err)
+	require.Equal(t, "1400000000.12345_0000000000000002", ts)
+	require.True(t, ts > "1400000000.12345")
+	require.True(t, ts < "1400000000.12346")
+	ts, err = offsetTimestamp(ts, 1)
+	require.Nil(t, err)
+	require.Equal(t, "1400000000.12345_0000000000000003", ts)
+	_, err = offsetTimestamp("nope", 1)
+	require.NotNil(t, err)
+}
@@ -274,6 +274,28 @@ func (rd *replicationDevice) replicateDatabaseToDevice(dev *ring.Device, c Repli
 	if err != nil {
 		return err
 	}
+	if remoteInfo != nil && remoteInfo.StoragePolicyIndex != info.StoragePolicyIndex {
+		// The replicas were created with different policies; the remote adopts ours when it replicates back to us if ours wins.
+		deleted := remoteInfo.DeleteTimestamp > remoteInfo.PutTimestamp
+		if changed, err := c.ReconcilePolicy(remoteInfo.StoragePolicyIndex, remoteInfo.StatusChangedAt, deleted); err != nil {
+			return fmt.Errorf("reconciling storage policy of %s: %v", c.RingHash(), err)
+		} else if changed {
+			rd.r.logger.Info("Adopted remote storage policy.",
+				zap.String("RingHash", c.RingHash()),
+				zap.Int("from", info.StoragePolicyIndex),
+				zap.Int("to", remoteInfo.StoragePolicyIndex))
+		}
+	}
+	// Shard ranges aren't part of the object table, so they're pushed separately from the rows.
+	if ranges, err := c.GetShardRanges(); err != nil {
+		return fmt.Errorf("getting shard ranges from %s: %v", c.RingHash(), err)
+	} else if len(ranges) > 0 {
+		if status, _, err := rd.i.sendReplicationMessage(dev, part, c.RingHash(), "merge_shard_ranges", ranges); err != nil {
+			return err
+		} else if status/100 != 2 {
+			return fmt.Errorf("Invalid status code from merge_shard_ranges: %d", status)
+		}
+	}
 	strategy := rd.i.chooseReplicationStrategy(info, remoteInfo, rd.r.perUsync*3)
 	rd.i.incrementStat(strategy)
 	switch strategy {
@@ -366,6 +388,86 @@ func (rd *replicationDevice) replicateDatabase(dbFile string) error {
 		rd.i.incrementStat("remove")
 		return os.RemoveAll(filepath.Dir(dbFile))
 	}
+	if !handoff {
+		if err := rd.queueMisplaced(c); err != nil {
+			rd.r.logger.Error("Error queueing misplaced objects.", zap.String("dbFile", dbFile), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// queueMisplaced adds any rows in a storage policy other than the container's, since the last time it checked,
+// to the .misplaced_objects queue for the container reconciler.
+func (rd *replicationDevice) queueMisplaced(c ReplicableContainer) error {
+	info, err := c.GetInfo()
+	if err != nil {
+		return err
+	}
+	if info.Account == misplacedObjectsAccount {
+		return nil
+	}
+	point := info.ReconcilerSyncPoint
+	for {
+		rows, err := c.ItemsSince(point, int(rd.r.perUsync))
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		for _, row := range rows {
+			if row.StoragePolicyIndex != info.StoragePolicyIndex {
+				if err := rd.queueMisplacedRow(info, row); err != nil {
+					return err
+				}
+				rd.i.incrementStat("misplaced")
+			}
+			point = row.Rowid
+		}
+		if err := c.SetReconcilerSyncPoint(point); err != nil {
+			return err
+		}
+	}
+}
+
+// queueMisplacedRow puts a misplaced row's queue entry on the queue container's nodes, returning an error unless a quorum took it.
+func (rd *replicationDevice) queueMisplacedRow(info *ContainerInfo, row *ObjectRecord) error {
+	container := misplacedQueueContainer(row.CreatedAt)
+	obj := misplacedQueueObject(row.StoragePolicyIndex, info.Account, info.Container, row.Name)
+	contentType := misplacedPut
+	if row.Deleted == 1 {
+		contentType = misplacedDelete
+	}
+	partition := rd.r.Ring.GetPartition(misplacedObjectsAccount, container, "")
+	nodes := rd.r.Ring.GetNodes(partition)
+	successes := 0
+	for _, node := range nodes {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", node.Scheme, node.Ip, node.Port, node.Device, partition,
+			common.Urlencode(misplacedObjectsAccount), common.Urlencode(container), common.Urlencode(obj)), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Timestamp", row.CreatedAt)
+		req.Header.Set("X-Size", "0")
+		req.Header.Set("X-Content-Type", contentType)
+		// Listings don't give exact timestamps, so the object's goes in the etag.
+		req.Header.Set("X-Etag", row.CreatedAt)
+		req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+		req.Header.Set("User-Agent", "container-replicator")
+		req.Cancel = rd.cancel
+		resp, err := rd.r.client.Do(req)
+		if err != nil {
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			successes++
+		}
+	}
+	if successes < len(nodes)/2+1 {
+		return fmt.Errorf("unable to queue misplaced object %s", obj)
+	}
 	return nil
 }
 
@@ -480,6 +582,7 @@ func newReplicationDevice(dev *ring.Device, r *Replicator) *replicationDevice {
 			"empty":        0,
 			"remote_merge": 0,
 			"diff_capped":  0,
+			"misplaced":    0,
 		},
 		lifetimeStats: map[string]int64{
 			"attempted":    0,
@@ -493,6 +596,7 @@ func newReplicationDevice(dev *ring.Device, r *Replicator) *replicationDevice {
 			"empty":        0,
 			"remote_merge": 0,
 			"diff_capped":  0,
+			"misplaced":    0,
 			"passes":       0,
 		},
 	}
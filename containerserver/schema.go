@@ -174,6 +174,21 @@ const (
 				WHERE ROWID = new.ROWID;
 			END;`
 
+	shardRangeTableScript = `
+		CREATE TABLE shard_range (
+				ROWID INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT UNIQUE,
+				timestamp TEXT,
+				lower TEXT,
+				upper TEXT,
+				object_count INTEGER DEFAULT 0,
+				bytes_used INTEGER DEFAULT 0,
+				meta_timestamp TEXT,
+				deleted INTEGER DEFAULT 0,
+				state INTEGER,
+				state_timestamp TEXT
+			);`
+
 	policyMigrateColumns = `account, container, created_at, put_timestamp, delete_timestamp, reported_put_timestamp,
 		reported_object_count, reported_bytes_used, hash, id, status, status_changed_at, metadata,
 		x_container_sync_point1, x_container_sync_point2`
@@ -215,6 +230,7 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 	hasMetadata := false
 	hasPolicyStat := false
 	hasExpireColumn := false
+	hasShardRange := false
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -223,7 +239,7 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 	defer tx.Rollback()
 
 	// We just pull the schema out of sqlite_master and look at it to get the current state of the database.
-	rows, err := tx.Query("SELECT name, sql FROM sqlite_master WHERE name in ('policy_stat', 'ix_object_deleted_name', 'container_stat')")
+	rows, err := tx.Query("SELECT name, sql FROM sqlite_master WHERE name in ('policy_stat', 'ix_object_deleted_name', 'container_stat', 'ix_object_expires', 'shard_range')")
 	if err != nil {
 		return false, err
 	}
@@ -241,6 +257,8 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 			hasMetadata = strings.Contains(sql, "metadata")
 		} else if name == "ix_object_expires" {
 			hasExpireColumn = true
+		} else if name == "shard_range" {
+			hasShardRange = true
 		}
 	}
 	if err := rows.Err(); err != nil {
@@ -250,7 +268,7 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 		return hasDeletedNameIndex, err
 	}
 
-	if hasSyncPoints && hasMetadata && hasPolicyStat {
+	if hasSyncPoints && hasMetadata && hasPolicyStat && hasExpireColumn && hasShardRange {
 		return hasDeletedNameIndex, nil
 	}
 
@@ -274,5 +292,10 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 			return hasDeletedNameIndex, fmt.Errorf("Performing expires migration: %v", err)
 		}
 	}
+	if !hasShardRange {
+		if _, err = tx.Exec(shardRangeTableScript); err != nil {
+			return hasDeletedNameIndex, fmt.Errorf("Adding shard_range table: %v", err)
+		}
+	}
 	return hasDeletedNameIndex, tx.Commit()
 }
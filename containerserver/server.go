@@ -181,12 +181,24 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 			headers.Set("X-Put-Timestamp", ts)
 		}
 	}
+	// For the sharder and proxy; the proxy drops X-Backend-* headers from client responses.
+	headers.Set("X-Backend-Sharding-State", info.ShardingState)
 	if request.Method == "HEAD" {
 		headers.Set("Content-Type", "text/plain; charset=utf-8")
 		writer.WriteHeader(http.StatusNoContent)
 		writer.Write([]byte(""))
 		return
 	}
+	recordType := request.Header.Get("X-Backend-Record-Type")
+	if recordType == "shard" || (recordType != "object" && info.ShardingState != ShardingStateUnsharded) {
+		server.shardRangeListing(writer, request, db)
+		return
+	}
+	format := common.ListingFormat(request.FormValue("format"), request.Header.Get("Accept"))
+	if format == "" {
+		srv.StandardResponse(writer, http.StatusNotAcceptable)
+		return
+	}
 	limit := int64(10000)
 	limitStr := request.FormValue("limit")
 	if limitStr != "" {
@@ -217,15 +229,26 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 		srv.StandardResponse(writer, http.StatusInternalServerError)
 		return
 	}
-	format := request.Form.Get("format")
-	if format == "" { /* TODO: real accept parsing */
-		accept := request.Header.Get("Accept")
-		if strings.Contains(accept, "application/json") {
-			format = "json"
-		} else if strings.Contains(accept, "application/xml") || strings.Contains(accept, "text/xml") {
-			format = "xml"
-		} else {
-			format = "text"
+	// Symlink targets, user metadata and the storage policy are only listed
+	// when asked for with include=symlink,meta,storage_policy. User metadata
+	// is only sent by object servers with container_listing_meta set.
+	include := map[string]bool{}
+	for _, field := range strings.Split(request.Form.Get("include"), ",") {
+		include[strings.TrimSpace(field)] = true
+	}
+	storagePolicy := ""
+	if policy := server.policyList[policyIndex]; policy != nil && include["storage_policy"] {
+		storagePolicy = policy.Name
+	}
+	for _, obj := range objects {
+		if or, ok := obj.(*ObjectListingRecord); ok {
+			if !include["symlink"] {
+				or.SymlinkPath, or.SymlinkEtag, or.SymlinkBytes = "", "", 0
+			}
+			if !include["meta"] {
+				or.Meta = nil
+			}
+			or.StoragePolicy = storagePolicy
 		}
 	}
 	if format == "text" {
@@ -287,6 +310,10 @@ func (server *ContainerServer) ContainerPutHandler(writer http.ResponseWriter, r
 			return
 		}
 	}
+	if request.Header.Get("X-Backend-Record-Type") == "shard" {
+		server.mergeShardRanges(writer, request, vars)
+		return
+	}
 	policyIndex, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
 	if err != nil {
 		policyIndex = -1
@@ -459,6 +486,9 @@ func (server *ContainerServer) ObjPutHandler(writer http.ResponseWriter, request
 		return
 	}
 	defer server.containerEngine.Return(db)
+	if server.shardRedirect(writer, request, db, vars["obj"]) {
+		return
+	}
 	expires := request.Header.Get("X-Delete-At")
 	if err := db.PutObject(vars["obj"], timestamp, size, contentType, etag, policyIndex, expires); err != nil {
 		srv.GetLogger(request).Error("Error adding object to container.", zap.Error(err))
@@ -498,6 +528,9 @@ func (server *ContainerServer) ObjDeleteHandler(writer http.ResponseWriter, requ
 		return
 	}
 	defer server.containerEngine.Return(db)
+	if server.shardRedirect(writer, request, db, vars["obj"]) {
+		return
+	}
 	if err := db.DeleteObject(vars["obj"], timestamp, policyIndex); err != nil {
 		srv.GetLogger(request).Error("Error adding object to container.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -507,6 +540,79 @@ func (server *ContainerServer) ObjDeleteHandler(writer http.ResponseWriter, requ
 	writer.Write([]byte(""))
 }
 
+// shardRangeListing writes the container's shard ranges that could hold names in the requested listing as json.
+func (server *ContainerServer) shardRangeListing(writer http.ResponseWriter, request *http.Request, db Container) {
+	ranges, err := db.GetShardRanges()
+	if err != nil {
+		srv.GetLogger(request).Error("Unable to get shard ranges.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	marker, endMarker := request.Form.Get("marker"), request.Form.Get("end_marker")
+	if common.LooksTrue(request.Form.Get("reverse")) {
+		marker, endMarker = endMarker, marker
+	}
+	overlapping := []*ShardRange{}
+	for _, sr := range ranges {
+		if sr.Overlaps(marker, endMarker) {
+			overlapping = append(overlapping, sr)
+		}
+	}
+	output, err := json.Marshal(overlapping)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("X-Backend-Record-Type", "shard")
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(output)
+}
+
+// mergeShardRanges merges shard ranges PUT to a container by the sharder.
+func (server *ContainerServer) mergeShardRanges(writer http.ResponseWriter, request *http.Request, vars map[string]string) {
+	var ranges []*ShardRange
+	if err := json.NewDecoder(request.Body).Decode(&ranges); err != nil {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	db, err := server.containerEngine.Get(vars)
+	if err == ErrorNoSuchContainer {
+		srv.StandardResponse(writer, http.StatusNotFound)
+		return
+	} else if err != nil {
+		srv.GetLogger(request).Error("Unable to get container.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	defer server.containerEngine.Return(db)
+	if err := db.MergeShardRanges(ranges); err != nil {
+		srv.GetLogger(request).Error("Unable to merge shard ranges.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	srv.StandardResponse(writer, http.StatusAccepted)
+}
+
+// shardRedirect responds with a redirect to the shard container, if the object's listing has been moved to one.
+func (server *ContainerServer) shardRedirect(writer http.ResponseWriter, request *http.Request, db Container, obj string) bool {
+	ranges, err := db.GetShardRanges()
+	if err != nil {
+		srv.GetLogger(request).Error("Unable to get shard ranges.", zap.Error(err))
+		return false
+	}
+	for _, sr := range ranges {
+		if sr.State == ShardRangeActive && sr.Includes(obj) {
+			writer.Header().Set("Location", "/"+common.Urlencode(sr.Account())+"/"+common.Urlencode(sr.Container())+"/"+common.Urlencode(obj))
+			writer.Header().Set("X-Backend-Redirect-Timestamp", sr.Timestamp)
+			srv.StandardResponse(writer, http.StatusMovedPermanently)
+			return true
+		}
+	}
+	return false
+}
+
 // HealthcheckHandler implements a basic health check, that just returns "OK".
 func (server *ContainerServer) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Set("Content-Length", "2")
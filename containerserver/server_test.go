@@ -366,6 +366,70 @@ func TestContainerPutObjectsGet(t *testing.T) {
 	// TODO parse and validate xml.  or maybe we won't do that.
 }
 
+func TestContainerListingInclude(t *testing.T) {
+	server, handler, cleanup, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup()
+	server.policyList = conf.PolicyList{0: {Index: 0, Name: "gold"}}
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("PUT", "/device/1/a/c/link", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Header.Set("X-Content-Type", common.ContentTypeWithMeta(`application/symlink; symlink_target="a/c/o"`, map[string]string{"Color": "blue"}))
+	req.Header.Set("X-Size", "0")
+	req.Header.Set("X-Etag", "d41d8cd98f00b204e9800998ecf8427e")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c?format=json", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	var data []ObjectListingRecord
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &data))
+	require.Equal(t, 1, len(data))
+	require.Equal(t, "application/symlink", data[0].ContentType)
+	require.Equal(t, "", data[0].SymlinkPath)
+	require.Nil(t, data[0].Meta)
+	require.Equal(t, "", data[0].StoragePolicy)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c?format=json&include=symlink,meta,storage_policy", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	data = nil
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &data))
+	require.Equal(t, "/v1/a/c/o", data[0].SymlinkPath)
+	require.Equal(t, map[string]string{"color": "blue"}, data[0].Meta)
+	require.Equal(t, "gold", data[0].StoragePolicy)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("Accept", "application/json;q=0.5, text/xml")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	require.Equal(t, "application/xml; charset=utf-8", rsp.Header().Get("Content-Type"))
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("Accept", "image/png")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 406, rsp.Status)
+}
+
 func TestContainerPutObjectsFails(t *testing.T) {
 	server, handler, cleanup, err := makeTestServer2()
 	require.Nil(t, err)
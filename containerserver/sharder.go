@@ -0,0 +1,556 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/fs"
+	"github.com/RocFang/hummingbird/common/ring"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/RocFang/hummingbird/middleware"
+	"github.com/justinas/alice"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uber-go/tally"
+	promreporter "github.com/uber-go/tally/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+const shardRowBatch = 1000
+
+// The sysmeta key naming the root container of a shard, as "account/container".
+const shardRootHeader = "X-Container-Sysmeta-Shard-Root"
+
+// ContainerSharder splits containers with more than shard_container_threshold
+// objects into shard containers in a hidden account.  The first primary node of
+// a container picks the ranges and cleaves them, moving their rows into shard
+// containers and marking them active, after which the container server
+// redirects updates for those names to the shards.  Every primary moves any rows
+// that land in active ranges afterward, and shards report their usage back to
+// their root container's ranges.
+type ContainerSharder struct {
+	logger          srv.LowLevelLogger
+	logLevel        zap.AtomicLevel
+	bindIp          string
+	port            int
+	certFile        string
+	keyFile         string
+	deviceRoot      string
+	checkMounts     bool
+	reconCachePath  string
+	interval        time.Duration
+	threshold       int64
+	shardAccountPfx string
+	serverPort      int
+	hashPathPrefix  string
+	hashPathSuffix  string
+	Ring            ring.Ring
+	accountRing     ring.Ring
+	client          common.HTTPClient
+	metricsScope    tally.Scope
+	metricsCloser   io.Closer
+	cleaved         int64
+	moved           int64
+	failures        int64
+}
+
+func (s *ContainerSharder) Type() string {
+	return "container-sharder"
+}
+
+func (s *ContainerSharder) Background(flags *flag.FlagSet) chan struct{} {
+	once := false
+	if f := flags.Lookup("once"); f != nil {
+		once = f.Value.(flag.Getter).Get() == true
+	}
+	if once {
+		ch := make(chan struct{})
+		go func() {
+			defer close(ch)
+			s.Run()
+		}()
+		return ch
+	}
+	go s.RunForever()
+	return nil
+}
+
+func (s *ContainerSharder) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
+	s.metricsScope, s.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
+		Prefix:         metricsPrefix,
+		Tags:           map[string]string{},
+		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
+		Separator:      promreporter.DefaultSeparator,
+	}, time.Second)
+	commonHandlers := alice.New(
+		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
+		s.LogRequest,
+		middleware.RecoverHandler,
+		middleware.ValidateRequest,
+	)
+	router := srv.NewRouter()
+	router.Get("/metrics", prometheus.Handler())
+	router.Get("/loglevel", s.logLevel)
+	router.Put("/loglevel", s.logLevel)
+	router.Get("/healthcheck", commonHandlers.ThenFunc(s.HealthcheckHandler))
+	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
+	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
+	return alice.New(middleware.Metrics(s.metricsScope)).Then(router)
+}
+
+func (s *ContainerSharder) Finalize() {
+	if s.metricsCloser != nil {
+		s.metricsCloser.Close()
+	}
+}
+
+func (s *ContainerSharder) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Length", "2")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("OK"))
+}
+
+func (s *ContainerSharder) LogRequest(next http.Handler) http.Handler {
+	return srv.LogRequest(s.logger, next)
+}
+
+// ringHash returns the hash a container's database is stored under.
+func (s *ContainerSharder) ringHash(account, container string) string {
+	h := md5.New()
+	fmt.Fprintf(h, "%s/%s/%s%s", s.hashPathPrefix, account, container, s.hashPathSuffix)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// quorum returns true if enough of a container's replicas succeeded.
+func (s *ContainerSharder) quorum(successes int) bool {
+	return uint64(successes) >= (s.Ring.ReplicaCount()/2)+1
+}
+
+// shardRanges splits a container's listing into ranges of half the threshold.
+// The final range is open-ended, so it picks up any names added past the last boundary.
+func shardRanges(shardAccount, container, ringHash, timestamp string, boundaries []string) []*ShardRange {
+	ranges := make([]*ShardRange, 0, len(boundaries)+1)
+	lower := ""
+	for i := 0; i <= len(boundaries); i++ {
+		upper := ""
+		if i < len(boundaries) {
+			upper = boundaries[i]
+		}
+		ranges = append(ranges, &ShardRange{
+			Name:           fmt.Sprintf("%s/%s-%s-%s-%d", shardAccount, container, ringHash, timestamp, i),
+			Timestamp:      timestamp,
+			Lower:          lower,
+			Upper:          upper,
+			MetaTimestamp:  timestamp,
+			State:          ShardRangeFound,
+			StateTimestamp: timestamp,
+		})
+		lower = upper
+	}
+	return ranges
+}
+
+// replicate sends a replication message to every primary node of a container, returning the number that accepted it.
+func (s *ContainerSharder) replicate(account, container string, args ...interface{}) int {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return 0
+	}
+	partition := s.Ring.GetPartition(account, container, "")
+	hash := s.ringHash(account, container)
+	successes := 0
+	for _, node := range s.Ring.GetNodes(partition) {
+		req, err := http.NewRequest("REPLICATE", fmt.Sprintf("%s://%s:%d/%s/%d/%s", node.Scheme, node.Ip, node.Port,
+			node.Device, partition, hash), bytes.NewBuffer(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("X-Backend-Suppress-2xx-Logging", "t")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			successes++
+		}
+	}
+	return successes
+}
+
+// containerRequest sends a request to every primary node of a container, returning the number that succeeded.
+func (s *ContainerSharder) containerRequest(method, account, container string, headers http.Header, body []byte) int {
+	partition := s.Ring.GetPartition(account, container, "")
+	var accountPartition uint64
+	var accountNodes []*ring.Device
+	if s.accountRing != nil {
+		accountPartition = s.accountRing.GetPartition(account, "", "")
+		accountNodes = s.accountRing.GetNodes(accountPartition)
+	}
+	successes := 0
+	for i, node := range s.Ring.GetNodes(partition) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s", node.Scheme, node.Ip, node.Port,
+			node.Device, partition, common.Urlencode(account), common.Urlencode(container)), bytes.NewBuffer(body))
+		if err != nil {
+			continue
+		}
+		for k := range headers {
+			req.Header.Set(k, headers.Get(k))
+		}
+		if len(accountNodes) > 0 {
+			accountNode := accountNodes[i%len(accountNodes)]
+			req.Header.Set("X-Account-Partition", strconv.FormatUint(accountPartition, 10))
+			req.Header.Set("X-Account-Host", fmt.Sprintf("%s:%d", accountNode.Ip, accountNode.Port))
+			req.Header.Set("X-Account-Device", accountNode.Device)
+			req.Header.Set("X-Account-Scheme", accountNode.Scheme)
+		}
+		req.Header.Set("User-Agent", "container-sharder")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			successes++
+		}
+	}
+	return successes
+}
+
+// moveRange moves the database's rows in the shard range to the shard container, returning the
+// number of objects and bytes moved.
+func (s *ContainerSharder) moveRange(db ReplicableContainer, sr *ShardRange) (int64, int64, error) {
+	var objects, bytesUsed int64
+	marker := ""
+	for {
+		rows, err := db.ObjectsInRange(sr.Lower, sr.Upper, marker, shardRowBatch)
+		if err != nil {
+			return objects, bytesUsed, err
+		}
+		if len(rows) == 0 {
+			return objects, bytesUsed, nil
+		}
+		if !s.quorum(s.replicate(sr.Account(), sr.Container(), "merge_items", rows, "")) {
+			return objects, bytesUsed, fmt.Errorf("unable to merge rows into %s", sr.Name)
+		}
+		if err := db.RemoveObjects(rows); err != nil {
+			return objects, bytesUsed, err
+		}
+		for _, row := range rows {
+			if row.Deleted == 0 {
+				objects++
+				bytesUsed += row.Size
+			}
+		}
+		atomic.AddInt64(&s.moved, int64(len(rows)))
+		s.metricsScope.Counter("moved").Inc(int64(len(rows)))
+		marker = rows[len(rows)-1].Name
+	}
+}
+
+// cleave creates the shard container for a range and moves the range's rows into it, then activates the range.
+func (s *ContainerSharder) cleave(db ReplicableContainer, info *ContainerInfo, sr *ShardRange) error {
+	if sr.State < ShardRangeCreated {
+		headers := http.Header{
+			"X-Timestamp":                    {sr.Timestamp},
+			"X-Backend-Storage-Policy-Index": {strconv.Itoa(info.StoragePolicyIndex)},
+			shardRootHeader:                  {info.Account + "/" + info.Container},
+		}
+		if !s.quorum(s.containerRequest("PUT", sr.Account(), sr.Container(), headers, nil)) {
+			return fmt.Errorf("unable to create shard container %s", sr.Name)
+		}
+		sr.State, sr.StateTimestamp = ShardRangeCreated, common.GetTimestamp()
+		if err := db.MergeShardRanges([]*ShardRange{sr}); err != nil {
+			return err
+		}
+	}
+	objects, bytesUsed, err := s.moveRange(db, sr)
+	if err != nil {
+		return err
+	}
+	now := common.GetTimestamp()
+	sr.ObjectCount, sr.BytesUsed, sr.MetaTimestamp = objects, bytesUsed, now
+	sr.State, sr.StateTimestamp = ShardRangeActive, now
+	if err := db.MergeShardRanges([]*ShardRange{sr}); err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.cleaved, 1)
+	s.metricsScope.Counter("cleaved").Inc(1)
+	return nil
+}
+
+// reportShard sends a shard container's usage to its root container's shard range.
+func (s *ContainerSharder) reportShard(info *ContainerInfo, root string) error {
+	parts := strings.SplitN(root, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid shard root %q", root)
+	}
+	body, err := json.Marshal([]*ShardRange{{
+		Name:          info.Account + "/" + info.Container,
+		ObjectCount:   info.ObjectCount,
+		BytesUsed:     info.BytesUsed,
+		MetaTimestamp: common.GetTimestamp(),
+	}})
+	if err != nil {
+		return err
+	}
+	headers := http.Header{"X-Timestamp": {common.GetTimestamp()}, "X-Backend-Record-Type": {"shard"}}
+	if !s.quorum(s.containerRequest("PUT", parts[0], parts[1], headers, body)) {
+		return fmt.Errorf("unable to report shard usage to %s", root)
+	}
+	return nil
+}
+
+// shardContainer does whatever sharding work the database at containerFile needs from this node.
+func (s *ContainerSharder) shardContainer(dev *ring.Device, containerFile string) {
+	db, err := sqliteOpenContainer(containerFile)
+	if err != nil {
+		s.logger.Error("Error opening container to shard", zap.String("file", containerFile), zap.Error(err))
+		return
+	}
+	defer db.Close()
+	if deleted, err := db.IsDeleted(); err != nil || deleted {
+		return
+	}
+	partition, err := s.Ring.PartitionForHash(db.RingHash())
+	if err != nil {
+		s.logger.Error("Error getting partition for container", zap.String("file", containerFile), zap.Error(err))
+		return
+	}
+	ordinal := -1
+	for i, node := range s.Ring.GetNodes(partition) {
+		if node.Id == dev.Id {
+			ordinal = i
+		}
+	}
+	if ordinal < 0 {
+		// Handoff copies are left to the replicator.
+		return
+	}
+	info, err := db.GetInfo()
+	if err != nil {
+		s.logger.Error("Error getting info for container to shard", zap.String("file", containerFile), zap.Error(err))
+		return
+	}
+	logger := s.logger.With(zap.String("account", info.Account), zap.String("container", info.Container))
+	metadata, err := db.GetMetadata()
+	if err != nil {
+		logger.Error("Error getting container metadata", zap.Error(err))
+		return
+	}
+	if root := metadata[shardRootHeader]; root != "" {
+		// Shards aren't sharded any further; they only keep their root's usage up to date.
+		if ordinal == 0 {
+			if err := s.reportShard(info, root); err != nil {
+				atomic.AddInt64(&s.failures, 1)
+				s.metricsScope.Counter("failures").Inc(1)
+				logger.Error("Error reporting shard usage", zap.Error(err))
+			}
+		}
+		return
+	}
+	ranges, err := db.GetShardRanges()
+	if err != nil {
+		logger.Error("Error getting shard ranges", zap.Error(err))
+		return
+	}
+	if len(ranges) == 0 {
+		if ordinal != 0 || info.ObjectCount < s.threshold {
+			return
+		}
+		boundaries, err := db.ShardBoundaries(int(s.threshold / 2))
+		if err != nil {
+			logger.Error("Error finding shard boundaries", zap.Error(err))
+			return
+		}
+		if len(boundaries) == 0 {
+			return
+		}
+		ranges = shardRanges(s.shardAccountPfx+info.Account, info.Container, db.RingHash(), common.GetTimestamp(), boundaries)
+		if err := db.MergeShardRanges(ranges); err != nil {
+			logger.Error("Error saving shard ranges", zap.Error(err))
+			return
+		}
+		logger.Info("Sharding container", zap.Int64("objects", info.ObjectCount), zap.Int("ranges", len(ranges)))
+	}
+	changed := false
+	for _, sr := range ranges {
+		if sr.State == ShardRangeActive {
+			// Rows can still show up in active ranges by way of replication from other nodes.
+			if _, _, err := s.moveRange(db, sr); err != nil {
+				atomic.AddInt64(&s.failures, 1)
+				s.metricsScope.Counter("failures").Inc(1)
+				logger.Error("Error moving misplaced rows", zap.String("shard", sr.Name), zap.Error(err))
+			}
+		} else if ordinal == 0 {
+			if err := s.cleave(db, info, sr); err != nil {
+				atomic.AddInt64(&s.failures, 1)
+				s.metricsScope.Counter("failures").Inc(1)
+				logger.Error("Error cleaving shard range", zap.String("shard", sr.Name), zap.Error(err))
+				break
+			}
+			changed = true
+		}
+	}
+	if changed {
+		// Let the other replicas start redirecting updates without waiting for the replicator.
+		if ranges, err := db.GetShardRanges(); err == nil {
+			s.replicate(info.Account, info.Container, "merge_shard_ranges", ranges)
+		}
+	}
+}
+
+// Run a single pass of the sharder over the local devices.
+func (s *ContainerSharder) Run() {
+	start := time.Now()
+	atomic.StoreInt64(&s.cleaved, 0)
+	atomic.StoreInt64(&s.moved, 0)
+	atomic.StoreInt64(&s.failures, 0)
+	s.metricsScope.Counter("passes").Inc(1)
+	devices, err := s.Ring.LocalDevices(s.serverPort)
+	if err != nil {
+		s.logger.Error("Error getting local devices from ring", zap.Error(err))
+		return
+	}
+	containers := 0
+	for _, dev := range devices {
+		devicePath := filepath.Join(s.deviceRoot, dev.Device)
+		if mount, err := fs.IsMount(devicePath); s.checkMounts && (err != nil || !mount) {
+			s.logger.Error("Device not mounted", zap.String("device", dev.Device))
+			continue
+		}
+		filepath.Walk(filepath.Join(devicePath, "containers"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.HasSuffix(path, ".db") {
+				containers++
+				s.shardContainer(dev, path)
+			}
+			return nil
+		})
+	}
+	s.logger.Info("Container sharder pass complete",
+		zap.Int("containers", containers),
+		zap.Int64("cleaved", atomic.LoadInt64(&s.cleaved)),
+		zap.Int64("moved", atomic.LoadInt64(&s.moved)),
+		zap.Int64("failures", atomic.LoadInt64(&s.failures)),
+		zap.Duration("elapsed", time.Since(start)))
+	if err := middleware.DumpReconCache(s.reconCachePath, "container",
+		map[string]interface{}{
+			"container_sharding_pass": float64(time.Since(start)) / float64(time.Second),
+			"cleaved_last_pass":       atomic.LoadInt64(&s.cleaved),
+			"moved_last_pass":         atomic.LoadInt64(&s.moved),
+			"sharding_failures":       atomic.LoadInt64(&s.failures),
+		}); err != nil {
+		s.logger.Error("Error saving container sharder recon data", zap.Error(err))
+	}
+}
+
+// Run sharder passes in a loop until forever.
+func (s *ContainerSharder) RunForever() {
+	for {
+		start := time.Now()
+		s.Run()
+		if elapsed := time.Since(start); elapsed < s.interval {
+			time.Sleep(s.interval - elapsed)
+		}
+	}
+}
+
+func NewContainerSharder(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader) (ipPort *srv.IpPort, server srv.Server, logger srv.LowLevelLogger, err error) {
+	if !serverconf.HasSection("container-sharder") {
+		return ipPort, nil, nil, fmt.Errorf("Unable to find container-sharder config section")
+	}
+	hashPathPrefix, hashPathSuffix, err := cnf.GetHashPrefixAndSuffix()
+	if err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Unable to get hash prefix and suffix: %s", err)
+	}
+	containerRing, err := cnf.GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error loading container ring: %s", err)
+	}
+	accountRing, err := cnf.GetRing("account", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error loading account ring: %s", err)
+	}
+	threshold := serverconf.GetInt("container-sharder", "shard_container_threshold", 1000000)
+	if threshold < 2 {
+		return ipPort, nil, nil, fmt.Errorf("Invalid shard_container_threshold: %d", threshold)
+	}
+	logLevelString := serverconf.GetDefault("container-sharder", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	certFile := serverconf.GetDefault("container-sharder", "cert_file", "")
+	keyFile := serverconf.GetDefault("container-sharder", "key_file", "")
+	transport := &http.Transport{
+		Dial:                (&net.Dialer{Timeout: time.Second}).Dial,
+		MaxIdleConnsPerHost: 100,
+		MaxIdleConns:        0,
+	}
+	if certFile != "" && keyFile != "" {
+		tlsConf, err := common.NewClientTLSConfig(certFile, keyFile)
+		if err != nil {
+			return ipPort, nil, nil, fmt.Errorf("Error getting TLS config: %v", err)
+		}
+		transport.TLSClientConfig = tlsConf
+		if err = http2.ConfigureTransport(transport); err != nil {
+			return ipPort, nil, nil, fmt.Errorf("Error setting up http2: %v", err)
+		}
+	}
+	cs := &ContainerSharder{
+		logLevel:        logLevel,
+		bindIp:          serverconf.GetDefault("container-sharder", "bind_ip", "0.0.0.0"),
+		port:            int(serverconf.GetInt("container-sharder", "bind_port", common.DefaultContainerSharderPort)),
+		certFile:        certFile,
+		keyFile:         keyFile,
+		deviceRoot:      serverconf.GetDefault("container-sharder", "devices", "/srv/node"),
+		checkMounts:     serverconf.GetBool("container-sharder", "mount_check", true),
+		reconCachePath:  serverconf.GetDefault("container-sharder", "recon_cache_path", "/var/cache/swift"),
+		interval:        time.Duration(serverconf.GetInt("container-sharder", "interval", 300)) * time.Second,
+		threshold:       threshold,
+		shardAccountPfx: serverconf.GetDefault("container-sharder", "auto_create_account_prefix", ".") + "shards_",
+		serverPort:      int(serverconf.GetInt("container-replicator", "bind_port", common.DefaultContainerReplicatorPort)),
+		hashPathPrefix:  hashPathPrefix,
+		hashPathSuffix:  hashPathSuffix,
+		Ring:            containerRing,
+		accountRing:     accountRing,
+		client:          &http.Client{Timeout: time.Minute * 15, Transport: transport},
+		metricsScope:    tally.NoopScope,
+	}
+	if cs.logger, err = srv.SetupLogger("container-sharder", &logLevel, flags); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	ipPort = &srv.IpPort{Ip: cs.bindIp, Port: cs.port, CertFile: certFile, KeyFile: keyFile}
+	return ipPort, cs, cs.logger, nil
+}
@@ -0,0 +1,44 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardRanges(t *testing.T) {
+	ranges := shardRanges(".shards_a", "c", "abcd", "1400000000.00000", []string{"g", "p"})
+	require.Equal(t, 3, len(ranges))
+	require.Equal(t, ".shards_a/c-abcd-1400000000.00000-0", ranges[0].Name)
+	require.Equal(t, "", ranges[0].Lower)
+	require.Equal(t, "g", ranges[0].Upper)
+	require.Equal(t, "g", ranges[1].Lower)
+	require.Equal(t, "p", ranges[1].Upper)
+	require.Equal(t, "p", ranges[2].Lower)
+	require.Equal(t, "", ranges[2].Upper)
+	for _, name := range []string{"a", "g", "h", "p", "q", "zzz"} {
+		owners := 0
+		for _, sr := range ranges {
+			require.Equal(t, ShardRangeFound, sr.State)
+			if sr.Includes(name) {
+				owners++
+			}
+		}
+		require.Equal(t, 1, owners)
+	}
+}
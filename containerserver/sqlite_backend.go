@@ -150,14 +150,14 @@ func (db *sqliteContainer) GetInfo() (*ContainerInfo, error) {
 							cs.reported_put_timestamp, cs.reported_delete_timestamp,
 							cs.reported_object_count, cs.reported_bytes_used, cs.hash,
 							cs.id, cs.x_container_sync_point1, cs.x_container_sync_point2,
-							cs.storage_policy_index, cs.metadata, maxrowid.max
+							cs.storage_policy_index, cs.reconciler_sync_point, cs.metadata, maxrowid.max
 						FROM container_stat cs, maxrowid`)
 	if err := row.Scan(&info.Account, &info.Container, &info.CreatedAt, &info.PutTimestamp,
 		&info.DeleteTimestamp, &info.StatusChangedAt, &info.ObjectCount,
 		&info.BytesUsed, &info.ReportedPutTimestamp, &info.ReportedDeleteTimestamp,
 		&info.ReportedObjectCount, &info.ReportedBytesUsed, &info.Hash,
 		&info.ID, &info.XContainerSyncPoint1, &info.XContainerSyncPoint2,
-		&info.StoragePolicyIndex, &info.RawMetadata, &info.MaxRow); err != nil {
+		&info.StoragePolicyIndex, &info.ReconcilerSyncPoint, &info.RawMetadata, &info.MaxRow); err != nil {
 		if common.IsCorruptDBError(err) {
 			return nil, fmt.Errorf("Failed to GetInfo: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
 		}
@@ -168,6 +168,27 @@ func (db *sqliteContainer) GetInfo() (*ContainerInfo, error) {
 	} else if err := json.Unmarshal([]byte(info.RawMetadata), &info.Metadata); err != nil {
 		return nil, err
 	}
+	// Objects in active shard ranges have been moved out of this database, so they're counted from the ranges.
+	var shardRanges, activeRanges, shardObjects, shardBytes int64
+	if err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(state = ?), 0),
+							   COALESCE(SUM(CASE WHEN state = ? THEN object_count ELSE 0 END), 0),
+							   COALESCE(SUM(CASE WHEN state = ? THEN bytes_used ELSE 0 END), 0)
+						   FROM shard_range WHERE deleted = 0`, ShardRangeActive, ShardRangeActive, ShardRangeActive).Scan(
+		&shardRanges, &activeRanges, &shardObjects, &shardBytes); err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to GetInfo shard ranges: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
+	}
+	info.ObjectCount += shardObjects
+	info.BytesUsed += shardBytes
+	if shardRanges == 0 {
+		info.ShardingState = ShardingStateUnsharded
+	} else if activeRanges == shardRanges {
+		info.ShardingState = ShardingStateSharded
+	} else {
+		info.ShardingState = ShardingStateSharding
+	}
 	db.infoCache.Store(info)
 	return info, nil
 }
@@ -220,6 +241,14 @@ func (db *sqliteContainer) Delete(timestamp string) error {
 	if err != nil {
 		return err
 	}
+	// The policy reconciler prefers the policy of whichever replica has gone longest without being deleted or recreated.
+	if _, err = tx.Exec("UPDATE container_info SET status_changed_at = ? WHERE delete_timestamp <= put_timestamp AND ? > put_timestamp",
+		timestamp, timestamp); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to Delete UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
 	if _, err = tx.Exec("UPDATE container_info SET delete_timestamp = ?, metadata = ?", timestamp, string(serializedMetadata)); err != nil {
 		if common.IsCorruptDBError(err) {
 			return fmt.Errorf("Failed to Delete UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
@@ -384,8 +413,19 @@ func updateRecord(rec *ObjectListingRecord) error {
 	whole, nans := math.Modf(f)
 	rec.LastModified = time.Unix(int64(whole), int64(nans*1.0e9)).In(common.GMT).Format("2006-01-02T15:04:05.000000")
 
+	if rec.ContentType, rec.Meta, err = common.ParseContentTypeForMeta(rec.ContentType); err != nil {
+		return err
+	}
 	rec.ContentType, rec.Size, err = common.ParseContentTypeForSlo(
 		rec.ContentType, rec.Size)
+	if err != nil {
+		return err
+	}
+	var target string
+	rec.ContentType, target, rec.SymlinkEtag, rec.SymlinkBytes, err = common.ParseContentTypeForSymlink(rec.ContentType)
+	if target != "" {
+		rec.SymlinkPath = "/v1/" + target
+	}
 	return err
 }
 
@@ -639,6 +679,17 @@ func (db *sqliteContainer) UpdateMetadata(newMetadata map[string][]string, times
 		}
 		return err
 	}
+	// A new sync destination has to start again from the beginning of the container.
+	if syncTo, ok := newMetadata["X-Container-Sync-To"]; ok {
+		if existing, ok := existingMetadata["X-Container-Sync-To"]; !ok || (existing[1] < syncTo[1] && existing[0] != syncTo[0]) {
+			if _, err = tx.Exec("UPDATE container_info SET x_container_sync_point1 = -1, x_container_sync_point2 = -1"); err != nil {
+				if common.IsCorruptDBError(err) {
+					return fmt.Errorf("Failed to UpdateMetadata UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+				}
+				return err
+			}
+		}
+	}
 	defer db.invalidateCache()
 	if err := tx.Commit(); err != nil {
 		if common.IsCorruptDBError(err) {
@@ -1109,8 +1160,10 @@ func sqliteCreateExistingContainer(db Container, putTimestamp string, newMetadat
 	if err != nil {
 		return false, err
 	}
-	if _, err := tx.Exec("UPDATE container_info SET put_timestamp = ?, storage_policy_index = ?, metadata = ?",
-		putTimestamp, policyIndex, metastr); err != nil {
+	recreated := cDeleteTimestamp > cPutTimestamp && putTimestamp > cDeleteTimestamp
+	if _, err := tx.Exec(`UPDATE container_info SET put_timestamp = ?, storage_policy_index = ?, metadata = ?,
+						  status_changed_at = CASE WHEN ? THEN ? ELSE status_changed_at END`,
+		putTimestamp, policyIndex, metastr, recreated, putTimestamp); err != nil {
 		if common.IsCorruptDBError(err) {
 			return false, fmt.Errorf("Failed to sqliteCreateExistingContainer UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(cdb.containerFile), 4, "containers"))
 		}
@@ -1123,7 +1176,7 @@ func sqliteCreateExistingContainer(db Container, putTimestamp string, newMetadat
 		}
 		return false, err
 	}
-	return (cDeleteTimestamp > cPutTimestamp && putTimestamp > cDeleteTimestamp), nil
+	return recreated, nil
 }
 
 func sqliteCreateContainer(containerFile string, account string, container string, putTimestamp string,
@@ -1171,7 +1224,7 @@ func sqliteCreateContainer(containerFile string, account string, container strin
 	}
 	defer tx.Rollback()
 	if _, err := tx.Exec(objectTableScript + policyStatTableScript + policyStatTriggerScript +
-		containerInfoTableScript + containerStatViewScript + syncTableScript); err != nil {
+		containerInfoTableScript + containerStatViewScript + syncTableScript + shardRangeTableScript); err != nil {
 		return err
 	}
 	if _, err := tx.Exec(`INSERT INTO container_info (account, container, created_at, id, put_timestamp,
@@ -1228,3 +1281,323 @@ func (db *sqliteContainer) Reported(putTimestamp, deleteTimestamp string, object
 	}
 	return nil
 }
+
+// SetSyncPoints records how far container sync has progressed through the object table.
+func (db *sqliteContainer) SetSyncPoints(point1, point2 int64) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("UPDATE container_info SET x_container_sync_point1 = ?, x_container_sync_point2 = ?", point1, point2); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to SetSyncPoints UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	defer db.invalidateCache()
+	if err := tx.Commit(); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to SetSyncPoints Commit: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	return nil
+}
+
+// ReconcilePolicy settles a storage policy disagreement with another replica of the container.  A replica that isn't
+// deleted wins over one that is, then the one whose status changed the longest ago, then the lowest policy index.
+// When the local policy loses, the database takes on the other policy and any rows from its old one are left to be
+// found as misplaced, so the reconciler sync point starts over.
+func (db *sqliteContainer) ReconcilePolicy(policyIndex int, statusChangedAt string, deleted bool) (bool, error) {
+	if err := db.connect(); err != nil {
+		return false, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var localPolicyIndex int
+	var localStatusChangedAt, putTimestamp, deleteTimestamp string
+	if err := tx.QueryRow("SELECT storage_policy_index, status_changed_at, put_timestamp, delete_timestamp FROM container_info").Scan(
+		&localPolicyIndex, &localStatusChangedAt, &putTimestamp, &deleteTimestamp); err != nil {
+		if common.IsCorruptDBError(err) {
+			return false, fmt.Errorf("Failed to ReconcilePolicy SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return false, err
+	}
+	localDeleted := deleteTimestamp > putTimestamp
+	if policyIndex == localPolicyIndex {
+		return false, nil
+	} else if deleted != localDeleted {
+		if deleted {
+			return false, nil
+		}
+	} else if statusChangedAt != localStatusChangedAt {
+		if statusChangedAt > localStatusChangedAt {
+			return false, nil
+		}
+	} else if policyIndex > localPolicyIndex {
+		return false, nil
+	}
+	if _, err = tx.Exec("UPDATE container_info SET storage_policy_index = ?, status_changed_at = ?, reconciler_sync_point = -1",
+		policyIndex, statusChangedAt); err != nil {
+		if common.IsCorruptDBError(err) {
+			return false, fmt.Errorf("Failed to ReconcilePolicy UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return false, err
+	}
+	defer db.invalidateCache()
+	if err := tx.Commit(); err != nil {
+		if common.IsCorruptDBError(err) {
+			return false, fmt.Errorf("Failed to ReconcilePolicy Commit: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// SetReconcilerSyncPoint records how far the object table has been checked for rows in the wrong storage policy.
+func (db *sqliteContainer) SetReconcilerSyncPoint(point int64) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE container_info SET reconciler_sync_point = ?", point); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to SetReconcilerSyncPoint UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	db.invalidateCache()
+	return nil
+}
+
+// GetShardRanges returns the container's shard ranges that haven't been deleted, ordered by their upper bounds.
+func (db *sqliteContainer) GetShardRanges() ([]*ShardRange, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT name, timestamp, lower, upper, object_count, bytes_used, meta_timestamp, deleted, state, state_timestamp
+						   FROM shard_range WHERE deleted = 0 ORDER BY upper = '', upper`)
+	if err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to GetShardRanges SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	ranges := []*ShardRange{}
+	for rows.Next() {
+		r := &ShardRange{}
+		if err := rows.Scan(&r.Name, &r.Timestamp, &r.Lower, &r.Upper, &r.ObjectCount, &r.BytesUsed, &r.MetaTimestamp,
+			&r.Deleted, &r.State, &r.StateTimestamp); err != nil {
+			if common.IsCorruptDBError(err) {
+				return nil, fmt.Errorf("Failed to GetShardRanges Scan: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	if err := rows.Err(); err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to GetShardRanges Err: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// MergeShardRanges merges shard ranges into the container.  Bounds, counts and states are each kept from whichever
+// copy of a range has the newest timestamp for them.
+func (db *sqliteContainer) MergeShardRanges(ranges []*ShardRange) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range ranges {
+		current := &ShardRange{}
+		err := tx.QueryRow(`SELECT name, timestamp, lower, upper, object_count, bytes_used, meta_timestamp, deleted, state, state_timestamp
+							FROM shard_range WHERE name = ?`, r.Name).Scan(&current.Name, &current.Timestamp, &current.Lower,
+			&current.Upper, &current.ObjectCount, &current.BytesUsed, &current.MetaTimestamp, &current.Deleted, &current.State,
+			&current.StateTimestamp)
+		if err == sql.ErrNoRows {
+			if r.Timestamp == "" {
+				// Stats reported by a shard for a range that hasn't been replicated here yet.
+				continue
+			}
+			if _, err := tx.Exec(`INSERT INTO shard_range (name, timestamp, lower, upper, object_count, bytes_used, meta_timestamp, deleted, state, state_timestamp)
+								  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, r.Name, r.Timestamp, r.Lower, r.Upper, r.ObjectCount, r.BytesUsed,
+				r.MetaTimestamp, r.Deleted, r.State, r.StateTimestamp); err != nil {
+				if common.IsCorruptDBError(err) {
+					return fmt.Errorf("Failed to MergeShardRanges INSERT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+				}
+				return err
+			}
+			continue
+		} else if err != nil {
+			if common.IsCorruptDBError(err) {
+				return fmt.Errorf("Failed to MergeShardRanges SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return err
+		}
+		merged := *current
+		if r.Timestamp > merged.Timestamp {
+			merged.Timestamp, merged.Lower, merged.Upper, merged.Deleted = r.Timestamp, r.Lower, r.Upper, r.Deleted
+		}
+		if r.MetaTimestamp > merged.MetaTimestamp {
+			merged.MetaTimestamp, merged.ObjectCount, merged.BytesUsed = r.MetaTimestamp, r.ObjectCount, r.BytesUsed
+		}
+		if r.StateTimestamp > merged.StateTimestamp {
+			merged.StateTimestamp, merged.State = r.StateTimestamp, r.State
+		}
+		if merged == *current {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE shard_range SET timestamp = ?, lower = ?, upper = ?, object_count = ?, bytes_used = ?,
+							  meta_timestamp = ?, deleted = ?, state = ?, state_timestamp = ? WHERE name = ?`,
+			merged.Timestamp, merged.Lower, merged.Upper, merged.ObjectCount, merged.BytesUsed, merged.MetaTimestamp,
+			merged.Deleted, merged.State, merged.StateTimestamp, merged.Name); err != nil {
+			if common.IsCorruptDBError(err) {
+				return fmt.Errorf("Failed to MergeShardRanges UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return err
+		}
+	}
+	defer db.invalidateCache()
+	if err := tx.Commit(); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to MergeShardRanges Commit: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	return nil
+}
+
+// ObjectsInRange returns up to limit object records, including tombstones, with names after marker that fall in the range (lower, upper].
+func (db *sqliteContainer) ObjectsInRange(lower, upper, marker string, limit int) ([]*ObjectRecord, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	if marker < lower {
+		marker = lower
+	}
+	records := []*ObjectRecord{}
+	rows, err := db.Query(`SELECT ROWID, name, created_at, size, content_type, etag, deleted, storage_policy_index, expires
+						   FROM object WHERE name > ? AND (? = '' OR name <= ?) ORDER BY name LIMIT ?`, marker, upper, upper, limit)
+	if err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to ObjectsInRange SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := &ObjectRecord{}
+		if err := rows.Scan(&r.Rowid, &r.Name, &r.CreatedAt, &r.Size, &r.ContentType, &r.ETag, &r.Deleted, &r.StoragePolicyIndex, &r.Expires); err != nil {
+			if common.IsCorruptDBError(err) {
+				return nil, fmt.Errorf("Failed to ObjectsInRange Scan: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to ObjectsInRange Err: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
+	}
+	return records, nil
+}
+
+// RemoveObjects removes object records that have been moved to a shard container.  Records that have been replaced by
+// newer ones since they were read are left alone.
+func (db *sqliteContainer) RemoveObjects(records []*ObjectRecord) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	dst, err := tx.Prepare("DELETE FROM object WHERE name = ? AND created_at = ? AND storage_policy_index = ?")
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	for _, record := range records {
+		if _, err := dst.Exec(record.Name, record.CreatedAt, record.StoragePolicyIndex); err != nil {
+			if common.IsCorruptDBError(err) {
+				return fmt.Errorf("Failed to RemoveObjects DELETE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return err
+		}
+	}
+	defer db.invalidateCache()
+	if err := tx.Commit(); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to RemoveObjects Commit: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	return nil
+}
+
+// ShardBoundaries returns the names of every size'th object, which split the listing into ranges of size objects.
+// The last range is left open-ended, so no boundary is returned for it.
+func (db *sqliteContainer) ShardBoundaries(size int) ([]string, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("Invalid shard size %d", size)
+	}
+	rows, err := db.Query("SELECT name FROM object WHERE deleted = 0 ORDER BY name")
+	if err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to ShardBoundaries SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	boundaries := []string{}
+	count := 0
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			if common.IsCorruptDBError(err) {
+				return nil, fmt.Errorf("Failed to ShardBoundaries Scan: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return nil, err
+		}
+		count++
+		if count%size == 0 {
+			boundaries = append(boundaries, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to ShardBoundaries Err: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
+	}
+	if len(boundaries) > 0 && count%size == 0 {
+		boundaries = boundaries[:len(boundaries)-1]
+	}
+	return boundaries, nil
+}
@@ -89,6 +89,19 @@ func TestContainerUpdateRecord(t *testing.T) {
 
 	rec = &ObjectListingRecord{Name: "a", ContentType: "text/plain; swift_bytes=X", LastModified: "1.0"}
 	require.NotNil(t, updateRecord(rec))
+
+	rec = &ObjectListingRecord{Name: "a", ContentType: `application/symlink; symlink_target="a/c/o"; symlink_target_etag=abc; symlink_target_bytes=5`, LastModified: "1.0"}
+	require.Nil(t, updateRecord(rec))
+	require.Equal(t, "application/symlink", rec.ContentType)
+	require.Equal(t, "/v1/a/c/o", rec.SymlinkPath)
+	require.Equal(t, "abc", rec.SymlinkEtag)
+	require.Equal(t, int64(5), rec.SymlinkBytes)
+
+	rec = &ObjectListingRecord{Name: "a", ContentType: common.ContentTypeWithMeta("text/plain; swift_bytes=100", map[string]string{"a": "b"}), LastModified: "1.0"}
+	require.Nil(t, updateRecord(rec))
+	require.Equal(t, "text/plain", rec.ContentType)
+	require.Equal(t, int64(100), rec.Size)
+	require.Equal(t, map[string]string{"a": "b"}, rec.Meta)
 }
 
 func TestContainerListingsLimit(t *testing.T) {
@@ -707,6 +720,131 @@ func TestCheckSyncLink(t *testing.T) {
 	require.False(t, fs.Exists(link))
 }
 
+func TestSetSyncPoints(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.SetSyncPoints(10, 5))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, "10", info.XContainerSyncPoint1)
+	require.Equal(t, "5", info.XContainerSyncPoint2)
+	db.UpdateMetadata(map[string][]string{
+		"X-Container-Sync-To": {"//realm/cluster/a/c", "200000000.00001"},
+	}, "200000000.00001")
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, "-1", info.XContainerSyncPoint1)
+	require.Equal(t, "-1", info.XContainerSyncPoint2)
+	require.Nil(t, db.SetSyncPoints(10, 5))
+	db.UpdateMetadata(map[string][]string{
+		"X-Container-Meta-Foo": {"bar", "200000000.00002"},
+	}, "200000000.00002")
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, "10", info.XContainerSyncPoint1)
+}
+
+func TestReconcilePolicy(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.SetReconcilerSyncPoint(3))
+	// a newer replica loses
+	changed, err := db.ReconcilePolicy(1, "200000000.00001", false)
+	require.Nil(t, err)
+	require.False(t, changed)
+	// so does a deleted one
+	changed, err = db.ReconcilePolicy(1, "100000000.00000", true)
+	require.Nil(t, err)
+	require.False(t, changed)
+	// an older one wins
+	changed, err = db.ReconcilePolicy(2, "100000000.00000", false)
+	require.Nil(t, err)
+	require.True(t, changed)
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 2, info.StoragePolicyIndex)
+	require.Equal(t, "100000000.00000", info.StatusChangedAt)
+	require.Equal(t, int64(-1), info.ReconcilerSyncPoint)
+	// ties go to the lower policy index
+	changed, err = db.ReconcilePolicy(3, "100000000.00000", false)
+	require.Nil(t, err)
+	require.False(t, changed)
+	changed, err = db.ReconcilePolicy(1, "100000000.00000", false)
+	require.Nil(t, err)
+	require.True(t, changed)
+	// a live replica wins over a deleted one
+	require.Nil(t, db.Delete("200000000.00002"))
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, "200000000.00002", info.StatusChangedAt)
+	changed, err = db.ReconcilePolicy(2, "300000000.00000", false)
+	require.Nil(t, err)
+	require.True(t, changed)
+}
+
+func TestMergeShardRanges(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, ShardingStateUnsharded, info.ShardingState)
+	require.Nil(t, db.MergeShardRanges([]*ShardRange{
+		{Name: ".shards_a/c-1", Timestamp: "200000000.00001", Upper: "m", MetaTimestamp: "200000000.00001", State: ShardRangeFound, StateTimestamp: "200000000.00001"},
+		{Name: ".shards_a/c-2", Timestamp: "200000000.00001", Lower: "m", MetaTimestamp: "200000000.00001", State: ShardRangeFound, StateTimestamp: "200000000.00001"},
+		// stats for a range that isn't known yet are dropped
+		{Name: ".shards_a/c-3", ObjectCount: 5, MetaTimestamp: "200000000.00001"},
+	}))
+	ranges, err := db.GetShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ranges))
+	require.Equal(t, "m", ranges[0].Upper)
+	require.Equal(t, "", ranges[1].Upper)
+	require.Nil(t, db.MergeShardRanges([]*ShardRange{
+		{Name: ".shards_a/c-1", ObjectCount: 10, BytesUsed: 100, MetaTimestamp: "200000000.00002", State: ShardRangeActive, StateTimestamp: "200000000.00002"},
+		{Name: ".shards_a/c-2", ObjectCount: 7, MetaTimestamp: "200000000.00000", State: ShardRangeActive, StateTimestamp: "200000000.00000"},
+	}))
+	ranges, err = db.GetShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, "m", ranges[0].Upper)
+	require.Equal(t, int64(10), ranges[0].ObjectCount)
+	require.Equal(t, ShardRangeActive, ranges[0].State)
+	require.Equal(t, int64(0), ranges[1].ObjectCount)
+	require.Equal(t, ShardRangeFound, ranges[1].State)
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, ShardingStateSharding, info.ShardingState)
+	require.Equal(t, int64(10), info.ObjectCount)
+	require.Equal(t, int64(100), info.BytesUsed)
+}
+
+func TestShardBoundaries(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		require.Nil(t, db.PutObject(name, "200000000.00001", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, ""))
+	}
+	require.Nil(t, db.DeleteObject("c", "200000000.00002", 0))
+	boundaries, err := db.ShardBoundaries(2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"b"}, boundaries)
+	boundaries, err = db.ShardBoundaries(1)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b", "d"}, boundaries)
+	records, err := db.ObjectsInRange("b", "d", "", 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "c", records[0].Name)
+	require.Equal(t, 1, records[0].Deleted)
+	require.Nil(t, db.RemoveObjects(records))
+	records, err = db.ObjectsInRange("", "", "", 10)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(records))
+}
+
 func TestMalformed(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -0,0 +1,477 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/fs"
+	"github.com/RocFang/hummingbird/common/ring"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/RocFang/hummingbird/middleware"
+	"github.com/justinas/alice"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uber-go/tally"
+	promreporter "github.com/uber-go/tally/prometheus"
+	"go.uber.org/zap"
+)
+
+// Headers copied from the local object to the remote PUT, along with X-Object-Meta-*.
+var syncObjectHeaders = []string{"Content-Length", "Content-Type", "Content-Encoding", "Content-Disposition", "X-Delete-At", "X-Static-Large-Object", "X-Object-Manifest"}
+
+const syncRowBatch = 100
+
+// ContainerSync pushes the objects of containers with an X-Container-Sync-To
+// set to the remote container named there.  Every primary node of a container
+// takes an equal share of its rows on the first pass (tracked by sync point 1),
+// then retries the rows skipped by everyone else on later passes (sync point 2),
+// so each row is sent at least once even if nodes fail.
+type ContainerSync struct {
+	logger         srv.LowLevelLogger
+	logLevel       zap.AtomicLevel
+	bindIp         string
+	port           int
+	certFile       string
+	keyFile        string
+	deviceRoot     string
+	checkMounts    bool
+	reconCachePath string
+	interval       time.Duration
+	containerTime  time.Duration
+	serverPort     int
+	Ring           ring.Ring
+	realms         conf.SyncRealmList
+	client         common.HTTPClient
+	hClient        client.RequestClient
+	pdc            client.ProxyClient
+	metricsScope   tally.Scope
+	metricsCloser  io.Closer
+	puts           int64
+	deletes        int64
+	skips          int64
+	failures       int64
+}
+
+func (s *ContainerSync) Type() string {
+	return "container-sync"
+}
+
+func (s *ContainerSync) Background(flags *flag.FlagSet) chan struct{} {
+	once := false
+	if f := flags.Lookup("once"); f != nil {
+		once = f.Value.(flag.Getter).Get() == true
+	}
+	if once {
+		ch := make(chan struct{})
+		go func() {
+			defer close(ch)
+			s.Run()
+		}()
+		return ch
+	}
+	go s.RunForever()
+	return nil
+}
+
+func (s *ContainerSync) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
+	s.metricsScope, s.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
+		Prefix:         metricsPrefix,
+		Tags:           map[string]string{},
+		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
+		Separator:      promreporter.DefaultSeparator,
+	}, time.Second)
+	commonHandlers := alice.New(
+		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
+		s.LogRequest,
+		middleware.RecoverHandler,
+		middleware.ValidateRequest,
+	)
+	router := srv.NewRouter()
+	router.Get("/metrics", prometheus.Handler())
+	router.Get("/loglevel", s.logLevel)
+	router.Put("/loglevel", s.logLevel)
+	router.Get("/healthcheck", commonHandlers.ThenFunc(s.HealthcheckHandler))
+	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
+	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
+	return alice.New(middleware.Metrics(s.metricsScope)).Then(router)
+}
+
+func (s *ContainerSync) Finalize() {
+	if s.metricsCloser != nil {
+		s.metricsCloser.Close()
+	}
+	if s.pdc != nil {
+		s.pdc.Close()
+	}
+}
+
+func (s *ContainerSync) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Length", "2")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("OK"))
+}
+
+func (s *ContainerSync) LogRequest(next http.Handler) http.Handler {
+	return srv.LogRequest(s.logger, next)
+}
+
+// syncTarget is where a container's rows are sent.
+type syncTarget struct {
+	account   string
+	container string
+	remote    string
+	realm     conf.SyncRealm
+	userKey   string
+}
+
+// ownsRow reports whether the node at ordinal is the one that first tries to sync the row.
+func ownsRow(target *syncTarget, row *ObjectRecord, ordinal, nodeCount int) bool {
+	h := md5.Sum([]byte("/" + target.account + "/" + target.container + "/" + row.Name))
+	return int(binary.BigEndian.Uint32(h[:4])%uint32(nodeCount)) == ordinal
+}
+
+// remoteRequest sends a signed request for the object to the remote cluster.
+func (s *ContainerSync) remoteRequest(target *syncTarget, method, obj, timestamp string, body io.Reader, headers http.Header) (int, error) {
+	req, err := http.NewRequest(method, target.remote+"/"+common.Urlencode(obj), body)
+	if err != nil {
+		return 0, err
+	}
+	for k := range headers {
+		req.Header.Set(k, headers.Get(k))
+	}
+	if length, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64); err == nil && body != nil {
+		req.ContentLength = length
+	}
+	nonce := common.UUID()
+	sig := conf.SyncSignature(target.realm.Key1, method, req.URL.EscapedPath(), timestamp, nonce, target.userKey)
+	req.Header.Set("X-Container-Sync-Auth", fmt.Sprintf("%s %s %s", target.realm.Name, nonce, sig))
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("User-Agent", "container-sync")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// syncRow sends a single object record to the remote container, returning false if it should be retried.
+func (s *ContainerSync) syncRow(target *syncTarget, row *ObjectRecord) bool {
+	logger := s.logger.With(zap.String("account", target.account), zap.String("container", target.container), zap.String("object", row.Name))
+	if row.Deleted == 1 {
+		status, err := s.remoteRequest(target, "DELETE", row.Name, row.CreatedAt, nil, http.Header{})
+		if err != nil || (status/100 != 2 && status != http.StatusNotFound) {
+			logger.Error("Error syncing object delete", zap.Int("status", status), zap.Error(err))
+			return false
+		}
+		atomic.AddInt64(&s.deletes, 1)
+		s.metricsScope.Counter("deletes").Inc(1)
+		return true
+	}
+	resp := s.hClient.GetObject(context.Background(), target.account, target.container, row.Name, http.Header{})
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// A later row will carry the delete.
+		atomic.AddInt64(&s.skips, 1)
+		s.metricsScope.Counter("skips").Inc(1)
+		return true
+	}
+	if resp.StatusCode/100 != 2 {
+		logger.Error("Error getting object to sync", zap.Int("status", resp.StatusCode))
+		return false
+	}
+	timestamp := resp.Header.Get("X-Timestamp")
+	objTime, err := strconv.ParseFloat(timestamp, 64)
+	if err != nil {
+		logger.Error("Invalid object timestamp", zap.String("timestamp", timestamp))
+		return false
+	}
+	if rowTime, err := strconv.ParseFloat(row.CreatedAt, 64); err != nil || objTime < rowTime {
+		// The object hasn't made it to the object servers yet.
+		logger.Debug("Object older than its container row", zap.String("timestamp", timestamp), zap.String("created_at", row.CreatedAt))
+		return false
+	}
+	headers := http.Header{"Etag": {resp.Header.Get("Etag")}}
+	for k := range resp.Header {
+		if strings.HasPrefix(k, "X-Object-Meta-") || common.StringInSlice(k, syncObjectHeaders) {
+			headers.Set(k, resp.Header.Get(k))
+		}
+	}
+	var body io.Reader = resp.Body
+	if resp.ContentLength == 0 {
+		body = nil
+	}
+	status, err := s.remoteRequest(target, "PUT", row.Name, timestamp, body, headers)
+	// A 409 means the remote already has something newer.
+	if err != nil || (status/100 != 2 && status != http.StatusConflict) {
+		logger.Error("Error syncing object", zap.Int("status", status), zap.Error(err))
+		return false
+	}
+	atomic.AddInt64(&s.puts, 1)
+	s.metricsScope.Counter("puts").Inc(1)
+	return true
+}
+
+// syncContainer runs container sync for the database at dbFile, a link in the device's sync_containers directory.
+func (s *ContainerSync) syncContainer(dev *ring.Device, dbFile string) {
+	containerFile, err := filepath.EvalSymlinks(dbFile)
+	if err != nil {
+		// The container has been removed since the link was made.
+		return
+	}
+	db, err := sqliteOpenContainer(containerFile)
+	if err != nil {
+		s.logger.Error("Error opening container to sync", zap.String("file", containerFile), zap.Error(err))
+		return
+	}
+	defer db.Close()
+	if deleted, err := db.IsDeleted(); err != nil || deleted {
+		return
+	}
+	info, err := db.GetInfo()
+	if err != nil {
+		s.logger.Error("Error getting info for container to sync", zap.String("file", containerFile), zap.Error(err))
+		return
+	}
+	metadata, err := db.GetMetadata()
+	if err != nil {
+		s.logger.Error("Error getting metadata for container to sync", zap.String("file", containerFile), zap.Error(err))
+		return
+	}
+	if metadata["X-Container-Sync-To"] == "" || metadata["X-Container-Sync-Key"] == "" {
+		return
+	}
+	target := &syncTarget{account: info.Account, container: info.Container, userKey: metadata["X-Container-Sync-Key"]}
+	if target.realm, target.remote, err = s.realms.SyncTo(metadata["X-Container-Sync-To"]); err != nil {
+		s.logger.Error("Invalid X-Container-Sync-To", zap.String("account", info.Account), zap.String("container", info.Container), zap.Error(err))
+		return
+	}
+	partition, err := s.Ring.PartitionForHash(db.RingHash())
+	if err != nil {
+		s.logger.Error("Error getting partition for container", zap.String("file", containerFile), zap.Error(err))
+		return
+	}
+	nodes := s.Ring.GetNodes(partition)
+	ordinal := -1
+	for i, node := range nodes {
+		if node.Id == dev.Id {
+			ordinal = i
+		}
+	}
+	if ordinal < 0 {
+		// Handoff copies are left to the replicator.
+		return
+	}
+	point1, _ := strconv.ParseInt(info.XContainerSyncPoint1, 10, 64)
+	point2, _ := strconv.ParseInt(info.XContainerSyncPoint2, 10, 64)
+	stopAt := time.Now().Add(s.containerTime)
+
+	// Retry the other nodes' rows up to sync point 1, since they may not have managed to send them; this node's own rows
+	// were already sent in an earlier pass.
+	nextPoint2 := int64(-2)
+	for point2 < point1 && time.Now().Before(stopAt) {
+		rows, err := db.ItemsSince(point2, syncRowBatch)
+		if err != nil {
+			s.logger.Error("Error reading container rows", zap.String("file", containerFile), zap.Error(err))
+			return
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			if row.Rowid > point1 {
+				point2 = point1
+				break
+			}
+			if !time.Now().Before(stopAt) {
+				break
+			}
+			if !ownsRow(target, row, ordinal, len(nodes)) && !s.syncRow(target, row) {
+				atomic.AddInt64(&s.failures, 1)
+				s.metricsScope.Counter("failures").Inc(1)
+				if nextPoint2 == -2 {
+					nextPoint2 = point2
+				}
+			}
+			point2 = row.Rowid
+		}
+		if err := db.SetSyncPoints(point1, point2); err != nil {
+			s.logger.Error("Error saving sync points", zap.String("file", containerFile), zap.Error(err))
+			return
+		}
+	}
+	if nextPoint2 != -2 {
+		point2 = nextPoint2
+	}
+
+	// Send this node's share of the rows past sync point 1.
+	for time.Now().Before(stopAt) {
+		rows, err := db.ItemsSince(point1, syncRowBatch)
+		if err != nil {
+			s.logger.Error("Error reading container rows", zap.String("file", containerFile), zap.Error(err))
+			break
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			if !time.Now().Before(stopAt) {
+				break
+			}
+			if ownsRow(target, row, ordinal, len(nodes)) && !s.syncRow(target, row) {
+				atomic.AddInt64(&s.failures, 1)
+				s.metricsScope.Counter("failures").Inc(1)
+			}
+			point1 = row.Rowid
+		}
+		if err := db.SetSyncPoints(point1, point2); err != nil {
+			s.logger.Error("Error saving sync points", zap.String("file", containerFile), zap.Error(err))
+			return
+		}
+	}
+	if err := db.SetSyncPoints(point1, point2); err != nil {
+		s.logger.Error("Error saving sync points", zap.String("file", containerFile), zap.Error(err))
+	}
+}
+
+// Run a single pass of container sync over the local devices.
+func (s *ContainerSync) Run() {
+	start := time.Now()
+	atomic.StoreInt64(&s.puts, 0)
+	atomic.StoreInt64(&s.deletes, 0)
+	atomic.StoreInt64(&s.skips, 0)
+	atomic.StoreInt64(&s.failures, 0)
+	s.metricsScope.Counter("passes").Inc(1)
+	devices, err := s.Ring.LocalDevices(s.serverPort)
+	if err != nil {
+		s.logger.Error("Error getting local devices from ring", zap.Error(err))
+		return
+	}
+	containers := 0
+	for _, dev := range devices {
+		devicePath := filepath.Join(s.deviceRoot, dev.Device)
+		if mount, err := fs.IsMount(devicePath); s.checkMounts && (err != nil || !mount) {
+			s.logger.Error("Device not mounted", zap.String("device", dev.Device))
+			continue
+		}
+		filepath.Walk(filepath.Join(devicePath, "sync_containers"), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.HasSuffix(path, ".db") {
+				containers++
+				s.syncContainer(dev, path)
+			}
+			return nil
+		})
+	}
+	synced := atomic.LoadInt64(&s.puts) + atomic.LoadInt64(&s.deletes)
+	s.logger.Info("Container sync pass complete",
+		zap.Int("containers", containers),
+		zap.Int64("puts", atomic.LoadInt64(&s.puts)),
+		zap.Int64("deletes", atomic.LoadInt64(&s.deletes)),
+		zap.Int64("skips", atomic.LoadInt64(&s.skips)),
+		zap.Int64("failures", atomic.LoadInt64(&s.failures)),
+		zap.Duration("elapsed", time.Since(start)))
+	if err := middleware.DumpReconCache(s.reconCachePath, "container",
+		map[string]interface{}{
+			"container_sync_pass": float64(time.Since(start)) / float64(time.Second),
+			"synced_last_pass":    synced,
+			"failures_last_pass":  atomic.LoadInt64(&s.failures),
+		}); err != nil {
+		s.logger.Error("Error saving container sync recon data", zap.Error(err))
+	}
+}
+
+// Run container sync passes in a loop until forever.
+func (s *ContainerSync) RunForever() {
+	for {
+		start := time.Now()
+		s.Run()
+		if elapsed := time.Since(start); elapsed < s.interval {
+			time.Sleep(s.interval - elapsed)
+		}
+	}
+}
+
+func NewContainerSync(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader) (ipPort *srv.IpPort, server srv.Server, logger srv.LowLevelLogger, err error) {
+	if !serverconf.HasSection("container-sync") {
+		return ipPort, nil, nil, fmt.Errorf("Unable to find container-sync config section")
+	}
+	hashPathPrefix, hashPathSuffix, err := cnf.GetHashPrefixAndSuffix()
+	if err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Unable to get hash prefix and suffix: %s", err)
+	}
+	containerRing, err := cnf.GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error loading container ring: %s", err)
+	}
+	realms, err := cnf.GetSyncRealms()
+	if err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error loading sync realms: %v", err)
+	}
+	logLevelString := serverconf.GetDefault("container-sync", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	certFile := serverconf.GetDefault("container-sync", "cert_file", "")
+	keyFile := serverconf.GetDefault("container-sync", "key_file", "")
+	cs := &ContainerSync{
+		logLevel:       logLevel,
+		bindIp:         serverconf.GetDefault("container-sync", "bind_ip", "0.0.0.0"),
+		port:           int(serverconf.GetInt("container-sync", "bind_port", common.DefaultContainerSyncPort)),
+		certFile:       certFile,
+		keyFile:        keyFile,
+		deviceRoot:     serverconf.GetDefault("container-sync", "devices", "/srv/node"),
+		checkMounts:    serverconf.GetBool("container-sync", "mount_check", true),
+		reconCachePath: serverconf.GetDefault("container-sync", "recon_cache_path", "/var/cache/swift"),
+		interval:       time.Duration(serverconf.GetInt("container-sync", "interval", 300)) * time.Second,
+		containerTime:  time.Duration(serverconf.GetInt("container-sync", "container_time", 60)) * time.Second,
+		serverPort:     int(serverconf.GetInt("container-replicator", "bind_port", common.DefaultContainerReplicatorPort)),
+		Ring:           containerRing,
+		realms:         realms,
+		// Requests to the remote cluster don't use the cluster's client certs.
+		client:       &http.Client{Timeout: time.Minute * 5},
+		metricsScope: tally.NoopScope,
+	}
+	if cs.logger, err = srv.SetupLogger("container-sync", &logLevel, flags); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	policies, err := cnf.GetPolicies()
+	if err != nil {
+		return ipPort, nil, nil, err
+	}
+	if cs.pdc, err = client.NewProxyClient(policies, cnf, cs.logger, certFile, keyFile, "", "", "", serverconf); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Could not make client: %v", err)
+	}
+	cs.hClient = cs.pdc.NewRequestClient(nil, nil, cs.logger)
+	cs.hClient.SetUserAgent("container-sync")
+	ipPort = &srv.IpPort{Ip: cs.bindIp, Port: cs.port, CertFile: certFile, KeyFile: keyFile}
+	return ipPort, cs, cs.logger, nil
+}
@@ -0,0 +1,130 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/nectar/nectarutil"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+type syncTestClient struct {
+	client.RequestClient
+	objects map[string]*http.Response
+}
+
+func (c *syncTestClient) GetObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response {
+	if resp, ok := c.objects[account+"/"+container+"/"+obj]; ok {
+		return resp
+	}
+	return nectarutil.ResponseStub(http.StatusNotFound, "")
+}
+
+func TestOwnsRow(t *testing.T) {
+	target := &syncTarget{account: "a", container: "c"}
+	for i := 0; i < 100; i++ {
+		owners := 0
+		for ordinal := 0; ordinal < 3; ordinal++ {
+			if ownsRow(target, &ObjectRecord{Name: strconv.Itoa(i)}, ordinal, 3) {
+				owners++
+			}
+		}
+		require.Equal(t, 1, owners)
+	}
+}
+
+func TestSyncRow(t *testing.T) {
+	type remoteRequest struct {
+		method  string
+		path    string
+		headers http.Header
+		body    string
+	}
+	var requests []remoteRequest
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, remoteRequest{r.Method, r.URL.EscapedPath(), r.Header, string(body)})
+		if r.Method == "DELETE" {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer remote.Close()
+
+	obj := nectarutil.ResponseStub(http.StatusOK, "hello")
+	obj.ContentLength = 5
+	obj.Header.Set("X-Timestamp", "1400000001.00000")
+	obj.Header.Set("Content-Length", "5")
+	obj.Header.Set("Content-Type", "text/plain")
+	obj.Header.Set("Etag", "5d41402abc4b2a76b9719d911017c592")
+	obj.Header.Set("X-Object-Meta-Color", "blue")
+	s := &ContainerSync{
+		logger:       zap.NewNop(),
+		client:       http.DefaultClient,
+		hClient:      &syncTestClient{objects: map[string]*http.Response{"a/c/o 1": obj}},
+		metricsScope: tally.NoopScope,
+	}
+	target := &syncTarget{
+		account:   "a",
+		container: "c",
+		remote:    remote.URL + "/v1/b/d",
+		realm:     conf.SyncRealm{Name: "realm", Key1: "key1"},
+		userKey:   "userkey",
+	}
+
+	require.True(t, s.syncRow(target, &ObjectRecord{Name: "o 1", CreatedAt: "1400000000.00000"}))
+	require.Equal(t, 1, len(requests))
+	require.Equal(t, "PUT", requests[0].method)
+	require.Equal(t, "/v1/b/d/o%201", requests[0].path)
+	require.Equal(t, "hello", requests[0].body)
+	require.Equal(t, "1400000001.00000", requests[0].headers.Get("X-Timestamp"))
+	require.Equal(t, "blue", requests[0].headers.Get("X-Object-Meta-Color"))
+	require.Equal(t, "text/plain", requests[0].headers.Get("Content-Type"))
+	auth := strings.Fields(requests[0].headers.Get("X-Container-Sync-Auth"))
+	require.Equal(t, 3, len(auth))
+	require.Equal(t, "realm", auth[0])
+	require.Equal(t, conf.SyncSignature("key1", "PUT", "/v1/b/d/o%201", "1400000001.00000", auth[1], "userkey"), auth[2])
+
+	require.True(t, s.syncRow(target, &ObjectRecord{Name: "o2", CreatedAt: "1400000002.00000", Deleted: 1}))
+	require.Equal(t, 2, len(requests))
+	require.Equal(t, "DELETE", requests[1].method)
+	require.Equal(t, "1400000002.00000", requests[1].headers.Get("X-Timestamp"))
+
+	// the object hasn't been deleted remotely, but is already gone locally.
+	require.True(t, s.syncRow(target, &ObjectRecord{Name: "o3", CreatedAt: "1400000003.00000"}))
+	require.Equal(t, 2, len(requests))
+	require.Equal(t, int64(1), s.puts)
+	require.Equal(t, int64(1), s.deletes)
+	require.Equal(t, int64(1), s.skips)
+
+	newer := nectarutil.ResponseStub(http.StatusOK, "")
+	newer.Header.Set("X-Timestamp", "1400000000.00000")
+	s.hClient = &syncTestClient{objects: map[string]*http.Response{"a/c/o4": newer}}
+	require.False(t, s.syncRow(target, &ObjectRecord{Name: "o4", CreatedAt: "1400000004.00000"}))
+	require.Equal(t, 2, len(requests))
+}
@@ -22,6 +22,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/bits"
 	"os"
 	"path/filepath"
@@ -72,12 +73,15 @@ type Auditor struct {
 	errors, totalErrors           int64
 }
 
-func slowCopyMd5(file *os.File, bps int64) (int64, string, error) {
+// slowCopyMd5 returns the md5 of the file, read at bps bytes per second. Also
+// writing to checksums lets them be verified without reading it again.
+func slowCopyMd5(file io.Reader, bps int64, checksums ...io.Writer) (int64, string, error) {
 	h := md5.New()
+	w := io.MultiWriter(append([]io.Writer{h}, checksums...)...)
 	st := time.Now()
 	bytesRead := int64(0)
 	for {
-		if b, err := io.CopyN(h, file, 64*1024); err != nil {
+		if b, err := io.CopyN(w, file, 64*1024); err != nil {
 			if err != io.EOF {
 				return bytesRead, "", err
 			}
@@ -98,7 +102,7 @@ type IndexDBAuditor interface {
 type ecAuditor struct{}
 
 func (ecAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64) (int64, error) {
-	finfo, err := os.Stat(path)
+	finfo, err := statItem(path, item)
 	if err != nil || !finfo.Mode().IsRegular() {
 		if item.Nursery {
 			// We're not going to do any quarantining here. It's likely the object
@@ -119,12 +123,15 @@ func (ecAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64)
 	if err != nil {
 		return 0, fmt.Errorf("Error parsing content-length from metadata: %q %v", metadata["Content-Length"], err)
 	}
+	// Checksums are of the whole object, so they can't be checked on shards.
+	checksums := common.Checksums{}
 	if item.Nursery {
 		hsh, ok = metadata["ETag"]
 		if !ok {
 			return 0, fmt.Errorf("Metadata missing ETag: %s", metadata)
 		}
 		fBytes = contentLength
+		checksums = common.NewChecksumsFor(metadata)
 	} else {
 		hsh = item.ShardHash
 		if _, ds, _, _, err := parseECScheme(metadata["Ec-Scheme"]); err == nil {
@@ -137,12 +144,12 @@ func (ecAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64)
 		return 0, fmt.Errorf("File size (%d) doesn't match metadata (%d)", finfo.Size(), fBytes)
 	}
 	if md5BytesPerSec > 0 {
-		file, err := os.Open(path)
+		file, err := openItem(path, item)
 		if err != nil {
 			return 0, fmt.Errorf("Error opening file: %s", err)
 		}
 		defer file.Close()
-		bytesRead, calcHsh, err := slowCopyMd5(file, md5BytesPerSec)
+		bytesRead, calcHsh, err := slowCopyMd5(file, md5BytesPerSec, checksums)
 		if err != nil {
 			return bytesRead, fmt.Errorf("Error calc md5 file: %s", err)
 		}
@@ -152,6 +159,9 @@ func (ecAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64)
 		if calcHsh != hsh {
 			return bytesRead, fmt.Errorf("File contents don't match object hash")
 		}
+		if err := checksums.Verify(metadata); err != nil {
+			return bytesRead, fmt.Errorf("File contents don't match checksum: %v", err)
+		}
 		return bytesRead, nil
 	}
 	return 0, nil
@@ -160,7 +170,7 @@ func (ecAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64)
 type repAuditor struct{}
 
 func (repAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64) (int64, error) {
-	finfo, err := os.Stat(path)
+	finfo, err := statItem(path, item)
 	if err != nil || !finfo.Mode().IsRegular() {
 		if item.Nursery {
 			// We're not going to do any quarantining here. It's likely the object
@@ -186,12 +196,13 @@ func (repAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64
 		return 0, fmt.Errorf("File size (%d) doesn't match metadata (%d)", finfo.Size(), fBytes)
 	}
 	if md5BytesPerSec > 0 {
-		file, err := os.Open(path)
+		file, err := openItem(path, item)
 		if err != nil {
 			return 0, fmt.Errorf("Error opening file: %s", err)
 		}
 		defer file.Close()
-		bytesRead, calcHsh, err := slowCopyMd5(file, md5BytesPerSec)
+		checksums := common.NewChecksumsFor(metadata)
+		bytesRead, calcHsh, err := slowCopyMd5(file, md5BytesPerSec, checksums)
 		if err != nil {
 			return bytesRead, fmt.Errorf("Error calc md5 file: %s", err)
 		}
@@ -201,6 +212,9 @@ func (repAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64
 		if calcHsh != hsh {
 			return bytesRead, fmt.Errorf("File contents don't match object hash")
 		}
+		if err := checksums.Verify(metadata); err != nil {
+			return bytesRead, fmt.Errorf("File contents don't match checksum: %v", err)
+		}
 		return bytesRead, nil
 	}
 	return 0, nil
@@ -220,7 +234,14 @@ func QuarantineItem(db *IndexDB, item *IndexDBItem) error {
 	}
 	dest := filepath.Join(quarantineDir, itemName)
 	var rerr error
-	if err = os.Rename(itemPath, dest); err != nil && !os.IsNotExist(err) {
+	if item.Inline {
+		if err = db.loadInline(item); err == nil {
+			err = ioutil.WriteFile(dest, item.inline, 0644)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			rerr = err
+		}
+	} else if err = os.Rename(itemPath, dest); err != nil && !os.IsNotExist(err) {
 		rerr = err
 	}
 	metaName := filepath.Join(quarantineDir, itemName+".idbmeta")
@@ -304,7 +325,8 @@ func auditHash(hashPath string, md5BytesPerSec int64) (bytesProcessed int64, err
 				if err != nil {
 					return bytesProcessed, fmt.Errorf("Error opening file: %s", err)
 				}
-				bytesRead, calcHsh, err := slowCopyMd5(file, md5BytesPerSec)
+				checksums := common.NewChecksumsFor(metadata)
+				bytesRead, calcHsh, err := slowCopyMd5(file, md5BytesPerSec, checksums)
 				if err != nil {
 					return bytesRead, fmt.Errorf("Error calc md5 file: %s", err)
 				}
@@ -312,6 +334,9 @@ func auditHash(hashPath string, md5BytesPerSec int64) (bytesProcessed int64, err
 				if calcHsh != metadata["ETag"] {
 					return bytesProcessed, fmt.Errorf("File contents don't match etag")
 				}
+				if err := checksums.Verify(metadata); err != nil {
+					return bytesProcessed, fmt.Errorf("File contents don't match checksum: %v", err)
+				}
 			}
 		} else if ext == ".ts" {
 			for _, reqEntry := range []string{"name", "X-Timestamp"} {
@@ -375,7 +400,7 @@ func (a *Auditor) auditDB(devPath string, objRing ring.Ring, policy *conf.Policy
 		a.logger.Error("No auditor set policy", zap.String("policy-type", policy.Type), zap.Int("policy-index", policy.Index))
 		return
 	}
-	db, err := NewIndexDB(dbpath, path, temppath, ringPartPower, int(dbPartPower), subdirs, 0, zapLogger, a.idbAuditors[policy.Index])
+	db, err := NewIndexDB(dbpath, path, temppath, ringPartPower, int(dbPartPower), subdirs, 0, 0, zapLogger, a.idbAuditors[policy.Index])
 	if err != nil {
 		a.errors++
 		a.totalErrors++
@@ -398,6 +423,13 @@ func (a *Auditor) auditDB(devPath string, objRing ring.Ring, policy *conf.Policy
 					zap.String("hash", item.Hash), zap.Error(err))
 				continue
 			}
+			if err = db.loadInline(item); err != nil {
+				if !os.IsNotExist(err) {
+					a.logger.Error("Error loading inline indexdb item",
+						zap.String("hash", item.Hash), zap.Error(err))
+				}
+				continue
+			}
 			a.passes++
 			a.totalPasses++
 			var bytesPerSecond int64
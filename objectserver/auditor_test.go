@@ -171,6 +171,27 @@ func TestAuditHashBadHash(t *testing.T) {
 	assert.Equal(t, bytesProcessed, int64(12))
 }
 
+func TestAuditHashChecksums(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "fffffffffffffffffffffffffffffabc"), 0777)
+	f, _ := os.Create(filepath.Join(dir, "fffffffffffffffffffffffffffffabc", "12345.data"))
+	defer f.Close()
+	metadata := map[string]string{"Content-Length": "12", "ETag": "d3ac5112fe464b81184352ccba743001", "name": "", "Content-Type": "", "X-Timestamp": "",
+		"X-Object-Checksum-Crc32c": "51ee8ed0", "X-Object-Checksum-Xxhash": "3e2092d24bf7adbc"}
+	common.SwiftObjectWriteMetadata(f.Fd(), metadata)
+	f.Write([]byte("testcontents"))
+	bytesProcessed, err := auditHash(filepath.Join(dir, "fffffffffffffffffffffffffffffabc"), 10000)
+	require.Nil(t, err)
+	require.Equal(t, int64(12), bytesProcessed)
+
+	metadata["X-Object-Checksum-Xxhash"] = "0000000000000000"
+	common.SwiftObjectWriteMetadata(f.Fd(), metadata)
+	bytesProcessed, err = auditHash(filepath.Join(dir, "fffffffffffffffffffffffffffffabc"), 10000)
+	require.NotNil(t, err)
+	require.Equal(t, int64(12), bytesProcessed)
+}
+
 func TestAuditHashBadFilename(t *testing.T) {
 	dir, _ := ioutil.TempDir("", "")
 	defer os.RemoveAll(dir)
@@ -535,7 +556,7 @@ func TestAuditDB(t *testing.T) {
 	policydir := filepath.Join(dir, "objects-2")
 	dbdir := filepath.Join(policydir, "hec.db")
 	hecdir := filepath.Join(policydir, "hec")
-	db, err := NewIndexDB(dbdir, hecdir, dir, 2, 1, 32, 0, zap.L(), fakeIndexDBAuditor{})
+	db, err := NewIndexDB(dbdir, hecdir, dir, 2, 1, 32, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	assert.Nil(t, err)
 	body := "some shard content nonsense"
 	shardHash := "d3ac5112fe464b81184352ccba743001"
@@ -690,13 +711,32 @@ func TestAuditNurseryFails(t *testing.T) {
 	assert.Equal(t, int64(16), bytes)
 }
 
+func TestAuditItemChecksums(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dir)
+	fName := filepath.Join(dir, "12345")
+	f, _ := os.Create(fName)
+	f.Write([]byte("testcontents"))
+	f.Close()
+	goodmeta := []byte(`{"Content-Length": "12", "ETag": "d3ac5112fe464b81184352ccba743001", "X-Object-Checksum-Sha256": "7097a82a108e78da1f0a6b994cefbb3f97d14cf581734619c38d2eb8ef4f2e60"}`)
+	badmeta := []byte(`{"Content-Length": "12", "ETag": "d3ac5112fe464b81184352ccba743001", "X-Object-Checksum-Sha256": "0097a82a108e78da1f0a6b994cefbb3f97d14cf581734619c38d2eb8ef4f2e60"}`)
+	for _, auditor := range []IndexDBAuditor{ecAuditor{}, repAuditor{}} {
+		bytes, err := auditor.AuditItem(fName, &IndexDBItem{Nursery: true, Metabytes: goodmeta}, 10000)
+		require.Nil(t, err)
+		require.Equal(t, int64(12), bytes)
+		bytes, err = auditor.AuditItem(fName, &IndexDBItem{Nursery: true, Metabytes: badmeta}, 10000)
+		require.NotNil(t, err)
+		require.Equal(t, int64(12), bytes)
+	}
+}
+
 func TestQuarantineShard(t *testing.T) {
 	dir, _ := ioutil.TempDir("", "")
 	defer os.RemoveAll(dir)
 	policydir := filepath.Join(dir, "objects")
 	dbdir := filepath.Join(policydir, "hec.db")
 	hecdir := filepath.Join(policydir, "hec")
-	db, err := NewIndexDB(dbdir, hecdir, dir, 2, 1, 32, 0, zap.L(), fakeIndexDBAuditor{})
+	db, err := NewIndexDB(dbdir, hecdir, dir, 2, 1, 32, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	timestamp := time.Now().UnixNano()
 	hash := "00000000000000000000000000000000"
 	body := "nonsense"
@@ -0,0 +1,319 @@
+//  Copyright (c) 2016 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// ECCodec computes and recovers the parity of a stripe of EC shards. Missing
+// shards are passed in as zero length slices, which may have the capacity to
+// be filled in place.
+type ECCodec interface {
+	// Encode fills in the parity shards from the data shards.
+	Encode(shards [][]byte) error
+	// Reconstruct fills in the missing shards listed in wanted, or every
+	// missing shard if wanted is nil.
+	Reconstruct(shards [][]byte, wanted []int) error
+	// ReconstructData fills in the missing data shards.
+	ReconstructData(shards [][]byte) error
+	// LocalGroup returns the other shards that can rebuild the given shard on
+	// their own, or nil if the shard needs dataShards others to be rebuilt.
+	LocalGroup(shard int) []int
+}
+
+// ECCodecConstructor is a function that, given the data and parity shard
+// counts and any options from the algorithm name, returns an ECCodec.
+type ECCodecConstructor func(dataShards, parityShards int, options string) (ECCodec, error)
+
+type codecFactoryEntry struct {
+	name        string
+	constructor ECCodecConstructor
+}
+
+var codecFactories = []codecFactoryEntry{}
+
+// RegisterECCodec lets you tell hummingbird about a new erasure code
+// algorithm, which policies can then name in their ec_algorithm setting.
+func RegisterECCodec(name string, newCodec ECCodecConstructor) {
+	for i, c := range codecFactories {
+		if c.name == name {
+			codecFactories[i].constructor = newCodec
+			return
+		}
+	}
+	codecFactories = append(codecFactories, codecFactoryEntry{name, newCodec})
+}
+
+// FindECCodec returns the registered erasure code algorithm with the given name.
+func FindECCodec(name string) (ECCodecConstructor, error) {
+	for _, c := range codecFactories {
+		if c.name == name {
+			return c.constructor, nil
+		}
+	}
+	return nil, errors.New("Not found")
+}
+
+// newECCodec returns the codec for an Ec-Scheme algorithm, which is a
+// registered name optionally followed by "-" and options, like "lrc-2".
+func newECCodec(algo string, dataShards, parityShards int) (ECCodec, error) {
+	name, options := algo, ""
+	if i := strings.Index(algo, "-"); i >= 0 {
+		name, options = algo[:i], algo[i+1:]
+	}
+	newCodec, err := FindECCodec(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown algorithm '%s'", algo)
+	}
+	return newCodec(dataShards, parityShards, options)
+}
+
+type rsCodec struct {
+	enc reedsolomon.Encoder
+}
+
+func (c *rsCodec) Encode(shards [][]byte) error {
+	return c.enc.Encode(shards)
+}
+
+func (c *rsCodec) Reconstruct(shards [][]byte, wanted []int) error {
+	return c.enc.Reconstruct(shards)
+}
+
+func (c *rsCodec) ReconstructData(shards [][]byte) error {
+	return c.enc.ReconstructData(shards)
+}
+
+func (c *rsCodec) LocalGroup(shard int) []int {
+	return nil
+}
+
+func newRSCodec(dataShards, parityShards int, options string) (ECCodec, error) {
+	if options != "" {
+		return nil, fmt.Errorf("reedsolomon takes no options: %q", options)
+	}
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &rsCodec{enc: enc}, nil
+}
+
+func newCauchyCodec(dataShards, parityShards int, options string) (ECCodec, error) {
+	if options != "" {
+		return nil, fmt.Errorf("cauchy takes no options: %q", options)
+	}
+	enc, err := reedsolomon.New(dataShards, parityShards, reedsolomon.WithCauchyMatrix())
+	if err != nil {
+		return nil, err
+	}
+	return &rsCodec{enc: enc}, nil
+}
+
+// lrcCodec is a locally repairable code. The data shards are split into
+// localGroups groups, each with an XOR parity shard of its own, and the rest
+// of the parity shards are Reed-Solomon parity over all the data. A single
+// lost shard in a group is rebuilt from the rest of its group alone.
+//
+// Shards are laid out as the data shards, then the global parity shards,
+// then one local parity shard per group.
+type lrcCodec struct {
+	dataShards   int
+	globalShards int
+	localGroups  int
+	enc          reedsolomon.Encoder
+}
+
+func newLRCCodec(dataShards, parityShards int, options string) (ECCodec, error) {
+	localGroups, err := strconv.Atoi(options)
+	if err != nil {
+		return nil, fmt.Errorf("lrc needs a local group count, like lrc-2: %q", options)
+	}
+	if localGroups < 1 || localGroups > dataShards {
+		return nil, fmt.Errorf("lrc local groups must be between 1 and %d; it was %d", dataShards, localGroups)
+	}
+	if parityShards-localGroups < 1 {
+		return nil, fmt.Errorf("lrc needs more parity shards (%d) than local groups (%d)", parityShards, localGroups)
+	}
+	enc, err := reedsolomon.New(dataShards, parityShards-localGroups)
+	if err != nil {
+		return nil, err
+	}
+	return &lrcCodec{
+		dataShards:   dataShards,
+		globalShards: parityShards - localGroups,
+		localGroups:  localGroups,
+		enc:          enc,
+	}, nil
+}
+
+func (c *lrcCodec) groupOf(shard int) int {
+	if shard < c.dataShards {
+		return shard * c.localGroups / c.dataShards
+	}
+	if shard >= c.dataShards+c.globalShards {
+		return shard - c.dataShards - c.globalShards
+	}
+	return -1
+}
+
+// members returns the data shards of group g followed by its parity shard.
+func (c *lrcCodec) members(g int) []int {
+	members := []int{}
+	for i := 0; i < c.dataShards; i++ {
+		if c.groupOf(i) == g {
+			members = append(members, i)
+		}
+	}
+	return append(members, c.dataShards+c.globalShards+g)
+}
+
+func (c *lrcCodec) LocalGroup(shard int) []int {
+	g := c.groupOf(shard)
+	if g < 0 {
+		return nil
+	}
+	group := []int{}
+	for _, m := range c.members(g) {
+		if m != shard {
+			group = append(group, m)
+		}
+	}
+	return group
+}
+
+// xorShard overwrites shards[dst] with the XOR of the srcs shards.
+func xorShard(shards [][]byte, dst int, srcs []int, size int) {
+	if cap(shards[dst]) >= size {
+		shards[dst] = shards[dst][:size]
+	} else {
+		shards[dst] = make([]byte, size)
+	}
+	out := shards[dst]
+	for i := range out {
+		out[i] = 0
+	}
+	for _, src := range srcs {
+		for i, b := range shards[src] {
+			out[i] ^= b
+		}
+	}
+}
+
+func (c *lrcCodec) Encode(shards [][]byte) error {
+	if len(shards) != c.dataShards+c.globalShards+c.localGroups {
+		return reedsolomon.ErrTooFewShards
+	}
+	if err := c.enc.Encode(shards[:c.dataShards+c.globalShards]); err != nil {
+		return err
+	}
+	for g := 0; g < c.localGroups; g++ {
+		members := c.members(g)
+		xorShard(shards, members[len(members)-1], members[:len(members)-1], len(shards[0]))
+	}
+	return nil
+}
+
+func (c *lrcCodec) reconstruct(shards [][]byte, wanted []int, dataOnly bool) error {
+	if len(shards) != c.dataShards+c.globalShards+c.localGroups {
+		return reedsolomon.ErrTooFewShards
+	}
+	size := 0
+	for _, shard := range shards {
+		if len(shard) > 0 {
+			size = len(shard)
+			break
+		}
+	}
+	if size == 0 {
+		return reedsolomon.ErrTooFewShards
+	}
+	if wanted == nil {
+		for i := range shards {
+			if !dataOnly || i < c.dataShards {
+				wanted = append(wanted, i)
+			}
+		}
+	}
+	// First rebuild whatever the local groups can, which only reads within
+	// a group.
+	for g := 0; g < c.localGroups; g++ {
+		members := c.members(g)
+		missing := -1
+		for _, m := range members {
+			if len(shards[m]) == 0 {
+				if missing >= 0 {
+					missing = -1
+					break
+				}
+				missing = m
+			}
+		}
+		if missing >= 0 {
+			others := []int{}
+			for _, m := range members {
+				if m != missing {
+					others = append(others, m)
+				}
+			}
+			xorShard(shards, missing, others, size)
+		}
+	}
+	done := true
+	for _, w := range wanted {
+		if len(shards[w]) == 0 {
+			done = false
+		}
+	}
+	if done {
+		return nil
+	}
+	// Then fall back to the global Reed-Solomon parity, recomputing any
+	// local parity from the recovered data.
+	if dataOnly {
+		return c.enc.ReconstructData(shards[:c.dataShards+c.globalShards])
+	}
+	if err := c.enc.Reconstruct(shards[:c.dataShards+c.globalShards]); err != nil {
+		return err
+	}
+	for g := 0; g < c.localGroups; g++ {
+		members := c.members(g)
+		if parity := members[len(members)-1]; len(shards[parity]) == 0 {
+			xorShard(shards, parity, members[:len(members)-1], size)
+		}
+	}
+	return nil
+}
+
+func (c *lrcCodec) Reconstruct(shards [][]byte, wanted []int) error {
+	return c.reconstruct(shards, wanted, false)
+}
+
+func (c *lrcCodec) ReconstructData(shards [][]byte) error {
+	return c.reconstruct(shards, nil, true)
+}
+
+func init() {
+	RegisterECCodec("reedsolomon", newRSCodec)
+	RegisterECCodec("cauchy", newCauchyCodec)
+	RegisterECCodec("lrc", newLRCCodec)
+}
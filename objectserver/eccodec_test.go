@@ -0,0 +1,128 @@
+//  Copyright (c) 2016 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func testStripe(total, size int) [][]byte {
+	shards := make([][]byte, total)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		for j := range shards[i] {
+			shards[i][j] = byte(i*31 + j)
+		}
+	}
+	return shards
+}
+
+func copyStripe(shards [][]byte) [][]byte {
+	c := make([][]byte, len(shards))
+	for i := range shards {
+		c[i] = append([]byte{}, shards[i]...)
+	}
+	return c
+}
+
+func TestECCodecs(t *testing.T) {
+	for _, algo := range []string{"reedsolomon", "cauchy", "lrc-2"} {
+		codec, err := newECCodec(algo, 4, 3)
+		require.Nil(t, err, algo)
+		shards := testStripe(7, 16)
+		require.Nil(t, codec.Encode(shards), algo)
+		damaged := copyStripe(shards)
+		damaged[0] = damaged[0][:0]
+		damaged[5] = damaged[5][:0]
+		require.Nil(t, codec.Reconstruct(damaged, nil), algo)
+		require.Equal(t, shards, damaged, algo)
+		damaged = copyStripe(shards)
+		damaged[1] = nil
+		require.Nil(t, codec.ReconstructData(damaged), algo)
+		require.Equal(t, shards[1], damaged[1], algo)
+	}
+	_, err := newECCodec("nope", 4, 3)
+	require.NotNil(t, err)
+	_, err = newECCodec("lrc", 4, 3)
+	require.NotNil(t, err)
+	_, err = newECCodec("lrc-3", 4, 3)
+	require.NotNil(t, err)
+	_, err = newECCodec("reedsolomon-2", 4, 3)
+	require.NotNil(t, err)
+}
+
+func TestLRCLocalRepair(t *testing.T) {
+	codec, err := newECCodec("lrc-2", 4, 3)
+	require.Nil(t, err)
+	// data 0-3, global parity 4, local parity 5 (data 0, 1) and 6 (data 2, 3)
+	require.Equal(t, []int{1, 5}, codec.LocalGroup(0))
+	require.Equal(t, []int{2, 3}, codec.LocalGroup(6))
+	require.Nil(t, codec.LocalGroup(4))
+	shards := testStripe(7, 16)
+	require.Nil(t, codec.Encode(shards))
+
+	// Only the local group is available, which is enough to rebuild shard 0.
+	damaged := make([][]byte, 7)
+	damaged[1] = append([]byte{}, shards[1]...)
+	damaged[5] = append([]byte{}, shards[5]...)
+	require.Nil(t, codec.Reconstruct(damaged, []int{0}))
+	require.Equal(t, shards[0], damaged[0])
+	require.NotNil(t, codec.Reconstruct(damaged, []int{2}))
+}
+
+func TestECReconstructLocal(t *testing.T) {
+	codec, err := newECCodec("lrc-2", 4, 3)
+	require.Nil(t, err)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	bufs := make([]*bytes.Buffer, 7)
+	writers := make([]io.WriteCloser, 7)
+	for i := range bufs {
+		bufs[i] = &bytes.Buffer{}
+		writers[i] = nopWriteCloser{bufs[i]}
+	}
+	require.Nil(t, ecSplit(codec, 4, 3, bytes.NewReader(data), 10, int64(len(data)), writers))
+
+	bodies := make([]io.Reader, 7)
+	bodies[1] = bytes.NewReader(bufs[1].Bytes())
+	bodies[5] = bytes.NewReader(bufs[5].Bytes())
+	require.Equal(t, map[int]bool{1: true, 5: true}, ecLocalRepairSet(codec, bodies, []int{0}))
+	require.Nil(t, ecLocalRepairSet(codec, bodies, []int{4}))
+	rebuilt := &bytes.Buffer{}
+	require.Nil(t, ecReconstruct(codec, 4, 3, bodies, 10, int64(len(data)), []io.Writer{rebuilt}, []int{0}, zap.NewNop()))
+	require.Equal(t, bufs[0].Bytes(), rebuilt.Bytes())
+
+	for i := range bodies {
+		bodies[i] = bytes.NewReader(bufs[i].Bytes())
+	}
+	bodies[0], bodies[2] = nil, nil
+	glued := &bytes.Buffer{}
+	require.Nil(t, ecGlue(codec, 4, 3, bodies, 10, int64(len(data)), glued))
+	require.Equal(t, data, glued.Bytes())
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -42,6 +42,7 @@ import (
 	"github.com/RocFang/hummingbird/common/ring"
 	"github.com/RocFang/hummingbird/common/srv"
 	"github.com/RocFang/hummingbird/common/tracing"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/uber-go/tally"
 	"golang.org/x/net/http2"
 )
@@ -52,6 +53,7 @@ type ecEngine struct {
 	hashPathPrefix                 string
 	hashPathSuffix                 string
 	reserve                        int64
+	inlineThreshold                int64
 	policy                         int
 	ring                           ring.Ring
 	idbs                           map[string]*IndexDB
@@ -63,7 +65,9 @@ type ecEngine struct {
 	dataShards                     int
 	parityShards                   int
 	chunkSize                      int
+	ecAlgorithm                    string
 	client                         common.HTTPClient
+	tracer                         opentracing.Tracer
 	nurseryReplicas                int
 	dbPartPower                    int
 	numSubDirs                     int
@@ -78,15 +82,20 @@ type ecEngine struct {
 func (f *ecEngine) getDB(device string) (*IndexDB, error) {
 	f.idbm.Lock()
 	defer f.idbm.Unlock()
+	ringPartPower := bits.Len64(f.ring.PartitionCount() - 1)
 	if idb, ok := f.idbs[device]; ok && idb != nil {
+		if idb.RingPartPower() != uint(ringPartPower) {
+			if err := idb.SetRingPartPower(ringPartPower); err != nil {
+				return nil, err
+			}
+		}
 		return idb, nil
 	}
 	var err error
 	dbpath := filepath.Join(f.driveRoot, device, PolicyDir(f.policy), "hec.db")
 	path := filepath.Join(f.driveRoot, device, PolicyDir(f.policy), "hec")
 	temppath := filepath.Join(f.driveRoot, device, "tmp")
-	ringPartPower := bits.Len64(f.ring.PartitionCount() - 1)
-	f.idbs[device], err = NewIndexDB(dbpath, path, temppath, ringPartPower, f.dbPartPower, f.numSubDirs, f.reserve, f.logger, ecAuditor{})
+	f.idbs[device], err = NewIndexDB(dbpath, path, temppath, ringPartPower, f.dbPartPower, f.numSubDirs, f.reserve, f.inlineThreshold, f.logger, ecAuditor{})
 	if err != nil {
 		return nil, err
 	}
@@ -104,12 +113,14 @@ func (f *ecEngine) New(vars map[string]string, needData bool, asyncWG *sync.Wait
 		},
 		dataShards:      f.dataShards, /* TODO: consider just putting a reference to the engine in the object */
 		parityShards:    f.parityShards,
+		ecAlgorithm:     f.ecAlgorithm,
 		chunkSize:       f.chunkSize,
 		reserve:         f.reserve,
 		ring:            f.ring,
 		logger:          f.logger,
 		policy:          f.policy,
 		client:          f.client,
+		tracer:          f.tracer,
 		metadata:        map[string]string{},
 		nurseryReplicas: f.nurseryReplicas,
 		txnId:           vars["txnId"],
@@ -122,7 +133,7 @@ func (f *ecEngine) New(vars map[string]string, needData bool, asyncWG *sync.Wait
 				return nil, fmt.Errorf("Error parsing metadata: %v", err)
 			}
 			if !item.Deletion {
-				if fi, err := os.Stat(item.Path); err != nil {
+				if fi, err := idb.Stat(item); err != nil {
 					obj.Quarantine()
 					return nil, err
 				} else if contentLength, err := strconv.ParseInt(obj.metadata["Content-Length"], 10, 64); err != nil {
@@ -161,7 +172,7 @@ func (f *ecEngine) ecShardGetHandler(writer http.ResponseWriter, request *http.R
 		return
 	}
 	shardTimestamp := request.Header.Get("X-Shard-Timestamp")
-	var fl *os.File
+	var fl IndexDBFile
 	var itemPath string
 	var ts int64
 	if shardTimestamp == "" {
@@ -178,7 +189,7 @@ func (f *ecEngine) ecShardGetHandler(writer http.ResponseWriter, request *http.R
 		writer.Header().Set("Ec-Shard-Index", metadata["Ec-Shard-Index"])
 		itemPath = item.Path
 		ts = item.Timestamp
-		fl, err = os.Open(itemPath)
+		fl, err = idb.Open(item)
 		if err != nil {
 			srv.StandardResponse(writer, http.StatusInternalServerError)
 			return
@@ -196,6 +207,12 @@ func (f *ecEngine) ecShardGetHandler(writer http.ResponseWriter, request *http.R
 		}
 		writer.Header().Set("Ec-Shard-Index", vars["index"])
 		fl, err = os.Open(itemPath)
+		if os.IsNotExist(err) {
+			// The shard may be stored inline rather than in its own file.
+			if item, lerr := idb.Lookup(vars["hash"], shardIndex, true); lerr == nil && item != nil && item.Inline && item.Timestamp == ts {
+				fl, err = idb.Open(item)
+			}
+		}
 		if err != nil {
 			if os.IsNotExist(err) {
 				srv.StandardResponse(writer, http.StatusNotFound)
@@ -476,6 +493,7 @@ func (f *ecEngine) GetObjectsToReplicate(prirep PriorityRepJob, c chan ObjectSta
 				idb:          idb,
 				dataShards:   f.dataShards,
 				parityShards: f.parityShards,
+				ecAlgorithm:  f.ecAlgorithm,
 				chunkSize:    f.chunkSize,
 				reserve:      f.reserve,
 				ring:         f.ring,
@@ -612,6 +630,7 @@ func (f *ecEngine) getObjectsToStabilize(device *ring.Device, c chan ObjectStabi
 			reserve:         f.reserve,
 			dataShards:      f.dataShards,
 			parityShards:    f.parityShards,
+			ecAlgorithm:     f.ecAlgorithm,
 			chunkSize:       f.chunkSize,
 			client:          f.client,
 			nurseryReplicas: f.nurseryReplicas,
@@ -659,6 +678,10 @@ func ecEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.Fl
 	if err != nil {
 		return nil, err
 	}
+	inlineThreshold, err := policy.GetInlineThreshold()
+	if err != nil {
+		return nil, err
+	}
 	certFile := config.GetDefault("app:object-server", "cert_file", "")
 	keyFile := config.GetDefault("app:object-server", "key_file", "")
 	transport := &http.Transport{
@@ -690,17 +713,18 @@ func ecEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.Fl
 		Transport: transport,
 	}
 	engine := &ecEngine{
-		driveRoot:      driveRoot,
-		hashPathPrefix: hashPathPrefix,
-		hashPathSuffix: hashPathSuffix,
-		reserve:        reserve,
-		policy:         policy.Index,
-		ring:           r,
-		idbs:           map[string]*IndexDB{},
-		stabItems:      map[string]bool{},
-		dbPartPower:    int(dbPartPower),
-		numSubDirs:     subdirs,
-		client:         httpClient,
+		driveRoot:       driveRoot,
+		hashPathPrefix:  hashPathPrefix,
+		hashPathSuffix:  hashPathSuffix,
+		reserve:         reserve,
+		inlineThreshold: inlineThreshold,
+		policy:          policy.Index,
+		ring:            r,
+		idbs:            map[string]*IndexDB{},
+		stabItems:       map[string]bool{},
+		dbPartPower:     int(dbPartPower),
+		numSubDirs:      subdirs,
+		client:          httpClient,
 	}
 	if engine.logger, err = srv.SetupLogger("ecengine", &logLevel, flags); err != nil {
 		return nil, fmt.Errorf("Error setting up logger: %v", err)
@@ -710,6 +734,7 @@ func ecEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.Fl
 		if err != nil {
 			return nil, fmt.Errorf("Error setting up tracer: %v", err)
 		}
+		engine.tracer = clientTracer
 		enableHTTPTrace := config.GetBool("tracing", "enable_httptrace", true)
 		engine.client, err = client.NewTracingClient(clientTracer, httpClient, enableHTTPTrace)
 		if err != nil {
@@ -728,6 +753,12 @@ func ecEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.Fl
 	if engine.nurseryReplicas, err = strconv.Atoi(policy.Config["nursery_replicas"]); err != nil {
 		engine.nurseryReplicas = 3
 	}
+	if engine.ecAlgorithm = policy.Config["ec_algorithm"]; engine.ecAlgorithm == "" {
+		engine.ecAlgorithm = defaultECAlgorithm
+	}
+	if _, err = newECCodec(engine.ecAlgorithm, engine.dataShards, engine.parityShards); err != nil {
+		return nil, fmt.Errorf("Invalid ec_algorithm %q: %v", engine.ecAlgorithm, err)
+	}
 	return engine, nil
 }
 
@@ -16,6 +16,7 @@
 package objectserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -29,6 +30,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	opentracing "github.com/opentracing/opentracing-go"
 	"go.uber.org/zap"
 
 	"github.com/RocFang/hummingbird/common"
@@ -51,11 +53,53 @@ type ecObject struct {
 	dataShards      int
 	parityShards    int
 	chunkSize       int
+	ecAlgorithm     string
 	client          common.HTTPClient
+	tracer          opentracing.Tracer
+	ctx             context.Context
 	nurseryReplicas int
 	txnId           string
 }
 
+func (o *ecObject) setContext(ctx context.Context) {
+	o.ctx = ctx
+}
+
+// startSpan starts a span for backend work done for the object's request, and
+// gives the context to make that work's requests with. Without a tracer the
+// span is nil.
+func (o *ecObject) startSpan(operationName string, tags opentracing.Tags) (opentracing.Span, context.Context) {
+	return o.startSpanFrom(o.ctx, operationName, tags)
+}
+
+// startSpanFrom is startSpan for work done as part of other backend work,
+// whose context is ctx. Replication and stabilization have no request, so
+// their spans start new traces.
+func (o *ecObject) startSpanFrom(ctx context.Context, operationName string, tags opentracing.Tags) (opentracing.Span, context.Context) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if o.tracer == nil {
+		return nil, ctx
+	}
+	var parent opentracing.SpanContext
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		parent = span.Context()
+	}
+	span := o.tracer.StartSpan(operationName, opentracing.ChildOf(parent), tags)
+	return span, opentracing.ContextWithSpan(context.Background(), span)
+}
+
+func finishSpan(span opentracing.Span, err error) {
+	if span != nil {
+		if err != nil {
+			span.SetTag("error", true)
+			span.LogKV("error", err.Error())
+		}
+		span.Finish()
+	}
+}
+
 func (o *ecObject) Metadata() map[string]string {
 	return o.metadata
 }
@@ -79,6 +123,20 @@ func (o *ecObject) Exists() bool {
 	return o.Path != ""
 }
 
+const defaultECAlgorithm = "reedsolomon"
+
+func (o *ecObject) algorithm() string {
+	if o.ecAlgorithm == "" {
+		return defaultECAlgorithm
+	}
+	return o.ecAlgorithm
+}
+
+// ecScheme returns the Ec-Scheme metadata value for shards this object makes.
+func (o *ecObject) ecScheme() string {
+	return fmt.Sprintf("%s/%d/%d/%d", o.algorithm(), o.dataShards, o.parityShards, o.chunkSize)
+}
+
 func parseECScheme(scheme string) (algo string, dataShards, parityShards, chunkSize int, err error) {
 	sections := strings.Split(scheme, "/")
 	if len(sections) != 4 {
@@ -106,7 +164,7 @@ func (o *ecObject) Copy(dsts ...io.Writer) (written int64, err error) {
 		return 0, nil
 	}
 	if o.Nursery {
-		file, err := os.Open(o.Path)
+		file, err := o.idb.Open(&o.IndexDBItem)
 		if err != nil {
 			return 0, err
 		}
@@ -118,8 +176,9 @@ func (o *ecObject) Copy(dsts ...io.Writer) (written int64, err error) {
 	if err != nil {
 		return 0, fmt.Errorf("Invalid scheme: %v", err)
 	}
-	if algo != "reedsolomon" {
-		return 0, fmt.Errorf("Attempt to read EC object with unknown algorithm '%s'", algo)
+	codec, err := newECCodec(algo, dataShards, parityShards)
+	if err != nil {
+		return 0, fmt.Errorf("Attempt to read EC object with %v", err)
 	}
 	partition, err := o.ring.PartitionForHash(o.Hash)
 	if err != nil {
@@ -134,6 +193,8 @@ func (o *ecObject) Copy(dsts ...io.Writer) (written int64, err error) {
 		i   int
 		bod io.ReadCloser
 	}
+	copySpan, ctx := o.startSpan("EC Copy", opentracing.Tags{"hash": o.Hash, "data_shards": dataShards, "parity_shards": parityShards})
+	defer func() { finishSpan(copySpan, err) }()
 	bods := make(chan *bod)
 	errs := make(chan error)
 	done := make(chan struct{})
@@ -146,6 +207,7 @@ func (o *ecObject) Copy(dsts ...io.Writer) (written int64, err error) {
 			}
 			return
 		}
+		req = req.WithContext(ctx)
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("X-Shard-Timestamp", strconv.FormatInt(o.Timestamp, 10))
 		req.Header.Set("X-Trans-Id", o.txnId)
@@ -184,7 +246,7 @@ func (o *ecObject) Copy(dsts ...io.Writer) (written int64, err error) {
 			bodcount++
 			if bodcount >= dataShards {
 				close(done)
-				return contentLength, ecGlue(dataShards, parityShards, bodies, chunkSize, contentLength, dsts...)
+				return contentLength, ecGlue(codec, dataShards, parityShards, bodies, chunkSize, contentLength, dsts...)
 			}
 		// if we get an error or a little time passes, request a parity shard.
 		case err := <-errs:
@@ -205,13 +267,13 @@ func (o *ecObject) Copy(dsts ...io.Writer) (written int64, err error) {
 }
 
 // CopyRange copies a range of bytes from the object to the writer.
-func (o *ecObject) CopyRange(w io.Writer, start int64, end int64) (int64, error) {
+func (o *ecObject) CopyRange(w io.Writer, start int64, end int64) (written int64, err error) {
 	if !o.Exists() {
 		return 0, errors.New("Doesn't exist")
 	}
 
 	if o.Nursery {
-		file, err := os.Open(o.Path)
+		file, err := o.idb.Open(&o.IndexDBItem)
 		if err != nil {
 			return 0, err
 		}
@@ -224,8 +286,9 @@ func (o *ecObject) CopyRange(w io.Writer, start int64, end int64) (int64, error)
 	if err != nil {
 		return 0, fmt.Errorf("Invalid scheme: %v", err)
 	}
-	if algo != "reedsolomon" {
-		return 0, fmt.Errorf("Attempt to read EC object with unknown algorithm '%s'", algo)
+	codec, err := newECCodec(algo, dataShards, parityShards)
+	if err != nil {
+		return 0, fmt.Errorf("Attempt to read EC object with %v", err)
 	}
 	contentLength := o.ContentLength()
 	partition, err := o.ring.PartitionForHash(o.Hash)
@@ -241,6 +304,8 @@ func (o *ecObject) CopyRange(w io.Writer, start int64, end int64) (int64, error)
 	if shardEnd > contentLength {
 		shardEnd = contentLength
 	}
+	rangeSpan, ctx := o.startSpan("EC CopyRange", opentracing.Tags{"hash": o.Hash, "data_shards": dataShards, "parity_shards": parityShards})
+	defer func() { finishSpan(rangeSpan, err) }()
 	bodies := make([]io.Reader, len(nodes))
 	// TODO: This could be parallelized, and we can probably stop looking once we have dataShards bodies available.
 	for i, node := range nodes {
@@ -248,6 +313,7 @@ func (o *ecObject) CopyRange(w io.Writer, start int64, end int64) (int64, error)
 		if err != nil {
 			continue
 		}
+		req = req.WithContext(ctx)
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", shardStart, shardEnd))
 		req.Header.Set("X-Trans-Id", o.txnId)
@@ -261,8 +327,10 @@ func (o *ecObject) CopyRange(w io.Writer, start int64, end int64) (int64, error)
 		}
 		bodies[i] = resp.Body
 	}
-	err = ecGlue(dataShards, parityShards, bodies, chunkSize, shardEnd-shardStart,
-		&rangeBytesWriter{startOffset: start % int64(chunkSize), length: end - start, writer: w})
+	if err = ecGlue(codec, dataShards, parityShards, bodies, chunkSize, shardEnd-shardStart,
+		&rangeBytesWriter{startOffset: start % int64(chunkSize), length: end - start, writer: w}); err != nil {
+		return 0, err
+	}
 	return end - start, nil
 }
 
@@ -332,13 +400,18 @@ func (o *ecObject) Close() error {
 }
 
 func (o *ecObject) Reconstruct() error {
+	return o.reconstruct(o.ctx)
+}
+
+func (o *ecObject) reconstruct(ctx context.Context) (err error) {
 	success := true
 	algo, dataShards, parityShards, chunkSize, err := parseECScheme(o.metadata["Ec-Scheme"])
 	if err != nil {
 		return fmt.Errorf("Invalid scheme: %v", err)
 	}
-	if algo != "reedsolomon" {
-		return fmt.Errorf("Attempt to read EC object with unknown algorithm '%s'", algo)
+	codec, err := newECCodec(algo, dataShards, parityShards)
+	if err != nil {
+		return fmt.Errorf("Attempt to read EC object with %v", err)
 	}
 	contentLength := o.ContentLength()
 	partition, err := o.ring.PartitionForHash(o.Hash)
@@ -349,6 +422,8 @@ func (o *ecObject) Reconstruct() error {
 	if len(nodes) < dataShards+parityShards {
 		return fmt.Errorf("Not enough nodes (%d) for scheme (%d)", len(nodes), dataShards+parityShards)
 	}
+	span, ctx := o.startSpanFrom(ctx, "EC Reconstruct", opentracing.Tags{"hash": o.Hash, "data_shards": dataShards, "parity_shards": parityShards})
+	defer func() { finishSpan(span, err) }()
 	bodies := make([]io.Reader, len(nodes))
 	readSuccesses := 0
 	readFails := 0
@@ -362,6 +437,7 @@ func (o *ecObject) Reconstruct() error {
 			readFails++
 			continue
 		}
+		req = req.WithContext(ctx)
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("X-Trans-Id", o.txnId)
 		resp, err := o.client.Do(req)
@@ -384,7 +460,22 @@ func (o *ecObject) Reconstruct() error {
 		bodies[i] = resp.Body
 		readSuccesses++
 	}
-	if readSuccesses < dataShards {
+	missing := []int{}
+	for i, node := range failed {
+		if node != nil {
+			missing = append(missing, i)
+		}
+	}
+	if local := ecLocalRepairSet(codec, bodies, missing); local != nil {
+		// The missing shards can be rebuilt from their local groups, so don't
+		// bother reading the rest of the stripe.
+		for i := range bodies {
+			if bodies[i] != nil && !local[i] {
+				bodies[i].(io.Closer).Close()
+				bodies[i] = nil
+			}
+		}
+	} else if readSuccesses < dataShards {
 		return fmt.Errorf("Not enough nodes (%d) to reconstruct from (%d)", readSuccesses, dataShards)
 	}
 
@@ -408,10 +499,11 @@ func (o *ecObject) Reconstruct() error {
 			o.logger.Info("PUT NewRequest failed", zap.String("url", url), zap.Error(err))
 			continue
 		}
+		req = req.WithContext(ctx)
 		req.ContentLength = ecShardLength(o.ContentLength(), o.dataShards)
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("X-Trans-Id", o.txnId)
-		req.Header.Set("Meta-Ec-Scheme", fmt.Sprintf("reedsolomon/%d/%d/%d", o.dataShards, o.parityShards, o.chunkSize))
+		req.Header.Set("Meta-Ec-Scheme", o.ecScheme())
 		for k, v := range o.metadata {
 			req.Header.Set("Meta-"+k, v)
 		}
@@ -434,7 +526,7 @@ func (o *ecObject) Reconstruct() error {
 			}
 		}(req)
 	}
-	err = ecReconstruct(dataShards, parityShards, bodies, chunkSize, contentLength, writers, shardsToFix, o.logger)
+	err = ecReconstruct(codec, dataShards, parityShards, bodies, chunkSize, contentLength, writers, shardsToFix, o.logger)
 	if err != nil {
 		o.logger.Error("ecReconstruct failed", zap.Error(err))
 	}
@@ -457,13 +549,15 @@ func (o *ecObject) Reconstruct() error {
 	return err
 }
 
-func (o *ecObject) Replicate(prirep PriorityRepJob) error {
+func (o *ecObject) Replicate(prirep PriorityRepJob) (err error) {
 	// If we are handoff, just replicate the shard and delete local shard
 	if o.Nursery {
 		return fmt.Errorf("not replicating object in nursery")
 	}
+	span, ctx := o.startSpan("EC Replicate", opentracing.Tags{"hash": o.Hash, "shard": o.Shard, "partition": prirep.Partition})
+	defer func() { finishSpan(span, err) }()
 	if _, handoff := o.ring.GetJobNodes(prirep.Partition, prirep.FromDevice.Id); handoff {
-		fp, err := os.Open(o.Path)
+		fp, err := o.idb.Open(&o.IndexDBItem)
 		if err != nil {
 			return err
 		}
@@ -472,12 +566,13 @@ func (o *ecObject) Replicate(prirep PriorityRepJob) error {
 		if err != nil {
 			return err
 		}
+		req = req.WithContext(ctx)
 		req.ContentLength = ecShardLength(o.ContentLength(), o.dataShards)
 		req.Header.Set("X-Timestamp", o.metadata["X-Timestamp"])
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("X-Trans-Id", o.txnId)
 		req.Header.Set("User-Agent", "nursery-stabilizer")
-		req.Header.Set("Meta-Ec-Scheme", fmt.Sprintf("reedsolomon/%d/%d/%d", o.dataShards, o.parityShards, o.chunkSize))
+		req.Header.Set("Meta-Ec-Scheme", o.ecScheme())
 		for k, v := range o.metadata {
 			req.Header.Set("Meta-"+k, v)
 		}
@@ -492,10 +587,12 @@ func (o *ecObject) Replicate(prirep PriorityRepJob) error {
 		_, err = o.idb.Remove(o.Hash, o.Shard, o.Timestamp, o.Nursery, o.Metahash)
 		return err
 	}
-	return o.Reconstruct()
+	return o.reconstruct(ctx)
 }
 
-func (o *ecObject) notifyStable(partition uint64, dev *ring.Device) error {
+func (o *ecObject) notifyStable(ctx context.Context, partition uint64, dev *ring.Device) error {
+	span, ctx := o.startSpanFrom(ctx, "EC notifyStable", opentracing.Tags{"hash": o.Hash, "partition": partition})
+	defer finishSpan(span, nil)
 	nodes := o.ring.GetNodes(partition)
 	var successes int64
 	wg := sync.WaitGroup{}
@@ -508,6 +605,7 @@ func (o *ecObject) notifyStable(partition uint64, dev *ring.Device) error {
 		if err != nil {
 			return
 		}
+		req = req.WithContext(ctx)
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("User-Agent", "nursery-stabilizer")
 		req.Header.Set("X-Trans-Id", o.txnId)
@@ -559,7 +657,9 @@ func (o *ecObject) notifyStable(partition uint64, dev *ring.Device) error {
 	return nil
 }
 
-func (o *ecObject) nurseryReplicate(partition uint64, dev *ring.Device) error {
+func (o *ecObject) nurseryReplicate(ctx context.Context, partition uint64, dev *ring.Device) (err error) {
+	span, ctx := o.startSpanFrom(ctx, "EC nurseryReplicate", opentracing.Tags{"hash": o.Hash, "partition": partition})
+	defer func() { finishSpan(span, err) }()
 	nodes, handoff := o.ring.GetJobNodes(partition, dev.Id)
 	more := o.ring.GetMoreNodes(partition)
 	var node *ring.Device
@@ -589,6 +689,7 @@ func (o *ecObject) nurseryReplicate(partition uint64, dev *ring.Device) error {
 		if err != nil {
 			return err
 		}
+		req = req.WithContext(ctx)
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("X-Trans-Id", o.txnId)
 		req.Header.Set("User-Agent", "nursery-stabilizer")
@@ -617,7 +718,7 @@ func (o *ecObject) nurseryReplicate(partition uint64, dev *ring.Device) error {
 				writers = append(writers, wrs[i])
 			}
 		}
-		fp, err := os.Open(o.Path)
+		fp, err := o.idb.Open(&o.IndexDBItem)
 		if err != nil {
 			return err
 		}
@@ -644,7 +745,7 @@ func (o *ecObject) nurseryReplicate(partition uint64, dev *ring.Device) error {
 	return nil
 }
 
-func (o *ecObject) restabilize(dev *ring.Device) error {
+func (o *ecObject) restabilize(ctx context.Context, dev *ring.Device) error {
 	partition, err := o.ring.PartitionForHash(o.Hash)
 	if err != nil {
 		return fmt.Errorf("invalid Hash: %s", o.Hash)
@@ -660,6 +761,7 @@ func (o *ecObject) restabilize(dev *ring.Device) error {
 		if err != nil {
 			return err
 		}
+		req = req.WithContext(ctx)
 		req.Header.Set("X-Timestamp", o.metadata["X-Timestamp"])
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("X-Trans-Id", o.txnId)
@@ -686,9 +788,11 @@ func (o *ecObject) restabilize(dev *ring.Device) error {
 	return o.idb.SetStabilized(o.Hash, o.Shard, o.Timestamp, false)
 }
 
-func (o *ecObject) Stabilize(dev *ring.Device) error {
+func (o *ecObject) Stabilize(dev *ring.Device) (err error) {
+	span, ctx := o.startSpan("EC Stabilize", opentracing.Tags{"hash": o.Hash, "restabilize": o.Restabilize, "deletion": o.Deletion})
+	defer func() { finishSpan(span, err) }()
 	if o.Restabilize {
-		return o.restabilize(dev)
+		return o.restabilize(ctx, dev)
 	}
 	partition, err := o.ring.PartitionForHash(o.Hash)
 	if err != nil {
@@ -716,13 +820,14 @@ func (o *ecObject) Stabilize(dev *ring.Device) error {
 		if err != nil {
 			return err
 		}
+		req = req.WithContext(ctx)
 		if !o.Deletion {
 			req.ContentLength = ecShardLength(o.ContentLength(), o.dataShards)
 		}
 		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(o.policy))
 		req.Header.Set("X-Trans-Id", o.txnId)
 		req.Header.Set("User-Agent", "nursery-stabilizer")
-		req.Header.Set("Meta-Ec-Scheme", fmt.Sprintf("reedsolomon/%d/%d/%d", o.dataShards, o.parityShards, o.chunkSize))
+		req.Header.Set("Meta-Ec-Scheme", o.ecScheme())
 		for k, v := range o.metadata {
 			req.Header.Set("Meta-"+k, v)
 		}
@@ -752,7 +857,7 @@ func (o *ecObject) Stabilize(dev *ring.Device) error {
 	}
 	if success {
 		if needUpload {
-			fp, err := os.Open(o.Path)
+			fp, err := o.idb.Open(&o.IndexDBItem)
 			if err != nil {
 				if os.IsNotExist(err) {
 					// probably got notified stable, skip
@@ -769,7 +874,11 @@ func (o *ecObject) Stabilize(dev *ring.Device) error {
 				contentLength = fi.Size()
 			}
 
-			ecSplit(o.dataShards, o.parityShards, fp, o.chunkSize, contentLength, writers)
+			codec, err := newECCodec(o.algorithm(), o.dataShards, o.parityShards)
+			if err != nil {
+				return err
+			}
+			ecSplit(codec, o.dataShards, o.parityShards, fp, o.chunkSize, contentLength, writers)
 		}
 		for _, w := range wrs {
 			w.Close()
@@ -784,7 +893,7 @@ func (o *ecObject) Stabilize(dev *ring.Device) error {
 	}
 
 	if !success {
-		o.nurseryReplicate(partition, dev)
+		o.nurseryReplicate(ctx, partition, dev)
 		return fmt.Errorf("Failed to stabilize object: %s", o.txnId)
 	} else if o.idb != nil {
 		nSuccess := e.Successes(0, 409)
@@ -792,7 +901,7 @@ func (o *ecObject) Stabilize(dev *ring.Device) error {
 			st := time.Now()
 			done := make(chan struct{}, 1)
 			go func() {
-				if err = o.notifyStable(partition, dev); err != nil {
+				if err := o.notifyStable(ctx, partition, dev); err != nil {
 					o.logger.Debug("stabilize notify failed", zap.Error(err), zap.Duration("dur", time.Since(st)))
 				} else {
 					o.logger.Debug("object notified", zap.String("hash", o.Uuid()), zap.Duration("dur", time.Since(st)))
@@ -17,6 +17,7 @@ package objectserver
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -33,6 +34,7 @@ import (
 
 	"github.com/RocFang/hummingbird/common/ring"
 	"github.com/RocFang/hummingbird/common/test"
+	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/stretchr/testify/require"
 )
 
@@ -76,7 +78,7 @@ func TestNurseryReplicate(t *testing.T) {
 		nurseryReplicas: 3,
 	}
 	node := &ring.Device{Scheme: u.Scheme, ReplicationIp: u.Hostname(), ReplicationPort: port - 1, Device: "sda"}
-	require.Nil(t, to.nurseryReplicate(1, node))
+	require.Nil(t, to.nurseryReplicate(context.Background(), 1, node))
 	require.Equal(t, int64(2), calls)
 }
 
@@ -127,7 +129,7 @@ func TestNurseryReplicateWithFailure(t *testing.T) {
 		nurseryReplicas: 3,
 	}
 	node := &ring.Device{Scheme: u.Scheme, ReplicationIp: u.Hostname(), ReplicationPort: port - 1, Device: "sda"}
-	require.Nil(t, to.nurseryReplicate(1, node))
+	require.Nil(t, to.nurseryReplicate(context.Background(), 1, node))
 	require.False(t, used["sdb"])
 	require.True(t, used["sdc"])
 	require.True(t, used["sdd"])
@@ -205,6 +207,66 @@ func TestStabilize(t *testing.T) {
 	require.Equal(t, int64(3), lengths["sde"])
 }
 
+func TestStabilizeTraced(t *testing.T) {
+	fp, err := ioutil.TempFile("", "")
+	fp.Write([]byte("TESTING"))
+	require.Nil(t, err)
+	defer os.RemoveAll(fp.Name())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	var devices []*ring.Device
+	for _, dev := range []string{"sda", "sdb", "sdc", "sdd", "sde"} {
+		devices = append(devices, &ring.Device{Scheme: u.Scheme, Ip: u.Hostname(), Port: port, ReplicationIp: u.Hostname(), ReplicationPort: port, Device: dev})
+	}
+	tracer := mocktracer.New()
+	to := &ecObject{
+		IndexDBItem: IndexDBItem{
+			Hash: "00000011111122222233333344444455",
+			Path: fp.Name(),
+		},
+		client:       http.DefaultClient,
+		tracer:       tracer,
+		dataShards:   3,
+		parityShards: 2,
+		chunkSize:    100,
+		ring:         &CustomFakeRing{FakeRing: test.FakeRing{MockDevices: devices}},
+		metadata: map[string]string{
+			"name":           "/a/c/o",
+			"Content-Length": "7",
+			"Ec-Scheme":      "reedsolomon/3/2/100",
+		},
+		nurseryReplicas: 3,
+	}
+	require.Nil(t, to.Stabilize(nil))
+	spans := tracer.FinishedSpans()
+	require.Equal(t, 1, len(spans))
+	require.Equal(t, "EC Stabilize", spans[0].OperationName)
+	require.Nil(t, spans[0].Tag("error"))
+
+	// Shard servers with nothing to give fail the range read and its span.
+	to.ring = &CustomFakeRing{FakeRing: test.FakeRing{MockDevices: []*ring.Device{
+		{Scheme: u.Scheme, Ip: u.Hostname(), Port: port - 1, Device: "sda"},
+		{Scheme: u.Scheme, Ip: u.Hostname(), Port: port - 1, Device: "sdb"},
+		{Scheme: u.Scheme, Ip: u.Hostname(), Port: port - 1, Device: "sdc"},
+		{Scheme: u.Scheme, Ip: u.Hostname(), Port: port - 1, Device: "sdd"},
+		{Scheme: u.Scheme, Ip: u.Hostname(), Port: port - 1, Device: "sde"},
+	}}}
+	to.Nursery = false
+	_, err = to.CopyRange(ioutil.Discard, 0, 5)
+	require.NotNil(t, err)
+	spans = tracer.FinishedSpans()
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, "EC CopyRange", spans[1].OperationName)
+	require.Equal(t, true, spans[1].Tag("error"))
+}
+
 func TestStabilizeDelete(t *testing.T) {
 	fp, err := ioutil.TempFile("", "")
 	fp.Write([]byte("TESTING"))
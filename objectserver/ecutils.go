@@ -7,7 +7,6 @@ import (
 	"io"
 
 	"github.com/RocFang/hummingbird/common/srv"
-	"github.com/klauspost/reedsolomon"
 	"go.uber.org/zap"
 )
 
@@ -23,11 +22,30 @@ func ecShardLength(length int64, dataShards int) int64 {
 	return shardLength
 }
 
-func ecSplit(dataChunks, parityChunks int, fp io.Reader, chunkSize int, contentLength int64, writers []io.WriteCloser) error {
-	enc, err := reedsolomon.New(dataChunks, parityChunks)
-	if err != nil {
-		return err
+// ecLocalRepairSet returns the shards needed to rebuild the missing shards
+// from their local groups alone, or nil if any of them needs a full
+// reconstruction from dataChunks other shards.
+func ecLocalRepairSet(codec ECCodec, bodies []io.Reader, missing []int) map[int]bool {
+	if len(missing) == 0 {
+		return nil
 	}
+	needed := map[int]bool{}
+	for _, m := range missing {
+		group := codec.LocalGroup(m)
+		if group == nil {
+			return nil
+		}
+		for _, g := range group {
+			if g >= len(bodies) || bodies[g] == nil {
+				return nil
+			}
+			needed[g] = true
+		}
+	}
+	return needed
+}
+
+func ecSplit(codec ECCodec, dataChunks, parityChunks int, fp io.Reader, chunkSize int, contentLength int64, writers []io.WriteCloser) error {
 	data := make([][]byte, dataChunks+parityChunks)
 	databuf := make([]byte, (dataChunks+parityChunks)*chunkSize)
 	for i := range data {
@@ -56,7 +74,7 @@ func ecSplit(dataChunks, parityChunks int, fp io.Reader, chunkSize int, contentL
 		for i := range data { // assign data chunks
 			data[i] = databuf[i*thisChunkSize : (i+1)*thisChunkSize]
 		}
-		if err := enc.Encode(data); err != nil {
+		if err := codec.Encode(data); err != nil {
 			return err
 		}
 		for i := range data {
@@ -71,13 +89,9 @@ func ecSplit(dataChunks, parityChunks int, fp io.Reader, chunkSize int, contentL
 	return nil
 }
 
-func ecReconstruct(dataChunks, parityChunks int, bodies []io.Reader, chunkSize int, contentLength int64, dsts []io.Writer, dstChunkNum []int, logger srv.LowLevelLogger) error {
+func ecReconstruct(codec ECCodec, dataChunks, parityChunks int, bodies []io.Reader, chunkSize int, contentLength int64, dsts []io.Writer, dstChunkNum []int, logger srv.LowLevelLogger) error {
 	logger.Info(fmt.Sprintf("ecReconstruct, dsts: %+v", dsts))
 	logger.Info(fmt.Sprintf("ecReconstruct, dstChunkNum: %+v", dstChunkNum))
-	enc, err := reedsolomon.New(dataChunks, parityChunks)
-	if err != nil {
-		return err
-	}
 	data := make([][]byte, dataChunks+parityChunks)
 	databuf := make([]byte, (dataChunks+parityChunks)*chunkSize)
 	totalDatabytes := int64(0)
@@ -108,7 +122,7 @@ func ecReconstruct(dataChunks, parityChunks int, bodies []io.Reader, chunkSize i
 			}
 		}
 
-		if err := enc.Reconstruct(data); err != nil {
+		if err := codec.Reconstruct(data, dstChunkNum); err != nil {
 			return err
 		}
 
@@ -119,8 +133,10 @@ func ecReconstruct(dataChunks, parityChunks int, bodies []io.Reader, chunkSize i
 			}
 		}
 
+		// Not every data chunk is necessarily read or rebuilt when the codec
+		// can repair the wanted chunks locally.
 		for i := 0; i < dataChunks; i++ {
-			datalen := int64(len(data[i]))
+			datalen := int64(expectedChunkSize)
 			if contentLength-totalDatabytes < datalen {
 				datalen = contentLength - totalDatabytes
 			}
@@ -131,11 +147,7 @@ func ecReconstruct(dataChunks, parityChunks int, bodies []io.Reader, chunkSize i
 	return nil
 }
 
-func ecGlue(dataChunks, parityChunks int, bodies []io.Reader, chunkSize int, contentLength int64, dsts ...io.Writer) error {
-	enc, err := reedsolomon.New(dataChunks, parityChunks)
-	if err != nil {
-		return err
-	}
+func ecGlue(codec ECCodec, dataChunks, parityChunks int, bodies []io.Reader, chunkSize int, contentLength int64, dsts ...io.Writer) error {
 	data := make([][]byte, dataChunks+parityChunks)
 	databuf := make([]byte, (dataChunks+parityChunks)*chunkSize)
 	totalWritten := int64(0)
@@ -165,7 +177,7 @@ func ecGlue(dataChunks, parityChunks int, bodies []io.Reader, chunkSize int, con
 				}
 			}
 		}
-		if err := enc.ReconstructData(data); err != nil {
+		if err := codec.ReconstructData(data); err != nil {
 			return err
 		}
 		for i := 0; i < dataChunks; i++ {
@@ -0,0 +1,431 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/RocFang/hummingbird/middleware"
+	"github.com/justinas/alice"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uber-go/tally"
+	promreporter "github.com/uber-go/tally/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// expirerTask is a single entry from the .expiring_objects queue.
+type expirerTask struct {
+	queueContainer string
+	queueObject    string
+	deleteAt       int64
+	account        string
+	container      string
+	obj            string
+}
+
+// parseExpirerTask splits a queue entry named
+// <delete_at>-<account>/<container>/<obj> into its parts.
+func parseExpirerTask(queueContainer, queueObject string) (*expirerTask, error) {
+	dash := strings.Index(queueObject, "-")
+	if dash < 0 {
+		return nil, fmt.Errorf("invalid expirer entry %q", queueObject)
+	}
+	deleteAt, err := strconv.ParseInt(queueObject[:dash], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expirer entry %q: %v", queueObject, err)
+	}
+	parts := strings.SplitN(queueObject[dash+1:], "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid expirer entry %q", queueObject)
+	}
+	return &expirerTask{
+		queueContainer: queueContainer,
+		queueObject:    queueObject,
+		deleteAt:       deleteAt,
+		account:        parts[0],
+		container:      parts[1],
+		obj:            parts[2],
+	}, nil
+}
+
+// Expirer is the object expirer daemon.  It walks the .expiring_objects
+// queue and deletes objects whose X-Delete-At has passed.  The queue can be
+// split across several expirers with the processes and process settings.
+type Expirer struct {
+	logger         srv.LowLevelLogger
+	logLevel       zap.AtomicLevel
+	bindIp         string
+	port           int
+	certFile       string
+	keyFile        string
+	reconCachePath string
+	interval       time.Duration
+	concurrency    int
+	processes      uint64
+	process        uint64
+	client         common.HTTPClient
+	hClient        client.RequestClient
+	pdc            client.ProxyClient
+	metricsScope   tally.Scope
+	metricsCloser  io.Closer
+	expired        int64
+	failures       int64
+}
+
+func (e *Expirer) Type() string {
+	return "object-expirer"
+}
+
+func (e *Expirer) Background(flags *flag.FlagSet) chan struct{} {
+	once := false
+	if f := flags.Lookup("once"); f != nil {
+		once = f.Value.(flag.Getter).Get() == true
+	}
+	if once {
+		ch := make(chan struct{})
+		go func() {
+			defer close(ch)
+			e.Run()
+		}()
+		return ch
+	}
+	go e.RunForever()
+	return nil
+}
+
+func (e *Expirer) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
+	e.metricsScope, e.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
+		Prefix:         metricsPrefix,
+		Tags:           map[string]string{},
+		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
+		Separator:      promreporter.DefaultSeparator,
+	}, time.Second)
+	commonHandlers := alice.New(
+		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
+		e.LogRequest,
+		middleware.RecoverHandler,
+		middleware.ValidateRequest,
+	)
+	router := srv.NewRouter()
+	router.Get("/metrics", prometheus.Handler())
+	router.Get("/loglevel", e.logLevel)
+	router.Put("/loglevel", e.logLevel)
+	router.Get("/healthcheck", commonHandlers.ThenFunc(e.HealthcheckHandler))
+	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
+	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
+	return alice.New(middleware.Metrics(e.metricsScope)).Then(router)
+}
+
+func (e *Expirer) Finalize() {
+	if e.metricsCloser != nil {
+		e.metricsCloser.Close()
+	}
+	if e.pdc != nil {
+		e.pdc.Close()
+	}
+}
+
+func (e *Expirer) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Length", "2")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte("OK"))
+}
+
+func (e *Expirer) LogRequest(next http.Handler) http.Handler {
+	return srv.LogRequest(e.logger, next)
+}
+
+// ownsTask reports whether this expirer process is responsible for the entry.
+func (e *Expirer) ownsTask(task *expirerTask) bool {
+	if e.processes <= 1 {
+		return true
+	}
+	h := md5.Sum([]byte(task.account + "/" + task.container + "/" + task.obj))
+	return binary.BigEndian.Uint64(h[:8])%e.processes == e.process
+}
+
+type expirerListingRecord struct {
+	Name string `json:"name"`
+}
+
+// listing pages through a JSON account or container listing of the
+// .expiring_objects account, passing each name to f until f returns false.
+func (e *Expirer) listing(container string, f func(name string) bool) error {
+	marker := ""
+	for {
+		options := map[string]string{"format": "json", "marker": marker}
+		var resp *http.Response
+		if container == "" {
+			resp = e.hClient.GetAccountRaw(context.Background(), deleteAtAccount, options, http.Header{})
+		} else {
+			resp = e.hClient.GetContainerRaw(context.Background(), deleteAtAccount, container, options, http.Header{})
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return nil
+		}
+		if resp.StatusCode/100 != 2 {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("listing %s/%s returned %d", deleteAtAccount, container, resp.StatusCode)
+		}
+		var records []expirerListingRecord
+		err := json.NewDecoder(resp.Body).Decode(&records)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("listing %s/%s: %v", deleteAtAccount, container, err)
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		for _, record := range records {
+			if !f(record.Name) {
+				return nil
+			}
+		}
+		marker = records[len(records)-1].Name
+	}
+}
+
+// deleteQueueEntry removes the task's entry from the .expiring_objects
+// container listing on each of the container's nodes.
+func (e *Expirer) deleteQueueEntry(task *expirerTask) bool {
+	containerRing := e.hClient.ContainerRing()
+	partition := containerRing.GetPartition(deleteAtAccount, task.queueContainer, "")
+	successes := uint64(0)
+	for _, node := range containerRing.GetNodes(partition) {
+		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", node.Scheme, node.Ip, node.Port, node.Device, partition,
+			common.Urlencode(deleteAtAccount), common.Urlencode(task.queueContainer), common.Urlencode(task.queueObject))
+		req, err := http.NewRequest("DELETE", url, nil)
+		if err != nil {
+			e.logger.Error("creating expirer queue delete request", zap.Error(err))
+			continue
+		}
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("User-Agent", "object-expirer")
+		resp, err := e.client.Do(req)
+		if err != nil {
+			e.logger.Error("deleting expirer queue entry", zap.String("url", url), zap.Error(err))
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusNotFound {
+			successes++
+		}
+	}
+	return successes >= (containerRing.ReplicaCount()/2)+1
+}
+
+// expire deletes the task's object, as long as it still has the X-Delete-At
+// that was queued, and then removes the queue entry.
+func (e *Expirer) expire(task *expirerTask) {
+	logger := e.logger.With(zap.String("account", task.account), zap.String("container", task.container), zap.String("object", task.obj))
+	headers := http.Header{
+		"X-If-Delete-At": {strconv.FormatInt(task.deleteAt, 10)},
+		"X-Timestamp":    {common.CanonicalTimestamp(float64(task.deleteAt))},
+	}
+	resp := e.hClient.DeleteObject(context.Background(), task.account, task.container, task.obj, headers)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	// A 404 means the object is already gone and a 412 means it has since
+	// been given a different X-Delete-At; either way the entry is done.
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusPreconditionFailed {
+		logger.Error("Error expiring object", zap.Int("status", resp.StatusCode))
+		atomic.AddInt64(&e.failures, 1)
+		e.metricsScope.Counter("failures").Inc(1)
+		return
+	}
+	if !e.deleteQueueEntry(task) {
+		logger.Error("Error removing expirer queue entry", zap.String("entry", task.queueObject))
+		atomic.AddInt64(&e.failures, 1)
+		e.metricsScope.Counter("failures").Inc(1)
+		return
+	}
+	atomic.AddInt64(&e.expired, 1)
+	e.metricsScope.Counter("objects").Inc(1)
+}
+
+// Run a single pass over the .expiring_objects queue.
+func (e *Expirer) Run() {
+	start := time.Now()
+	atomic.StoreInt64(&e.expired, 0)
+	atomic.StoreInt64(&e.failures, 0)
+	e.metricsScope.Counter("passes").Inc(1)
+	now := start.Unix()
+
+	var containers []string
+	if err := e.listing("", func(name string) bool {
+		ts, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			e.logger.Error("Invalid expirer container", zap.String("container", name))
+			return true
+		}
+		if ts > now {
+			return false
+		}
+		containers = append(containers, name)
+		return true
+	}); err != nil {
+		e.logger.Error("Error listing expirer containers", zap.Error(err))
+		return
+	}
+
+	tasks := make(chan *expirerTask, e.concurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < e.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				e.expire(task)
+			}
+		}()
+	}
+	for _, container := range containers {
+		if err := e.listing(container, func(name string) bool {
+			task, err := parseExpirerTask(container, name)
+			if err != nil {
+				e.logger.Error("Skipping expirer entry", zap.String("container", container), zap.Error(err))
+				return true
+			}
+			if task.deleteAt > now {
+				return false
+			}
+			if e.ownsTask(task) {
+				tasks <- task
+			}
+			return true
+		}); err != nil {
+			e.logger.Error("Error listing expirer container", zap.String("container", container), zap.Error(err))
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	// Containers still holding entries, including ones owned by other
+	// processes, refuse the delete with a 409.
+	for _, container := range containers {
+		resp := e.hClient.DeleteContainer(context.Background(), deleteAtAccount, container, http.Header{"X-Timestamp": {common.GetTimestamp()}})
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	expired := atomic.LoadInt64(&e.expired)
+	e.logger.Info("Object expiration pass complete",
+		zap.Int64("expired", expired),
+		zap.Int64("failures", atomic.LoadInt64(&e.failures)),
+		zap.Duration("elapsed", time.Since(start)))
+	if err := middleware.DumpReconCache(e.reconCachePath, "object",
+		map[string]interface{}{
+			"object_expiration_pass": float64(time.Since(start)) / float64(time.Second),
+			"expired_last_pass":      expired,
+		}); err != nil {
+		e.logger.Error("Error saving expirer recon data", zap.Error(err))
+	}
+}
+
+// Run expiration passes in a loop until forever.
+func (e *Expirer) RunForever() {
+	for {
+		start := time.Now()
+		e.Run()
+		if elapsed := time.Since(start); elapsed < e.interval {
+			time.Sleep(e.interval - elapsed)
+		}
+	}
+}
+
+func NewExpirer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader) (ipPort *srv.IpPort, server srv.Server, logger srv.LowLevelLogger, err error) {
+	if !serverconf.HasSection("object-expirer") {
+		return ipPort, nil, nil, fmt.Errorf("Unable to find object-expirer config section")
+	}
+	logLevelString := serverconf.GetDefault("object-expirer", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	certFile := serverconf.GetDefault("object-expirer", "cert_file", "")
+	keyFile := serverconf.GetDefault("object-expirer", "key_file", "")
+	expirer := &Expirer{
+		logLevel:       logLevel,
+		bindIp:         serverconf.GetDefault("object-expirer", "bind_ip", "0.0.0.0"),
+		port:           int(serverconf.GetInt("object-expirer", "bind_port", common.DefaultObjectExpirerPort)),
+		certFile:       certFile,
+		keyFile:        keyFile,
+		reconCachePath: serverconf.GetDefault("object-expirer", "recon_cache_path", "/var/cache/swift"),
+		interval:       time.Duration(serverconf.GetInt("object-expirer", "interval", 300)) * time.Second,
+		concurrency:    int(serverconf.GetInt("object-expirer", "concurrency", 1)),
+		processes:      uint64(serverconf.GetInt("object-expirer", "processes", 0)),
+		process:        uint64(serverconf.GetInt("object-expirer", "process", 0)),
+		metricsScope:   tally.NoopScope,
+	}
+	if expirer.concurrency < 1 {
+		expirer.concurrency = 1
+	}
+	if expirer.processes > 0 && expirer.process >= expirer.processes {
+		return ipPort, nil, nil, fmt.Errorf("object-expirer process %d must be less than processes %d", expirer.process, expirer.processes)
+	}
+	if expirer.logger, err = srv.SetupLogger("object-expirer", &logLevel, flags); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: 100,
+		MaxIdleConns:        0,
+	}
+	if certFile != "" && keyFile != "" {
+		tlsConf, err := common.NewClientTLSConfig(certFile, keyFile)
+		if err != nil {
+			return ipPort, nil, nil, fmt.Errorf("Error getting TLS config: %v", err)
+		}
+		transport.TLSClientConfig = tlsConf
+		if err = http2.ConfigureTransport(transport); err != nil {
+			return ipPort, nil, nil, fmt.Errorf("Error setting up http2: %v", err)
+		}
+	}
+	expirer.client = &http.Client{
+		Timeout:   time.Second * 60,
+		Transport: transport,
+	}
+	policies, err := cnf.GetPolicies()
+	if err != nil {
+		return ipPort, nil, nil, err
+	}
+	if expirer.pdc, err = client.NewProxyClient(policies, cnf, expirer.logger, certFile, keyFile, "", "", "", serverconf); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Could not make client: %v", err)
+	}
+	expirer.hClient = expirer.pdc.NewRequestClient(nil, nil, expirer.logger)
+	expirer.hClient.SetUserAgent("object-expirer")
+	ipPort = &srv.IpPort{Ip: expirer.bindIp, Port: expirer.port, CertFile: certFile, KeyFile: keyFile}
+	return ipPort, expirer, expirer.logger, nil
+}
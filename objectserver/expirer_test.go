@@ -0,0 +1,182 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common/ring"
+	"github.com/RocFang/hummingbird/common/test"
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/nectar/nectarutil"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+type expirerTestClient struct {
+	client.RequestClient
+	sync.Mutex
+	listings      map[string][]string
+	statuses      map[string]int
+	deleted       map[string]http.Header
+	containerRing ring.Ring
+}
+
+func (c *expirerTestClient) listing(key string, options map[string]string) *http.Response {
+	records := []expirerListingRecord{}
+	for _, name := range c.listings[key] {
+		if name > options["marker"] {
+			records = append(records, expirerListingRecord{Name: name})
+		}
+	}
+	body, _ := json.Marshal(records)
+	return nectarutil.ResponseStub(http.StatusOK, string(body))
+}
+
+func (c *expirerTestClient) GetAccountRaw(ctx context.Context, account string, options map[string]string, headers http.Header) *http.Response {
+	return c.listing(account, options)
+}
+
+func (c *expirerTestClient) GetContainerRaw(ctx context.Context, account string, container string, options map[string]string, headers http.Header) *http.Response {
+	return c.listing(account+"/"+container, options)
+}
+
+func (c *expirerTestClient) DeleteObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response {
+	c.Lock()
+	defer c.Unlock()
+	path := account + "/" + container + "/" + obj
+	c.deleted[path] = headers
+	if status, ok := c.statuses[path]; ok {
+		return nectarutil.ResponseStub(status, "")
+	}
+	return nectarutil.ResponseStub(http.StatusNoContent, "")
+}
+
+func (c *expirerTestClient) DeleteContainer(ctx context.Context, account string, container string, headers http.Header) *http.Response {
+	return nectarutil.ResponseStub(http.StatusConflict, "")
+}
+
+func (c *expirerTestClient) ContainerRing() ring.Ring {
+	return c.containerRing
+}
+
+func TestParseExpirerTask(t *testing.T) {
+	task, err := parseExpirerTask("1434671963", "1434707411-a/c/o/with/slashes")
+	require.Nil(t, err)
+	require.Equal(t, int64(1434707411), task.deleteAt)
+	require.Equal(t, "a", task.account)
+	require.Equal(t, "c", task.container)
+	require.Equal(t, "o/with/slashes", task.obj)
+	require.Equal(t, "1434671963", task.queueContainer)
+
+	_, err = parseExpirerTask("1434671963", "1434707411")
+	require.NotNil(t, err)
+	_, err = parseExpirerTask("1434671963", "abc-a/c/o")
+	require.NotNil(t, err)
+	_, err = parseExpirerTask("1434671963", "1434707411-a/c")
+	require.NotNil(t, err)
+}
+
+func TestExpirerOwnsTask(t *testing.T) {
+	e := &Expirer{processes: 3}
+	for i := 0; i < 100; i++ {
+		task := &expirerTask{account: "a", container: "c", obj: strconv.Itoa(i)}
+		owners := 0
+		for e.process = 0; e.process < e.processes; e.process++ {
+			if e.ownsTask(task) {
+				owners++
+			}
+		}
+		require.Equal(t, 1, owners)
+	}
+	e.processes = 0
+	require.True(t, e.ownsTask(&expirerTask{account: "a", container: "c", obj: "o"}))
+}
+
+func TestExpirerRun(t *testing.T) {
+	var lock sync.Mutex
+	queueDeletes := []string{}
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		queueDeletes = append(queueDeletes, r.Method+" "+r.URL.Path)
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer cs.Close()
+	u, err := url.Parse(cs.URL)
+	require.Nil(t, err)
+	host, ports, err := net.SplitHostPort(u.Host)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(ports)
+	require.Nil(t, err)
+	containerRing := &test.FakeRing{}
+	for i := 0; i < 3; i++ {
+		containerRing.MockDevices = append(containerRing.MockDevices, &ring.Device{Id: i, Device: "sda", Scheme: "http", Ip: host, Port: port})
+	}
+
+	reconDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	hClient := &expirerTestClient{
+		listings: map[string][]string{
+			".expiring_objects":            {"0000000100", "9999999999"},
+			".expiring_objects/0000000100": {"0000000150-a/c/o1", "0000000160-a/c/o2", "0000000170-a/c/o3", "9999999999-a/c/o4"},
+		},
+		statuses: map[string]int{
+			"a/c/o2": http.StatusPreconditionFailed,
+			"a/c/o3": http.StatusServiceUnavailable,
+		},
+		deleted:       map[string]http.Header{},
+		containerRing: containerRing,
+	}
+	e := &Expirer{
+		logger:         zap.NewNop(),
+		reconCachePath: reconDir,
+		concurrency:    2,
+		client:         http.DefaultClient,
+		hClient:        hClient,
+		metricsScope:   tally.NoopScope,
+	}
+	e.Run()
+
+	require.Equal(t, 3, len(hClient.deleted))
+	require.Equal(t, "150", hClient.deleted["a/c/o1"].Get("X-If-Delete-At"))
+	require.Equal(t, "0000000150.00000", hClient.deleted["a/c/o1"].Get("X-Timestamp"))
+	require.Nil(t, hClient.deleted["a/c/o4"])
+	require.Equal(t, int64(2), e.expired)
+	require.Equal(t, int64(1), e.failures)
+	require.Equal(t, 6, len(queueDeletes))
+	for _, d := range queueDeletes {
+		require.NotContains(t, d, "o3")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(reconDir, "object.recon"))
+	require.Nil(t, err)
+	recon := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(data, &recon))
+	require.Equal(t, float64(2), recon["expired_last_pass"])
+	require.NotNil(t, recon["object_expiration_pass"])
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/RocFang/hummingbird/common"
@@ -40,14 +41,17 @@ type IndexDBItem struct {
 	ShardHash   string
 	Restabilize bool
 	Expires     *int64
+	Inline      bool
+	inline      []byte
 }
 
 // IndexDB will track a set of objects.
 //
-// This is the "index.db" per disk. Right now it just handles whole objects,
-// but eventually we'd like to add either slab support or direct database
-// embedding for small objects. But, those details should be transparent from
-// users of a IndexDB.
+// This is the "index.db" per disk. Objects are normally stored as whole
+// object files, but objects no larger than the inline threshold are embedded
+// directly in the database to save an inode and a seek per object. Those
+// details are transparent to users of a IndexDB, as long as they read object
+// content through Open and Stat rather than the item's Path.
 //
 // This is different from the standard Swift full replica object tracking in
 // that the directory structure is much shallower, there are a configurable
@@ -62,13 +66,17 @@ type IndexDBItem struct {
 // A given IndexDB may not even store any metadata, such as in an EC
 // system, with just "key" IndexDBs storing the metadata.
 type IndexDB struct {
+	// ringPartPower is first for 64-bit alignment; it's changed by
+	// SetRingPartPower while requests are using it, so it's only read with
+	// RingPartPower.
+	ringPartPower uint64
 	dbpath        string
 	filepath      string
-	RingPartPower uint // GLH: Temp exported for fakelist
 	dbPartPower   uint
 	subdirs       int
 	temppath      string
 	reserve       int64
+	inline        int64
 	dbs           []*sql.DB
 	logger        srv.LowLevelLogger
 	auditor       IndexDBAuditor
@@ -80,8 +88,9 @@ type IndexDB struct {
 // the dbPartPower. The dbPartPower will define how many
 // databases are created (e.g. dbPartPower = 6 gives 64 databases). The
 // subdirs value will define how many subdirectories are created where object
-// content files are placed.
-func NewIndexDB(dbpath, filepath, temppath string, ringPartPower, dbPartPower, subdirs int, reserve int64, logger srv.LowLevelLogger, auditor IndexDBAuditor) (*IndexDB, error) {
+// content files are placed. Objects whose expected size is no more than
+// inlineThreshold bytes are stored in the database itself; 0 disables that.
+func NewIndexDB(dbpath, filepath, temppath string, ringPartPower, dbPartPower, subdirs int, reserve, inlineThreshold int64, logger srv.LowLevelLogger, auditor IndexDBAuditor) (*IndexDB, error) {
 	if ringPartPower <= dbPartPower {
 		return nil, fmt.Errorf("ringPartPower must be greater than dbPartPower: %d is not greater than %d", ringPartPower, dbPartPower)
 	}
@@ -92,12 +101,13 @@ func NewIndexDB(dbpath, filepath, temppath string, ringPartPower, dbPartPower, s
 		dbpath:        dbpath,
 		filepath:      filepath,
 		temppath:      temppath,
-		RingPartPower: uint(ringPartPower),
+		ringPartPower: uint64(ringPartPower),
 		dbPartPower:   uint(dbPartPower),
 		subdirs:       subdirs,
 		dbs:           make([]*sql.DB, 1<<uint(dbPartPower)),
 		logger:        logger,
 		reserve:       reserve,
+		inline:        inlineThreshold,
 		auditor:       auditor,
 	}
 	err := os.MkdirAll(ot.dbpath, 0700)
@@ -138,6 +148,22 @@ func NewIndexDB(dbpath, filepath, temppath string, ringPartPower, dbPartPower, s
 	return ot, nil
 }
 
+// SetRingPartPower updates the ring part power after a partition power
+// increase. Objects are stored by hash alone, so nothing on disk has to move;
+// only the partition ranges change.
+func (ot *IndexDB) SetRingPartPower(ringPartPower int) error {
+	if ringPartPower <= int(ot.dbPartPower) {
+		return fmt.Errorf("ringPartPower must be greater than dbPartPower: %d is not greater than %d", ringPartPower, ot.dbPartPower)
+	}
+	atomic.StoreUint64(&ot.ringPartPower, uint64(ringPartPower))
+	return nil
+}
+
+// RingPartPower returns the part power of the ring in use.
+func (ot *IndexDB) RingPartPower() uint {
+	return uint(atomic.LoadUint64(&ot.ringPartPower))
+}
+
 func (ot *IndexDB) init(dbi int) error {
 	db := ot.dbs[dbi]
 	if _, err := db.Exec(`
@@ -166,6 +192,7 @@ func (ot *IndexDB) init(dbi int) error {
 			shardhash TEXT, -- NULLable because not every object is a shard
 			restabilize BOOLEAN NOT NULL,
 			expires INTEGER DEFAULT NULL,
+			inline BLOB DEFAULT NULL, -- NULL unless the content is embedded
 			CONSTRAINT ix_objects_hash_shard_timestamp PRIMARY KEY (hash, shard, timestamp, nursery)
 		) WITHOUT ROWID;
 	`)
@@ -178,6 +205,15 @@ func (ot *IndexDB) init(dbi int) error {
 	if _, err = tx.Exec("CREATE INDEX IF NOT EXISTS ix_object_expires ON objects(expires) WHERE expires IS NOT NULL"); err != nil {
 		return err
 	}
+	var hasInline bool
+	if err = tx.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('objects') WHERE name = 'inline'").Scan(&hasInline); err != nil {
+		return err
+	}
+	if !hasInline {
+		if _, err = tx.Exec("ALTER TABLE objects ADD COLUMN inline BLOB DEFAULT NULL"); err != nil {
+			return err
+		}
+	}
 	return tx.Commit()
 }
 
@@ -205,6 +241,9 @@ func (ot *IndexDB) TempFile(hsh string, shard int, timestamp int64, sizeHint int
 			if err != nil {
 				return nil, err
 			}
+			if err = ot.loadInline(item); err != nil {
+				return nil, err
+			}
 			if _, err = ot.auditor.AuditItem(itemPath, item, 0); err != nil {
 				if qerr := QuarantineItem(ot, item); qerr != nil {
 					return nil, qerr
@@ -218,6 +257,9 @@ func (ot *IndexDB) TempFile(hsh string, shard int, timestamp int64, sizeHint int
 	if err != nil {
 		return nil, err
 	}
+	if sizeHint >= 0 && sizeHint <= ot.inline {
+		return &inlineWriter{limit: ot.inline, temppath: ot.temppath, dir: dir}, nil
+	}
 	afw, err := fs.NewAtomicFileWriter(ot.temppath, dir)
 	if err != nil {
 		return nil, err
@@ -239,7 +281,7 @@ func (ot *IndexDB) TempFile(hsh string, shard int, timestamp int64, sizeHint int
 // Timestamp is the timestamp for the object contents, not necessarily the
 // metadata.
 func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestamp int64, method string, metadata map[string]string, nursery bool, shardhash string) error {
-	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower(), ot.dbPartPower, ot.subdirs)
 	if err != nil {
 		return err
 	}
@@ -258,7 +300,11 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 		}
 	}
 
-	if f != nil {
+	var inline []byte
+	if iw, ok := f.(*inlineWriter); ok {
+		inline = iw.inlined()
+	}
+	if f != nil && inline == nil {
 		if err = f.Sync(); err != nil {
 			return err
 		}
@@ -287,7 +333,7 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 	}
 	deletion := method == "DELETE"
 	rows, err = tx.Query(`
-        SELECT timestamp, metahash, metadata, shardhash
+        SELECT timestamp, metahash, metadata, shardhash, inline IS NOT NULL
         FROM objects
         WHERE hash = ? AND shard = ? AND nursery = ?
         ORDER BY timestamp DESC
@@ -297,6 +343,7 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 	}
 	var dbWholeObjectPath string
 	var dbTimestamp int64
+	var dbInline bool
 	if !rows.Next() {
 		rows.Close()
 		if err = rows.Err(); err != nil {
@@ -308,7 +355,7 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 	} else {
 		var dbMetahash, dbShardHash string
 		var dbMetadata []byte
-		if err = rows.Scan(&dbTimestamp, &dbMetahash, &dbMetadata, &dbShardHash); err != nil {
+		if err = rows.Scan(&dbTimestamp, &dbMetahash, &dbMetadata, &dbShardHash, &dbInline); err != nil {
 			return err
 		}
 		if f == nil && !deletion {
@@ -378,13 +425,14 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 	restabilize := false
 	if dbWholeObjectPath == "" {
 		_, err = tx.Exec(`
-            INSERT INTO objects (hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-        `, hsh, shard, timestamp, deletion, metahash, metabytes, nursery, shardhash, restabilize, expires)
-	} else {
+            INSERT INTO objects (hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires, inline)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `, hsh, shard, timestamp, deletion, metahash, metabytes, nursery, shardhash, restabilize, expires, inline)
+	} else if f == nil && !deletion {
 		if !nursery && method == "POST" {
 			restabilize = true
 		}
+		// Just new metadata; the content, inline or not, stays as it is.
 		_, err = tx.Exec(`
             UPDATE objects
             SET timestamp = ?, deletion = ?, metahash = ?, metadata = ?, nursery = ?, shardhash = ?, restabilize = ?, expires = ?
@@ -393,8 +441,17 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 		if err != nil {
 			return err
 		}
+	} else {
+		_, err = tx.Exec(`
+            UPDATE objects
+            SET timestamp = ?, deletion = ?, metahash = ?, metadata = ?, nursery = ?, shardhash = ?, restabilize = ?, expires = ?, inline = ?
+            WHERE hash = ? AND shard = ? AND nursery = ?
+        `, timestamp, deletion, metahash, metabytes, nursery, shardhash, restabilize, expires, inline, hsh, shard, nursery)
+		if err != nil {
+			return err
+		}
 	}
-	if f != nil {
+	if f != nil && inline == nil {
 		if err = f.Finalize(pth); err != nil {
 			return err
 		}
@@ -402,7 +459,7 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 	if err == nil {
 		err = tx.Commit()
 	}
-	if err == nil && dbWholeObjectPath != "" && (f != nil || deletion) && timestamp > dbTimestamp {
+	if err == nil && dbWholeObjectPath != "" && !dbInline && (f != nil || deletion) && timestamp > dbTimestamp {
 		if err2 := os.Remove(dbWholeObjectPath); err2 != nil {
 			ot.logger.Error(
 				"error removing older file",
@@ -415,7 +472,7 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 }
 
 func (ot *IndexDB) SetStabilized(hsh string, shard int, timestamp int64, stabilizePath bool) error {
-	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower(), ot.dbPartPower, ot.subdirs)
 	if err != nil {
 		return err
 	}
@@ -432,7 +489,14 @@ func (ot *IndexDB) SetStabilized(hsh string, shard int, timestamp int64, stabili
 	if err != nil {
 		return err
 	}
-	if stabilizePath {
+	var inline bool
+	if err = tx.QueryRow(`
+		SELECT COUNT(*) > 0 FROM objects
+		WHERE hash = ? AND shard = ? AND timestamp = ? AND inline IS NOT NULL
+		`, hsh, shard, timestamp).Scan(&inline); err != nil {
+		return err
+	}
+	if stabilizePath && !inline {
 		var wasPath, toPath string
 		if wasPath, err = ot.WholeObjectPath(hsh, shard, timestamp, true); err == nil {
 			if toPath, err = ot.WholeObjectPath(hsh, shard, timestamp, false); err == nil {
@@ -447,7 +511,7 @@ func (ot *IndexDB) SetStabilized(hsh string, shard int, timestamp int64, stabili
 }
 
 func (ot *IndexDB) wholeObjectDir(hsh string) (string, error) {
-	hsh, _, _, dirNm, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	hsh, _, _, dirNm, err := ValidateHash(hsh, ot.RingPartPower(), ot.dbPartPower, ot.subdirs)
 	if err != nil {
 		return "", err
 	}
@@ -455,7 +519,7 @@ func (ot *IndexDB) wholeObjectDir(hsh string) (string, error) {
 }
 
 func (ot *IndexDB) WholeObjectPath(hsh string, shard int, timestamp int64, nursery bool) (string, error) {
-	hsh, _, _, dirNm, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	hsh, _, _, dirNm, err := ValidateHash(hsh, ot.RingPartPower(), ot.dbPartPower, ot.subdirs)
 	if err != nil {
 		return "", err
 	}
@@ -467,11 +531,18 @@ func (ot *IndexDB) WholeObjectPath(hsh string, shard int, timestamp int64, nurse
 
 // Remove removes an entry from the database and its backing disk file.
 func (ot *IndexDB) Remove(hsh string, shard int, timestamp int64, nursery bool, metahash string) (int64, error) {
-	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower(), ot.dbPartPower, ot.subdirs)
 	if err != nil {
 		return 0, err
 	}
 	db := ot.dbs[dbPart]
+	var inline bool
+	if err = db.QueryRow(`
+        SELECT COUNT(*) > 0 FROM objects
+        WHERE hash = ? AND shard = ? AND timestamp = ? AND nursery = ? AND metahash = ? AND inline IS NOT NULL
+    `, hsh, shard, timestamp, nursery, metahash).Scan(&inline); err != nil {
+		return 0, err
+	}
 	res, err := db.Exec(`
         DELETE
 		FROM objects
@@ -481,7 +552,7 @@ func (ot *IndexDB) Remove(hsh string, shard int, timestamp int64, nursery bool,
 		return 0, err
 	}
 	af := int64(0)
-	if af, err = res.RowsAffected(); err == nil && af > 0 {
+	if af, err = res.RowsAffected(); err == nil && af > 0 && !inline {
 		path, err := ot.WholeObjectPath(hsh, shard, timestamp, nursery)
 		if err != nil {
 			return af, err
@@ -499,7 +570,7 @@ func (ot *IndexDB) Remove(hsh string, shard int, timestamp int64, nursery bool,
 // NOTE: if justStable is true then you must specify shard. TODO: is this kinda weird?
 func (ot *IndexDB) Lookup(hsh string, shard int, justStable bool) (*IndexDBItem, error) {
 	var err error
-	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower(), ot.dbPartPower, ot.subdirs)
 	if err != nil {
 		return nil, err
 	}
@@ -507,14 +578,14 @@ func (ot *IndexDB) Lookup(hsh string, shard int, justStable bool) (*IndexDBItem,
 	var rows *sql.Rows
 	if justStable {
 		rows, err = db.Query(`
-			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires
+			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires, inline IS NOT NULL, inline
 			FROM objects
 			WHERE hash = ? AND shard = ? AND nursery = 0
 			LIMIT 1
 		`, hsh, shard)
 	} else if shard == shardAny {
 		rows, err = db.Query(`
-			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires
+			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires, inline IS NOT NULL, inline
 			FROM objects
 			WHERE hash = ? AND metadata IS NOT NULL
 			ORDER BY nursery DESC, shard ASC
@@ -522,7 +593,7 @@ func (ot *IndexDB) Lookup(hsh string, shard int, justStable bool) (*IndexDBItem,
 		`, hsh)
 	} else {
 		rows, err = db.Query(`
-			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires
+			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires, inline IS NOT NULL, inline
 			FROM objects
 			WHERE hash = ? AND shard = ?
 			ORDER BY nursery DESC
@@ -538,20 +609,74 @@ func (ot *IndexDB) Lookup(hsh string, shard int, justStable bool) (*IndexDBItem,
 	}
 	item := &IndexDBItem{Hash: hsh}
 	if err = rows.Scan(&item.Timestamp, &item.Deletion, &item.Metahash,
-		&item.Metabytes, &item.Nursery, &item.Shard, &item.ShardHash, &item.Restabilize, &item.Expires); err != nil {
+		&item.Metabytes, &item.Nursery, &item.Shard, &item.ShardHash, &item.Restabilize, &item.Expires, &item.Inline, &item.inline); err != nil {
 		return nil, err
 	}
 	item.Path, err = ot.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery)
 	return item, err
 }
 
+// loadInline fetches the embedded content for an inline item that came from a
+// listing, which only flags items as inline.
+func (ot *IndexDB) loadInline(item *IndexDBItem) error {
+	if !item.Inline || item.inline != nil {
+		return nil
+	}
+	hsh, _, dbPart, _, err := ValidateHash(item.Hash, ot.RingPartPower(), ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return err
+	}
+	err = ot.dbs[dbPart].QueryRow(`
+		SELECT inline
+		FROM objects
+		WHERE hash = ? AND shard = ? AND timestamp = ? AND nursery = ? AND inline IS NOT NULL
+	`, hsh, item.Shard, item.Timestamp, item.Nursery).Scan(&item.inline)
+	if err == sql.ErrNoRows {
+		pth, _ := ot.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery)
+		return &os.PathError{Op: "open", Path: pth, Err: os.ErrNotExist}
+	}
+	return err
+}
+
+func (ot *IndexDB) itemPath(item *IndexDBItem) (string, error) {
+	if item.Path != "" {
+		return item.Path, nil
+	}
+	return ot.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery)
+}
+
+// Open returns the content of the item, wherever it is stored.
+func (ot *IndexDB) Open(item *IndexDBItem) (IndexDBFile, error) {
+	if err := ot.loadInline(item); err != nil {
+		return nil, err
+	}
+	pth, err := ot.itemPath(item)
+	if err != nil {
+		return nil, err
+	}
+	return openItem(pth, item)
+}
+
+// Stat returns the file information for the content of the item, wherever it
+// is stored.
+func (ot *IndexDB) Stat(item *IndexDBItem) (os.FileInfo, error) {
+	if err := ot.loadInline(item); err != nil {
+		return nil, err
+	}
+	pth, err := ot.itemPath(item)
+	if err != nil {
+		return nil, err
+	}
+	return statItem(pth, item)
+}
+
 // ListObjectsToStabilize lists oldest objects in the nursery, it will be limited to numStabilizeObjects * # index.db's
 func (ot *IndexDB) ListObjectsToStabilize() ([]*IndexDBItem, error) {
 	listing := []*IndexDBItem{}
 	for _, db := range ot.dbs {
 		if err := func() error {
 			rows, err := db.Query(`
-				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, restabilize, expires
+				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, restabilize, expires, inline IS NOT NULL
 				FROM objects
 				WHERE nursery = 1 OR restabilize = 1
                 ORDER BY timestamp LIMIT ?`, numStabilizeObjects)
@@ -562,7 +687,7 @@ func (ot *IndexDB) ListObjectsToStabilize() ([]*IndexDBItem, error) {
 			for rows.Next() {
 				item := &IndexDBItem{}
 				if err = rows.Scan(&item.Hash, &item.Shard, &item.Timestamp, &item.Deletion, &item.Metahash,
-					&item.Metabytes, &item.Nursery, &item.Restabilize, &item.Expires); err != nil {
+					&item.Metabytes, &item.Nursery, &item.Restabilize, &item.Expires, &item.Inline); err != nil {
 					return err
 				}
 				item.Path, err = ot.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery)
@@ -591,11 +716,11 @@ func (ot *IndexDB) List(startHash, stopHash, marker string, limit int) ([]*Index
 	if stopHash == "" {
 		stopHash = "ffffffffffffffffffffffffffffffff"
 	}
-	_, _, startDBPart, _, err := ValidateHash(startHash, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	_, _, startDBPart, _, err := ValidateHash(startHash, ot.RingPartPower(), ot.dbPartPower, ot.subdirs)
 	if err != nil {
 		return nil, err
 	}
-	_, _, stopDBPart, _, err := ValidateHash(stopHash, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	_, _, stopDBPart, _, err := ValidateHash(stopHash, ot.RingPartPower(), ot.dbPartPower, ot.subdirs)
 	if err != nil {
 		return nil, err
 	}
@@ -605,7 +730,7 @@ func (ot *IndexDB) List(startHash, stopHash, marker string, limit int) ([]*Index
 		var rows *sql.Rows
 		if limit > 0 {
 			rows, err = db.Query(`
-				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires
+				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires, inline IS NOT NULL
 			FROM objects
 			WHERE hash BETWEEN ? AND ? AND hash > ?
 			ORDER BY hash
@@ -613,7 +738,7 @@ func (ot *IndexDB) List(startHash, stopHash, marker string, limit int) ([]*Index
 		    `, startHash, stopHash, marker, limit)
 		} else {
 			rows, err = db.Query(`
-				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires
+				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires, inline IS NOT NULL
 			FROM objects
 			WHERE hash BETWEEN ? AND ? AND hash > ?
 			ORDER BY hash
@@ -626,7 +751,7 @@ func (ot *IndexDB) List(startHash, stopHash, marker string, limit int) ([]*Index
 		for rows.Next() {
 			item := &IndexDBItem{}
 			if err = rows.Scan(&item.Hash, &item.Shard, &item.Timestamp, &item.Deletion, &item.Metahash,
-				&item.Metabytes, &item.Nursery, &item.ShardHash, &item.Restabilize, &item.Expires); err != nil {
+				&item.Metabytes, &item.Nursery, &item.ShardHash, &item.Restabilize, &item.Expires, &item.Inline); err != nil {
 				return listing, err
 			}
 			listing = append(listing, item)
@@ -710,8 +835,9 @@ func ValidateHash(hsh string, ringPartPower, dbPartPower uint, subdirs int) (hsh
 }
 
 func (ot *IndexDB) RingPartRange(ringPart int) (string, string) {
-	start := uint64(ringPart << (64 - ot.RingPartPower))
-	stop := uint64((ringPart+1)<<(64-ot.RingPartPower)) - 1
+	ringPartPower := ot.RingPartPower()
+	start := uint64(ringPart << (64 - ringPartPower))
+	stop := uint64((ringPart+1)<<(64-ringPartPower)) - 1
 	return fmt.Sprintf("%016x0000000000000000", start), fmt.Sprintf("%016xffffffffffffffff", stop)
 }
 
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,7 +32,7 @@ func md5hash(data string) string {
 
 func newTestIndexDB(t *testing.T, pth string) *IndexDB {
 	t.Helper()
-	ot, err := NewIndexDB(pth, pth, pth, 2, 1, 1, 0, zap.L(), fakeIndexDBAuditor{})
+	ot, err := NewIndexDB(pth, pth, pth, 2, 1, 1, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	errnil(t, err)
 	return ot
 }
@@ -335,13 +336,13 @@ func TestIndexDB_List(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if hshb[0]>>(8-ot.RingPartPower) == 0 {
+		if hshb[0]>>(8-ot.RingPartPower()) == 0 {
 			matchHashes0_0[hsh] = struct{}{}
 		}
-		if hshb[0]>>(8-ot.RingPartPower) == 0 {
+		if hshb[0]>>(8-ot.RingPartPower()) == 0 {
 			matchHashes0_1[hsh] = struct{}{}
 		}
-		if hshb[0]>>(8-ot.RingPartPower) == 1 {
+		if hshb[0]>>(8-ot.RingPartPower()) == 1 {
 			matchHashes1_1[hsh] = struct{}{}
 		}
 		timestamp := time.Now().UnixNano()
@@ -578,7 +579,7 @@ func TestIndexDB_ListDefaults(t *testing.T) {
 func TestIndexDB_RingPartRange(t *testing.T) {
 	pth, _ := ioutil.TempDir("", "")
 	defer os.RemoveAll(pth)
-	ot, err := NewIndexDB(pth, pth, pth, 4, 1, 1, 0, zap.L(), fakeIndexDBAuditor{})
+	ot, err := NewIndexDB(pth, pth, pth, 4, 1, 1, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	errnil(t, err)
 	defer ot.Close()
 	startHash, stopHash := ot.RingPartRange(0)
@@ -602,7 +603,7 @@ func TestIndexDB_RingPartRange(t *testing.T) {
 	if stopHash != "ffffffffffffffffffffffffffffffff" {
 		t.Fatal(stopHash)
 	}
-	ot, err = NewIndexDB(pth, pth, pth, 8, 1, 1, 0, zap.L(), fakeIndexDBAuditor{})
+	ot, err = NewIndexDB(pth, pth, pth, 8, 1, 1, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	errnil(t, err)
 	defer ot.Close()
 	startHash, stopHash = ot.RingPartRange(0)
@@ -628,6 +629,34 @@ func TestIndexDB_RingPartRange(t *testing.T) {
 	}
 }
 
+func TestIndexDB_SetRingPartPower(t *testing.T) {
+	pth, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth)
+	ot, err := NewIndexDB(pth, pth, pth, 4, 1, 1, 0, 0, zap.L(), fakeIndexDBAuditor{})
+	errnil(t, err)
+	defer ot.Close()
+	if err = ot.SetRingPartPower(1); err == nil {
+		t.Fatal("part power not greater than the db part power accepted")
+	}
+	// Requests keep using the IndexDB while the part power changes.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ot.RingPartRange(0)
+		}
+	}()
+	errnil(t, ot.SetRingPartPower(5))
+	<-done
+	if ot.RingPartPower() != 5 {
+		t.Fatal(ot.RingPartPower())
+	}
+	_, stopHash := ot.RingPartRange(0)
+	if stopHash != "07ffffffffffffffffffffffffffffff" {
+		t.Fatal(stopHash)
+	}
+}
+
 func TestIndexDB_Expire(t *testing.T) {
 	pth, _ := ioutil.TempDir("", "")
 	defer os.RemoveAll(pth)
@@ -661,3 +690,64 @@ func TestIndexDB_Expire(t *testing.T) {
 	require.Nil(t, err)
 	require.False(t, fs.Exists(path))
 }
+
+func TestIndexDB_CommitInline(t *testing.T) {
+	pth, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth)
+	ot, err := NewIndexDB(pth, pth, pth, 2, 1, 1, 0, 64, zap.L(), fakeIndexDBAuditor{})
+	errnil(t, err)
+	defer ot.Close()
+	hsh := md5hash("object1")
+	timestamp := time.Now().UnixNano()
+	body := "just testing"
+	f, err := ot.TempFile(hsh, 0, timestamp, int64(len(body)), true)
+	errnil(t, err)
+	f.Write([]byte(body))
+	errnil(t, ot.Commit(f, hsh, 0, timestamp, "PUT", map[string]string{"Content-Length": "12"}, true, ""))
+	wholePath, err := ot.WholeObjectPath(hsh, 0, timestamp, true)
+	errnil(t, err)
+	_, err = os.Stat(wholePath)
+	require.True(t, os.IsNotExist(err))
+
+	item, err := ot.Lookup(hsh, 0, false)
+	errnil(t, err)
+	require.True(t, item.Inline)
+	fi, err := ot.Stat(item)
+	errnil(t, err)
+	require.Equal(t, int64(len(body)), fi.Size())
+	fl, err := ot.Open(item)
+	errnil(t, err)
+	data, err := ioutil.ReadAll(fl)
+	errnil(t, err)
+	require.Equal(t, body, string(data))
+
+	// Listings only flag inline items; Open loads the content.
+	items, err := ot.List("", "", "", 0)
+	errnil(t, err)
+	require.Equal(t, 1, len(items))
+	require.True(t, items[0].Inline)
+	fl, err = ot.Open(items[0])
+	errnil(t, err)
+	data, err = ioutil.ReadAll(fl)
+	errnil(t, err)
+	require.Equal(t, body, string(data))
+
+	// New metadata keeps the inline content.
+	errnil(t, ot.Commit(nil, hsh, 0, timestamp+1, "POST", map[string]string{"X-Object-Meta-Color": "blue"}, true, ""))
+	item, err = ot.Lookup(hsh, 0, false)
+	errnil(t, err)
+	require.True(t, item.Inline)
+
+	// A larger overwrite goes to a whole object file.
+	body = strings.Repeat("x", 100)
+	f, err = ot.TempFile(hsh, 0, timestamp+2, int64(len(body)), true)
+	errnil(t, err)
+	f.Write([]byte(body))
+	errnil(t, ot.Commit(f, hsh, 0, timestamp+2, "PUT", map[string]string{"Content-Length": "100"}, true, ""))
+	item, err = ot.Lookup(hsh, 0, false)
+	errnil(t, err)
+	require.False(t, item.Inline)
+	fi, err = os.Stat(item.Path)
+	errnil(t, err)
+	require.Equal(t, int64(len(body)), fi.Size())
+}
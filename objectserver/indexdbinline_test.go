@@ -0,0 +1,53 @@
+package objectserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInlineWriter(t *testing.T) {
+	pth, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth)
+	w := &inlineWriter{limit: 10, temppath: pth, dir: pth}
+	w.Write([]byte("hello"))
+	require.Equal(t, "hello", string(w.inlined()))
+	require.Nil(t, w.Sync())
+
+	// Going past the limit spills to a regular file.
+	w.Write([]byte(strings.Repeat("x", 10)))
+	require.Nil(t, w.inlined())
+	dst := filepath.Join(pth, "dst")
+	require.Nil(t, w.Finalize(dst))
+	data, err := ioutil.ReadFile(dst)
+	require.Nil(t, err)
+	require.Equal(t, "hello"+strings.Repeat("x", 10), string(data))
+
+	w = &inlineWriter{limit: 10, temppath: pth, dir: pth}
+	require.NotNil(t, w.inlined())
+	require.Equal(t, 0, len(w.inlined()))
+}
+
+func TestOpenInlineItem(t *testing.T) {
+	item := &IndexDBItem{Inline: true, inline: []byte("hello world"), Timestamp: 1400000000000000000}
+	fi, err := statItem("/nonexistent/thing", item)
+	require.Nil(t, err)
+	require.Equal(t, int64(11), fi.Size())
+	require.Equal(t, "thing", fi.Name())
+	require.True(t, fi.Mode().IsRegular())
+	f, err := openItem("/nonexistent/thing", item)
+	require.Nil(t, err)
+	_, err = f.Seek(6, os.SEEK_SET)
+	require.Nil(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.Nil(t, err)
+	require.Equal(t, "world", string(data))
+	require.Nil(t, f.Close())
+
+	_, err = statItem("/nonexistent/thing", &IndexDBItem{Inline: true})
+	require.True(t, os.IsNotExist(err))
+}
@@ -35,6 +35,7 @@ import (
 	"github.com/RocFang/hummingbird/common"
 	"github.com/RocFang/hummingbird/common/conf"
 	"github.com/RocFang/hummingbird/common/fs"
+	"github.com/RocFang/hummingbird/common/ring"
 	"github.com/RocFang/hummingbird/common/srv"
 	"github.com/RocFang/hummingbird/common/tracing"
 	"github.com/RocFang/hummingbird/middleware"
@@ -53,6 +54,8 @@ type ObjectServer struct {
 	hashPathSuffix     string
 	reconCachePath     string
 	checkEtags         bool
+	checksums          []string
+	listingMeta        bool
 	checkMounts        bool
 	allowedHeaders     map[string]bool
 	logger             srv.LowLevelLogger
@@ -60,6 +63,7 @@ type ObjectServer struct {
 	diskInUse          *common.KeyedLimit
 	accountDiskInUse   *common.KeyedLimit
 	expiringDivisor    int64
+	containerRing      ring.Ring
 	updateClient       common.HTTPClient
 	objEngines         map[int]ObjectEngine
 	updateTimeout      time.Duration
@@ -100,7 +104,11 @@ func (server *ObjectServer) newObject(req *http.Request, vars map[string]string,
 	if !ok {
 		return nil, fmt.Errorf("Engine for policy index %d not found.", policy)
 	}
-	return engine.New(vars, needData, &server.asyncWG)
+	obj, err := engine.New(vars, needData, &server.asyncWG)
+	if o, ok := obj.(contextObject); ok && err == nil {
+		o.setContext(req.Context())
+	}
+	return obj, err
 }
 
 func resolveEtag(req *http.Request, metadata map[string]string) string {
@@ -166,7 +174,8 @@ func (server *ObjectServer) ObjGetHandler(writer http.ResponseWriter, request *h
 	for key, value := range metadata {
 		if allowed, ok := server.allowedHeaders[key]; (ok && allowed) ||
 			strings.HasPrefix(key, "X-Object-Meta-") ||
-			strings.HasPrefix(key, "X-Object-Sysmeta-") {
+			strings.HasPrefix(key, "X-Object-Sysmeta-") ||
+			strings.HasPrefix(key, common.ChecksumHeaderPrefix) {
 			headers.Set(key, value)
 		}
 	}
@@ -195,7 +204,15 @@ func (server *ObjectServer) ObjGetHandler(writer http.ResponseWriter, request *h
 	headers.Set("Content-Type", metadata["Content-Type"])
 	headers.Set("Content-Length", metadata["Content-Length"])
 
-	if rangeHeader := request.Header.Get("Range"); rangeHeader != "" {
+	rangeHeader := request.Header.Get("Range")
+	// Middlewares that keep their own objects, like symlinks, can ask for the
+	// whole of those whatever range the client wanted.
+	for _, key := range strings.Split(request.Header.Get("X-Backend-Ignore-Range-If-Metadata-Present"), ",") {
+		if key = strings.TrimSpace(key); key != "" && metadata[http.CanonicalHeaderKey(key)] != "" {
+			rangeHeader = ""
+		}
+	}
+	if rangeHeader != "" {
 		ranges, err := common.ParseRange(rangeHeader, obj.ContentLength())
 		if err != nil {
 			headers.Set("Content-Length", "0")
@@ -272,6 +289,20 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 			return
 		}
 	}
+	// Checksums the client sent are computed and checked along with any the
+	// server always keeps.
+	algorithms := append([]string{}, server.checksums...)
+	requestChecksums := map[string]string{}
+	for key := range request.Header {
+		if algorithm := common.ChecksumAlgorithm(key); algorithm != "" {
+			if !common.ValidChecksumAlgorithm(algorithm) {
+				http.Error(writer, "Unsupported checksum algorithm", http.StatusBadRequest)
+				return
+			}
+			algorithms = append(algorithms, algorithm)
+			requestChecksums[common.ChecksumHeader(algorithm)] = request.Header.Get(key)
+		}
+	}
 
 	obj, err := server.newObject(request, vars, false)
 	if err != nil {
@@ -281,12 +312,14 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 	}
 	defer obj.Close()
 
+	prevDeleteAt := ""
 	if obj.Exists() {
 		if inm := request.Header.Get("If-None-Match"); inm == "*" {
 			srv.StandardResponse(writer, http.StatusPreconditionFailed)
 			return
 		}
 		metadata := obj.Metadata()
+		prevDeleteAt = metadata["X-Delete-At"]
 		if requestTime, err := common.ParseDate(requestTimestamp); err == nil {
 			if lastModified, err := common.ParseDate(metadata["X-Timestamp"]); err == nil && !requestTime.After(lastModified) {
 				outHeaders.Set("X-Backend-Timestamp", metadata["X-Timestamp"])
@@ -312,7 +345,8 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 	}
 
 	hash := md5.New()
-	totalSize, err := common.Copy(request.Body, tempFile, hash)
+	checksums := common.NewChecksums(algorithms...)
+	totalSize, err := common.Copy(request.Body, tempFile, hash, checksums)
 	if err == io.ErrUnexpectedEOF || (request.ContentLength >= 0 && totalSize != request.ContentLength) {
 		srv.StandardResponse(writer, 499)
 		return
@@ -328,25 +362,44 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 		"Content-Length": strconv.FormatInt(totalSize, 10),
 		"ETag":           hex.EncodeToString(hash.Sum(nil)),
 	}
+	for key, value := range checksums.Headers() {
+		metadata[key] = value
+	}
 	for key := range request.Header {
 		if allowed, ok := server.allowedHeaders[key]; (ok && allowed) ||
 			strings.HasPrefix(key, "X-Object-Meta-") ||
-			strings.HasPrefix(key, "X-Object-Sysmeta-") {
+			strings.HasPrefix(key, "X-Object-Sysmeta-") ||
+			strings.HasPrefix(key, "X-Object-Transient-Sysmeta-") {
 			metadata[key] = request.Header.Get(key)
 		}
 	}
+	// Sysmeta that depends on the body, like an etag computed by a
+	// middleware, can only be sent once the body is done, as trailers.
+	for key := range request.Trailer {
+		if strings.HasPrefix(key, "X-Object-Sysmeta-") && request.Trailer.Get(key) != "" {
+			metadata[key] = request.Trailer.Get(key)
+		}
+	}
 	requestEtag := strings.Trim(strings.ToLower(request.Header.Get("ETag")), "\"")
 	if requestEtag != "" && requestEtag != metadata["ETag"] {
 		http.Error(writer, "Unprocessable Entity", 422)
 		return
 	}
+	if err := checksums.Verify(requestChecksums); err != nil {
+		srv.GetLogger(request).Debug("Checksum mismatch", zap.Error(err))
+		http.Error(writer, "Unprocessable Entity", 422)
+		return
+	}
 	outHeaders.Set("ETag", metadata["ETag"])
+	for key, value := range checksums.Headers() {
+		outHeaders.Set(key, value)
+	}
 
 	if err := obj.Commit(metadata); err != nil {
 		srv.ErrorResponse(writer, err)
 		return
 	}
-	server.containerUpdates(writer, request, metadata, request.Header.Get("X-Delete-At"), vars, srv.GetLogger(request))
+	server.containerUpdates(writer, request, metadata, prevDeleteAt, vars, srv.GetLogger(request))
 	srv.StandardResponse(writer, http.StatusCreated)
 }
 
@@ -408,10 +461,18 @@ func (server *ObjectServer) ObjPostHandler(writer http.ResponseWriter, request *
 		if allowed, ok := server.allowedHeaders[key]; (ok && allowed) ||
 			copyHdrs[key] ||
 			strings.HasPrefix(key, "X-Object-Meta-") ||
+			strings.HasPrefix(key, "X-Object-Sysmeta-") ||
 			strings.HasPrefix(key, "X-Object-Transient-Sysmeta-") {
 			metadata[key] = request.Header.Get(key)
 		}
 	}
+	// Unlike user metadata, sysmeta a POST doesn't change is kept, so the .meta
+	// carries it all and a later POST doesn't lose what an earlier one set.
+	for key, value := range origMetadata {
+		if _, ok := metadata[key]; !ok && strings.HasPrefix(key, "X-Object-Sysmeta-") {
+			metadata[key] = value
+		}
+	}
 	metadata["name"] = "/" + vars["account"] + "/" + vars["container"] + "/" + vars["obj"]
 	metadata["X-Timestamp"] = requestTimestamp
 
@@ -420,6 +481,20 @@ func (server *ObjectServer) ObjPostHandler(writer http.ResponseWriter, request *
 		srv.StandardResponse(writer, http.StatusInternalServerError)
 		return
 	}
+	if server.listingMeta {
+		// Listings can include the object's user metadata, so they're
+		// updated with the new metadata and the rest of the object as it was.
+		updateMetadata := make(map[string]string)
+		for key, value := range origMetadata {
+			if !strings.HasPrefix(key, "X-Object-Meta-") && key != "X-Delete-At" {
+				updateMetadata[key] = value
+			}
+		}
+		for key, value := range metadata {
+			updateMetadata[key] = value
+		}
+		server.containerUpdates(writer, request, updateMetadata, origMetadata["X-Delete-At"], vars, srv.GetLogger(request))
+	}
 	srv.StandardResponse(writer, http.StatusAccepted)
 }
 
@@ -651,6 +726,10 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	server.reconCachePath = serverconf.GetDefault("app:object-server", "recon_cache_path", "/var/cache/swift")
 	server.checkMounts = serverconf.GetBool("app:object-server", "mount_check", true)
 	server.checkEtags = serverconf.GetBool("app:object-server", "check_etags", false)
+	if server.checksums, err = common.ParseChecksumAlgorithms(serverconf.GetDefault("app:object-server", "checksums", "")); err != nil {
+		return ipPort, nil, nil, err
+	}
+	server.listingMeta = serverconf.GetBool("app:object-server", "container_listing_meta", false)
 	server.diskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:object-server", "disk_limit", 25, 0))
 	server.accountDiskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:object-server", "account_rate_limit", 0, 0))
 	server.expiringDivisor = serverconf.GetInt("app:object-server", "expiring_objects_container_divisor", 86400)
@@ -670,6 +749,12 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	if server.logger, err = srv.SetupLogger("object-server", &server.logLevel, flags); err != nil {
 		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
+	// The container ring is only needed to queue objects for the expirer and to follow sharded containers' redirects,
+	// so run without those rather than not at all.
+	if server.containerRing, err = cnf.GetRing("container", server.hashPathPrefix, server.hashPathSuffix, 0); err != nil {
+		server.logger.Error("Unable to load container ring; X-Delete-At won't queue objects for the expirer and sharded container updates won't be redirected", zap.Error(err))
+		server.containerRing = nil
+	}
 	server.updateTimeout = time.Duration(serverconf.GetFloat("app:object-server", "container_update_timeout", 0.25) * float64(time.Second))
 	connTimeout := time.Duration(serverconf.GetFloat("app:object-server", "conn_timeout", 1.0) * float64(time.Second))
 	nodeTimeout := time.Duration(serverconf.GetFloat("app:object-server", "node_timeout", 10.0) * float64(time.Second))
@@ -693,6 +778,8 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	httpClient := &http.Client{
 		Timeout:   nodeTimeout,
 		Transport: transport,
+		// Sharded containers redirect updates to their shards, which is handled by hand.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
 	}
 	server.updateClient = httpClient
 	if serverconf.HasSection("tracing") {
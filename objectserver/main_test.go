@@ -36,6 +36,7 @@ import (
 	"github.com/RocFang/hummingbird/common"
 	"github.com/RocFang/hummingbird/common/conf"
 	"github.com/RocFang/hummingbird/common/pickle"
+	"github.com/RocFang/hummingbird/common/ring"
 	"github.com/RocFang/hummingbird/common/srv"
 	"github.com/RocFang/hummingbird/common/test"
 
@@ -260,6 +261,119 @@ func TestPostContentType(t *testing.T) {
 	assert.Equal(t, 409, resp.StatusCode)
 }
 
+func TestPostContainerUpdates(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	defer ts.Close()
+	var updates []string
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updates = append(updates, r.Method+" "+r.Header.Get("X-Content-Type"))
+	}))
+	defer cs.Close()
+	u, err := url.Parse(cs.URL)
+	require.Nil(t, err)
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte("SOME DATA")))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 201, resp.StatusCode)
+
+	post := func() {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Object-Meta-Color", "blue")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("X-Container-Partition", "1")
+		req.Header.Set("X-Container-Host", u.Host)
+		req.Header.Set("X-Container-Device", "sdb")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		require.Equal(t, 202, resp.StatusCode)
+	}
+	// Listings only get the metadata, and so POSTs, when asked to.
+	post()
+	require.Empty(t, updates)
+
+	ts.objServer.listingMeta = true
+	post()
+	require.Equal(t, []string{"PUT text/plain; swift_meta=\"color=blue\""}, updates)
+}
+
+func TestNewServerWithoutContainerRing(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	confLoader.GetRingFunc = func(ringType, prefix, suffix string, policy int) (ring.Ring, error) {
+		if ringType == "container" {
+			return nil, fmt.Errorf("no container ring")
+		}
+		return testRing, nil
+	}
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	defer ts.Close()
+	require.Nil(t, ts.objServer.containerRing)
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte("SOME DATA")))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Header.Set("X-Delete-At", strconv.FormatInt(time.Now().Unix()+3600, 10))
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 201, resp.StatusCode)
+}
+
+func TestPostSysmeta(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte("SOME DATA")))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Header.Set("X-Object-Sysmeta-Color", "red")
+	req.Header.Set("X-Object-Sysmeta-Size", "big")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 201, resp.StatusCode)
+
+	post := func(header, value string) {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		require.Equal(t, 202, resp.StatusCode)
+	}
+	head := func() http.Header {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+		require.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		return resp.Header
+	}
+	post("X-Object-Sysmeta-Color", "blue")
+	require.Equal(t, "blue", head().Get("X-Object-Sysmeta-Color"))
+	require.Equal(t, "big", head().Get("X-Object-Sysmeta-Size"))
+
+	// Sysmeta outlives the POSTs that don't touch it, unlike user metadata.
+	post("X-Object-Meta-Shape", "round")
+	header := head()
+	require.Equal(t, "blue", header.Get("X-Object-Sysmeta-Color"))
+	require.Equal(t, "big", header.Get("X-Object-Sysmeta-Size"))
+	require.Equal(t, "round", header.Get("X-Object-Meta-Shape"))
+}
+
 func TestPostNotFound(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -327,6 +441,37 @@ func TestGetRanges(t *testing.T) {
 	assert.Equal(t, 2, strings.Count(string(body), "UVWXYZ"))
 }
 
+func TestGetIgnoreRange(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	assert.Nil(t, err)
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte{}))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/symlink")
+	req.Header.Set("Content-Length", "0")
+	req.Header.Set("X-Object-Sysmeta-Symlink-Target", "c/o2")
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+	assert.Nil(t, err)
+	req.Header.Set("Range", "bytes=10-20")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	req.Header.Set("X-Backend-Ignore-Range-If-Metadata-Present", "x-object-sysmeta-symlink-target")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "c/o2", resp.Header.Get("X-Object-Sysmeta-Symlink-Target"))
+}
+
 func TestBadEtag(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -387,6 +532,54 @@ func TestUppercaseEtag(t *testing.T) {
 	assert.Equal(t, "437bba8e0bf58337674f4539e75186ac", resp.Header.Get("Etag"))
 }
 
+func TestPutGetChecksums(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader, "checksums", "crc32c")
+	require.Nil(t, err)
+	defer ts.Close()
+
+	put := func(headers map[string]string) *http.Response {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port),
+			bytes.NewBuffer([]byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")))
+		require.Nil(t, err)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Length", "26")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+	resp := put(map[string]string{"X-Object-Checksum-Sha256": strings.Repeat("0", 64)})
+	require.Equal(t, 422, resp.StatusCode)
+	resp = put(map[string]string{"X-Object-Checksum-Md4": "0"})
+	require.Equal(t, 400, resp.StatusCode)
+	resp = put(map[string]string{"X-Object-Checksum-Sha256": "D6EC6898DE87DDAC6E5B3611708A7AA1C2D298293349CC1A6C299A1DB7149D38"})
+	require.Equal(t, 201, resp.StatusCode)
+	require.Equal(t, "319897cd", resp.Header.Get("X-Object-Checksum-Crc32c"))
+	require.Equal(t, "d6ec6898de87ddac6e5b3611708a7aa1c2d298293349cc1a6c299a1db7149d38", resp.Header.Get("X-Object-Checksum-Sha256"))
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Header.Set("X-Object-Meta-Color", "blue")
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 202, resp.StatusCode)
+
+	req, err = http.NewRequest("HEAD", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+	require.Nil(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "blue", resp.Header.Get("X-Object-Meta-Color"))
+	require.Equal(t, "319897cd", resp.Header.Get("X-Object-Checksum-Crc32c"))
+	require.Equal(t, "d6ec6898de87ddac6e5b3611708a7aa1c2d298293349cc1a6c299a1db7149d38", resp.Header.Get("X-Object-Checksum-Sha256"))
+}
+
 type shortReader struct{}
 
 func (s *shortReader) Read(p []byte) (n int, err error) {
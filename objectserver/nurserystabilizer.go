@@ -65,6 +65,10 @@ func (nrd *nurseryDevice) Scan() {
 		nrd.r.logger.Error("[stabilizeDevice] Drive not mounted", zap.String("Device", nrd.dev.Device), zap.Error(err))
 		return
 	}
+	if nrd.r.partPowerIncreasing(nrd.policy) {
+		nrd.r.logger.Info("[stabilizeDevice] Partition power increase in progress; not stabilizing", zap.String("Device", nrd.dev.Device), zap.Int("policy", nrd.policy))
+		return
+	}
 	start := time.Now()
 	c, cancel := nrd.objEngine.GetObjectsToStabilize(nrd.dev)
 	defer close(cancel)
@@ -16,6 +16,7 @@
 package objectserver
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -87,6 +88,12 @@ type ObjectEngine interface {
 	// Replicator here needs to be something else- it mostly needs logger, updateStat thing, and certs. not whole object- maybe an interface that gives those things
 }
 
+// contextObject is implemented by objects that make backend requests on behalf
+// of the request that opened them, so those requests can be traced with it.
+type contextObject interface {
+	setContext(ctx context.Context)
+}
+
 type NurseryObjectEngine interface {
 	ObjectEngine
 	GetObjectsToStabilize(device *ring.Device) (c chan ObjectStabilizer, cancel chan struct{})
@@ -0,0 +1,201 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/RocFang/hummingbird/common/fs"
+	"github.com/RocFang/hummingbird/common/ring"
+)
+
+// A partition power increase happens in stages:
+//
+//   prepare: the ring gets a next part power, so object servers start linking
+//            new writes into both the current and the next partition layout.
+//   relink:  RelinkDevice hard-links the existing objects into the partitions
+//            they will have under the next part power.
+//   increase: the ring doubles its partitions; partition p becomes 2p and 2p+1
+//            on the same devices, so everything is already where it belongs.
+//   cleanup: CleanupDevice removes the links left in the old partitions.
+//   finish:  the ring drops the next part power.
+//
+// Only the swift engine's objects directories are partition based. The
+// IndexDB engines store objects by hash and just follow the ring's part power
+// when it changes, so there is nothing to relink for them.
+
+// RelinkStats counts what RelinkDevice or CleanupDevice did.
+type RelinkStats struct {
+	HashDirs int64
+	Linked   int64
+	Removed  int64
+	Errors   int64
+}
+
+// linkHashDir hard-links every file in srcDir into dstDir, returning the
+// number of new links made.
+func linkHashDir(srcDir, dstDir string) (int64, error) {
+	names, err := fs.ReadDirNames(srcDir)
+	if err != nil {
+		return 0, err
+	}
+	if err = os.MkdirAll(dstDir, 0755); err != nil {
+		return 0, err
+	}
+	var linked int64
+	for _, name := range names {
+		if err := os.Link(filepath.Join(srcDir, name), filepath.Join(dstDir, name)); err == nil {
+			linked++
+		} else if !os.IsExist(err) {
+			return linked, err
+		}
+	}
+	return linked, nil
+}
+
+// walkHashDirs calls fn for every hash dir in the policy's objects directory
+// with the partition it is in.
+func walkHashDirs(devicePath string, policy int, fn func(partition uint64, partitionDir, suffix, hsh string)) error {
+	objPath := filepath.Join(devicePath, PolicyDir(policy))
+	partitions, err := fs.ReadDirNames(objPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, partition := range partitions {
+		part, err := strconv.ParseUint(partition, 10, 64)
+		if err != nil {
+			continue
+		}
+		partitionDir := filepath.Join(objPath, partition)
+		suffixes, err := fs.ReadDirNames(partitionDir)
+		if err != nil {
+			continue
+		}
+		for _, suffix := range suffixes {
+			if len(suffix) != 3 {
+				continue
+			}
+			hashes, err := fs.ReadDirNames(filepath.Join(partitionDir, suffix))
+			if err != nil {
+				continue
+			}
+			for _, hsh := range hashes {
+				if len(hsh) != 32 {
+					continue
+				}
+				fn(part, partitionDir, suffix, hsh)
+			}
+		}
+	}
+	return nil
+}
+
+// RelinkDevice hard-links the objects on a device into the partitions they
+// belong to under nextPartPower. It can be run repeatedly; links that already
+// exist are left alone.
+func RelinkDevice(devicePath string, policy int, nextPartPower uint) (*RelinkStats, error) {
+	stats := &RelinkStats{}
+	objPath := filepath.Join(devicePath, PolicyDir(policy))
+	err := walkHashDirs(devicePath, policy, func(partition uint64, partitionDir, suffix, hsh string) {
+		newPart, err := ring.PartitionForHashPower(hsh, nextPartPower)
+		if err != nil {
+			stats.Errors++
+			return
+		}
+		if newPart == partition {
+			return
+		}
+		stats.HashDirs++
+		newHashDir := filepath.Join(objPath, strconv.FormatUint(newPart, 10), suffix, hsh)
+		linked, err := linkHashDir(filepath.Join(partitionDir, suffix, hsh), newHashDir)
+		stats.Linked += linked
+		if err != nil {
+			stats.Errors++
+			return
+		}
+		if linked > 0 {
+			InvalidateHash(newHashDir)
+		}
+	})
+	return stats, err
+}
+
+// CleanupDevice removes objects left in partitions they no longer belong to
+// under partPower, linking anything the relink missed first. Partition
+// directories left without any suffixes are removed.
+func CleanupDevice(devicePath string, policy int, partPower uint) (*RelinkStats, error) {
+	stats := &RelinkStats{}
+	objPath := filepath.Join(devicePath, PolicyDir(policy))
+	cleaned := map[string]bool{}
+	err := walkHashDirs(devicePath, policy, func(partition uint64, partitionDir, suffix, hsh string) {
+		newPart, err := ring.PartitionForHashPower(hsh, partPower)
+		if err != nil {
+			stats.Errors++
+			return
+		}
+		if newPart == partition {
+			return
+		}
+		stats.HashDirs++
+		hashDir := filepath.Join(partitionDir, suffix, hsh)
+		newHashDir := filepath.Join(objPath, strconv.FormatUint(newPart, 10), suffix, hsh)
+		linked, err := linkHashDir(hashDir, newHashDir)
+		stats.Linked += linked
+		if err != nil {
+			stats.Errors++
+			return
+		}
+		if linked > 0 {
+			InvalidateHash(newHashDir)
+		}
+		names, err := fs.ReadDirNames(hashDir)
+		if err == nil {
+			stats.Removed += int64(len(names))
+			err = os.RemoveAll(hashDir)
+		}
+		if err != nil {
+			stats.Errors++
+			return
+		}
+		os.Remove(filepath.Join(partitionDir, suffix))
+		InvalidateHash(hashDir)
+		cleaned[partitionDir] = true
+	})
+	for partitionDir := range cleaned {
+		names, err := fs.ReadDirNames(partitionDir)
+		if err != nil {
+			continue
+		}
+		empty := true
+		for _, name := range names {
+			if len(name) == 3 {
+				if fi, err := os.Stat(filepath.Join(partitionDir, name)); err == nil && fi.IsDir() {
+					empty = false
+					break
+				}
+			}
+		}
+		if empty {
+			os.RemoveAll(partitionDir)
+		}
+	}
+	return stats, err
+}
@@ -0,0 +1,98 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/RocFang/hummingbird/common/fs"
+	"github.com/RocFang/hummingbird/common/ring"
+	"github.com/stretchr/testify/require"
+)
+
+type nextPartPowerRing struct {
+	ring.Ring
+	nextPartPower int
+}
+
+func (r *nextPartPowerRing) NextPartPower() int {
+	return r.nextPartPower
+}
+
+func TestRelinkAndCleanupDevice(t *testing.T) {
+	devicePath, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(devicePath)
+	// d41d8cd9... is partition 13 at part power 4 and 26 at part power 5.
+	hsh := "d41d8cd98f00b204e9800998ecf8427e"
+	oldDir := filepath.Join(devicePath, "objects", "13", "27e", hsh)
+	newDir := filepath.Join(devicePath, "objects", "26", "27e", hsh)
+	require.Nil(t, os.MkdirAll(oldDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(oldDir, "1400000000.00000.data"), []byte("!"), 0644))
+
+	stats, err := RelinkDevice(devicePath, 0, 5)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), stats.Linked)
+	require.True(t, fs.Exists(filepath.Join(oldDir, "1400000000.00000.data")))
+	require.True(t, fs.Exists(filepath.Join(newDir, "1400000000.00000.data")))
+	stats, err = RelinkDevice(devicePath, 0, 5)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), stats.Linked)
+
+	// Written after the relink passed, before the increase.
+	require.Nil(t, ioutil.WriteFile(filepath.Join(oldDir, "1400000001.00000.meta"), []byte("!"), 0644))
+	stats, err = CleanupDevice(devicePath, 0, 5)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), stats.Linked)
+	require.Equal(t, int64(2), stats.Removed)
+	require.False(t, fs.Exists(filepath.Join(devicePath, "objects", "13")))
+	require.True(t, fs.Exists(filepath.Join(newDir, "1400000000.00000.data")))
+	require.True(t, fs.Exists(filepath.Join(newDir, "1400000001.00000.meta")))
+	stats, err = CleanupDevice(devicePath, 0, 5)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), stats.HashDirs)
+}
+
+func TestSwiftObjectLinksIntoNextPartition(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	swcon := &SwiftEngine{driveRoot: driveRoot, hashPathPrefix: "prefix", hashPathSuffix: "suffix", ring: &nextPartPowerRing{nextPartPower: 5}}
+	vars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": "1"}
+	hsh := ObjHash(vars, "prefix", "suffix")
+	part, err := ring.PartitionForHashPower(hsh, 5)
+	require.Nil(t, err)
+	vars["partition"] = "99"
+	var wg sync.WaitGroup
+	swo, err := swcon.New(vars, false, &wg)
+	require.Nil(t, err)
+	w, err := swo.SetData(1)
+	require.Nil(t, err)
+	w.Write([]byte("!"))
+	require.Nil(t, swo.Commit(map[string]string{"Content-Length": "1", "Content-Type": "text/plain", "X-Timestamp": "1234567890.123456"}))
+	swo.Close()
+	wg.Wait()
+	nextVars := map[string]string{"device": "sda", "account": "a", "container": "c", "obj": "o", "partition": strconv.FormatUint(part, 10)}
+	require.True(t, fs.Exists(filepath.Join(ObjHashDir(nextVars, driveRoot, "prefix", "suffix", 0), "1234567890.123456.data")))
+
+	swcon.ring = &nextPartPowerRing{}
+	require.Equal(t, "", swcon.nextHashDir(vars, ObjHashDir(vars, driveRoot, "prefix", "suffix", 0)))
+}
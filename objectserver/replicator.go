@@ -222,6 +222,14 @@ func (r *Replicator) addMetrics(devStats *DeviceStats, policy int, name string)
 	devStats.lastPassDurationMetric = r.metricsScope.Timer(fmt.Sprintf("%d_%s_last_pass_duration", policy, name))
 }
 
+// partPowerIncreasing reports whether the policy's ring is part way through a
+// partition power increase. The relinked partitions look like handoffs to the
+// old ring until it finishes, so nothing is replicated or reconstructed then.
+func (r *Replicator) partPowerIncreasing(policy int) bool {
+	oring, ok := r.objectRings[policy]
+	return ok && ring.NextPartPower(oring) != 0
+}
+
 func (r *Replicator) verifyRunningDevices() {
 	r.runningDevicesLock.Lock()
 	defer r.runningDevicesLock.Unlock()
@@ -508,6 +516,8 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 	httpClient := &http.Client{
 		Timeout:   time.Second * 60,
 		Transport: transport,
+		// Sharded containers redirect updates to their shards, which is handled by hand.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
 	}
 	replicator := &Replicator{
 		reserve:             serverconf.GetInt("object-replicator", "fallocate_reserve", 0),
@@ -499,6 +499,38 @@ func TestPriorityRepHandler404(t *testing.T) {
 	require.EqualValues(t, 404, w.Code)
 }
 
+func TestPartPowerIncreaseStopsReplication(t *testing.T) {
+	deviceRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(deviceRoot)
+	testRing := &nextPartPowerRing{Ring: &test.FakeRing{}, nextPartPower: 5}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	replicator, _, err := newTestReplicator(confLoader, "bind_port", "1234", "check_mounts", "no")
+	require.Nil(t, err)
+	replicator.deviceRoot = deviceRoot
+	replicator.objectRings[0] = testRing
+	var replicated []string
+	rd := newPatchableReplicationDevice(testRing, replicator)
+	rd._cleanTemp = func() {}
+	rd._listPartitions = func() ([]string, []string, error) { return []string{"26"}, []string{"26"}, nil }
+	rd._replicatePartition = func(partition string) { replicated = append(replicated, partition) }
+	rd.Scan()
+	require.Empty(t, replicated)
+
+	w := httptest.NewRecorder()
+	jsonned, _ := json.Marshal(&PriorityRepJob{
+		FromDevice: &ring.Device{Id: 1, Device: "sda"},
+		ToDevice:   &ring.Device{Id: 2, Device: "sdb"},
+	})
+	req, _ := http.NewRequest("POST", "/priorityrep", bytes.NewBuffer(jsonned))
+	replicator.priorityRepHandler(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	testRing.nextPartPower = 0
+	rd.Scan()
+	require.Equal(t, []string{"26"}, replicated)
+}
+
 func TestSyncFile(t *testing.T) {
 	deviceRoot, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
@@ -57,8 +57,8 @@ func (ro *repObject) Exists() bool {
 }
 
 func (ro *repObject) Copy(dsts ...io.Writer) (written int64, err error) {
-	var f *os.File
-	f, err = os.Open(ro.Path)
+	var f IndexDBFile
+	f, err = ro.idb.Open(&ro.IndexDBItem)
 	if err != nil {
 		return 0, err
 	}
@@ -78,7 +78,7 @@ func (ro *repObject) Copy(dsts ...io.Writer) (written int64, err error) {
 }
 
 func (ro *repObject) CopyRange(w io.Writer, start int64, end int64) (int64, error) {
-	f, err := os.Open(ro.Path)
+	f, err := ro.idb.Open(&ro.IndexDBItem)
 	if err != nil {
 		return 0, err
 	}
@@ -312,7 +312,7 @@ func (ro *repObject) Stabilize(dev *ring.Device) error {
 
 func (ro *repObject) Replicate(prirep PriorityRepJob) error {
 	_, isHandoff := ro.ring.GetJobNodes(prirep.Partition, prirep.FromDevice.Id)
-	fp, err := os.Open(ro.Path)
+	fp, err := ro.idb.Open(&ro.IndexDBItem)
 	if err != nil {
 		return err
 	}
@@ -8,7 +8,6 @@ import (
 	"math/bits"
 	"net"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -54,6 +53,10 @@ func repEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.F
 	if err != nil {
 		return nil, err
 	}
+	inlineThreshold, err := policy.GetInlineThreshold()
+	if err != nil {
+		return nil, err
+	}
 	logLevelString := config.GetDefault("app:object-server", "log_level", "INFO")
 	logLevel := zap.NewAtomicLevel()
 	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
@@ -81,15 +84,16 @@ func repEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.F
 		}
 	}
 	re := &repEngine{
-		driveRoot:      driveRoot,
-		hashPathPrefix: hashPathPrefix,
-		hashPathSuffix: hashPathSuffix,
-		reserve:        config.GetInt("app:object-server", "fallocate_reserve", 0),
-		policy:         policy.Index,
-		ring:           rng,
-		idbs:           map[string]*IndexDB{},
-		dbPartPower:    int(dbPartPower),
-		numSubDirs:     subdirs,
+		driveRoot:       driveRoot,
+		hashPathPrefix:  hashPathPrefix,
+		hashPathSuffix:  hashPathSuffix,
+		reserve:         config.GetInt("app:object-server", "fallocate_reserve", 0),
+		inlineThreshold: inlineThreshold,
+		policy:          policy.Index,
+		ring:            rng,
+		idbs:            map[string]*IndexDB{},
+		dbPartPower:     int(dbPartPower),
+		numSubDirs:      subdirs,
 		client: &http.Client{
 			Timeout:   120 * time.Minute,
 			Transport: transport,
@@ -104,32 +108,38 @@ func repEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.F
 var _ ObjectEngine = &repEngine{}
 
 type repEngine struct {
-	driveRoot      string
-	hashPathPrefix string
-	hashPathSuffix string
-	reserve        int64
-	policy         int
-	ring           ring.Ring
-	logger         srv.LowLevelLogger
-	idbs           map[string]*IndexDB
-	dblock         sync.Mutex
-	dbPartPower    int
-	numSubDirs     int
-	client         *http.Client
+	driveRoot       string
+	hashPathPrefix  string
+	hashPathSuffix  string
+	reserve         int64
+	inlineThreshold int64
+	policy          int
+	ring            ring.Ring
+	logger          srv.LowLevelLogger
+	idbs            map[string]*IndexDB
+	dblock          sync.Mutex
+	dbPartPower     int
+	numSubDirs      int
+	client          *http.Client
 }
 
 func (re *repEngine) getDB(device string) (*IndexDB, error) {
 	re.dblock.Lock()
 	defer re.dblock.Unlock()
+	ringPartPower := bits.Len64(re.ring.PartitionCount() - 1)
 	if idb, ok := re.idbs[device]; ok && idb != nil {
+		if idb.RingPartPower() != uint(ringPartPower) {
+			if err := idb.SetRingPartPower(ringPartPower); err != nil {
+				return nil, err
+			}
+		}
 		return idb, nil
 	}
 	var err error
 	dbpath := filepath.Join(re.driveRoot, device, PolicyDir(re.policy), "repng.db")
 	path := filepath.Join(re.driveRoot, device, PolicyDir(re.policy), "repng")
 	temppath := filepath.Join(re.driveRoot, device, "tmp")
-	ringPartPower := bits.Len64(re.ring.PartitionCount() - 1)
-	re.idbs[device], err = NewIndexDB(dbpath, path, temppath, ringPartPower, re.dbPartPower, re.numSubDirs, re.reserve, re.logger, repAuditor{})
+	re.idbs[device], err = NewIndexDB(dbpath, path, temppath, ringPartPower, re.dbPartPower, re.numSubDirs, re.reserve, re.inlineThreshold, re.logger, repAuditor{})
 	if err != nil {
 		return nil, err
 	}
@@ -159,7 +169,7 @@ func (re *repEngine) New(vars map[string]string, needData bool, asyncWG *sync.Wa
 				return nil, fmt.Errorf("Error parsing metadata: %v", err)
 			}
 			if !item.Deletion {
-				if fi, err := os.Stat(item.Path); err != nil {
+				if fi, err := idb.Stat(item); err != nil {
 					obj.Quarantine()
 					return nil, err
 				} else if contentLength, err := strconv.ParseInt(obj.metadata["Content-Length"], 10, 64); err != nil {
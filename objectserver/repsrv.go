@@ -97,6 +97,10 @@ func (r *Replicator) priorityRepHandler(w http.ResponseWriter, req *http.Request
 			return
 		}
 	}
+	if r.partPowerIncreasing(pri.Policy) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	r.runningDevicesLock.Lock()
 	rd, ok := r.runningDevices[deviceKeyId(pri.FromDevice.Device, pri.Policy)]
 	r.runningDevicesLock.Unlock()
@@ -126,6 +130,10 @@ func (r *Replicator) stabilizeHandler(w http.ResponseWriter, req *http.Request)
 		w.WriteHeader(500)
 		return
 	}
+	if r.partPowerIncreasing(policy) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	ringDevices, err := oring.LocalDevices(r.port)
 	if err != nil {
 		r.logger.Error("Error getting local devices from ring", zap.Error(err))
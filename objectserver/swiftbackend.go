@@ -323,7 +323,10 @@ func applyMetaFile(metaFile string, datafileMetadata map[string]string) (map[str
 		return nil, err
 	} else {
 		for k, v := range datafileMetadata {
-			if k == "Content-Length" || k == "Content-Type" || k == "deleted" || k == "ETag" || k == "X-Backend-Data-Timestamp" || strings.HasPrefix(k, "X-Object-Sysmeta-") {
+			if k == "Content-Length" || k == "Content-Type" || k == "deleted" || k == "ETag" || k == "X-Backend-Data-Timestamp" || strings.HasPrefix(k, common.ChecksumHeaderPrefix) {
+				metadata[k] = v
+			} else if _, ok := metadata[k]; !ok && strings.HasPrefix(k, "X-Object-Sysmeta-") {
+				// sysmeta set by a POST is newer than the data file's
 				metadata[k] = v
 			}
 		}
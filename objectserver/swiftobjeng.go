@@ -618,6 +618,10 @@ func (rd *swiftDevice) Scan() {
 	if fs.Exists(filepath.Join(rd.r.deviceRoot, rd.dev.Device, "lock_device")) {
 		return
 	}
+	if rd.r.partPowerIncreasing(rd.policy) {
+		rd.r.logger.Info("[replicateDevice] Partition power increase in progress; not replicating", zap.String("Device", rd.dev.Device), zap.Int("policy", rd.policy))
+		return
+	}
 
 	rd.i.cleanTemp()
 
@@ -705,6 +709,7 @@ type SwiftObject struct {
 	file         *os.File
 	afw          fs.AtomicFileWriter
 	hashDir      string
+	nextHashDir  string
 	tempDir      string
 	dataFile     string
 	metaFile     string
@@ -801,15 +806,30 @@ func (o *SwiftObject) Commit(metadata map[string]string) error {
 	}
 	fileName := filepath.Join(o.hashDir, fmt.Sprintf("%s.%s", timestamp, o.workingClass))
 	o.afw.Save(fileName)
+	if o.nextHashDir != "" {
+		// A partition power increase is in progress; the relinker may have
+		// already passed this object, so link it into its next partition too.
+		if err := os.MkdirAll(o.nextHashDir, 0755); err != nil {
+			return fmt.Errorf("Error creating next partition dir: %v", err)
+		}
+		if err := os.Link(fileName, filepath.Join(o.nextHashDir, filepath.Base(fileName))); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Error linking into next partition: %v", err)
+		}
+	}
 	o.asyncWG.Add(1)
 	go func() {
 		defer o.asyncWG.Done()
-		HashCleanupListDir(o.hashDir, o.reclaimAge)
-		if dir, err := os.OpenFile(o.hashDir, os.O_RDONLY, 0666); err == nil {
-			dir.Sync()
-			dir.Close()
+		for _, hashDir := range []string{o.hashDir, o.nextHashDir} {
+			if hashDir == "" {
+				continue
+			}
+			HashCleanupListDir(hashDir, o.reclaimAge)
+			if dir, err := os.OpenFile(hashDir, os.O_RDONLY, 0666); err == nil {
+				dir.Sync()
+				dir.Close()
+			}
+			InvalidateHash(hashDir)
 		}
-		InvalidateHash(o.hashDir)
 	}()
 	return nil
 }
@@ -852,6 +872,25 @@ type SwiftEngine struct {
 	reserve        int64
 	reclaimAge     int64
 	policy         int
+	ring           ring.Ring
+}
+
+// nextHashDir gives the hash dir an object will have once the ring's pending
+// partition power increase is done, or "" if there isn't one or it won't move.
+func (f *SwiftEngine) nextHashDir(vars map[string]string, hashDir string) string {
+	if f.ring == nil {
+		return ""
+	}
+	nextPartPower := ring.NextPartPower(f.ring)
+	if nextPartPower == 0 {
+		return ""
+	}
+	hsh := filepath.Base(hashDir)
+	partition, err := ring.PartitionForHashPower(hsh, uint(nextPartPower))
+	if err != nil || strconv.FormatUint(partition, 10) == vars["partition"] {
+		return ""
+	}
+	return filepath.Join(f.driveRoot, vars["device"], PolicyDir(f.policy), strconv.FormatUint(partition, 10), hsh[29:32], hsh)
 }
 
 // New returns an instance of SwiftObject with the given parameters. Metadata is read in and if needData is true, the file is opened.  AsyncWG is a waitgroup if the object spawns any async operations
@@ -859,6 +898,7 @@ func (f *SwiftEngine) New(vars map[string]string, needData bool, asyncWG *sync.W
 	var err error
 	sor := &SwiftObject{reclaimAge: f.reclaimAge, reserve: f.reserve, asyncWG: asyncWG}
 	sor.hashDir = ObjHashDir(vars, f.driveRoot, f.hashPathPrefix, f.hashPathSuffix, f.policy)
+	sor.nextHashDir = f.nextHashDir(vars, sor.hashDir)
 	sor.tempDir = TempDirPath(f.driveRoot, vars["device"])
 	sor.dataFile, sor.metaFile = ObjectFiles(sor.hashDir)
 	if sor.Exists() {
@@ -920,13 +960,17 @@ func SwiftEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag
 		return nil, errors.New("Unable to load hashpath prefix and suffix")
 	}
 	reclaimAge := int64(config.GetInt("app:object-server", "reclaim_age", int64(common.ONE_WEEK)))
+	// The ring is only needed to follow partition power increases, so an
+	// engine without one still serves objects.
+	rng, _ := ring.GetRing("object", hashPathPrefix, hashPathSuffix, policy.Index)
 	return &SwiftEngine{
 		driveRoot:      driveRoot,
 		hashPathPrefix: hashPathPrefix,
 		hashPathSuffix: hashPathSuffix,
 		reserve:        reserve,
 		reclaimAge:     reclaimAge,
-		policy:         policy.Index}, nil
+		policy:         policy.Index,
+		ring:           rng}, nil
 }
 
 func init() {
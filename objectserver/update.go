@@ -22,8 +22,10 @@ import (
 	"io"
 	"math/big"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -69,7 +71,10 @@ func (server *ObjectServer) expirerContainer(deleteAt time.Time, account, contai
 	return fmt.Sprintf("%010d", timestamp)
 }
 
-func (server *ObjectServer) sendContainerUpdate(ctx context.Context, scheme, host, device, method, partition, account, container, obj string, headers http.Header) bool {
+// sendContainerUpdate sends an object's update to one container node. With followRedirect, a sharded container's
+// redirect to the shard holding the object's listing is followed once; the shard's own redirects aren't, so
+// containers that redirect to each other can't loop.
+func (server *ObjectServer) sendContainerUpdate(ctx context.Context, scheme, host, device, method, partition, account, container, obj string, headers http.Header, followRedirect bool) bool {
 	obj_url := fmt.Sprintf("%s://%s/%s/%s/%s/%s/%s", scheme, host, device, partition,
 		common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 	if req, err := http.NewRequest(method, obj_url, nil); err == nil {
@@ -80,11 +85,44 @@ func (server *ObjectServer) sendContainerUpdate(ctx context.Context, scheme, hos
 			if resp.StatusCode/100 == 2 {
 				return true
 			}
+			if shardAccount, shardContainer, ok := shardRedirect(resp); ok && followRedirect && server.containerRing != nil &&
+				(shardAccount != account || shardContainer != container) {
+				return server.sendShardUpdate(ctx, method, shardAccount, shardContainer, obj, headers)
+			}
 		}
 	}
 	return false
 }
 
+// shardRedirect returns the shard container a sharded container redirected an update to.
+func shardRedirect(resp *http.Response) (account, container string, ok bool) {
+	if resp.StatusCode != http.StatusMovedPermanently {
+		return "", "", false
+	}
+	location, err := url.PathUnescape(resp.Header.Get("Location"))
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(location, "/", 4)
+	if len(parts) != 4 || parts[0] != "" || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// sendShardUpdate sends a redirected container update to the shard container's nodes.
+func (server *ObjectServer) sendShardUpdate(ctx context.Context, method, account, container, obj string, headers http.Header) bool {
+	partition := server.containerRing.GetPartition(account, container, "")
+	successes := uint64(0)
+	for _, node := range server.containerRing.GetNodes(partition) {
+		if server.sendContainerUpdate(ctx, node.Scheme, fmt.Sprintf("%s:%d", node.Ip, node.Port), node.Device, method,
+			strconv.FormatUint(partition, 10), account, container, obj, headers, false) {
+			successes++
+		}
+	}
+	return successes >= (server.containerRing.ReplicaCount()/2)+1
+}
+
 func (server *ObjectServer) saveAsync(method, account, container, obj, localDevice string, headers http.Header, logger srv.LowLevelLogger) {
 	hash := server.hashPath(account, container, obj)
 	asyncFile := filepath.Join(server.driveRoot, localDevice, "async_pending", hash[29:32], hash+"-"+headers.Get("X-Timestamp"))
@@ -129,14 +167,40 @@ func (server *ObjectServer) updateContainer(ctx context.Context, metadata map[st
 		"X-Timestamp":                    request.Header["X-Timestamp"],
 		"X-Delete-At":                    request.Header["X-Delete-At"],
 	}
-	if request.Method != "DELETE" {
+	method := request.Method
+	if method == "POST" {
+		// A POST lists the object again with its new metadata, which is a
+		// PUT to the container servers.
+		method = "PUT"
+		requestHeaders.Del("X-Delete-At")
+		if deleteAt := metadata["X-Delete-At"]; deleteAt != "" {
+			requestHeaders.Set("X-Delete-At", deleteAt)
+		}
+	}
+	if method != "DELETE" {
 		requestHeaders.Add("X-Content-Type", metadata["Content-Type"])
 		requestHeaders.Add("X-Size", metadata["Content-Length"])
 		requestHeaders.Add("X-Etag", metadata["ETag"])
+		for _, key := range []string{"Content-Type", "Size", "Etag"} {
+			if v, ok := metadata["X-Object-Sysmeta-Container-Update-Override-"+key]; ok {
+				requestHeaders.Set("X-"+key, v)
+			}
+		}
+		if server.listingMeta {
+			// User metadata rides along in the content type, for listings
+			// that include it.
+			meta := map[string]string{}
+			for key, value := range metadata {
+				if strings.HasPrefix(key, "X-Object-Meta-") {
+					meta[key[len("X-Object-Meta-"):]] = value
+				}
+			}
+			requestHeaders.Set("X-Content-Type", common.ContentTypeWithMeta(requestHeaders.Get("X-Content-Type"), meta))
+		}
 	}
 	failures := 0
 	for index := range hosts {
-		if !server.sendContainerUpdate(ctx, schemes[index], hosts[index], devices[index], request.Method, partition, vars["account"], vars["container"], vars["obj"], requestHeaders) {
+		if !server.sendContainerUpdate(ctx, schemes[index], hosts[index], devices[index], method, partition, vars["account"], vars["container"], vars["obj"], requestHeaders, true) {
 			logger.Error("ERROR container update failed (saving for async update later)",
 				zap.String("Host", hosts[index]),
 				zap.String("Device", devices[index]))
@@ -144,17 +208,74 @@ func (server *ObjectServer) updateContainer(ctx context.Context, metadata map[st
 		}
 	}
 	if failures > 0 {
-		server.saveAsync(request.Method, vars["account"], vars["container"], vars["obj"], vars["device"], requestHeaders, logger)
+		server.saveAsync(method, vars["account"], vars["container"], vars["obj"], vars["device"], requestHeaders, logger)
+	}
+}
+
+func expirerObject(deleteAt time.Time, account, container, obj string) string {
+	return fmt.Sprintf("%010d-%s/%s/%s", deleteAt.Unix(), account, container, obj)
+}
+
+// updateDeleteAt files the object in the .expiring_objects queue under its
+// new X-Delete-At, and removes any entry for the X-Delete-At it replaced.
+func (server *ObjectServer) updateDeleteAt(ctx context.Context, request *http.Request, deleteAt, prevDeleteAt string, vars map[string]string, logger srv.LowLevelLogger) {
+	if deleteAt == prevDeleteAt || server.containerRing == nil {
+		return
+	}
+	if prevDeleteAt != "" {
+		server.sendDeleteAtUpdate(ctx, "DELETE", prevDeleteAt, request, vars, logger)
+	}
+	if deleteAt != "" {
+		server.sendDeleteAtUpdate(ctx, "PUT", deleteAt, request, vars, logger)
+	}
+}
+
+func (server *ObjectServer) sendDeleteAtUpdate(ctx context.Context, method, deleteAt string, request *http.Request, vars map[string]string, logger srv.LowLevelLogger) {
+	deleteTime, err := common.ParseDate(deleteAt)
+	if err != nil {
+		logger.Error("Invalid X-Delete-At for expirer update", zap.String("X-Delete-At", deleteAt), zap.Error(err))
+		return
+	}
+	container := server.expirerContainer(deleteTime, vars["account"], vars["container"], vars["obj"])
+	obj := expirerObject(deleteTime, vars["account"], vars["container"], vars["obj"])
+	requestHeaders := http.Header{
+		"X-Backend-Storage-Policy-Index": {"0"},
+		"Referer":                        {common.GetDefault(request.Header, "Referer", "-")},
+		"User-Agent":                     {common.GetDefault(request.Header, "User-Agent", "-")},
+		"X-Trans-Id":                     {common.GetDefault(request.Header, "X-Trans-Id", "-")},
+		"X-Timestamp":                    request.Header["X-Timestamp"],
+	}
+	if method == "PUT" {
+		requestHeaders.Set("X-Content-Type", "text/plain")
+		requestHeaders.Set("X-Size", "0")
+		requestHeaders.Set("X-Etag", zeroByteHash)
+	}
+	partition := server.containerRing.GetPartition(deleteAtAccount, container, "")
+	failures := 0
+	for _, node := range server.containerRing.GetNodes(partition) {
+		if !server.sendContainerUpdate(ctx, node.Scheme, fmt.Sprintf("%s:%d", node.Ip, node.Port), node.Device, method, strconv.FormatUint(partition, 10), deleteAtAccount, container, obj, requestHeaders, true) {
+			logger.Error("ERROR expirer update failed (saving for async update later)",
+				zap.String("Host", fmt.Sprintf("%s:%d", node.Ip, node.Port)),
+				zap.String("Device", node.Device))
+			failures++
+		}
+	}
+	if failures > 0 {
+		server.saveAsync(method, deleteAtAccount, container, obj, vars["device"], requestHeaders, logger)
 	}
 }
 
-func (server *ObjectServer) containerUpdates(writer http.ResponseWriter, request *http.Request, metadata map[string]string, deleteAt string, vars map[string]string, logger srv.LowLevelLogger) {
+// containerUpdates sends the container listing update for the request, along
+// with any .expiring_objects queue update. prevDeleteAt is the X-Delete-At of
+// the object being overwritten or deleted, if any.
+func (server *ObjectServer) containerUpdates(writer http.ResponseWriter, request *http.Request, metadata map[string]string, prevDeleteAt string, vars map[string]string, logger srv.LowLevelLogger) {
 	defer middleware.Recover(writer, request, "PANIC WHILE UPDATING CONTAINER LISTINGS")
 
 	done := make(chan struct{}, 1)
 	go func() {
 		ctx := tracing.CopySpanFromContext(request.Context())
 		server.updateContainer(ctx, metadata, request, vars, logger)
+		server.updateDeleteAt(ctx, request, metadata["X-Delete-At"], prevDeleteAt, vars, logger)
 		done <- struct{}{}
 	}()
 	select {
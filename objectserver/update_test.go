@@ -16,16 +16,23 @@
 package objectserver
 
 import (
+	"context"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/RocFang/hummingbird/common"
 	"github.com/RocFang/hummingbird/common/fs"
 	"github.com/RocFang/hummingbird/common/pickle"
+	"github.com/RocFang/hummingbird/common/ring"
 	"github.com/RocFang/hummingbird/common/srv"
 	"github.com/RocFang/hummingbird/common/test"
 	"github.com/stretchr/testify/require"
@@ -114,6 +121,84 @@ func TestUpdateContainer(t *testing.T) {
 	require.Equal(t, asyncData["obj"], "o")
 }
 
+func TestUpdateContainerOverride(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+
+	requestSent := false
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "text/plain", r.Header.Get("X-Content-Type"))
+		require.Equal(t, "30", r.Header.Get("X-Size"))
+		require.Equal(t, "encrypted etag", r.Header.Get("X-Etag"))
+		requestSent = true
+	}))
+	defer cs.Close()
+	u, err := url.Parse(cs.URL)
+	require.Nil(t, err)
+	req, err := http.NewRequest("PUT", "/I/dont/think/this/matters", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Container-Partition", "1")
+	req.Header.Add("X-Container-Host", u.Host)
+	req.Header.Add("X-Container-Device", "sdb")
+	req.Header.Add("X-Timestamp", "12345.6789")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	req = srv.SetVars(req, vars)
+	metadata := map[string]string{
+		"X-Timestamp":    "12345.789",
+		"Content-Type":   "text/plain",
+		"Content-Length": "30",
+		"ETag":           "ffffffffffffffffffffffffffffffff",
+		"X-Object-Sysmeta-Container-Update-Override-Etag": "encrypted etag",
+	}
+	server.updateContainer(req.Context(), metadata, req, vars, zap.NewNop())
+	require.True(t, requestSent)
+}
+
+func TestUpdateContainerMeta(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+
+	var contentType string
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("X-Content-Type")
+	}))
+	defer cs.Close()
+	u, err := url.Parse(cs.URL)
+	require.Nil(t, err)
+	req, err := http.NewRequest("PUT", "/I/dont/think/this/matters", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Container-Partition", "1")
+	req.Header.Add("X-Container-Host", u.Host)
+	req.Header.Add("X-Container-Device", "sdb")
+	req.Header.Add("X-Timestamp", "12345.6789")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	req = srv.SetVars(req, vars)
+	metadata := map[string]string{
+		"X-Timestamp":         "12345.789",
+		"Content-Type":        "text/plain",
+		"Content-Length":      "30",
+		"ETag":                "ffffffffffffffffffffffffffffffff",
+		"X-Object-Meta-Color": "blue",
+	}
+	server.updateContainer(req.Context(), metadata, req, vars, zap.NewNop())
+	require.Equal(t, "text/plain", contentType)
+
+	server.listingMeta = true
+	server.updateContainer(req.Context(), metadata, req, vars, zap.NewNop())
+	ct, meta, err := common.ParseContentTypeForMeta(contentType)
+	require.Nil(t, err)
+	require.Equal(t, "text/plain", ct)
+	require.Equal(t, map[string]string{"color": "blue"}, meta)
+}
+
 func TestUpdateContainerNoHeaders(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -150,3 +235,112 @@ func TestUpdateContainerNoHeaders(t *testing.T) {
 	expectedFile := filepath.Join(ts.root, "sda", "async_pending", "099", "2f714cd91b0e5d803cde2012b01d7099-12345.6789")
 	require.False(t, fs.Exists(expectedFile))
 }
+
+func TestUpdateDeleteAt(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+	server.hashPathPrefix = ""
+	server.hashPathSuffix = "changeme"
+
+	requests := []string{}
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == "PUT" {
+			require.Equal(t, "0", r.Header.Get("X-Size"))
+			require.Equal(t, zeroByteHash, r.Header.Get("X-Etag"))
+		}
+		require.Equal(t, "12345.6789", r.Header.Get("X-Timestamp"))
+	}))
+	defer cs.Close()
+	u, err := url.Parse(cs.URL)
+	require.Nil(t, err)
+	host, ports, err := net.SplitHostPort(u.Host)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(ports)
+	require.Nil(t, err)
+	containerRing := &test.FakeRing{}
+	for i := 0; i < 3; i++ {
+		containerRing.MockDevices = append(containerRing.MockDevices, &ring.Device{Id: i, Device: "sdb", Scheme: "http", Ip: host, Port: port})
+	}
+	server.containerRing = containerRing
+
+	req, err := http.NewRequest("PUT", "/I/dont/think/this/matters", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Timestamp", "12345.6789")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	req = srv.SetVars(req, vars)
+	dl := zap.NewNop()
+
+	server.updateDeleteAt(req.Context(), req, "1434707411", "1434707411", vars, dl)
+	require.Equal(t, 0, len(requests))
+
+	server.updateDeleteAt(req.Context(), req, "1434707411", "", vars, dl)
+	require.Equal(t, 3, len(requests))
+	require.Equal(t, "PUT /sdb/0/.expiring_objects/1434671963/1434707411-a/c/o", requests[0])
+
+	requests = requests[:0]
+	server.updateDeleteAt(req.Context(), req, "", "1434707411", vars, dl)
+	require.Equal(t, 3, len(requests))
+	require.Equal(t, "DELETE /sdb/0/.expiring_objects/1434671963/1434707411-a/c/o", requests[0])
+
+	cs.Close()
+	server.updateDeleteAt(req.Context(), req, "1434707411", "", vars, dl)
+	hash := server.hashPath(".expiring_objects", "1434671963", "1434707411-a/c/o")
+	require.True(t, fs.Exists(filepath.Join(ts.root, "sda", "async_pending", hash[29:32], hash+"-12345.6789")))
+}
+
+func TestShardRedirect(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusMovedPermanently, Header: http.Header{"Location": {"/.shards_a/c-1/o%20%2F1"}}}
+	account, container, ok := shardRedirect(resp)
+	require.True(t, ok)
+	require.Equal(t, ".shards_a", account)
+	require.Equal(t, "c-1", container)
+	resp.Header.Set("Location", "/.shards_a")
+	_, _, ok = shardRedirect(resp)
+	require.False(t, ok)
+	resp = &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{"Location": {"/.shards_a/c-1/o"}}}
+	_, _, ok = shardRedirect(resp)
+	require.False(t, ok)
+}
+
+func TestShardRedirectLoop(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	defer ts.Close()
+	server := ts.objServer
+
+	// c and c2 redirect to each other.
+	var requests int64
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if strings.HasPrefix(r.URL.Path, "/sdb/0/a/c/") {
+			w.Header().Set("Location", "/a/c2/o")
+		} else {
+			w.Header().Set("Location", "/a/c/o")
+		}
+		w.WriteHeader(http.StatusMovedPermanently)
+	}))
+	defer cs.Close()
+	u, err := url.Parse(cs.URL)
+	require.Nil(t, err)
+	host, ports, err := net.SplitHostPort(u.Host)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(ports)
+	require.Nil(t, err)
+	containerRing := &test.FakeRing{}
+	for i := 0; i < 3; i++ {
+		containerRing.MockDevices = append(containerRing.MockDevices, &ring.Device{Id: i, Device: "sdb", Scheme: "http", Ip: host, Port: port})
+	}
+	server.containerRing = containerRing
+
+	headers := http.Header{"X-Timestamp": {"12345.6789"}}
+	require.False(t, server.sendContainerUpdate(context.Background(), "http", u.Host, "sdb", "PUT", "0", "a", "c", "o", headers, true))
+	// The first redirect is followed to each of the shard's replicas, and no further.
+	require.Equal(t, int64(4), atomic.LoadInt64(&requests))
+}
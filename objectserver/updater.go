@@ -86,29 +86,41 @@ func (ud *updateDevice) listAsyncs(c chan string, cancel chan struct{}) {
 }
 
 func (ud *updateDevice) updateContainers(ap *asyncPending) bool {
-	successes := uint64(0)
-	part := ud.r.containerRing.GetPartition(ap.Account, ap.Container, "")
+	account, container := ap.Account, ap.Container
 	header := common.Map2Headers(ap.Headers)
 	header.Set("User-Agent", fmt.Sprintf("object-updater %d", os.Getpid()))
-	for _, node := range ud.r.containerRing.GetNodes(part) {
-		objUrl := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", node.Scheme, node.Ip, node.Port, node.Device, part,
-			common.Urlencode(ap.Account), common.Urlencode(ap.Container), common.Urlencode(ap.Object))
-		req, err := http.NewRequest(ap.Method, objUrl, nil)
-		if err != nil {
-			ud.r.logger.Error("updateContainers creating new request", zap.Error(err))
-			continue
-		}
-		req.Header = header
-		resp, err := ud.r.client.Do(req)
-		if err != nil {
-			continue
+	// A sharded container redirects the update to the shard holding the object's listing, which gets one try.
+	for attempt := 0; attempt < 2; attempt++ {
+		successes := uint64(0)
+		redirected := false
+		part := ud.r.containerRing.GetPartition(account, container, "")
+		for _, node := range ud.r.containerRing.GetNodes(part) {
+			objUrl := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", node.Scheme, node.Ip, node.Port, node.Device, part,
+				common.Urlencode(account), common.Urlencode(container), common.Urlencode(ap.Object))
+			req, err := http.NewRequest(ap.Method, objUrl, nil)
+			if err != nil {
+				ud.r.logger.Error("updateContainers creating new request", zap.Error(err))
+				continue
+			}
+			req.Header = header
+			resp, err := ud.r.client.Do(req)
+			if err != nil {
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				successes++
+			} else if shardAccount, shardContainer, ok := shardRedirect(resp); ok && !redirected {
+				account, container, redirected = shardAccount, shardContainer, true
+			}
 		}
-		resp.Body.Close()
-		if resp.StatusCode/100 == 2 {
-			successes++
+		if successes >= (ud.r.containerRing.ReplicaCount()/2)+1 {
+			return true
+		} else if !redirected {
+			return false
 		}
 	}
-	return successes >= (ud.r.containerRing.ReplicaCount()/2)+1
+	return false
 }
 
 func (ud *updateDevice) processAsync(async string) {
@@ -16,13 +16,18 @@
 package proxyserver
 
 import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/RocFang/hummingbird/common"
 	"github.com/RocFang/hummingbird/common/srv"
 	"github.com/RocFang/hummingbird/proxyserver/middleware"
+	"go.uber.org/zap"
 )
 
 var listingQueryParms = map[string]bool{
@@ -34,6 +39,7 @@ var listingQueryParms = map[string]bool{
 	"delimiter":  true,
 	"reverse":    true,
 	"path":       true,
+	"include":    true,
 }
 
 func (server *ProxyServer) ContainerGetHandler(writer http.ResponseWriter, request *http.Request) {
@@ -65,6 +71,10 @@ func (server *ProxyServer) ContainerGetHandler(writer http.ResponseWriter, reque
 			return
 		}
 	}
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("X-Backend-Record-Type") == "shard" {
+		server.shardedContainerListing(writer, request, resp, options)
+		return
+	}
 	for k := range resp.Header {
 		if !common.OwnerHeaders[strings.ToLower(k)] || ctx.StorageOwner {
 			writer.Header().Set(k, resp.Header.Get(k))
@@ -74,6 +84,214 @@ func (server *ProxyServer) ContainerGetHandler(writer http.ResponseWriter, reque
 	common.Copy(resp.Body, writer)
 }
 
+// shardRange is the part of a container server's shard range the proxy needs to stitch listings together.
+type shardRange struct {
+	Name  string `json:"name"`
+	Lower string `json:"lower"`
+	Upper string `json:"upper"`
+	State int    `json:"state"`
+}
+
+// Matches containerserver.ShardRangeActive.
+const shardRangeActive = 30
+
+// listingRecord is a single entry of a json container listing, which is re-rendered as xml when needed.
+type listingRecord struct {
+	XMLName       xml.Name `xml:"object" json:"-"`
+	Name          string   `xml:"name" json:"name"`
+	LastModified  string   `xml:"last_modified" json:"last_modified"`
+	Size          int64    `xml:"bytes" json:"bytes"`
+	ContentType   string   `xml:"content_type" json:"content_type"`
+	ETag          string   `xml:"hash" json:"hash"`
+	SymlinkPath   string   `xml:"symlink_path,omitempty" json:"symlink_path"`
+	SymlinkEtag   string   `xml:"symlink_etag,omitempty" json:"symlink_etag"`
+	SymlinkBytes  int64    `xml:"symlink_bytes,omitempty" json:"symlink_bytes"`
+	StoragePolicy string   `xml:"storage_policy,omitempty" json:"storage_policy"`
+	Subdir        string   `xml:"-" json:"subdir"`
+}
+
+type listingSubdir struct {
+	XMLName xml.Name `xml:"subdir"`
+	Name2   string   `xml:"name,attr"`
+	Name    string   `xml:"name"`
+}
+
+// stitchShardListing builds a container listing from its shard ranges, fetching each range's part of the listing
+// as json from the shard container if the range is active, or from the root container otherwise.
+func stitchShardListing(root string, ranges []shardRange, options map[string]string,
+	fetch func(container string, options map[string]string) ([]json.RawMessage, error)) ([]json.RawMessage, []*listingRecord, error) {
+	limit := 10000
+	if l, err := strconv.Atoi(options["limit"]); err == nil && l >= 0 && l < limit {
+		limit = l
+	}
+	reverse := common.LooksTrue(options["reverse"])
+	if reverse {
+		for i, j := 0, len(ranges)-1; i < j; i, j = i+1, j-1 {
+			ranges[i], ranges[j] = ranges[j], ranges[i]
+		}
+	}
+	raw := []json.RawMessage{}
+	records := []*listingRecord{}
+	for _, sr := range ranges {
+		if len(records) >= limit {
+			break
+		}
+		// Names in a range are greater than its lower bound and no greater than its upper bound.
+		lower, upper := sr.Lower, ""
+		if sr.Upper != "" {
+			upper = sr.Upper + "\x00"
+		}
+		prefix := options["prefix"]
+		if path, ok := options["path"]; ok && path != "" {
+			prefix = strings.TrimRight(path, "/") + "/"
+		}
+		if prefix != "" && ((sr.Upper != "" && sr.Upper < prefix) || (lower > prefix && !strings.HasPrefix(lower, prefix))) {
+			continue
+		}
+		subOptions := map[string]string{}
+		for k, v := range options {
+			subOptions[k] = v
+		}
+		subOptions["format"] = "json"
+		subOptions["limit"] = strconv.Itoa(limit - len(records))
+		if reverse {
+			if upper != "" && (options["marker"] == "" || upper < options["marker"]) {
+				subOptions["marker"] = upper
+			}
+			if lower > options["end_marker"] {
+				subOptions["end_marker"] = lower
+			}
+		} else {
+			if lower > options["marker"] {
+				subOptions["marker"] = lower
+			}
+			if upper != "" && (options["end_marker"] == "" || upper < options["end_marker"]) {
+				subOptions["end_marker"] = upper
+			}
+		}
+		container := root
+		if sr.State == shardRangeActive {
+			container = sr.Name
+		}
+		entries, err := fetch(container, subOptions)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries {
+			record := &listingRecord{}
+			if err := json.Unmarshal(entry, record); err != nil {
+				return nil, nil, err
+			}
+			// A subdir can span ranges, but should only be listed once.
+			if record.Subdir != "" && len(records) > 0 && records[len(records)-1].Subdir == record.Subdir {
+				continue
+			}
+			raw = append(raw, entry)
+			records = append(records, record)
+			if len(records) >= limit {
+				break
+			}
+		}
+	}
+	return raw, records, nil
+}
+
+// shardedContainerListing responds with a listing stitched together from a sharded container's shard ranges.
+func (server *ProxyServer) shardedContainerListing(writer http.ResponseWriter, request *http.Request, resp *http.Response, options map[string]string) {
+	vars := srv.GetVars(request)
+	ctx := middleware.GetProxyContext(request)
+	format := common.ListingFormat(options["format"], request.Header.Get("Accept"))
+	if format == "" {
+		srv.StandardResponse(writer, http.StatusNotAcceptable)
+		return
+	}
+	var ranges []shardRange
+	if err := json.NewDecoder(resp.Body).Decode(&ranges); err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	headers := make(http.Header)
+	for k := range request.Header {
+		headers.Set(k, request.Header.Get(k))
+	}
+	headers.Set("X-Backend-Record-Type", "object")
+	fetch := func(container string, options map[string]string) ([]json.RawMessage, error) {
+		account := vars["account"]
+		if i := strings.Index(container, "/"); i >= 0 {
+			account, container = container[:i], container[i+1:]
+		}
+		resp := ctx.C.GetContainerRaw(request.Context(), account, container, options, headers)
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return nil, fmt.Errorf("%d listing %s/%s", resp.StatusCode, account, container)
+		}
+		var entries []json.RawMessage
+		if resp.StatusCode == http.StatusNoContent {
+			return entries, nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			return nil, err
+		}
+		return entries, nil
+	}
+	raw, records, err := stitchShardListing(vars["container"], ranges, options, fetch)
+	if err != nil {
+		ctx.Logger.Error("container GET: error listing shard ranges", zap.String("container", vars["container"]), zap.Error(err))
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	for k := range resp.Header {
+		if k == "X-Backend-Record-Type" || k == "Content-Length" || k == "Content-Type" {
+			continue
+		}
+		if !common.OwnerHeaders[strings.ToLower(k)] || ctx.StorageOwner {
+			writer.Header().Set(k, resp.Header.Get(k))
+		}
+	}
+	var output []byte
+	switch format {
+	case "json":
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		output, _ = json.Marshal(raw)
+	case "xml":
+		type Container struct {
+			XMLName xml.Name `xml:"container"`
+			Name    string   `xml:"name,attr"`
+			Objects []interface{}
+		}
+		container := &Container{Name: vars["container"]}
+		for _, record := range records {
+			if record.Subdir != "" {
+				container.Objects = append(container.Objects, &listingSubdir{Name2: record.Subdir, Name: record.Subdir})
+			} else {
+				container.Objects = append(container.Objects, record)
+			}
+		}
+		writer.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		body, _ := xml.Marshal(container)
+		output = append([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"), body...)
+	default:
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		var buf bytes.Buffer
+		for _, record := range records {
+			if record.Subdir != "" {
+				buf.WriteString(record.Subdir + "\n")
+			} else {
+				buf.WriteString(record.Name + "\n")
+			}
+		}
+		output = buf.Bytes()
+		if len(output) == 0 {
+			writer.Header().Set("Content-Length", "0")
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writer.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(output)
+}
+
 func (server *ProxyServer) ContainerHeadHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
 	ctx := middleware.GetProxyContext(request)
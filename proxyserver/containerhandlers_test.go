@@ -17,6 +17,7 @@ package proxyserver
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -127,3 +128,50 @@ func TestOptionsHandlerNotSetup(t *testing.T) {
 	require.Equal(t, fakeWriter.StatusMap["S"], 401)
 	require.Equal(t, theHeader.Get("Access-Control-Allow-Origin"), "")
 }
+
+func TestStitchShardListing(t *testing.T) {
+	listings := map[string][]string{
+		"c":             {"a", "b", "x"},
+		".shards_a/c-1": {"c", "d"},
+	}
+	var requested []map[string]string
+	fetch := func(container string, options map[string]string) ([]json.RawMessage, error) {
+		requested = append(requested, options)
+		var entries []json.RawMessage
+		for _, name := range listings[container] {
+			if name > options["marker"] && (options["end_marker"] == "" || name < options["end_marker"]) {
+				entries = append(entries, json.RawMessage(`{"name":"`+name+`","bytes":1}`))
+			}
+		}
+		return entries, nil
+	}
+	ranges := []shardRange{
+		{Name: "", Upper: "b", State: 10},
+		{Name: ".shards_a/c-1", Lower: "b", Upper: "m", State: shardRangeActive},
+		{Name: "", Lower: "m", State: 10},
+	}
+	_, records, err := stitchShardListing("c", ranges, map[string]string{}, fetch)
+	require.Nil(t, err)
+	names := []string{}
+	for _, r := range records {
+		names = append(names, r.Name)
+	}
+	require.Equal(t, []string{"a", "b", "c", "d", "x"}, names)
+	require.Equal(t, "b\x00", requested[0]["end_marker"])
+	require.Equal(t, "json", requested[0]["format"])
+
+	requested = nil
+	_, records, err = stitchShardListing("c", ranges, map[string]string{"limit": "3", "marker": "a"}, fetch)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(records))
+	require.Equal(t, "d", records[2].Name)
+	require.Equal(t, 2, len(requested))
+	require.Equal(t, "2", requested[1]["limit"])
+
+	// A path skips ranges that can't hold its objects, like a prefix.
+	requested = nil
+	_, records, err = stitchShardListing("c", ranges, map[string]string{"path": "x"}, fetch)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(requested))
+	require.Equal(t, "x", requested[0]["path"])
+}
@@ -148,11 +148,15 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 			{middleware.NewCatchError, "filter:catch_errors"},
 			{middleware.NewHealthcheck, "filter:healthcheck"},
 			{middleware.NewRequestLogger, "filter:proxy-logging"},
+			{middleware.NewUsage, "filter:usage"},
+			{middleware.NewCNAMELookup, "filter:cname_lookup"},
+			{middleware.NewDomainRemap, "filter:domain_remap"},
 			{middleware.NewS3Auth, "filter:s3api"},
 			{middleware.NewCrossDomain, "filter:crossdomain"},
 			{middleware.NewCors, "filter:cors"}, // TODO: i dont want to have to have a seciton for this
 			{middleware.NewFormPost, "filter:formpost"},
 			{middleware.NewTempURL, "filter:tempurl"},
+			{middleware.NewContainerSync, "filter:container_sync"},
 			{middleware.NewTempAuth, "filter:tempauth"},
 			{middleware.NewS3Api, "filter:s3api"},
 			{middleware.NewBulk, "filter:bulk"},
@@ -163,7 +167,11 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 			{middleware.NewAccountQuota, "filter:account-quotas"},
 			{middleware.NewContainerQuota, "filter:container-quotas"},
 			{middleware.NewVersionedWrites, "filter:versioned_writes"},
+			{middleware.NewLifecycle, "filter:lifecycle"},
+			{middleware.NewSymlink, "filter:symlink"},
 			{middleware.NewXlo, "filter:slo"},
+			{middleware.NewKeymaster, "filter:keymaster"},
+			{middleware.NewEncryption, "filter:encryption"},
 		}
 	} else {
 		middlewares = []struct {
@@ -173,11 +181,15 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 			{middleware.NewCatchError, "filter:catch_errors"},
 			{middleware.NewHealthcheck, "filter:healthcheck"},
 			{middleware.NewRequestLogger, "filter:proxy-logging"},
+			{middleware.NewUsage, "filter:usage"},
+			{middleware.NewCNAMELookup, "filter:cname_lookup"},
+			{middleware.NewDomainRemap, "filter:domain_remap"},
 			{middleware.NewS3Auth, "filter:s3api"},
 			{middleware.NewCrossDomain, "filter:crossdomain"},
 			{middleware.NewCors, "filter:cors"},
 			{middleware.NewFormPost, "filter:formpost"},
 			{middleware.NewTempURL, "filter:tempurl"},
+			{middleware.NewContainerSync, "filter:container_sync"},
 			{middleware.NewAuthToken, "filter:authtoken"},
 			{middleware.NewS3Api, "filter:s3api"},
 			{middleware.NewKeystoneAuth, "filter:keystoneauth"},
@@ -189,7 +201,11 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 			{middleware.NewAccountQuota, "filter:account-quotas"},
 			{middleware.NewContainerQuota, "filter:container-quotas"},
 			{middleware.NewVersionedWrites, "filter:versioned_writes"},
+			{middleware.NewLifecycle, "filter:lifecycle"},
+			{middleware.NewSymlink, "filter:symlink"},
 			{middleware.NewXlo, "filter:slo"},
+			{middleware.NewKeymaster, "filter:keymaster"},
+			{middleware.NewEncryption, "filter:encryption"},
 		}
 	}
 	pipeline := alice.New(globalmiddleware.ServerTracer(server.tracer), middleware.NewContext(config.GetBool("debug", "debug_x_source_code", false),
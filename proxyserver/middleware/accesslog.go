@@ -0,0 +1,326 @@
+//  Copyright (c) 2015-2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+// The access log is a line per request, separate from the server's own
+// logging, for billing and analytics. It's configured in the
+// [filter:proxy-logging] section:
+//
+//   access_log_format = swift
+//   access_log_sink = file:/var/log/hummingbird/access.log
+//
+// The format is "swift", for the same space delimited lines as Swift's
+// proxy-logging, "json", for an object per line with the fields listed in
+// access_log_fields (all of them by default), or a template like
+// "{client_ip} {method} {path} {status_int}". Empty values are logged as "-"
+// and spaces and other unprintable characters in values are %-encoded, except
+// in json.
+//
+// The sink is one of:
+//
+//   file:<path>         appended to, and rotated once it reaches
+//                       access_log_max_size_mb (100), keeping
+//                       access_log_max_backups (5) old files as <path>.1 etc.
+//   syslog              the local syslog, or syslog:<network>://<address>,
+//                       like syslog:udp://loghost:514
+//   unix:<path>         a line at a time to a listener on a Unix socket
+//
+// Lines are written in the background; if access_log_buffer (4096) lines are
+// waiting, more are dropped and counted rather than holding up requests.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+// swiftAccessLogFormat is the order of Swift's proxy-logging lines. Auth tokens
+// and request headers are never logged, so those fields are always "-".
+const swiftAccessLogFormat = "{client_ip} {remote_addr} {datetime} {method} {path} {protocol} {status_int} {referer} " +
+	"{user_agent} {auth_token} {bytes_recvd} {bytes_sent} {client_etag} {transaction_id} {headers} {request_time} " +
+	"{source} {log_info} {start_time} {end_time} {policy_index}"
+
+var accessLogFields = map[string]func(e *accessLogEntry) interface{}{
+	"client_ip": func(e *accessLogEntry) interface{} {
+		if forwarded := e.request.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+		if client := e.request.Header.Get("X-Cluster-Client-Ip"); client != "" {
+			return client
+		}
+		return remoteHost(e.request)
+	},
+	"remote_addr":    func(e *accessLogEntry) interface{} { return remoteHost(e.request) },
+	"datetime":       func(e *accessLogEntry) interface{} { return e.end.UTC().Format("02/Jan/2006/15/04/05") },
+	"method":         func(e *accessLogEntry) interface{} { return e.request.Method },
+	"path":           func(e *accessLogEntry) interface{} { return e.request.URL.RequestURI() },
+	"protocol":       func(e *accessLogEntry) interface{} { return e.request.Proto },
+	"status_int":     func(e *accessLogEntry) interface{} { return e.writer.Status },
+	"referer":        func(e *accessLogEntry) interface{} { return e.request.Header.Get("Referer") },
+	"user_agent":     func(e *accessLogEntry) interface{} { return e.request.Header.Get("User-Agent") },
+	"auth_token":     func(e *accessLogEntry) interface{} { return "" },
+	"headers":        func(e *accessLogEntry) interface{} { return "" },
+	"bytes_recvd":    func(e *accessLogEntry) interface{} { return e.reader.ByteCount },
+	"bytes_sent":     func(e *accessLogEntry) interface{} { return e.writer.ByteCount },
+	"client_etag":    func(e *accessLogEntry) interface{} { return e.request.Header.Get("Etag") },
+	"transaction_id": func(e *accessLogEntry) interface{} { return e.ctx.TxId },
+	"request_time":   func(e *accessLogEntry) interface{} { return e.end.Sub(e.start).Seconds() },
+	"ttfb": func(e *accessLogEntry) interface{} {
+		if e.writer.ResponseStarted.IsZero() {
+			return e.end.Sub(e.start).Seconds()
+		}
+		return e.writer.ResponseStarted.Sub(e.start).Seconds()
+	},
+	"source": func(e *accessLogEntry) interface{} { return e.ctx.Source },
+	"log_info": func(e *accessLogEntry) interface{} {
+		if e.request.Header.Get("X-Force-Acquire") == "true" {
+			return "FA"
+		}
+		return ""
+	},
+	"start_time": func(e *accessLogEntry) interface{} { return float64(e.start.UnixNano()) / float64(time.Second) },
+	"end_time":   func(e *accessLogEntry) interface{} { return float64(e.end.UnixNano()) / float64(time.Second) },
+	"policy_index": func(e *accessLogEntry) interface{} {
+		// Only use what the request already learned; looking the container
+		// up here would hold up every request behind a HEAD.
+		if policy := e.writer.Header().Get("X-Backend-Storage-Policy-Index"); policy != "" {
+			return policy
+		}
+		account, container, _ := e.path()
+		if account == "" || container == "" {
+			return ""
+		}
+		if ci := e.ctx.cachedContainerInfo(account, container); ci != nil {
+			return strconv.Itoa(ci.StoragePolicyIndex)
+		}
+		return ""
+	},
+	"auth_user": func(e *accessLogEntry) interface{} {
+		if e.ctx.S3Auth != nil {
+			return e.ctx.S3Auth.Key
+		}
+		return strings.Join(e.ctx.RemoteUsers, ",")
+	},
+	"api": func(e *accessLogEntry) interface{} {
+		if e.ctx.S3Auth != nil {
+			return "s3"
+		}
+		return "swift"
+	},
+	"account":   func(e *accessLogEntry) interface{} { account, _, _ := e.path(); return account },
+	"container": func(e *accessLogEntry) interface{} { _, container, _ := e.path(); return container },
+	"object":    func(e *accessLogEntry) interface{} { _, _, object := e.path(); return object },
+}
+
+func remoteHost(request *http.Request) string {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
+
+// accessLogEntry is a finished request, whose fields are worked out as the
+// log format needs them.
+type accessLogEntry struct {
+	request    *http.Request
+	ctx        *ProxyContext
+	writer     *srv.WebWriter
+	reader     *srv.CountingReadCloser
+	start, end time.Time
+}
+
+// path gives the account, container and object of the request, for either the
+// Swift or the S3 API.
+func (e *accessLogEntry) path() (string, string, string) {
+	if e.ctx.S3Auth != nil {
+		if e.ctx.S3Auth.Bucket != "" {
+			return "AUTH_" + e.ctx.S3Auth.Account, e.ctx.S3Auth.Bucket, strings.TrimPrefix(e.request.URL.Path, "/")
+		}
+		container, object := s3PathSplit(e.request.URL.Path)
+		return "AUTH_" + e.ctx.S3Auth.Account, container, object
+	}
+	isAPI, account, container, object := getPathParts(e.request)
+	if !isAPI {
+		return "", "", ""
+	}
+	return account, container, object
+}
+
+// accessLogQuote %-encodes characters that would make a log line hard to split.
+func accessLogQuote(s string) string {
+	if s == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c >= 0x7f || c == '"' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+type accessLogFormatter func(e *accessLogEntry) []byte
+
+// newTemplateFormatter returns a formatter for a template with {field}s in it.
+func newTemplateFormatter(template string) (accessLogFormatter, error) {
+	var literals []string
+	var fields []func(e *accessLogEntry) interface{}
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("Unterminated field in access log format: %q", template[start:])
+		}
+		name := template[start+1 : start+end]
+		field, ok := accessLogFields[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown access log field %q", name)
+		}
+		literals = append(literals, template[:start])
+		fields = append(fields, field)
+		template = template[start+end+1:]
+	}
+	literals = append(literals, template)
+	return func(e *accessLogEntry) []byte {
+		var b strings.Builder
+		for i, field := range fields {
+			b.WriteString(literals[i])
+			switch v := field(e).(type) {
+			case string:
+				b.WriteString(accessLogQuote(v))
+			case float64:
+				b.WriteString(strconv.FormatFloat(v, 'f', 4, 64))
+			default:
+				fmt.Fprint(&b, v)
+			}
+		}
+		b.WriteString(literals[len(literals)-1])
+		b.WriteByte('\n')
+		return []byte(b.String())
+	}, nil
+}
+
+// newJSONFormatter returns a formatter for a JSON object per line holding the
+// named fields, or every field if there are none.
+func newJSONFormatter(names []string) (accessLogFormatter, error) {
+	if len(names) == 0 {
+		for name := range accessLogFields {
+			if name != "auth_token" && name != "headers" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		if _, ok := accessLogFields[name]; !ok {
+			return nil, fmt.Errorf("Unknown access log field %q", name)
+		}
+	}
+	return func(e *accessLogEntry) []byte {
+		record := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			record[name] = accessLogFields[name](e)
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil
+		}
+		return append(line, '\n')
+	}, nil
+}
+
+// accessLogger formats lines on the request's goroutine and writes them to
+// its sink on its own.
+type accessLogger struct {
+	format  accessLogFormatter
+	sink    accessLogSink
+	lines   chan []byte
+	dropped tally.Counter
+}
+
+func (a *accessLogger) run() {
+	for line := range a.lines {
+		a.sink.Write(line)
+	}
+	a.sink.Close()
+}
+
+// Log queues the entry's line, dropping it if the sink has fallen too far
+// behind.
+func (a *accessLogger) Log(e *accessLogEntry) {
+	line := a.format(e)
+	if line == nil {
+		return
+	}
+	select {
+	case a.lines <- line:
+	default:
+		a.dropped.Inc(1)
+	}
+}
+
+// newAccessLogger returns the access logger the config asks for, or nil if
+// there's no access_log_format.
+func newAccessLogger(config conf.Section, metricsScope tally.Scope) (*accessLogger, error) {
+	var format accessLogFormatter
+	var err error
+	switch template := config.GetDefault("access_log_format", ""); template {
+	case "":
+		return nil, nil
+	case "swift":
+		format, err = newTemplateFormatter(swiftAccessLogFormat)
+	case "json":
+		var names []string
+		for _, name := range strings.Split(config.GetDefault("access_log_fields", ""), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		format, err = newJSONFormatter(names)
+	default:
+		format, err = newTemplateFormatter(template)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sink, err := newAccessLogSink(config)
+	if err != nil {
+		return nil, err
+	}
+	a := &accessLogger{
+		format:  format,
+		sink:    sink,
+		lines:   make(chan []byte, config.GetInt("access_log_buffer", 4096)),
+		dropped: metricsScope.Counter("access_log_dropped"),
+	}
+	go a.run()
+	return a, nil
+}
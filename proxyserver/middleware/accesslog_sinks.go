@@ -0,0 +1,184 @@
+//  Copyright (c) 2015-2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/RocFang/hummingbird/common/conf"
+)
+
+// accessLogSink is somewhere access log lines go. It's only used from the
+// access logger's goroutine.
+type accessLogSink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+func newAccessLogSink(config conf.Section) (accessLogSink, error) {
+	sink := config.GetDefault("access_log_sink", "syslog")
+	switch {
+	case strings.HasPrefix(sink, "file:"):
+		return newRotatingFileSink(sink[len("file:"):], config.GetInt("access_log_max_size_mb", 100)*1024*1024,
+			int(config.GetInt("access_log_max_backups", 5)))
+	case sink == "syslog":
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_LOCAL0, "proxy-access")
+		if err != nil {
+			return nil, err
+		}
+		return &syslogSink{w}, nil
+	case strings.HasPrefix(sink, "syslog:"):
+		parts := strings.SplitN(sink[len("syslog:"):], "://", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid syslog access log sink %q", sink)
+		}
+		w, err := syslog.Dial(parts[0], parts[1], syslog.LOG_INFO|syslog.LOG_LOCAL0, "proxy-access")
+		if err != nil {
+			return nil, err
+		}
+		return &syslogSink{w}, nil
+	case strings.HasPrefix(sink, "unix:"):
+		return &unixSocketSink{path: sink[len("unix:"):]}, nil
+	}
+	return nil, fmt.Errorf("Unknown access log sink %q", sink)
+}
+
+// rotatingFileSink appends to a file, moving it aside once it's maxSize bytes.
+type rotatingFileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newRotatingFileSink(path string, maxSize int64, maxBackups int) (*rotatingFileSink, error) {
+	s := &rotatingFileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *rotatingFileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	finfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = finfo.Size()
+	return nil
+}
+
+// rotate renames path.N to path.N+1, dropping the oldest, and path to path.1.
+func (s *rotatingFileSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		os.Rename(s.path, s.path+".1")
+	} else {
+		os.Remove(s.path)
+	}
+	return s.open()
+}
+
+func (s *rotatingFileSink) Write(line []byte) error {
+	if s.file == nil {
+		// A rotation failed to open the new file; try again.
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *rotatingFileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	return s.w.Info(strings.TrimSuffix(string(line), "\n"))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// unixSocketSink writes to a Unix stream socket, reconnecting as needed. Lines
+// are dropped while nothing is listening.
+type unixSocketSink struct {
+	path      string
+	conn      net.Conn
+	lastDial  time.Time
+	dialDelay time.Duration
+}
+
+func (s *unixSocketSink) Write(line []byte) error {
+	if s.conn == nil {
+		if time.Since(s.lastDial) < s.dialDelay {
+			return fmt.Errorf("Not connected to %s", s.path)
+		}
+		s.lastDial = time.Now()
+		conn, err := net.DialTimeout("unix", s.path, time.Second)
+		if err != nil {
+			s.dialDelay = time.Second
+			return err
+		}
+		s.conn = conn
+		s.dialDelay = 0
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := s.conn.Write(line); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *unixSocketSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,208 @@
+//  Copyright (c) 2015-2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+func newTestAccessLogEntry(path string) *accessLogEntry {
+	request := httptest.NewRequest("PUT", path, nil)
+	request.RemoteAddr = "10.0.0.1:5555"
+	request.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+	request.Header.Set("User-Agent", "curl/7.0 (linux)")
+	start := time.Unix(1500000000, 0)
+	return &accessLogEntry{
+		request: request,
+		ctx:     &ProxyContext{TxId: "tx123", RemoteUsers: []string{"test", "test:tester"}},
+		writer:  &srv.WebWriter{ResponseWriter: httptest.NewRecorder(), Status: 201, ResponseStarted: start.Add(time.Second), ByteCount: 7},
+		reader:  &srv.CountingReadCloser{ByteCount: 1024},
+		start:   start,
+		end:     start.Add(1500 * time.Millisecond),
+	}
+}
+
+func TestAccessLogTemplate(t *testing.T) {
+	format, err := newTemplateFormatter("{client_ip} {method} {path} {status_int} {bytes_recvd}/{bytes_sent} {auth_user} {api} " +
+		"{account} {container} {object} {referer} {user_agent} {ttfb} {transaction_id}")
+	require.Nil(t, err)
+	line := string(format(newTestAccessLogEntry("/v1/a/c/o%20x?foo=bar")))
+	require.Equal(t, "1.2.3.4 PUT /v1/a/c/o%20x?foo=bar 201 1024/7 test,test:tester swift a c o%20x - curl/7.0%20(linux) 1.0000 tx123\n", line)
+
+	format, err = newTemplateFormatter(swiftAccessLogFormat)
+	require.Nil(t, err)
+	fields := strings.Fields(string(format(newTestAccessLogEntry("/v1/a/c/o"))))
+	require.Equal(t, 21, len(fields))
+	require.Equal(t, "10.0.0.1", fields[1])
+	require.Equal(t, "14/Jul/2017/02/40/01", fields[2])
+	require.Equal(t, "-", fields[9])
+	require.Equal(t, "1.5000", fields[15])
+	require.Equal(t, "1500000000.0000", fields[18])
+
+	_, err = newTemplateFormatter("{method} {nope}")
+	require.NotNil(t, err)
+	_, err = newTemplateFormatter("{method")
+	require.NotNil(t, err)
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	format, err := newJSONFormatter([]string{"method", "status_int", "api", "auth_user", "account", "container", "object"})
+	require.Nil(t, err)
+	e := newTestAccessLogEntry("/bucket/some/key")
+	e.ctx.S3Auth = &S3AuthInfo{Key: "test:tester", Account: "test"}
+	record := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(format(e), &record))
+	require.Equal(t, map[string]interface{}{"method": "PUT", "status_int": 201.0, "api": "s3", "auth_user": "test:tester",
+		"account": "AUTH_test", "container": "bucket", "object": "some/key"}, record)
+
+	// A virtual-hosted-style request's bucket is in the Host.
+	e = newTestAccessLogEntry("/some/key")
+	e.request.Host = "bucket.s3.example.com"
+	e.ctx.S3Auth = &S3AuthInfo{Key: "test:tester", Account: "test", Bucket: "bucket"}
+	record = map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(format(e), &record))
+	require.Equal(t, "bucket", record["container"])
+	require.Equal(t, "some/key", record["object"])
+
+	format, err = newJSONFormatter(nil)
+	require.Nil(t, err)
+	record = map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(format(newTestAccessLogEntry("/v1/a")), &record))
+	require.Equal(t, 1024.0, record["bytes_recvd"])
+	_, ok := record["auth_token"]
+	require.False(t, ok)
+
+	_, err = newJSONFormatter([]string{"nope"})
+	require.NotNil(t, err)
+}
+
+func TestAccessLogPolicyIndex(t *testing.T) {
+	format, err := newTemplateFormatter("{policy_index}")
+	require.Nil(t, err)
+	// Nothing is looked up just for the log line.
+	e := newTestAccessLogEntry("/v1/a/c/o")
+	require.Equal(t, "-\n", string(format(e)))
+
+	e.ctx.containerInfoCache = map[string]*client.ContainerInfo{"container/a/c": {StoragePolicyIndex: 2}}
+	require.Equal(t, "2\n", string(format(e)))
+
+	e = newTestAccessLogEntry("/v1/a/c/o")
+	e.writer.Header().Set("X-Backend-Storage-Policy-Index", "1")
+	require.Equal(t, "1\n", string(format(e)))
+}
+
+func TestAccessLogRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	sink, err := newRotatingFileSink(path, 10, 1)
+	require.Nil(t, err)
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		require.Nil(t, sink.Write([]byte(line)))
+	}
+	require.Nil(t, sink.Close())
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "third\n", string(data))
+	data, err = ioutil.ReadFile(path + ".1")
+	require.Nil(t, err)
+	require.Equal(t, "second\n", string(data))
+	_, err = os.Stat(path + ".2")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestAccessLogUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.sock")
+	sink := &unixSocketSink{path: path}
+	require.NotNil(t, sink.Write([]byte("nobody listening\n")))
+
+	listener, err := net.Listen("unix", path)
+	require.Nil(t, err)
+	defer listener.Close()
+	sink.dialDelay = 0
+	require.Nil(t, sink.Write([]byte("hello\n")))
+	conn, err := listener.Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.Nil(t, err)
+	require.Equal(t, "hello\n", line)
+	require.Nil(t, sink.Close())
+}
+
+func TestAccessLogDropsWhenBehind(t *testing.T) {
+	scope := tally.NewTestScope("", nil)
+	format, err := newTemplateFormatter("{method}")
+	require.Nil(t, err)
+	a := &accessLogger{format: format, lines: make(chan []byte, 1), dropped: scope.Counter("access_log_dropped")}
+	a.Log(newTestAccessLogEntry("/v1/a"))
+	a.Log(newTestAccessLogEntry("/v1/a"))
+	require.Equal(t, "PUT\n", string(<-a.lines))
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["access_log_dropped+"].Value())
+}
+
+func TestRequestLoggerAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	config, err := conf.StringConfig("[filter:proxy-logging]\naccess_log_format = {method} {path} {status_int} {bytes_sent}\naccess_log_sink = file:" + path + "\n")
+	require.Nil(t, err)
+	mw, err := NewRequestLogger(config.GetSection("filter:proxy-logging"), tally.NoopScope)
+	require.Nil(t, err)
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("hello"))
+	}))
+	request := httptest.NewRequest("GET", "/v1/a/c/o", nil)
+	request = request.WithContext(context.WithValue(request.Context(), "proxycontext", &ProxyContext{Logger: zap.NewNop()}))
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	var data []byte
+	for i := 0; i < 100; i++ {
+		if data, err = ioutil.ReadFile(path); err == nil && len(data) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, "GET /v1/a/c/o 200 5\n", string(data))
+
+	config, err = conf.StringConfig("[filter:proxy-logging]\naccess_log_format = json\naccess_log_fields = nope\n")
+	require.Nil(t, err)
+	_, err = NewRequestLogger(config.GetSection("filter:proxy-logging"), tally.NoopScope)
+	require.NotNil(t, err)
+}
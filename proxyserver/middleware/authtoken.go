@@ -330,6 +330,10 @@ func (at *authToken) validateS3Signature(ctx context.Context, proxyCtx *ProxyCon
 
 	if tok != nil {
 		proxyCtx.S3Auth.Account = tok.Project.ID
+		if tok.S3Creds != nil {
+			// V4 streaming uploads need the signing key to verify each chunk
+			proxyCtx.S3Auth.setSecret([]byte(tok.S3Creds.Secret))
+		}
 		// TODO: We need to get and cache the secret to sign our own requests
 		at.cacheToken(ctx, proxyCtx, "S3:"+proxyCtx.S3Auth.Key, tok)
 		return tok, true
@@ -365,7 +369,8 @@ func (at *authToken) cacheToken(ctx context.Context, proxyCtx *ProxyContext, key
 // doValidateS3 returns an error for any problems attempting the validation
 // (i.e. the end user did nothing wrong); it will return nil, nil if the user's
 // credentials could not be validated; or it will return the token, nil on
-// successful validation.
+// successful validation. Keystone tells V2 and V4 signatures apart by the
+// string to sign, so both are sent the same way.
 func (at *authToken) doValidateS3(ctx context.Context, proxyCtx *ProxyContext, stringToSign, key, signature string) (*token, error) {
 	creds := &s3Creds{}
 	creds.Credentials.Access = key
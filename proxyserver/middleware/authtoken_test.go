@@ -171,6 +171,14 @@ func (mr *mockTokenMemcacheRing) SetMulti(ctx context.Context, serverKey string,
 	return nil
 }
 
+func (mr *mockTokenMemcacheRing) GetStructuredCAS(ctx context.Context, key string, val interface{}) (uint64, error) {
+	return 0, mr.GetStructured(ctx, key, val)
+}
+
+func (mr *mockTokenMemcacheRing) SetCAS(ctx context.Context, key string, value interface{}, cas uint64, timeout int) error {
+	return mr.Set(ctx, key, value, timeout)
+}
+
 func (mr *mockTokenMemcacheRing) getTimeout(key string) int {
 	mr.lock.Lock()
 	defer mr.lock.Unlock()
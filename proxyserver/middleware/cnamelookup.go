@@ -0,0 +1,207 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+// CNAME lookup lets customers point their own domains at a container: a
+// request for www.example.org, a CNAME of web.auth-test.storage.example.com,
+// is handled as a request for the latter, which domain_remap then turns into
+// a request to /v1/AUTH_test/web. It's configured in the
+// [filter:cname_lookup] section:
+//
+//   storage_domain = storage.example.com
+//   lookup_depth = 1
+//   resolver = dns
+//   cache_time = 300
+//
+// and does nothing without a storage_domain. Up to lookup_depth CNAMEs are
+// followed looking for a host in the storage_domain (a comma separated list
+// is fine). The resolver is "dns", or "file:<path>" to read CNAMEs from a file
+// of "<host> <cname>" lines instead, for testing. Lookups are cached in
+// memcache for cache_time seconds.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// cnameResolver looks up the CNAME of a host, returning "" if it doesn't
+// have one.
+type cnameResolver interface {
+	LookupCNAME(ctx context.Context, host string) (string, error)
+}
+
+type dnsCNAMEResolver struct {
+	resolver *net.Resolver
+}
+
+func (r *dnsCNAMEResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	cname, err := r.resolver.LookupCNAME(ctx, host)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	cname = strings.ToLower(strings.TrimSuffix(cname, "."))
+	if cname == host {
+		return "", nil
+	}
+	return cname, nil
+}
+
+// staticCNAMEResolver has a fixed set of CNAMEs.
+type staticCNAMEResolver map[string]string
+
+func (r staticCNAMEResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	return r[host], nil
+}
+
+func loadStaticCNAMEResolver(path string) (staticCNAMEResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := staticCNAMEResolver{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected <host> <cname>", path, line)
+		}
+		r[strings.ToLower(strings.TrimSuffix(fields[0], "."))] = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+	}
+	return r, scanner.Err()
+}
+
+type cnameCacheEntry struct {
+	CNAME string `json:"cname"`
+}
+
+type cnameLookup struct {
+	storageDomains []string
+	lookupDepth    int
+	resolver       cnameResolver
+	cacheTime      int
+	requestsMetric tally.Counter
+}
+
+func (c *cnameLookup) inStorageDomain(host string) bool {
+	for _, domain := range c.storageDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cnameLookup) lookup(ctx context.Context, proxyCtx *ProxyContext, host string) (string, error) {
+	key := "cname:" + host
+	if proxyCtx.Cache != nil {
+		var entry *cnameCacheEntry
+		if err := proxyCtx.Cache.GetStructured(ctx, key, &entry); err == nil && entry != nil {
+			return entry.CNAME, nil
+		}
+	}
+	cname, err := c.resolver.LookupCNAME(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if proxyCtx.Cache != nil {
+		proxyCtx.Cache.Set(ctx, key, &cnameCacheEntry{CNAME: cname}, c.cacheTime)
+	}
+	return cname, nil
+}
+
+func (c *cnameLookup) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := GetProxyContext(request)
+		host := strings.ToLower(requestHost(request))
+		if host == "" || ctx.Source != "" || c.inStorageDomain(host) || net.ParseIP(host) != nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		c.requestsMetric.Inc(1)
+		for depth := 0; depth < c.lookupDepth; depth++ {
+			cname, err := c.lookup(request.Context(), ctx, host)
+			if err != nil {
+				ctx.Logger.Debug("CNAME lookup failed", zap.String("host", host), zap.Error(err))
+				next.ServeHTTP(writer, request)
+				return
+			}
+			if cname == "" {
+				if depth == 0 {
+					// Not a CNAME at all, so not one of ours.
+					next.ServeHTTP(writer, request)
+					return
+				}
+				break
+			}
+			if c.inStorageDomain(cname) {
+				request.Host = cname
+				next.ServeHTTP(writer, request)
+				return
+			}
+			host = cname
+		}
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "CNAME lookup failed to resolve to a valid domain")
+	})
+}
+
+func NewCNAMELookup(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	c := &cnameLookup{
+		storageDomains: splitConfigList(strings.ToLower(config.GetDefault("storage_domain", ""))),
+		lookupDepth:    int(config.GetInt("lookup_depth", 1)),
+		cacheTime:      int(config.GetInt("cache_time", 300)),
+		requestsMetric: metricsScope.Counter("cname_lookup_requests"),
+	}
+	if len(c.storageDomains) == 0 {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	for i, domain := range c.storageDomains {
+		c.storageDomains[i] = strings.Trim(domain, ".")
+	}
+	if c.lookupDepth < 1 {
+		c.lookupDepth = 1
+	}
+	switch resolver := config.GetDefault("resolver", "dns"); {
+	case resolver == "dns":
+		c.resolver = &dnsCNAMEResolver{resolver: net.DefaultResolver}
+	case strings.HasPrefix(resolver, "file:"):
+		r, err := loadStaticCNAMEResolver(resolver[len("file:"):])
+		if err != nil {
+			return nil, err
+		}
+		c.resolver = r
+	default:
+		return nil, fmt.Errorf("Unknown cname_lookup resolver %q", resolver)
+	}
+	RegisterInfo("cname_lookup", map[string]interface{}{"lookup_depth": c.lookupDepth})
+	return c.handler, nil
+}
@@ -0,0 +1,108 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/test"
+	"github.com/justinas/alice"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+func TestCNAMELookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cnames := filepath.Join(dir, "cnames")
+	require.Nil(t, ioutil.WriteFile(cnames, []byte("# customer sites\n"+
+		"www.example.org. web.auth-test.storage.example.com.\n"+
+		"example.net www.example.org\n"+
+		"a.example.org b.example.org\n"+
+		"b.example.org c.example.org\n"), 0644))
+	config, err := conf.StringConfig("[filter:cname_lookup]\nstorage_domain = storage.example.com\nresolver = file:" + cnames + "\n" +
+		"[filter:domain_remap]\nstorage_domain = storage.example.com\n")
+	require.Nil(t, err)
+	lookup, err := NewCNAMELookup(config.GetSection("filter:cname_lookup"), tally.NoopScope)
+	require.Nil(t, err)
+	remap, err := NewDomainRemap(config.GetSection("filter:domain_remap"), tally.NoopScope)
+	require.Nil(t, err)
+	var served *http.Request
+	handler := alice.New(lookup, remap).Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r
+		w.WriteHeader(200)
+	}))
+	cache := &test.FakeMemcacheRing{}
+	for _, tc := range []struct {
+		host     string
+		status   int
+		expected string
+	}{
+		{"www.example.org:8080", 200, "/v1/AUTH_test/web/index.html"},
+		{"WWW.Example.org", 200, "/v1/AUTH_test/web/index.html"},
+		{"web.auth-test.storage.example.com", 200, "/v1/AUTH_test/web/index.html"},
+		{"unknown.example.org", 200, "/index.html"},
+		{"127.0.0.1", 200, "/index.html"},
+		// CNAMEs pointing elsewhere, or too far away with the default depth.
+		{"a.example.org", 400, ""},
+		{"example.net", 400, ""},
+	} {
+		served = nil
+		request := httptest.NewRequest("GET", "/index.html", nil)
+		request.Host = tc.host
+		request = request.WithContext(context.WithValue(request.Context(), "proxycontext", &ProxyContext{
+			ProxyContextMiddleware: &ProxyContextMiddleware{Cache: cache},
+			Logger:                 zap.NewNop(),
+		}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, request)
+		require.Equal(t, tc.status, rec.Code, tc.host)
+		if tc.status == 200 {
+			require.Equal(t, tc.expected, served.URL.Path, tc.host)
+		}
+	}
+	require.Equal(t, &cnameCacheEntry{CNAME: "web.auth-test.storage.example.com"}, cache.MockSetValues[0])
+
+	config, err = conf.StringConfig("[filter:cname_lookup]\nstorage_domain = storage.example.com\nlookup_depth = 2\nresolver = file:" + cnames + "\n")
+	require.Nil(t, err)
+	lookup, err = NewCNAMELookup(config.GetSection("filter:cname_lookup"), tally.NoopScope)
+	require.Nil(t, err)
+	handler = alice.New(lookup, remap).Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r
+	}))
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = "example.net"
+	request = request.WithContext(context.WithValue(request.Context(), "proxycontext", &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{},
+		Logger:                 zap.NewNop(),
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	require.Equal(t, "/v1/AUTH_test/web/", served.URL.Path)
+
+	config, err = conf.StringConfig("[filter:cname_lookup]\nstorage_domain = storage.example.com\nresolver = nope\n")
+	require.Nil(t, err)
+	_, err = NewCNAMELookup(config.GetSection("filter:cname_lookup"), tally.NoopScope)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,109 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"strings"
+
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+// checkSyncAuth verifies an X-Container-Sync-Auth value of the form "realm nonce signature".
+func checkSyncAuth(realms conf.SyncRealmList, auth, method, path, timestamp, userKey string) bool {
+	parts := strings.Fields(auth)
+	if len(parts) != 3 || userKey == "" {
+		return false
+	}
+	realm, ok := realms[parts[0]]
+	if !ok {
+		return false
+	}
+	for _, key := range []string{realm.Key1, realm.Key2} {
+		if key != "" && hmac.Equal([]byte(parts[2]), []byte(conf.SyncSignature(key, method, path, timestamp, parts[1], userKey))) {
+			return true
+		}
+	}
+	return false
+}
+
+func containerSync(realms conf.SyncRealmList, requestsMetric tally.Counter, failuresMetric tally.Counter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			auth := request.Header.Get("X-Container-Sync-Auth")
+			if auth == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			ctx := GetProxyContext(request)
+			if ctx.Authorize != nil {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			requestsMetric.Inc(1)
+			apiReq, account, container, obj := getPathParts(request)
+			if !apiReq || account == "" || container == "" || obj == "" {
+				failuresMetric.Inc(1)
+				srv.StandardResponse(writer, 401)
+				return
+			}
+			timestamp, err := common.StandardizeTimestamp(ctx.clientTimestamp)
+			if err != nil {
+				failuresMetric.Inc(1)
+				srv.StandardResponse(writer, 400)
+				return
+			}
+			ci, err := ctx.C.GetContainerInfo(request.Context(), account, container)
+			if err != nil || !checkSyncAuth(realms, auth, request.Method, request.URL.EscapedPath(), ctx.clientTimestamp, ci.SyncKey) {
+				failuresMetric.Inc(1)
+				srv.StandardResponse(writer, 401)
+				return
+			}
+			// Synced objects keep the timestamp they had on the source cluster.
+			request.Header.Set("X-Timestamp", timestamp)
+			ctx.RemoteUsers = []string{".container_sync"}
+			ctx.Authorize = func(r *http.Request) (bool, int) {
+				ar, a, c, _ := getPathParts(r)
+				if ar && a == account && c == container {
+					return true, http.StatusOK
+				}
+				return false, http.StatusUnauthorized
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func NewContainerSync(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	realms, err := conf.GetSyncRealms()
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]interface{}{}
+	for name, realm := range realms {
+		clusters := map[string]interface{}{}
+		for cluster := range realm.Clusters {
+			clusters[cluster] = map[string]interface{}{}
+		}
+		info[name] = map[string]interface{}{"clusters": clusters}
+	}
+	RegisterInfo("container_sync", map[string]interface{}{"realms": info})
+	return containerSync(realms, metricsScope.Counter("container_sync_requests"), metricsScope.Counter("container_sync_failures")), nil
+}
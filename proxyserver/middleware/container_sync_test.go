@@ -0,0 +1,100 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/RocFang/hummingbird/common/test"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var testSyncRealms = conf.SyncRealmList{"realm": {Name: "realm", Key1: "key1", Key2: "key2", Clusters: map[string]string{"east": "http://east/v1/"}}}
+
+func newContainerSyncTestRequest(t *testing.T, auth, timestamp string) *http.Request {
+	r := httptest.NewRequest("PUT", "/v1/a/c/o", nil)
+	r.Header.Set("X-Container-Sync-Auth", auth)
+	r.Header.Set("X-Timestamp", "9999999999.00000")
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	ctx := &ProxyContext{
+		C: f.NewRequestClient(nil, map[string]*client.ContainerInfo{
+			"container/a/c": {SyncKey: "userkey", Metadata: map[string]string{}},
+		}, zap.NewNop()),
+		clientTimestamp: timestamp,
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+}
+
+func TestCheckSyncAuth(t *testing.T) {
+	sig := conf.SyncSignature("key2", "PUT", "/v1/a/c/o", "1400000000.00000", "nonce", "userkey")
+	require.True(t, checkSyncAuth(testSyncRealms, "realm nonce "+sig, "PUT", "/v1/a/c/o", "1400000000.00000", "userkey"))
+	require.False(t, checkSyncAuth(testSyncRealms, "realm nonce "+sig, "DELETE", "/v1/a/c/o", "1400000000.00000", "userkey"))
+	require.False(t, checkSyncAuth(testSyncRealms, "realm nonce "+sig, "PUT", "/v1/a/c/o", "1400000000.00000", ""))
+	require.False(t, checkSyncAuth(testSyncRealms, "other nonce "+sig, "PUT", "/v1/a/c/o", "1400000000.00000", "userkey"))
+	require.False(t, checkSyncAuth(testSyncRealms, "realm "+sig, "PUT", "/v1/a/c/o", "1400000000.00000", "userkey"))
+}
+
+func TestContainerSyncMiddlewarePassNoAuth(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/v1/a/c/o", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
+	w := httptest.NewRecorder()
+	served := false
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		served = true
+	})
+	scope := common.NewTestScope()
+	containerSync(testSyncRealms, scope.Counter("requests"), scope.Counter("failures"))(handler).ServeHTTP(w, r)
+	require.True(t, served)
+}
+
+func TestContainerSyncMiddleware401BadSig(t *testing.T) {
+	r := newContainerSyncTestRequest(t, "realm nonce 0000", "1400000000.00000")
+	w := httptest.NewRecorder()
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
+	scope := common.NewTestScope()
+	containerSync(testSyncRealms, scope.Counter("requests"), scope.Counter("failures"))(handler).ServeHTTP(w, r)
+	require.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestContainerSyncMiddlewareAuthorized(t *testing.T) {
+	sig := conf.SyncSignature("key1", "PUT", "/v1/a/c/o", "1400000000.00000", "nonce", "userkey")
+	r := newContainerSyncTestRequest(t, "realm nonce "+sig, "1400000000.00000")
+	w := httptest.NewRecorder()
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := GetProxyContext(request)
+		require.NotNil(t, ctx.Authorize)
+		ok, _ := ctx.Authorize(request)
+		require.True(t, ok)
+		ok, _ = ctx.Authorize(httptest.NewRequest("PUT", "/v1/a/other/o", nil))
+		require.False(t, ok)
+		require.Equal(t, []string{".container_sync"}, ctx.RemoteUsers)
+		require.Equal(t, "1400000000.00000", request.Header.Get("X-Timestamp"))
+		writer.WriteHeader(201)
+	})
+	scope := common.NewTestScope()
+	containerSync(testSyncRealms, scope.Counter("requests"), scope.Counter("failures"))(handler).ServeHTTP(w, r)
+	require.Equal(t, 201, w.Result().StatusCode)
+}
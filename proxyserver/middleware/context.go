@@ -114,6 +114,23 @@ type ProxyContext struct {
 	depth            int
 	Source           string
 	S3Auth           *S3AuthInfo
+	// clientTimestamp is the X-Timestamp sent by the client, which is
+	// replaced on the request but honored for container sync.
+	clientTimestamp string
+	// cryptoKeys are set by the keymaster for the encryption middleware.
+	cryptoKeys *cryptoKeys
+	// remappedPrefix is what domain_remap put in front of the client's path,
+	// so staticweb can send the client paths it knows.
+	remappedPrefix string
+	// containerInfoCache is the request client's local container info cache,
+	// kept so the access log can read it without looking anything up.
+	containerInfoCache map[string]*client.ContainerInfo
+}
+
+// cachedContainerInfo returns the container info already looked up during
+// the request, or nil if it hasn't been; it never makes a request itself.
+func (pc *ProxyContext) cachedContainerInfo(account, container string) *client.ContainerInfo {
+	return pc.containerInfoCache[fmt.Sprintf("container/%s/%s", account, container)]
 }
 
 func GetProxyContext(r *http.Request) *ProxyContext {
@@ -245,6 +262,7 @@ func (pc *ProxyContext) newSubrequest(method, urlStr string, body io.Reader, req
 		C:                      pc.C,
 		TxId:                   pc.TxId,
 		accountInfoCache:       pc.accountInfoCache,
+		containerInfoCache:     pc.containerInfoCache,
 		status:                 500,
 		depth:                  pc.depth + 1,
 		Source:                 source,
@@ -307,6 +325,7 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 		}
 	}
 
+	clientTimestamp := request.Header.Get("X-Timestamp")
 	for k := range request.Header {
 		for _, ex := range excludeHeaders {
 			if strings.HasPrefix(k, ex) || k == "X-Timestamp" {
@@ -321,6 +340,7 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 	writer.Header().Set("X-Openstack-Request-Id", transId)
 	request.Header.Set("X-Timestamp", common.GetTimestamp())
 	logr := m.log.With(zap.String("txn", transId))
+	containerInfoCache := make(map[string]*client.ContainerInfo)
 	pc := &ProxyContext{
 		ProxyContextMiddleware: m,
 		Authorize:              nil,
@@ -328,7 +348,9 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 		TxId:                   transId,
 		status:                 500,
 		accountInfoCache:       make(map[string]*AccountInfo),
-		C:                      m.proxyClientFactory.NewRequestClient(m.Cache, make(map[string]*client.ContainerInfo), logr),
+		containerInfoCache:     containerInfoCache,
+		C:                      m.proxyClientFactory.NewRequestClient(m.Cache, containerInfoCache, logr),
+		clientTimestamp:        clientTimestamp,
 	}
 	// we'll almost certainly need the AccountInfo and ContainerInfo for the current path, so pre-fetch them in parallel.
 	apiRequest, account, container, _ := getPathParts(request)
@@ -0,0 +1,51 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RocFang/hummingbird/client"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/RocFang/hummingbird/common/test"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestContextStripsBackendHeaders(t *testing.T) {
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	for _, writeHeader := range []bool{true, false} {
+		next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Header().Set("X-Backend-Sharding-State", "sharded")
+			writer.Header().Set("X-Container-Object-Count", "3")
+			if writeHeader {
+				writer.WriteHeader(200)
+			}
+			writer.Write([]byte("o"))
+		})
+		rec := httptest.NewRecorder()
+		NewContext(false, nil, zap.NewNop(), f)(next).ServeHTTP(rec, httptest.NewRequest("GET", "/v2/a/c", nil))
+		require.Equal(t, 200, rec.Code)
+		require.Equal(t, "", rec.Header().Get("X-Backend-Sharding-State"))
+		require.Equal(t, "3", rec.Header().Get("X-Container-Object-Count"))
+		require.Equal(t, "o", rec.Body.String())
+	}
+}
@@ -0,0 +1,166 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+// Domain remap turns requests to container.account.storage_domain into
+// requests to /v1/account/container, so containers can be served as websites
+// by staticweb at their own hostnames. It's configured in the
+// [filter:domain_remap] section:
+//
+//   storage_domain = storage.example.com
+//   path_root = v1
+//   reseller_prefixes = AUTH
+//   default_reseller_prefix =
+//
+// and does nothing without a storage_domain. storage_domain, path_root and
+// reseller_prefixes can be comma separated lists; requests are remapped onto
+// the first path_root. Since hostnames can't have underscores, an account of
+// auth-test is taken to be AUTH_test. Accounts without one of the
+// reseller_prefixes get default_reseller_prefix, if there is one, or aren't
+// remapped. Paths that already start with the account (and container) are
+// left alone.
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+type domainRemap struct {
+	storageDomains        []string
+	pathRoots             []string
+	resellerPrefixes      []string
+	defaultResellerPrefix string
+	requestsMetric        tally.Counter
+}
+
+// splitConfigList splits a comma separated config value, dropping empty
+// entries.
+func splitConfigList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// requestHost returns the request's host without a port.
+func requestHost(request *http.Request) string {
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+}
+
+// storageDomainSubdomain returns the part of host before one of the
+// (lowercase) storage domains, or "" if it isn't in any of them.
+func storageDomainSubdomain(host string, storageDomains []string) string {
+	lower := strings.ToLower(host)
+	for _, domain := range storageDomains {
+		if strings.HasSuffix(lower, "."+domain) {
+			return host[:len(host)-len(domain)-1]
+		}
+	}
+	return ""
+}
+
+// account returns the real account name for the one in the hostname, or ""
+// if it doesn't have a known reseller prefix.
+func (d *domainRemap) account(account string) string {
+	if !strings.Contains(account, "_") {
+		account = strings.Replace(account, "-", "_", 1)
+	}
+	prefix := strings.SplitN(account, "_", 2)[0]
+	for _, reseller := range d.resellerPrefixes {
+		if strings.EqualFold(prefix, reseller) && strings.Contains(account, "_") {
+			return reseller + account[len(prefix):]
+		}
+	}
+	if d.defaultResellerPrefix != "" {
+		return d.defaultResellerPrefix + "_" + account
+	}
+	return ""
+}
+
+func (d *domainRemap) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := GetProxyContext(request)
+		subdomain := storageDomainSubdomain(requestHost(request), d.storageDomains)
+		if subdomain == "" || ctx.Source != "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		parts := strings.Split(subdomain, ".")
+		if len(parts) > 2 {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Bad domain in host header")
+			return
+		}
+		account := d.account(parts[len(parts)-1])
+		if account == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		d.requestsMetric.Inc(1)
+		suffix, rawSuffix := "/"+account, "/"+url.PathEscape(account)
+		if len(parts) == 2 {
+			suffix, rawSuffix = suffix+"/"+parts[0], rawSuffix+"/"+url.PathEscape(parts[0])
+		}
+		for _, root := range d.pathRoots {
+			prefix := "/" + root + suffix
+			if request.URL.Path == prefix || strings.HasPrefix(request.URL.Path, prefix+"/") {
+				next.ServeHTTP(writer, request)
+				return
+			}
+		}
+		prefix := "/" + d.pathRoots[0] + suffix
+		request.URL.RawPath = "/" + d.pathRoots[0] + rawSuffix + request.URL.EscapedPath()
+		request.URL.Path = prefix + request.URL.Path
+		ctx.remappedPrefix = prefix
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func NewDomainRemap(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	d := &domainRemap{
+		storageDomains:        splitConfigList(strings.ToLower(config.GetDefault("storage_domain", ""))),
+		pathRoots:             splitConfigList(config.GetDefault("path_root", "v1")),
+		resellerPrefixes:      splitConfigList(config.GetDefault("reseller_prefixes", "AUTH")),
+		defaultResellerPrefix: strings.TrimSpace(config.GetDefault("default_reseller_prefix", "")),
+		requestsMetric:        metricsScope.Counter("domain_remap_requests"),
+	}
+	if len(d.storageDomains) == 0 {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	for i, domain := range d.storageDomains {
+		d.storageDomains[i] = strings.Trim(domain, ".")
+	}
+	for i, root := range d.pathRoots {
+		d.pathRoots[i] = strings.Trim(root, "/")
+	}
+	if len(d.pathRoots) == 0 {
+		d.pathRoots = []string{"v1"}
+	}
+	RegisterInfo("domain_remap", map[string]interface{}{"default_reseller_prefix": d.defaultResellerPrefix})
+	return d.handler, nil
+}
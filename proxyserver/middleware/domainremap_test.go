@@ -0,0 +1,86 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+func TestDomainRemap(t *testing.T) {
+	config, err := conf.StringConfig("[filter:domain_remap]\nstorage_domain = storage.example.com, .other.example.com\n" +
+		"path_root = v1, v2\nreseller_prefixes = AUTH, SERVICE\n")
+	require.Nil(t, err)
+	mw, err := NewDomainRemap(config.GetSection("filter:domain_remap"), tally.NoopScope)
+	require.Nil(t, err)
+	var served *http.Request
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r
+		w.WriteHeader(200)
+	}))
+	for _, tc := range []struct {
+		host, path, source string
+		status             int
+		expected, prefix   string
+	}{
+		{"c.auth-test.storage.example.com", "/o", "", 200, "/v1/AUTH_test/c/o", "/v1/AUTH_test/c"},
+		{"C.AUTH-Test.Storage.Example.com:8080", "/dir/", "", 200, "/v1/AUTH_Test/C/dir/", "/v1/AUTH_Test/C"},
+		{"c.service_x.other.example.com", "/", "", 200, "/v1/SERVICE_x/c/", "/v1/SERVICE_x/c"},
+		{"auth-test.storage.example.com", "/c/o", "", 200, "/v1/AUTH_test/c/o", "/v1/AUTH_test"},
+		{"c.auth-test.storage.example.com", "/o%20x", "", 200, "/v1/AUTH_test/c/o x", "/v1/AUTH_test/c"},
+		// Already full paths are left alone.
+		{"c.auth-test.storage.example.com", "/v2/AUTH_test/c/o", "", 200, "/v2/AUTH_test/c/o", ""},
+		// Unknown reseller prefixes, other domains and subrequests aren't remapped.
+		{"c.test.storage.example.com", "/o", "", 200, "/o", ""},
+		{"c.auth-test.example.com", "/o", "", 200, "/o", ""},
+		{"storage.example.com", "/v1/AUTH_test", "", 200, "/v1/AUTH_test", ""},
+		{"c.auth-test.storage.example.com", "/v1/AUTH_test/c/o", "staticweb", 200, "/v1/AUTH_test/c/o", ""},
+		{"x.c.auth-test.storage.example.com", "/o", "", 400, "", ""},
+	} {
+		served = nil
+		request := httptest.NewRequest("GET", tc.path, nil)
+		request.Host = tc.host
+		ctx := &ProxyContext{Logger: zap.NewNop(), Source: tc.source}
+		request = request.WithContext(context.WithValue(request.Context(), "proxycontext", ctx))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, request)
+		require.Equal(t, tc.status, rec.Code, tc.host+tc.path)
+		if tc.status == 200 {
+			require.Equal(t, tc.expected, served.URL.Path, tc.host+tc.path)
+			require.Equal(t, tc.prefix, ctx.remappedPrefix, tc.host+tc.path)
+		}
+	}
+
+	config, err = conf.StringConfig("[filter:domain_remap]\nstorage_domain = storage.example.com\ndefault_reseller_prefix = AUTH\n")
+	require.Nil(t, err)
+	mw, err = NewDomainRemap(config.GetSection("filter:domain_remap"), tally.NoopScope)
+	require.Nil(t, err)
+	handler = mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r
+	}))
+	request := httptest.NewRequest("GET", "/o", nil)
+	request.Host = "c.test.storage.example.com"
+	request = request.WithContext(context.WithValue(request.Context(), "proxycontext", &ProxyContext{Logger: zap.NewNop()}))
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	require.Equal(t, "/v1/AUTH_test/c/o", served.URL.Path)
+}
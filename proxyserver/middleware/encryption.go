@@ -0,0 +1,631 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+const (
+	cryptoCipher         = "AES_CTR_256"
+	cryptoBodyMeta       = "X-Object-Sysmeta-Crypto-Body-Meta"
+	cryptoEtag           = "X-Object-Sysmeta-Crypto-Etag"
+	cryptoEtagMac        = "X-Object-Sysmeta-Crypto-Etag-Mac"
+	cryptoMetaPrefix     = "X-Object-Transient-Sysmeta-Crypto-Meta-"
+	cryptoChecksumPrefix = "X-Object-Sysmeta-Crypto-Checksum-"
+	overrideEtag         = "X-Object-Sysmeta-Container-Update-Override-Etag"
+	cryptoMetaSeparator  = "; swift_meta="
+)
+
+var errEtagMismatch = errors.New("etag mismatch")
+
+// cryptoMeta describes how a value was encrypted.
+type cryptoMeta struct {
+	Cipher  string      `json:"cipher"`
+	IV      string      `json:"iv"`
+	BodyKey *cryptoMeta `json:"body_key,omitempty"`
+	Key     string      `json:"key,omitempty"`
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// newCTRStream returns an AES-CTR stream positioned offset bytes in.
+func newCTRStream(key, iv []byte, offset int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV length %d", len(iv))
+	}
+	counter := new(big.Int).SetBytes(iv)
+	counter.Add(counter, big.NewInt(offset/aes.BlockSize))
+	ctr := make([]byte, aes.BlockSize)
+	cb := counter.Bytes()
+	if len(cb) > aes.BlockSize {
+		cb = cb[len(cb)-aes.BlockSize:]
+	}
+	copy(ctr[aes.BlockSize-len(cb):], cb)
+	stream := cipher.NewCTR(block, ctr)
+	if skip := offset % aes.BlockSize; skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	return stream, nil
+}
+
+func crypt(key, iv, data []byte) ([]byte, error) {
+	stream, err := newCTRStream(key, iv, 0)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	stream.XORKeyStream(out, data)
+	return out, nil
+}
+
+// encryptValue encrypts a header value, returning it in the form
+// "<base64 ciphertext>; swift_meta=<url encoded crypto meta>".
+func encryptValue(key []byte, value string) (string, error) {
+	iv, err := randomBytes(aes.BlockSize)
+	if err != nil {
+		return "", err
+	}
+	ct, err := crypt(key, iv, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	meta, err := json.Marshal(&cryptoMeta{Cipher: cryptoCipher, IV: base64.StdEncoding.EncodeToString(iv)})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(ct) + cryptoMetaSeparator + url.QueryEscape(string(meta)), nil
+}
+
+func (m *cryptoMeta) iv() ([]byte, error) {
+	if m.Cipher != cryptoCipher {
+		return nil, fmt.Errorf("unsupported cipher %q", m.Cipher)
+	}
+	return base64.StdEncoding.DecodeString(m.IV)
+}
+
+func parseCryptoMeta(value string) (*cryptoMeta, []byte, error) {
+	meta := &cryptoMeta{}
+	if err := json.Unmarshal([]byte(value), meta); err != nil {
+		return nil, nil, err
+	}
+	iv, err := meta.iv()
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, iv, nil
+}
+
+// decryptValue reverses encryptValue.
+func decryptValue(key []byte, value string) (string, error) {
+	i := strings.Index(value, cryptoMetaSeparator)
+	if i < 0 {
+		return "", errors.New("missing crypto meta")
+	}
+	ct, err := base64.StdEncoding.DecodeString(value[:i])
+	if err != nil {
+		return "", err
+	}
+	rawMeta, err := url.QueryUnescape(value[i+len(cryptoMetaSeparator):])
+	if err != nil {
+		return "", err
+	}
+	_, iv, err := parseCryptoMeta(rawMeta)
+	if err != nil {
+		return "", err
+	}
+	pt, err := crypt(key, iv, ct)
+	if err != nil {
+		return "", err
+	}
+	return string(pt), nil
+}
+
+func etagMac(key []byte, etag string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(etag))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newBodyCrypto makes a random body key, and returns the stream to encrypt the
+// body with and the body crypto meta, with the body key wrapped by the object
+// key.
+func newBodyCrypto(objectKey []byte) (cipher.Stream, string, error) {
+	bodyKey, err := randomBytes(32)
+	if err != nil {
+		return nil, "", err
+	}
+	bodyIV, err := randomBytes(aes.BlockSize)
+	if err != nil {
+		return nil, "", err
+	}
+	wrapIV, err := randomBytes(aes.BlockSize)
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := crypt(objectKey, wrapIV, bodyKey)
+	if err != nil {
+		return nil, "", err
+	}
+	stream, err := newCTRStream(bodyKey, bodyIV, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	meta, err := json.Marshal(&cryptoMeta{
+		Cipher: cryptoCipher,
+		IV:     base64.StdEncoding.EncodeToString(bodyIV),
+		BodyKey: &cryptoMeta{
+			Cipher: cryptoCipher,
+			IV:     base64.StdEncoding.EncodeToString(wrapIV),
+			Key:    base64.StdEncoding.EncodeToString(wrapped),
+		},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return stream, string(meta), nil
+}
+
+// openBodyCrypto unwraps the body key from the body crypto meta and returns a
+// stream to decrypt the body from offset.
+func openBodyCrypto(objectKey []byte, value string, offset int64) (cipher.Stream, error) {
+	meta, iv, err := parseCryptoMeta(value)
+	if err != nil {
+		return nil, err
+	}
+	if meta.BodyKey == nil {
+		return nil, errors.New("missing body key")
+	}
+	wrapIV, err := meta.BodyKey.iv()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(meta.BodyKey.Key)
+	if err != nil {
+		return nil, err
+	}
+	bodyKey, err := crypt(objectKey, wrapIV, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newCTRStream(bodyKey, iv, offset)
+}
+
+// encryptMetadata moves user metadata into encrypted transient sysmeta.
+func encryptMetadata(key []byte, header http.Header) error {
+	for k := range header {
+		if !strings.HasPrefix(k, "X-Object-Meta-") {
+			continue
+		}
+		name := k[len("X-Object-Meta-"):]
+		value := header.Get(k)
+		header.Del(k)
+		if value == "" {
+			continue
+		}
+		ev, err := encryptValue(key, value)
+		if err != nil {
+			return err
+		}
+		header.Set(cryptoMetaPrefix+name, ev)
+	}
+	return nil
+}
+
+// encryptingReader encrypts the body of an object PUT, and once it has all
+// been read fills in the encrypted etag and checksum trailers. The object
+// servers only see the ciphertext, so the checksums the client sent are
+// verified here against the plaintext instead.
+type encryptingReader struct {
+	src               io.Reader
+	stream            cipher.Stream
+	hash              hash.Hash
+	checksums         common.Checksums
+	keys              *cryptoKeys
+	expectedEtag      string
+	expectedChecksums map[string]string
+	trailer           http.Header
+	etag              string
+	mismatch          bool
+}
+
+func (r *encryptingReader) Trailer() http.Header {
+	return r.trailer
+}
+
+func (r *encryptingReader) finish() error {
+	if r.etag != "" || r.mismatch {
+		return nil
+	}
+	etag := hex.EncodeToString(r.hash.Sum(nil))
+	if r.expectedEtag != "" && r.expectedEtag != etag {
+		r.mismatch = true
+		return errEtagMismatch
+	}
+	if err := r.checksums.Verify(r.expectedChecksums); err != nil {
+		r.mismatch = true
+		return err
+	}
+	for _, algorithm := range r.checksums.Algorithms() {
+		encSum, err := encryptValue(r.keys.object, hex.EncodeToString(r.checksums[algorithm].Sum(nil)))
+		if err != nil {
+			return err
+		}
+		r.trailer.Set(cryptoChecksumPrefix+algorithm, encSum)
+	}
+	encEtag, err := encryptValue(r.keys.object, etag)
+	if err != nil {
+		return err
+	}
+	listingEtag, err := encryptValue(r.keys.container, etag)
+	if err != nil {
+		return err
+	}
+	r.trailer.Set(cryptoEtag, encEtag)
+	r.trailer.Set(cryptoEtagMac, etagMac(r.keys.object, etag))
+	r.trailer.Set(overrideEtag, listingEtag)
+	r.etag = etag
+	return nil
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	if r.mismatch {
+		return 0, errEtagMismatch
+	}
+	n, err := r.src.Read(p)
+	if n > 0 {
+		r.hash.Write(p[:n])
+		r.checksums.Write(p[:n])
+		r.stream.XORKeyStream(p[:n], p[:n])
+	}
+	if err == io.EOF {
+		if ferr := r.finish(); ferr != nil {
+			return n, ferr
+		}
+	}
+	return n, err
+}
+
+// encryptPutWriter reports the plaintext etag and checksums of an encrypted
+// PUT, or a 422 if the body didn't match the etag or checksums the client sent.
+type encryptPutWriter struct {
+	http.ResponseWriter
+	reader   *encryptingReader
+	dropBody bool
+}
+
+func (w *encryptPutWriter) WriteHeader(status int) {
+	if w.reader.mismatch {
+		w.Header().Del("Etag")
+		w.dropBody = true
+		srv.StandardResponse(w.ResponseWriter, http.StatusUnprocessableEntity)
+		return
+	}
+	if status/100 == 2 && w.reader.etag != "" {
+		w.Header().Set("Etag", w.reader.etag)
+		dropChecksums(w.Header())
+		for k, v := range w.reader.checksums.Headers() {
+			w.Header().Set(k, v)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *encryptPutWriter) Write(b []byte) (int, error) {
+	if w.dropBody {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// etagMatches reports whether an If-Match or If-None-Match value matches etag.
+func etagMatches(condition, etag string) bool {
+	for _, e := range strings.Split(condition, ",") {
+		e = strings.Trim(strings.TrimSpace(e), "\"")
+		if e == "*" || e == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// dropChecksums removes the checksums the object servers computed, which are of
+// the ciphertext.
+func dropChecksums(header http.Header) {
+	for k := range header {
+		if common.ChecksumAlgorithm(k) != "" {
+			header.Del(k)
+		}
+	}
+}
+
+// decryptObjectWriter decrypts the metadata and body of object GET and HEAD
+// responses. Conditional requests are checked here against the plaintext etag,
+// since the object servers only know the etag of the ciphertext.
+type decryptObjectWriter struct {
+	http.ResponseWriter
+	keys        *cryptoKeys
+	logger      *zap.Logger
+	ifMatch     string
+	ifNoneMatch string
+	stream      cipher.Stream
+	buf         []byte
+	dropBody    bool
+}
+
+func (w *decryptObjectWriter) fail(msg string, err error) {
+	w.logger.Error(msg, zap.Error(err))
+	w.dropBody = true
+	srv.StandardResponse(w.ResponseWriter, http.StatusInternalServerError)
+}
+
+func (w *decryptObjectWriter) WriteHeader(status int) {
+	header := w.Header()
+	if status/100 == 2 {
+		for k := range header {
+			if strings.HasPrefix(k, cryptoMetaPrefix) {
+				value, err := decryptValue(w.keys.object, header.Get(k))
+				if err != nil {
+					w.fail("Unable to decrypt object metadata", err)
+					return
+				}
+				header.Set("X-Object-Meta-"+k[len(cryptoMetaPrefix):], value)
+				header.Del(k)
+			}
+		}
+		if header.Get(cryptoBodyMeta) != "" {
+			dropChecksums(header)
+		}
+		for k := range header {
+			if strings.HasPrefix(k, cryptoChecksumPrefix) {
+				sum, err := decryptValue(w.keys.object, header.Get(k))
+				if err != nil {
+					w.fail("Unable to decrypt object checksum", err)
+					return
+				}
+				header.Set(common.ChecksumHeader(k[len(cryptoChecksumPrefix):]), sum)
+				header.Del(k)
+			}
+		}
+		if v := header.Get(cryptoEtag); v != "" {
+			etag, err := decryptValue(w.keys.object, v)
+			if err != nil {
+				w.fail("Unable to decrypt object etag", err)
+				return
+			}
+			header.Set("Etag", etag)
+		}
+		if v := header.Get(cryptoBodyMeta); v != "" {
+			var offset int64
+			if cr := header.Get("Content-Range"); status == http.StatusPartialContent && cr != "" {
+				var end int64
+				if _, err := fmt.Sscanf(cr, "bytes %d-%d/", &offset, &end); err != nil {
+					w.fail("Unable to parse Content-Range", err)
+					return
+				}
+			}
+			stream, err := openBodyCrypto(w.keys.object, v, offset)
+			if err != nil {
+				w.fail("Unable to decrypt object body key", err)
+				return
+			}
+			w.stream = stream
+		}
+		for _, k := range []string{cryptoBodyMeta, cryptoEtag, cryptoEtagMac, overrideEtag} {
+			header.Del(k)
+		}
+		etag := strings.Trim(header.Get("Etag"), "\"")
+		if w.ifMatch != "" && !etagMatches(w.ifMatch, etag) {
+			w.dropBody = true
+			srv.StandardResponse(w.ResponseWriter, http.StatusPreconditionFailed)
+			return
+		}
+		if w.ifNoneMatch != "" && etagMatches(w.ifNoneMatch, etag) {
+			w.dropBody = true
+			header.Del("Content-Range")
+			srv.StandardResponse(w.ResponseWriter, http.StatusNotModified)
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *decryptObjectWriter) Write(b []byte) (int, error) {
+	if w.dropBody {
+		return len(b), nil
+	}
+	if w.stream == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	if cap(w.buf) < len(b) {
+		w.buf = make([]byte, len(b))
+	}
+	buf := w.buf[:len(b)]
+	w.stream.XORKeyStream(buf, b)
+	return w.ResponseWriter.Write(buf)
+}
+
+var (
+	jsonListingHash = regexp.MustCompile(`("hash": ?")([^"]*` + regexp.QuoteMeta(cryptoMetaSeparator) + `[^"]*)(")`)
+	xmlListingHash  = regexp.MustCompile(`(<hash>)([^<]*` + regexp.QuoteMeta(cryptoMetaSeparator) + `[^<]*)(</hash>)`)
+)
+
+// decryptListing decrypts the encrypted etags in a JSON or XML container
+// listing.
+func decryptListing(key []byte, body []byte, re *regexp.Regexp, logger *zap.Logger) []byte {
+	return re.ReplaceAllFunc(body, func(m []byte) []byte {
+		parts := re.FindSubmatch(m)
+		etag, err := decryptValue(key, string(parts[2]))
+		if err != nil {
+			logger.Error("Unable to decrypt listing etag", zap.Error(err))
+			return m
+		}
+		return append(append(append([]byte{}, parts[1]...), etag...), parts[3]...)
+	})
+}
+
+func encryption(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := GetProxyContext(request)
+		if ctx == nil || ctx.cryptoKeys == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		keys := ctx.cryptoKeys
+		_, _, _, obj := getPathParts(request)
+		if obj == "" {
+			if request.Method != "GET" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			cw := NewCaptureWriter()
+			next.ServeHTTP(cw, request)
+			body := cw.body
+			if cw.status == http.StatusOK {
+				switch strings.Split(cw.header.Get("Content-Type"), ";")[0] {
+				case "application/json":
+					body = decryptListing(keys.container, body, jsonListingHash, ctx.Logger)
+				case "application/xml", "text/xml":
+					body = decryptListing(keys.container, body, xmlListingHash, ctx.Logger)
+				}
+				cw.header.Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			for k, v := range cw.header {
+				writer.Header()[k] = v
+			}
+			writer.WriteHeader(cw.status)
+			writer.Write(body)
+			return
+		}
+		switch request.Method {
+		case "PUT":
+			if status, str := common.CheckMetadata(request, "Object"); status != http.StatusOK {
+				srv.SimpleErrorResponse(writer, status, str)
+				return
+			}
+			if err := encryptMetadata(keys.object, request.Header); err != nil {
+				ctx.Logger.Error("Unable to encrypt object metadata", zap.Error(err))
+				srv.StandardResponse(writer, http.StatusInternalServerError)
+				return
+			}
+			stream, bodyMeta, err := newBodyCrypto(keys.object)
+			if err != nil {
+				ctx.Logger.Error("Unable to create object body key", zap.Error(err))
+				srv.StandardResponse(writer, http.StatusInternalServerError)
+				return
+			}
+			trailer := http.Header{cryptoEtag: nil, cryptoEtagMac: nil, overrideEtag: nil}
+			expectedChecksums := map[string]string{}
+			var algorithms []string
+			for k := range request.Header {
+				if algorithm := common.ChecksumAlgorithm(k); algorithm != "" {
+					if !common.ValidChecksumAlgorithm(algorithm) {
+						http.Error(writer, "Unsupported checksum algorithm", http.StatusBadRequest)
+						return
+					}
+					algorithms = append(algorithms, algorithm)
+					expectedChecksums[common.ChecksumHeader(algorithm)] = request.Header.Get(k)
+					trailer[http.CanonicalHeaderKey(cryptoChecksumPrefix+algorithm)] = nil
+					request.Header.Del(k)
+				}
+			}
+			request.Header.Set(cryptoBodyMeta, bodyMeta)
+			er := &encryptingReader{
+				src:               request.Body,
+				stream:            stream,
+				hash:              md5.New(),
+				checksums:         common.NewChecksums(algorithms...),
+				keys:              keys,
+				expectedEtag:      strings.Trim(strings.ToLower(request.Header.Get("Etag")), "\""),
+				expectedChecksums: expectedChecksums,
+				trailer:           trailer,
+			}
+			request.Header.Del("Etag")
+			request.Body = struct {
+				*encryptingReader
+				io.Closer
+			}{er, request.Body}
+			next.ServeHTTP(&encryptPutWriter{ResponseWriter: writer, reader: er}, request)
+		case "POST":
+			if status, str := common.CheckMetadata(request, "Object"); status != http.StatusOK {
+				srv.SimpleErrorResponse(writer, status, str)
+				return
+			}
+			if err := encryptMetadata(keys.object, request.Header); err != nil {
+				ctx.Logger.Error("Unable to encrypt object metadata", zap.Error(err))
+				srv.StandardResponse(writer, http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(writer, request)
+		case "GET", "HEAD":
+			dw := &decryptObjectWriter{
+				ResponseWriter: writer,
+				keys:           keys,
+				logger:         ctx.Logger,
+				ifMatch:        request.Header.Get("If-Match"),
+				ifNoneMatch:    request.Header.Get("If-None-Match"),
+			}
+			request.Header.Del("If-Match")
+			request.Header.Del("If-None-Match")
+			next.ServeHTTP(dw, request)
+		default:
+			next.ServeHTTP(writer, request)
+		}
+	})
+}
+
+// NewEncryption returns the middleware that encrypts object data, user
+// metadata and listing etags at rest, using the keys the keymaster set up.
+// Each object body is encrypted with AES-CTR under its own random key, which
+// is stored wrapped by the object key in sysmeta.
+func NewEncryption(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	return encryption, nil
+}
@@ -0,0 +1,253 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var testRootSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// fakeCryptoBackend stores objects the way the object servers would, including
+// the trailers, and serves single ranges of them back.
+type fakeCryptoBackend struct {
+	header  http.Header
+	body    []byte
+	listing string
+}
+
+func (b *fakeCryptoBackend) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	_, _, _, obj := getPathParts(request)
+	if obj == "" {
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer.WriteHeader(200)
+		writer.Write([]byte(b.listing))
+		return
+	}
+	switch request.Method {
+	case "PUT":
+		b.body, _ = ioutil.ReadAll(request.Body)
+		if request.Header.Get("Etag") != "" {
+			writer.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		b.header = http.Header{}
+		for k, v := range request.Header {
+			b.header[k] = v
+		}
+		if t, ok := request.Body.(interface{ Trailer() http.Header }); ok {
+			for k := range t.Trailer() {
+				b.header.Set(k, t.Trailer().Get(k))
+			}
+		}
+		sum := md5.Sum(b.body)
+		b.header.Set("Etag", hex.EncodeToString(sum[:]))
+		b.listing = fmt.Sprintf(`[{"name":"o","hash":"%s","bytes":%d}]`, b.header.Get(overrideEtag), len(b.body))
+		writer.Header().Set("Etag", b.header.Get("Etag"))
+		writer.WriteHeader(201)
+	case "GET", "HEAD":
+		for k, v := range b.header {
+			writer.Header()[k] = v
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(request.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			writer.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(b.body)))
+			writer.WriteHeader(206)
+			writer.Write(b.body[start : end+1])
+			return
+		}
+		writer.WriteHeader(200)
+		writer.Write(b.body)
+	}
+}
+
+func cryptoTestRequest(method, path string, body []byte) *http.Request {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{Logger: zap.NewNop()}))
+}
+
+func TestCTRStreamOffset(t *testing.T) {
+	key, iv := testRootSecret, []byte("fedcba9876543210")
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ct, err := crypt(key, iv, data)
+	require.Nil(t, err)
+	require.NotEqual(t, data, ct)
+	for _, offset := range []int64{0, 15, 16, 37} {
+		stream, err := newCTRStream(key, iv, offset)
+		require.Nil(t, err)
+		pt := make([]byte, len(ct)-int(offset))
+		stream.XORKeyStream(pt, ct[offset:])
+		require.Equal(t, data[offset:], pt)
+	}
+	// the counter carries across the whole IV
+	_, err = newCTRStream(key, bytes.Repeat([]byte{0xff}, 16), 32)
+	require.Nil(t, err)
+}
+
+func TestEncryptValue(t *testing.T) {
+	ev, err := encryptValue(testRootSecret, "hello")
+	require.Nil(t, err)
+	require.NotContains(t, ev, "hello")
+	require.Contains(t, ev, cryptoMetaSeparator)
+	v, err := decryptValue(testRootSecret, ev)
+	require.Nil(t, err)
+	require.Equal(t, "hello", v)
+	_, err = decryptValue(testRootSecret, "hello")
+	require.NotNil(t, err)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	backend := &fakeCryptoBackend{}
+	handler := keymaster(testRootSecret)(encryption(backend))
+	data := []byte(strings.Repeat("some plaintext data ", 10))
+	sum := md5.Sum(data)
+	etag := hex.EncodeToString(sum[:])
+
+	r := cryptoTestRequest("PUT", "/v1/a/c/o", data)
+	r.Header.Set("Etag", etag)
+	r.Header.Set("X-Object-Meta-Color", "blue")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, etag, w.Header().Get("Etag"))
+	require.NotEqual(t, data, backend.body)
+	require.Equal(t, len(data), len(backend.body))
+	require.Equal(t, "", backend.header.Get("X-Object-Meta-Color"))
+	require.NotEqual(t, "", backend.header.Get(cryptoMetaPrefix+"Color"))
+	require.NotEqual(t, "", backend.header.Get(cryptoBodyMeta))
+	require.NotEqual(t, etag, backend.header.Get(cryptoEtag))
+
+	r = cryptoTestRequest("GET", "/v1/a/c/o", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, data, w.Body.Bytes())
+	require.Equal(t, etag, w.Header().Get("Etag"))
+	require.Equal(t, "blue", w.Header().Get("X-Object-Meta-Color"))
+	require.Equal(t, "", w.Header().Get(cryptoBodyMeta))
+
+	r = cryptoTestRequest("GET", "/v1/a/c/o", nil)
+	r.Header.Set("Range", "bytes=37-120")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 206, w.Code)
+	require.Equal(t, data[37:121], w.Body.Bytes())
+
+	r = cryptoTestRequest("GET", "/v1/a/c/o", nil)
+	r.Header.Set("If-None-Match", "\""+etag+"\"")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 304, w.Code)
+
+	r = cryptoTestRequest("GET", "/v1/a/c/o", nil)
+	r.Header.Set("If-Match", backend.header.Get("Etag"))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 412, w.Code)
+
+	r = cryptoTestRequest("GET", "/v1/a/c", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, fmt.Sprintf(`[{"name":"o","hash":"%s","bytes":%d}]`, etag, len(data)), w.Body.String())
+
+	// another object's key can't read it
+	r = cryptoTestRequest("GET", "/v1/a/c/o2", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.NotEqual(t, data, w.Body.Bytes())
+}
+
+func TestEncryptionEtagMismatch(t *testing.T) {
+	backend := &fakeCryptoBackend{}
+	handler := keymaster(testRootSecret)(encryption(backend))
+	r := cryptoTestRequest("PUT", "/v1/a/c/o", []byte("data"))
+	r.Header.Set("Etag", "d41d8cd98f00b204e9800998ecf8427e")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 422, w.Code)
+	require.Equal(t, "", w.Header().Get("Etag"))
+}
+
+func TestEncryptionChecksums(t *testing.T) {
+	backend := &fakeCryptoBackend{}
+	handler := keymaster(testRootSecret)(encryption(backend))
+	data := []byte("some plaintext data")
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+
+	r := cryptoTestRequest("PUT", "/v1/a/c/o", data)
+	r.Header.Set("X-Object-Checksum-Sha256", checksum)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, checksum, w.Header().Get("X-Object-Checksum-Sha256"))
+	// The object servers only ever see the ciphertext, so they aren't asked
+	// to check the client's checksum against it.
+	require.Equal(t, "", backend.header.Get("X-Object-Checksum-Sha256"))
+	require.NotEqual(t, "", backend.header.Get(cryptoChecksumPrefix+"Sha256"))
+	require.NotContains(t, backend.header.Get(cryptoChecksumPrefix+"Sha256"), checksum)
+
+	// Checksums the object servers keep of the ciphertext aren't shown.
+	backend.header.Set("X-Object-Checksum-Crc32c", "01234567")
+	for _, method := range []string{"GET", "HEAD"} {
+		r = cryptoTestRequest(method, "/v1/a/c/o", nil)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		require.Equal(t, 200, w.Code)
+		require.Equal(t, checksum, w.Header().Get("X-Object-Checksum-Sha256"))
+		require.Equal(t, "", w.Header().Get("X-Object-Checksum-Crc32c"))
+		require.Equal(t, "", w.Header().Get(cryptoChecksumPrefix+"Sha256"))
+	}
+
+	r = cryptoTestRequest("PUT", "/v1/a/c/o", data)
+	r.Header.Set("X-Object-Checksum-Sha256", strings.Repeat("0", 64))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 422, w.Code)
+
+	r = cryptoTestRequest("PUT", "/v1/a/c/o", data)
+	r.Header.Set("X-Object-Checksum-Md4", "0123")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 400, w.Code)
+}
+
+func TestEncryptionNoKeys(t *testing.T) {
+	backend := &fakeCryptoBackend{}
+	r := cryptoTestRequest("PUT", "/v1/a/c/o", []byte("data"))
+	w := httptest.NewRecorder()
+	encryption(backend).ServeHTTP(w, r)
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, []byte("data"), backend.body)
+	require.Equal(t, "", backend.header.Get(cryptoBodyMeta))
+}
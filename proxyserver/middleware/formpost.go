@@ -18,10 +18,9 @@ package middleware
 import (
 	"context"
 	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"html"
 	"io"
 	"io/ioutil"
@@ -66,20 +65,22 @@ func (o *fpLimitReader) Read(p []byte) (int, error) {
 	return i, err
 }
 
-func authenticateFormpost(ctx context.Context, proxyCtx *ProxyContext, account, container, path string, attrs map[string]string) int {
+func authenticateFormpost(ctx context.Context, proxyCtx *ProxyContext, account, container, path string, attrs map[string]string, digests map[string]func() hash.Hash) int {
 	if expires, err := common.ParseDate(attrs["expires"]); err != nil {
 		return FP_ERROR
 	} else if time.Now().After(expires) {
 		return FP_EXPIRED
 	}
 
-	sigb, err := hex.DecodeString(attrs["signature"])
-	if err != nil || len(sigb) == 0 {
+	digest, sigb := parseSignature(attrs["signature"], digests)
+	if sigb == nil {
 		return FP_ERROR
+	} else if digest == nil {
+		return FP_INVALID
 	}
 
 	checkhmac := func(key []byte) bool {
-		mac := hmac.New(sha1.New, key)
+		mac := hmac.New(digest, key)
 		fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", path, attrs["redirect"],
 			attrs["max_file_size"], attrs["max_file_count"], attrs["expires"])
 		return hmac.Equal(sigb, mac.Sum(nil))
@@ -139,7 +140,7 @@ func formpostAuthorizer(scope int, account, container string) func(r *http.Reque
 	}
 }
 
-func formpost(formpostRequestsMetric tally.Counter) func(http.Handler) http.Handler {
+func formpost(formpostRequestsMetric tally.Counter, digests map[string]func() hash.Hash) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			if request.Method != "POST" {
@@ -203,7 +204,7 @@ func formpost(formpostRequestsMetric tally.Counter) func(http.Handler) http.Hand
 							formpostRespond(writer, 400, "max_file_size not valid", attrs["redirect"])
 							return
 						}
-						scope := authenticateFormpost(request.Context(), ctx, account, container, request.URL.Path, attrs)
+						scope := authenticateFormpost(request.Context(), ctx, account, container, request.URL.Path, attrs, digests)
 						switch scope {
 						case FP_EXPIRED:
 							formpostRespond(writer, 401, "Form Expired", attrs["redirect"])
@@ -265,6 +266,10 @@ func formpost(formpostRequestsMetric tally.Counter) func(http.Handler) http.Hand
 }
 
 func NewFormPost(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
-	RegisterInfo("formpost", map[string]interface{}{})
-	return formpost(metricsScope.Counter("formpost_requests")), nil
+	digests, err := parseAllowedDigests(config)
+	if err != nil {
+		return nil, err
+	}
+	RegisterInfo("formpost", map[string]interface{}{"allowed_digests": digestNames(digests)})
+	return formpost(metricsScope.Counter("formpost_requests"), digests), nil
 }
@@ -20,8 +20,11 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -62,7 +65,7 @@ func makeFormpostRequest(t *testing.T, body, boundary string, next http.Handler)
 		},
 	}
 	newr = newr.WithContext(context.WithValue(newr.Context(), "proxycontext", ctx))
-	formpost(common.NewTestScope().Counter("test_formpost"))(next).ServeHTTP(neww, newr)
+	formpost(common.NewTestScope().Counter("test_formpost"), tempurlDigests)(next).ServeHTTP(neww, newr)
 	return neww
 }
 
@@ -187,30 +190,42 @@ func TestAuthenticateFormpost(t *testing.T) {
 	}
 
 	require.Equal(t, FP_ERROR,
-		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "X"}))
+		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "X"}, tempurlDigests))
 	require.Equal(t, FP_EXPIRED,
-		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "12345"}))
+		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "12345"}, tempurlDigests))
 	require.Equal(t, FP_ERROR,
-		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999", "signature": "X"}))
+		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999", "signature": "X"}, tempurlDigests))
 
 	// account key 1
 	require.Equal(t, FP_SCOPE_ACCOUNT,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "1d4cb17a0d70b32f7987fe49b1990020bab52ae6"}))
+			"signature": "1d4cb17a0d70b32f7987fe49b1990020bab52ae6"}, tempurlDigests))
 	// account key 2
 	require.Equal(t, FP_SCOPE_ACCOUNT,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "9749158451be0383af1ec6d8e10f09a2d0d5f2b1"}))
+			"signature": "9749158451be0383af1ec6d8e10f09a2d0d5f2b1"}, tempurlDigests))
 	// container key 1
 	require.Equal(t, FP_SCOPE_CONTAINER,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "3320ff06b119d287a1c8d18d4356cd91e8518fe7"}))
+			"signature": "3320ff06b119d287a1c8d18d4356cd91e8518fe7"}, tempurlDigests))
 	// container key 2
 	require.Equal(t, FP_SCOPE_CONTAINER,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "a3c3dd56ad65f5b87eeb384f9e0406c79511b556"}))
+			"signature": "a3c3dd56ad65f5b87eeb384f9e0406c79511b556"}, tempurlDigests))
 	// invalid key
 	require.Equal(t, FP_INVALID,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "1111111111111111111111111111111111111111"}))
+			"signature": "1111111111111111111111111111111111111111"}, tempurlDigests))
+
+	// sha256, base64 encoded
+	mac := hmac.New(sha256.New, []byte("containerkey"))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", "/v1/a/c", "", "", "", "9999999999")
+	sig := "sha256:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	require.Equal(t, FP_SCOPE_CONTAINER,
+		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
+			"signature": sig}, tempurlDigests))
+	// but not if sha256 isn't allowed
+	require.Equal(t, FP_INVALID,
+		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
+			"signature": sig}, map[string]func() hash.Hash{"sha1": sha1.New}))
 }
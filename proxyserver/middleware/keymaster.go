@@ -0,0 +1,145 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/uber-go/tally"
+)
+
+const minRootSecretLength = 32
+
+// cryptoKeys are the keys the encryption middleware uses for a request.
+type cryptoKeys struct {
+	container []byte
+	object    []byte
+}
+
+// keyServer hands out root secrets by key id.
+type keyServer interface {
+	GetSecret(keyID string) ([]byte, error)
+}
+
+// localKeyServer is a stand-in for a KMIP server: a JSON file mapping key ids
+// to base64 encoded secrets.
+type localKeyServer struct {
+	path string
+}
+
+func (k *localKeyServer) GetSecret(keyID string) ([]byte, error) {
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]string{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("Unable to parse key store %s: %v", k.path, err)
+	}
+	secret, ok := keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("Key %q not found in key store %s", keyID, k.path)
+	}
+	return base64.StdEncoding.DecodeString(secret)
+}
+
+// deriveKey returns the key for an account, container or object path.
+func deriveKey(secret []byte, path string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)
+}
+
+func keymaster(secret []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			apiReq, account, container, obj := getPathParts(request)
+			if ctx := GetProxyContext(request); ctx != nil && apiReq && container != "" {
+				keys := &cryptoKeys{container: deriveKey(secret, "/"+account+"/"+container)}
+				if obj != "" {
+					keys.object = deriveKey(secret, "/"+account+"/"+container+"/"+obj)
+				}
+				ctx.cryptoKeys = keys
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+// loadRootSecret finds the root secret in the keymaster section, in a separate
+// keymaster config file, or in a local key server.
+func loadRootSecret(config conf.Section) ([]byte, error) {
+	encoded, ok := config.Get("encryption_root_secret")
+	if path, ok2 := config.Get("keymaster_config_path"); ok2 {
+		if ok {
+			return nil, errors.New("keymaster: only one of encryption_root_secret and keymaster_config_path may be set")
+		}
+		kconf, err := conf.LoadConfig(path)
+		if err != nil {
+			return nil, fmt.Errorf("keymaster: unable to load %s: %v", path, err)
+		}
+		encoded, ok = kconf.Get("keymaster", "encryption_root_secret")
+		if !ok {
+			return nil, fmt.Errorf("keymaster: no encryption_root_secret in %s", path)
+		}
+	}
+	var secret []byte
+	if ok {
+		var err error
+		if secret, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("keymaster: encryption_root_secret is not valid base64: %v", err)
+		}
+	} else if path, ok := config.Get("kmip_keystore_path"); ok {
+		keyID := config.GetDefault("key_id", "")
+		if keyID == "" {
+			return nil, errors.New("keymaster: kmip_keystore_path needs a key_id")
+		}
+		var err error
+		var ks keyServer = &localKeyServer{path: path}
+		if secret, err = ks.GetSecret(keyID); err != nil {
+			return nil, fmt.Errorf("keymaster: %v", err)
+		}
+	} else {
+		return nil, nil
+	}
+	if len(secret) < minRootSecretLength {
+		return nil, fmt.Errorf("keymaster: the root secret must be at least %d bytes", minRootSecretLength)
+	}
+	return secret, nil
+}
+
+// NewKeymaster returns the middleware that gives each container and object
+// request the keys the encryption middleware needs. With no root secret
+// configured, nothing is encrypted.
+func NewKeymaster(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	secret, err := loadRootSecret(config)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	RegisterInfo("encryption", map[string]interface{}{"cipher": cryptoCipher})
+	return keymaster(secret), nil
+}
@@ -0,0 +1,88 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRootSecret(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(testRootSecret)
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	secret, err := loadRootSecret(conf.Section{})
+	require.Nil(t, err)
+	require.Nil(t, secret)
+
+	config, err := conf.StringConfig("[filter:keymaster]\nencryption_root_secret=" + encoded)
+	require.Nil(t, err)
+	secret, err = loadRootSecret(config.GetSection("filter:keymaster"))
+	require.Nil(t, err)
+	require.Equal(t, testRootSecret, secret)
+
+	config, err = conf.StringConfig("[filter:keymaster]\nencryption_root_secret=" + base64.StdEncoding.EncodeToString([]byte("short")))
+	require.Nil(t, err)
+	_, err = loadRootSecret(config.GetSection("filter:keymaster"))
+	require.NotNil(t, err)
+
+	kpath := filepath.Join(dir, "keymaster.conf")
+	require.Nil(t, ioutil.WriteFile(kpath, []byte("[keymaster]\nencryption_root_secret="+encoded+"\n"), 0600))
+	config, err = conf.StringConfig("[filter:keymaster]\nkeymaster_config_path=" + kpath)
+	require.Nil(t, err)
+	secret, err = loadRootSecret(config.GetSection("filter:keymaster"))
+	require.Nil(t, err)
+	require.Equal(t, testRootSecret, secret)
+
+	kspath := filepath.Join(dir, "keys.json")
+	require.Nil(t, ioutil.WriteFile(kspath, []byte(`{"1": "`+encoded+`"}`), 0600))
+	config, err = conf.StringConfig("[filter:keymaster]\nkmip_keystore_path=" + kspath + "\nkey_id=1")
+	require.Nil(t, err)
+	secret, err = loadRootSecret(config.GetSection("filter:keymaster"))
+	require.Nil(t, err)
+	require.Equal(t, testRootSecret, secret)
+
+	config, err = conf.StringConfig("[filter:keymaster]\nkmip_keystore_path=" + kspath + "\nkey_id=2")
+	require.Nil(t, err)
+	_, err = loadRootSecret(config.GetSection("filter:keymaster"))
+	require.NotNil(t, err)
+}
+
+func TestKeymasterKeys(t *testing.T) {
+	var keys *cryptoKeys
+	handler := keymaster(testRootSecret)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		keys = GetProxyContext(request).cryptoKeys
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), cryptoTestRequest("GET", "/v1/a", nil))
+	require.Nil(t, keys)
+	handler.ServeHTTP(httptest.NewRecorder(), cryptoTestRequest("GET", "/v1/a/c", nil))
+	require.Equal(t, deriveKey(testRootSecret, "/a/c"), keys.container)
+	require.Nil(t, keys.object)
+	handler.ServeHTTP(httptest.NewRecorder(), cryptoTestRequest("GET", "/v1/a/c/o", nil))
+	require.Equal(t, deriveKey(testRootSecret, "/a/c"), keys.container)
+	require.Equal(t, deriveKey(testRootSecret, "/a/c/o"), keys.object)
+	require.NotEqual(t, keys.container, keys.object)
+}
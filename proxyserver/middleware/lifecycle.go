@@ -0,0 +1,84 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/lifecycle"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+// lifecycleContainerWriter shows the container's lifecycle rules to clients
+// as X-Container-Lifecycle.
+type lifecycleContainerWriter struct {
+	http.ResponseWriter
+}
+
+func (w *lifecycleContainerWriter) WriteHeader(status int) {
+	if rules := w.ResponseWriter.Header().Get(lifecycle.Sysmeta); rules != "" {
+		w.ResponseWriter.Header().Set(lifecycle.Header, rules)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// containerLifecycle lets clients set a container's lifecycle rules with
+// X-Container-Lifecycle, which is kept in sysmeta so only validated rules get
+// to the container-lifecycle daemon. Setting it to "" or sending
+// X-Remove-Container-Lifecycle removes the rules.
+func containerLifecycle(requestsMetric tally.Counter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			apiReq, account, container, obj := getPathParts(request)
+			if !apiReq || account == "" || container == "" || obj != "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			if request.Method == "PUT" || request.Method == "POST" {
+				remove := request.Header.Get("X-Remove-Container-Lifecycle") != ""
+				if values, ok := request.Header[lifecycle.Header]; ok {
+					if values[0] == "" {
+						remove = true
+					} else {
+						rules, err := lifecycle.Parse(values[0])
+						if err != nil {
+							srv.SimpleErrorResponse(writer, http.StatusBadRequest, err.Error())
+							return
+						}
+						request.Header.Set(lifecycle.Sysmeta, lifecycle.Format(rules))
+						requestsMetric.Inc(1)
+						// Setting rules trumps removing them.
+						remove = false
+					}
+				}
+				if remove {
+					request.Header.Set(lifecycle.Sysmeta, "")
+					requestsMetric.Inc(1)
+				}
+				request.Header.Del(lifecycle.Header)
+				request.Header.Del("X-Remove-Container-Lifecycle")
+			}
+			next.ServeHTTP(&lifecycleContainerWriter{ResponseWriter: writer}, request)
+		})
+	}
+}
+
+func NewLifecycle(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	RegisterInfo("lifecycle", map[string]interface{}{"max_rules": lifecycle.MaxRules})
+	return containerLifecycle(metricsScope.Counter("lifecycle_requests")), nil
+}
@@ -0,0 +1,68 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RocFang/hummingbird/common/lifecycle"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+func TestContainerLifecycle(t *testing.T) {
+	var backendHeader http.Header
+	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		backendHeader = request.Header
+		writer.Header().Set(lifecycle.Sysmeta, `[{"expiration_days":1}]`)
+		writer.WriteHeader(204)
+	})
+	h := containerLifecycle(tally.NoopScope.Counter("test"))(next)
+
+	r := httptest.NewRequest("POST", "/v1/a/c", nil)
+	r.Header.Set(lifecycle.Header, `[{"id": "logs", "prefix": "logs/", "expiration_days": 30}]`)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, `[{"id":"logs","prefix":"logs/","expiration_days":30}]`, backendHeader.Get(lifecycle.Sysmeta))
+	require.Equal(t, "", backendHeader.Get(lifecycle.Header))
+	require.Equal(t, `[{"expiration_days":1}]`, w.Header().Get(lifecycle.Header))
+
+	r = httptest.NewRequest("POST", "/v1/a/c", nil)
+	r.Header.Set("X-Remove-Container-Lifecycle", "x")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	values, ok := backendHeader[lifecycle.Sysmeta]
+	require.True(t, ok)
+	require.Equal(t, []string{""}, values)
+
+	r = httptest.NewRequest("PUT", "/v1/a/c", nil)
+	r.Header.Set(lifecycle.Header, `[{"prefix": "logs/"}]`)
+	backendHeader = nil
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 400, w.Code)
+	require.Nil(t, backendHeader)
+
+	// Objects aren't touched.
+	r = httptest.NewRequest("PUT", "/v1/a/c/o", nil)
+	r.Header.Set(lifecycle.Header, "nonsense")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, "nonsense", backendHeader.Get(lifecycle.Header))
+}
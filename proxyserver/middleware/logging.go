@@ -27,6 +27,10 @@ import (
 
 func NewRequestLogger(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
 	requestsMetric := metricsScope.Counter("requests")
+	accessLog, err := newAccessLogger(config, metricsScope)
+	if err != nil {
+		return nil, err
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			start := time.Now()
@@ -36,6 +40,9 @@ func NewRequestLogger(config conf.Section, metricsScope tally.Scope) (func(http.
 			next.ServeHTTP(newWriter, request)
 			ctx := GetProxyContext(request)
 			srv.LogRequestLine(ctx.Logger, request, start, newWriter, newReader)
+			if accessLog != nil {
+				accessLog.Log(&accessLogEntry{request: request, ctx: ctx, writer: newWriter, reader: newReader, start: start, end: time.Now()})
+			}
 			if ctx.Source == "" {
 				requestsMetric.Inc(1)
 				metricsScope.Counter(request.Method + "_requests").Inc(1)
@@ -18,6 +18,7 @@ package middleware
 import (
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/RocFang/hummingbird/common/srv"
@@ -72,9 +73,15 @@ func PipedGet(urlStr string, request *http.Request, source string, auth Authoriz
 		ctx.Logger.Error("getSourceObject GET error", zap.Error(err))
 		return nil, nil, 400
 	}
+	query := url.Values{}
 	if request.URL.Query().Get("multipart-manifest") == "get" {
-		subRequest.URL.RawQuery = "multipart-manifest=get&format=raw"
+		query.Set("multipart-manifest", "get")
+		query.Set("format", "raw")
 	}
+	if request.URL.Query().Get("symlink") == "get" {
+		query.Set("symlink", "get")
+	}
+	subRequest.URL.RawQuery = query.Encode()
 	CopyItems(subRequest.Header, request.Header)
 	// FIXME. Are we going to do X-Newest?
 	subRequest.Header.Set("X-Newest", "true")
@@ -18,8 +18,10 @@ package middleware
 import (
 	"context"
 	"fmt"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/RocFang/hummingbird/common"
@@ -41,10 +43,63 @@ var writeMethods = map[string]bool{"PUT": true, "DELETE": true, "POST": true}
 // accurate as the clocks in the proxy layer- meaning if your clocks
 // are accurate to 1/100 of a second then the max reliable rate/sec
 // you can set is 100/sec.
+//
+// Client requests are also limited per account by token buckets, one for
+// each of these operations, configured with account_<op>_rate and
+// account_<op>_burst:
+//
+//   get      object GETs and HEADs, a second
+//   listing  account and container GETs and HEADs, a second
+//   put      object PUTs, POSTs and DELETEs, a second
+//   bytes    bytes sent to and from the client, a second
+//
+// A bucket holds burst tokens, one second's worth by default, so that many
+// requests can be made at once before being limited. An account can have its
+// own limits with sysmeta like X-Account-Sysmeta-Ratelimit-Get-Rate and
+// X-Account-Sysmeta-Ratelimit-Get-Burst; a rate of 0 means no limit. Bytes
+// are counted once a request is done, and the account's next request waits
+// until they've been paid for.
+//
+// Limited requests sleep, for up to max_sleep_time_seconds, or with
+// retry_after = true are answered at once with a 429 (or a 498 for the write
+// limits above) and a Retry-After header.
+
+// Token bucket operations.
+const (
+	rateGet     = "get"
+	rateListing = "listing"
+	ratePut     = "put"
+	rateBytes   = "bytes"
+)
+
+var rateOperations = []string{rateGet, rateListing, ratePut, rateBytes}
+
+type bucketLimit struct {
+	rate  float64
+	burst float64
+}
+
+// size gives how many tokens the bucket holds when full.
+func (l bucketLimit) size() float64 {
+	if l.burst > 0 {
+		return l.burst
+	}
+	return math.Max(l.rate, 1)
+}
+
+// tokenBucket is the state of a bucket kept in memcache.
+type tokenBucket struct {
+	Tokens float64 `json:"tokens"`
+	Time   int64   `json:"time"`
+}
 
 type ratelimiter struct {
 	accountLimit   int64
 	containerLimit int64
+	limits         map[string]bucketLimit
+	maxSleep       int64
+	retryAfter     bool
+	metricsScope   tally.Scope
 	next           http.Handler
 }
 
@@ -77,19 +132,96 @@ func (r *ratelimiter) getSleepTime(ctx context.Context, mc ring.MemcacheRing, ke
 	return sleepTime, nil
 }
 
-func (r *ratelimiter) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	isWrite := writeMethods[request.Method]
-	pathParts, err := common.ParseProxyPath(request.URL.Path)
-	if !isWrite || err != nil || pathParts["container"] == "" {
-		r.next.ServeHTTP(writer, request)
-		return
+// takeTokens takes cost tokens from the bucket at key, which refills at
+// limit.rate tokens a second. The bucket may go into debt, and the returned
+// wait is how long until it's out of it. If that's longer than maxWait, unless
+// maxWait is negative, the tokens are left in the bucket.
+func (r *ratelimiter) takeTokens(ctx context.Context, mc ring.MemcacheRing, key string, limit bucketLimit, cost float64, maxWait int64) (int64, error) {
+	for tries := 0; tries < 3; tries++ {
+		bucket := tokenBucket{}
+		cas, err := mc.GetStructuredCAS(ctx, key, &bucket)
+		now := nowNano()
+		if err == ring.CacheMiss {
+			bucket = tokenBucket{Tokens: limit.size(), Time: now}
+			cas = 0
+		} else if err != nil {
+			return 0, err
+		}
+		if elapsed := now - bucket.Time; elapsed > 0 {
+			bucket.Tokens = math.Min(limit.size(), bucket.Tokens+limit.rate*float64(elapsed)/float64(nsPerSecond))
+			bucket.Time = now
+		}
+		bucket.Tokens -= cost
+		wait := int64(0)
+		if bucket.Tokens < 0 {
+			wait = int64(-bucket.Tokens / limit.rate * float64(nsPerSecond))
+		}
+		if maxWait >= 0 && wait > maxWait {
+			return wait, nil
+		}
+		if err = mc.SetCAS(ctx, key, &bucket, cas, 3600); err == nil {
+			return wait, nil
+		} else if err != ring.CASConflict && err != ring.CacheMiss {
+			return 0, err
+		}
 	}
-	ctx := GetProxyContext(request)
-	if ctx == nil {
-		ctx.Logger.Error("Error ratelimiter getting ctx")
-		srv.StandardResponse(writer, 500)
-		return
+	return 0, fmt.Errorf("Too much contention for %s", key)
+}
+
+// getLimit gives the account's limit for op, from its sysmeta if it has any.
+func (r *ratelimiter) getLimit(op string, ai *AccountInfo) bucketLimit {
+	limit := r.limits[op]
+	if ai == nil {
+		return limit
+	}
+	prefix := "Ratelimit-" + strings.Title(op) + "-"
+	if rate, err := strconv.ParseFloat(ai.SysMetadata[prefix+"Rate"], 64); err == nil && rate >= 0 {
+		limit.rate = rate
+	}
+	if burst, err := strconv.ParseFloat(ai.SysMetadata[prefix+"Burst"], 64); err == nil && burst >= 0 {
+		limit.burst = burst
+	}
+	return limit
+}
+
+// rateOperation gives the token bucket a request counts against, if any.
+func rateOperation(method string, pathParts map[string]string) string {
+	if pathParts["object"] != "" {
+		switch method {
+		case "GET", "HEAD":
+			return rateGet
+		case "PUT", "POST", "DELETE", "COPY":
+			return ratePut
+		}
+	} else if method == "GET" || method == "HEAD" {
+		return rateListing
+	}
+	return ""
+}
+
+// limited counts a request that had to wait, or was refused, in the metrics.
+func (r *ratelimiter) limited(account, op string, rejected bool) {
+	scope := r.metricsScope.Tagged(map[string]string{"account": account, "operation": op})
+	if rejected {
+		scope.Counter("ratelimit_rejects").Inc(1)
+	} else {
+		scope.Counter("ratelimit_sleeps").Inc(1)
 	}
+}
+
+// reject refuses a request with a Retry-After of wait rounded up to seconds.
+func (r *ratelimiter) reject(writer http.ResponseWriter, status int, wait int64) {
+	retry := (wait + nsPerSecond - 1) / nsPerSecond
+	if retry < 1 {
+		retry = 1
+	}
+	writer.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+	srv.StandardResponse(writer, status)
+}
+
+// limitWrites applies the write limits to the request, returning false if it
+// has been answered.
+func (r *ratelimiter) limitWrites(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, pathParts map[string]string, ai *AccountInfo) bool {
 	limit := int64(0)
 	var ratekey string
 	if pathParts["object"] == "" {
@@ -101,19 +233,15 @@ func (r *ratelimiter) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 			"ratelimit/%s/%s", pathParts["account"], pathParts["container"])
 		limit = r.containerLimit
 	}
-	ai, err := ctx.GetAccountInfo(request.Context(), pathParts["account"])
-	if err != nil {
-		ctx.Logger.Debug("Error ratelimiter getting account info", zap.Error(err))
-	} else {
+	if ai != nil {
 		if rl, ok := ai.SysMetadata["Global-Write-Ratelimit"]; ok {
 			if rl == "BLACKLIST" {
 				sleep(time.Second)
 				srv.StandardResponse(writer, 497)
-				return
+				return false
 			}
 			if rl == "WHITELIST" {
-				r.next.ServeHTTP(writer, request)
-				return
+				return true
 			}
 			if rli, err := strconv.ParseInt(rl, 10, 64); err == nil && rli > 0 {
 				ratekey = fmt.Sprintf(
@@ -124,29 +252,159 @@ func (r *ratelimiter) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 	}
 	if limit > 0 {
 		sleepTime, err := r.getSleepTime(request.Context(), ctx.Cache, ratekey, limit)
-		if err == nil {
-			if sleepTime > maxSleep {
-				sleep(time.Second)
-				srv.StandardResponse(writer, 498)
-				return
-			}
-			sleep(time.Duration(sleepTime))
-		} else {
+		if err != nil {
 			ctx.Logger.Debug("Ratelimiter errored while getting sleep time", zap.Error(err))
+			return true
+		}
+		if r.retryAfter && sleepTime > 0 {
+			// This request doesn't happen, so give back its time.
+			ctx.Cache.Decr(request.Context(), ratekey, nsPerSecond/limit, 3600)
+			r.limited(pathParts["account"], "write", true)
+			r.reject(writer, 498, sleepTime)
+			return false
+		}
+		if sleepTime > r.maxSleep {
+			r.limited(pathParts["account"], "write", true)
+			sleep(time.Second)
+			srv.StandardResponse(writer, 498)
+			return false
+		}
+		if sleepTime > 0 {
+			r.limited(pathParts["account"], "write", false)
+		}
+		sleep(time.Duration(sleepTime))
+	}
+	return true
+}
+
+// limitTokens takes cost tokens from the account's bucket for op, returning
+// false if the request has been answered.
+func (r *ratelimiter) limitTokens(writer http.ResponseWriter, request *http.Request, ctx *ProxyContext, account, op string, limit bucketLimit, cost float64) bool {
+	maxWait := r.maxSleep
+	if r.retryAfter {
+		maxWait = 0
+	}
+	key := fmt.Sprintf("ratelimit/%s/%s", op, account)
+	wait, err := r.takeTokens(request.Context(), ctx.Cache, key, limit, cost, maxWait)
+	if err != nil {
+		ctx.Logger.Debug("Ratelimiter errored while taking tokens", zap.String("key", key), zap.Error(err))
+		return true
+	}
+	if wait > maxWait {
+		r.limited(account, op, true)
+		if r.retryAfter {
+			r.reject(writer, http.StatusTooManyRequests, wait)
+		} else {
+			sleep(time.Second)
+			srv.StandardResponse(writer, 498)
+		}
+		return false
+	}
+	if wait > 0 {
+		r.limited(account, op, false)
+		sleep(time.Duration(wait))
+	}
+	return true
+}
+
+func (r *ratelimiter) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	pathParts, err := common.ParseProxyPath(request.URL.Path)
+	if err != nil || pathParts["account"] == "" {
+		r.next.ServeHTTP(writer, request)
+		return
+	}
+	ctx := GetProxyContext(request)
+	if ctx == nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	isWrite := writeMethods[request.Method] && pathParts["container"] != ""
+	op := rateOperation(request.Method, pathParts)
+	// Subrequests are limited only by the write limits.
+	if ctx.Source != "" {
+		op = ""
+	}
+	if !isWrite && op == "" {
+		r.next.ServeHTTP(writer, request)
+		return
+	}
+	ai, err := ctx.GetAccountInfo(request.Context(), pathParts["account"])
+	if err != nil {
+		ctx.Logger.Debug("Error ratelimiter getting account info", zap.Error(err))
+		ai = nil
+	}
+	if isWrite && !r.limitWrites(writer, request, ctx, pathParts, ai) {
+		return
+	}
+	if op == "" {
+		r.next.ServeHTTP(writer, request)
+		return
+	}
+	if limit := r.getLimit(op, ai); limit.rate > 0 {
+		if !r.limitTokens(writer, request, ctx, pathParts["account"], op, limit, 1) {
+			return
+		}
+	}
+	limit := r.getLimit(rateBytes, ai)
+	if limit.rate <= 0 {
+		r.next.ServeHTTP(writer, request)
+		return
+	}
+	// Waits for the account's earlier requests to be paid for, then charges
+	// for this one once its size is known.
+	if !r.limitTokens(writer, request, ctx, pathParts["account"], rateBytes, limit, 0) {
+		return
+	}
+	countingWriter := &srv.WebWriter{ResponseWriter: writer, Status: 500}
+	var countingReader *srv.CountingReadCloser
+	if request.Body != nil {
+		countingReader = &srv.CountingReadCloser{ReadCloser: request.Body}
+		request.Body = countingReader
+	}
+	r.next.ServeHTTP(countingWriter, request)
+	bytes := countingWriter.ByteCount
+	if countingReader != nil {
+		bytes += countingReader.ByteCount
+	}
+	if bytes > 0 {
+		key := fmt.Sprintf("ratelimit/%s/%s", rateBytes, pathParts["account"])
+		if _, err := r.takeTokens(request.Context(), ctx.Cache, key, limit, float64(bytes), -1); err != nil {
+			ctx.Logger.Debug("Ratelimiter errored while taking tokens", zap.String("key", key), zap.Error(err))
 		}
 	}
-	r.next.ServeHTTP(writer, request)
 }
 
 func NewRatelimiter(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
 
 	accLimit := int64(config.GetInt("account_db_max_writes_per_sec", 0))
 	contLimit := int64(config.GetInt("container_db_max_writes_per_sec", 0))
-	RegisterInfo("ratelimit", map[string]interface{}{"account_ratelimit": accLimit, "container_ratelimits": [][]int64{{contLimit}}, "max_sleep_time_seconds": float64(60.0)})
+	maxSleepSeconds := config.GetFloat("max_sleep_time_seconds", float64(maxSleep/nsPerSecond))
+	retryAfter := config.GetBool("retry_after", false)
+	limits := map[string]bucketLimit{}
+	bucketInfo := map[string]interface{}{}
+	for _, op := range rateOperations {
+		limit := bucketLimit{
+			rate:  config.GetFloat(fmt.Sprintf("account_%s_rate", op), 0),
+			burst: config.GetFloat(fmt.Sprintf("account_%s_burst", op), 0),
+		}
+		if limit.rate < 0 || limit.burst < 0 {
+			return nil, fmt.Errorf("Invalid %s ratelimit: %v/%v", op, limit.rate, limit.burst)
+		}
+		limits[op] = limit
+		if limit.rate > 0 {
+			bucketInfo[op] = map[string]float64{"rate": limit.rate, "burst": limit.size()}
+		}
+	}
+	RegisterInfo("ratelimit", map[string]interface{}{"account_ratelimit": accLimit, "container_ratelimits": [][]int64{{contLimit}},
+		"max_sleep_time_seconds": maxSleepSeconds, "account_token_buckets": bucketInfo, "retry_after": retryAfter})
 	return func(next http.Handler) http.Handler {
 		return &ratelimiter{
 			accountLimit:   accLimit,
 			containerLimit: contLimit,
+			limits:         limits,
+			maxSleep:       int64(maxSleepSeconds * float64(nsPerSecond)),
+			retryAfter:     retryAfter,
+			metricsScope:   metricsScope,
 			next:           next,
 		}
 	}, nil
@@ -18,11 +18,15 @@ package middleware
 import (
 	"context"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/RocFang/hummingbird/common/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
 )
 
 var now = 10 * nsPerSecond
@@ -76,52 +80,122 @@ func TestGetSleepTime(t *testing.T) {
 	assert.Equal(t, fakeMr.MockSetValues[0], now+nsPerSecond/1000)
 }
 
-/*
-TODO:
-need to figure out a decent way to put the FakeMemcacheRing
-into the request's context
-
-func TestServeHTTP(t *testing.T) {
-	fakeMr := test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000}}
+func newRatelimitRequest(method, path string, mc *test.FakeMemcacheRing, sysmeta map[string]string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{Cache: mc},
+		Logger:                 zap.NewNop(),
+		accountInfoCache:       map[string]*AccountInfo{"account/a": {SysMetadata: sysmeta}},
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+}
 
-	rt := ratelimiter{accountLimit: 10, containerLimit: 100, mc: &fakeMr}
+func fakeRatelimitTime(t *testing.T) (*sleeper, func()) {
 	oldSleep := sleep
 	oldNowNano := nowNano
-	defer func() {
-		sleep = oldSleep
-		nowNano = oldNowNano
-	}()
-	s := sleeper{}
+	s := &sleeper{}
 	sleep = s.fakeSleep
 	nowNano = fakeNowNano
-	fakeWriter := test.MockResponseWriter{}
-	rt.next = FakeHandler{}
-
-	req, _ := http.NewRequest("GET", "/v/a/co", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 0)
-	assert.Equal(t, len(fakeMr.MockIncrKeys), 0)
-
-	req, _ = http.NewRequest("PUT", "/v/a/c", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 1)
-
-	rt.accountLimit = 0
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 1)
-
-	req, _ = http.NewRequest("PUT", "/v/a/c/o", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 2)
-
-	assert.Equal(t, fakeMr.MockIncrKeys[0], "ratelimit/a")
-	assert.Equal(t, fakeMr.MockIncrKeys[1], "ratelimit/a/c")
-
-	fakeMr = test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000 + MaxSleep}}
-	rt.mc = &fakeMr
-	req, _ = http.NewRequest("PUT", "/v/a/c/o", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 3)
-	assert.Equal(t, s.SleepVals[len(s.SleepVals)-1], time.Second)
+	return s, func() {
+		sleep = oldSleep
+		nowNano = oldNowNano
+	}
+}
+
+func TestRatelimitWrites(t *testing.T) {
+	s, restore := fakeRatelimitTime(t)
+	defer restore()
+	rt := &ratelimiter{accountLimit: 10, containerLimit: 100, maxSleep: maxSleep, metricsScope: tally.NoopScope, next: FakeHandler{}}
+
+	fakeMr := &test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000}}
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, newRatelimitRequest("GET", "/v1/a/c/o", fakeMr, nil))
+	require.Equal(t, 0, len(s.SleepVals))
+	require.Equal(t, 0, len(fakeMr.MockIncrKeys))
+
+	rt.ServeHTTP(w, newRatelimitRequest("PUT", "/v1/a/c", fakeMr, nil))
+	require.Equal(t, []time.Duration{2000}, s.SleepVals)
+	require.Equal(t, []string{"ratelimit/a"}, fakeMr.MockIncrKeys)
+
+	fakeMr = &test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000}}
+	rt.ServeHTTP(w, newRatelimitRequest("PUT", "/v1/a/c/o", fakeMr, map[string]string{"Global-Write-Ratelimit": "5"}))
+	require.Equal(t, []string{"ratelimit/global/a"}, fakeMr.MockIncrKeys)
+
+	fakeMr = &test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000 + maxSleep}}
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, newRatelimitRequest("PUT", "/v1/a/c/o", fakeMr, nil))
+	require.Equal(t, 498, w.Code)
+	require.Equal(t, time.Second, s.SleepVals[len(s.SleepVals)-1])
+
+	rt.retryAfter = true
+	sleeps := len(s.SleepVals)
+	fakeMr = &test.FakeMemcacheRing{MockIncrResults: []int64{now + 2*nsPerSecond}}
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, newRatelimitRequest("PUT", "/v1/a/c/o", fakeMr, nil))
+	require.Equal(t, 498, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
+	require.Equal(t, sleeps, len(s.SleepVals))
+}
+
+func TestRatelimitTokenBuckets(t *testing.T) {
+	s, restore := fakeRatelimitTime(t)
+	defer restore()
+	defer func() { now = 10 * nsPerSecond }()
+	scope := tally.NewTestScope("", nil)
+	rt := &ratelimiter{
+		limits:       map[string]bucketLimit{rateGet: {rate: 1, burst: 2}},
+		maxSleep:     maxSleep,
+		retryAfter:   true,
+		metricsScope: scope,
+		next:         FakeHandler{},
+	}
+	fakeMr := &test.FakeMemcacheRing{}
+	serve := func(method, path string, sysmeta map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, newRatelimitRequest(method, path, fakeMr, sysmeta))
+		return w
+	}
+	require.Equal(t, 200, serve("GET", "/v1/a/c/o", nil).Code)
+	require.Equal(t, 200, serve("HEAD", "/v1/a/c/o", nil).Code)
+	w := serve("GET", "/v1/a/c/o", nil)
+	require.Equal(t, 429, w.Code)
+	require.Equal(t, "1", w.Header().Get("Retry-After"))
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["ratelimit_rejects+account=a,operation=get"].Value())
+	// Listings and writes have their own buckets.
+	require.Equal(t, 200, serve("GET", "/v1/a/c", nil).Code)
+	require.Equal(t, 200, serve("PUT", "/v1/a/c/o", nil).Code)
+	// As does every account, which can have its own limits.
+	require.Equal(t, 200, serve("GET", "/v1/a/c/o", map[string]string{"Ratelimit-Get-Rate": "0"}).Code)
+
+	now += nsPerSecond
+	require.Equal(t, 200, serve("GET", "/v1/a/c/o", nil).Code)
+
+	// Without retry_after the request waits its turn instead.
+	rt.retryAfter = false
+	require.Equal(t, 200, serve("GET", "/v1/a/c/o", nil).Code)
+	require.Equal(t, []time.Duration{time.Second}, s.SleepVals)
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["ratelimit_sleeps+account=a,operation=get"].Value())
+}
+
+func TestRatelimitBandwidth(t *testing.T) {
+	_, restore := fakeRatelimitTime(t)
+	defer restore()
+	rt := &ratelimiter{
+		limits:       map[string]bucketLimit{rateBytes: {rate: 10}},
+		maxSleep:     maxSleep,
+		retryAfter:   true,
+		metricsScope: tally.NoopScope,
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("0123456789012345678901234"))
+		}),
+	}
+	fakeMr := &test.FakeMemcacheRing{}
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, newRatelimitRequest("GET", "/v1/a/c/o", fakeMr, nil))
+	require.Equal(t, 200, w.Code)
+	// The 25 bytes sent put the account 15 bytes, or 1.5 seconds, in debt.
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, newRatelimitRequest("GET", "/v1/a/c", fakeMr, nil))
+	require.Equal(t, 429, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
 }
-*/
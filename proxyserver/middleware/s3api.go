@@ -20,6 +20,22 @@
 //
 //   [filter:s3api]
 //   enabled = true
+//   location = us-east-1
+//
+// Both V2 and V4 signatures are accepted; V4 requests must be signed for the
+// configured location (region).
+//
+// Bucket versioning uses versioned_writes, keeping old versions in a
+// "<bucket>+versions" container, and object tags are kept in object sysmeta.
+// Incomplete multipart uploads can be aborted with
+// `DELETE /<bucket>?uploads&older-than=<seconds>`. Bucket lifecycle rules
+// (?lifecycle) are kept in container sysmeta and applied by the
+// container-lifecycle daemon; only prefix filters are supported, and
+// expiration leaves encrypted objects in versioned buckets in place.
+// x-amz-checksum-crc32c and x-amz-checksum-sha256 headers on object PUTs are
+// checked by the object servers, and returned on GET and HEAD when asked for
+// with `x-amz-checksum-mode: ENABLED`. Bucket listings, V1 and V2, also take
+// Swift's reverse, end_marker and path parameters.
 //
 // Example using boto2 and haio with tempauth:
 //
@@ -41,7 +57,9 @@ package middleware
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
@@ -49,15 +67,18 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/RocFang/hummingbird/accountserver"
 	"github.com/RocFang/hummingbird/common"
 	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/lifecycle"
 	"github.com/RocFang/hummingbird/common/srv"
 	"github.com/RocFang/hummingbird/containerserver"
 	"github.com/uber-go/tally"
@@ -67,6 +88,14 @@ const (
 	s3Xmlns                      = "http://s3.amazonaws.com/doc/2006-03-01"
 	s3MultipartCompleteBodyLimit = 65536
 	s3MultipartMaxParts          = 1000
+	s3DeleteBodyLimit            = 2 * 1024 * 1024
+	s3DeleteMaxKeys              = 1000
+	s3ConfigBodyLimit            = 65536
+	s3MaxTags                    = 10
+	s3TaggingSysmeta             = "X-Object-Sysmeta-S3api-Tagging"
+	s3VersioningSysmeta          = "X-Container-Sysmeta-S3api-Versioning"
+	s3AllUsers                   = "http://acs.amazonaws.com/groups/global/AllUsers"
+	s3PublicReadACL              = ".r:*,.rlistings"
 )
 
 type s3Response struct {
@@ -84,9 +113,18 @@ var s3Responses = map[int]s3Response{
 	503:   {"ServiceUnavailable", "Reduce your request rate."},
 	40000: {"InvalidBucketName", "The specified bucket is not valid."},
 	40001: {"BucketAlreadyExists", "The specified bucket is not valid."},
+	40002: {"AuthorizationHeaderMalformed", "The authorization header you provided is invalid."},
+	40003: {"AuthorizationQueryParametersError", "The authorization query parameters you provided are invalid."},
+	40004: {"MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema."},
+	40005: {"InvalidTag", "The tag provided was not a valid tag."},
+	40006: {"BadDigest", "The Content-MD5 you specified did not match what we received."},
+	40007: {"InvalidArgument", "Invalid Argument."},
 	40300: {"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."},
+	40301: {"RequestTimeTooSkewed", "The difference between the request time and the current time is too large."},
+	40302: {"AccessDenied", "Request has expired."},
 	40400: {"NoSuchBucket", "The specified bucket does not exist."},
 	40401: {"NoSuchKey", "The specified key does not exist."},
+	40402: {"NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist."},
 }
 
 type s3Owner struct {
@@ -185,6 +223,120 @@ type s3ListMultipartUploadsResult struct {
 	Uploads            []s3ListMultipartUploadsUpload `xml:"Upload"`
 }
 
+type s3DeleteObject struct {
+	Key       string
+	VersionId string
+}
+
+type s3Delete struct {
+	XMLName xml.Name         `xml:"Delete"`
+	Quiet   bool             `xml:"Quiet"`
+	Objects []s3DeleteObject `xml:"Object"`
+}
+
+type s3Deleted struct {
+	Key string
+}
+
+type s3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []s3Deleted     `xml:"Deleted"`
+	Errors  []s3DeleteError `xml:"Error"`
+}
+
+type s3VersioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Status  string   `xml:"Status,omitempty"`
+}
+
+// s3LifecycleConfiguration is a bucket's lifecycle rules. Rules have either a
+// Prefix or a Filter with a Prefix; tag filters, transitions and expiration
+// dates aren't supported.
+type s3LifecycleConfiguration struct {
+	XMLName xml.Name          `xml:"LifecycleConfiguration"`
+	Xmlns   string            `xml:"xmlns,attr,omitempty"`
+	Rules   []s3LifecycleRule `xml:"Rule"`
+}
+
+type s3LifecycleRule struct {
+	ID                             string                            `xml:"ID,omitempty"`
+	Prefix                         *string                           `xml:"Prefix"`
+	Filter                         *s3LifecycleFilter                `xml:"Filter"`
+	Status                         string                            `xml:"Status"`
+	Expiration                     *s3LifecycleExpiration            `xml:"Expiration"`
+	NoncurrentVersionExpiration    *s3NoncurrentVersionExpiration    `xml:"NoncurrentVersionExpiration"`
+	AbortIncompleteMultipartUpload *s3AbortIncompleteMultipartUpload `xml:"AbortIncompleteMultipartUpload"`
+	Transitions                    []struct{}                        `xml:"Transition"`
+	NoncurrentTransitions          []struct{}                        `xml:"NoncurrentVersionTransition"`
+}
+
+type s3LifecycleFilter struct {
+	Prefix string    `xml:"Prefix"`
+	Tag    *struct{} `xml:"Tag"`
+	And    *struct{} `xml:"And"`
+}
+
+type s3LifecycleExpiration struct {
+	Days                      int     `xml:"Days,omitempty"`
+	Date                      *string `xml:"Date"`
+	ExpiredObjectDeleteMarker *string `xml:"ExpiredObjectDeleteMarker"`
+}
+
+type s3NoncurrentVersionExpiration struct {
+	NoncurrentDays int `xml:"NoncurrentDays"`
+}
+
+type s3AbortIncompleteMultipartUpload struct {
+	DaysAfterInitiation int `xml:"DaysAfterInitiation"`
+}
+
+type s3Tag struct {
+	Key   string
+	Value string
+}
+
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	TagSet  struct {
+		Tags []s3Tag `xml:"Tag"`
+	} `xml:"TagSet"`
+}
+
+type s3LocationConstraint struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+type s3Grantee struct {
+	XmlnsXsi    string `xml:"xmlns:xsi,attr,omitempty"`
+	Type        string `xml:"xsi:type,attr,omitempty"`
+	ID          string `xml:"ID,omitempty"`
+	DisplayName string `xml:"DisplayName,omitempty"`
+	URI         string `xml:"URI,omitempty"`
+}
+
+type s3Grant struct {
+	Grantee    s3Grantee
+	Permission string
+}
+
+type s3AccessControlPolicy struct {
+	XMLName xml.Name  `xml:"AccessControlPolicy"`
+	Xmlns   string    `xml:"xmlns,attr,omitempty"`
+	Owner   s3Owner   `xml:"Owner"`
+	Grants  []s3Grant `xml:"AccessControlList>Grant"`
+}
+
 func NewS3BucketList() *s3BucketList {
 	return &s3BucketList{Xmlns: s3Xmlns}
 }
@@ -388,9 +540,18 @@ type s3ApiHandler struct {
 	object         string
 	path           string
 	signature      string
+	region         string
+	storageDomains []string
 	requestsMetric tally.Counter
 }
 
+// s3HostBucket returns the bucket of a virtual-hosted-style request, the
+// bucket in bucket.s3.example.com when s3.example.com is one of the storage
+// domains, or "" for a path-style request.
+func s3HostBucket(request *http.Request, storageDomains []string) string {
+	return strings.ToLower(storageDomainSubdomain(requestHost(request), storageDomains))
+}
+
 func s3PathSplit(path string) (string, string) {
 	if len(path) > 0 && !strings.HasPrefix(path, "/") {
 		path = "/" + path
@@ -462,6 +623,66 @@ func BucketAlreadyExistsResponse(writer http.ResponseWriter, request *http.Reque
 	writer.Write(nil)
 }
 
+func MalformedXMLResponse(writer http.ResponseWriter, request *http.Request) {
+	writer.WriteHeader(40004)
+	writer.Write(nil)
+}
+
+func NotImplementedResponse(writer http.ResponseWriter, request *http.Request) {
+	writer.WriteHeader(http.StatusNotImplemented)
+	writer.Write(nil)
+}
+
+func InvalidTagResponse(writer http.ResponseWriter, request *http.Request) {
+	writer.WriteHeader(40005)
+	writer.Write(nil)
+}
+
+func BadDigestResponse(writer http.ResponseWriter, request *http.Request) {
+	writer.WriteHeader(40006)
+	writer.Write(nil)
+}
+
+func InvalidArgumentResponse(writer http.ResponseWriter, request *http.Request) {
+	writer.WriteHeader(40007)
+	writer.Write(nil)
+}
+
+func NoSuchLifecycleConfigurationResponse(writer http.ResponseWriter, request *http.Request) {
+	writer.WriteHeader(40402)
+	writer.Write(nil)
+}
+
+// s3ChecksumAlgorithms are the x-amz-checksum-* algorithms the object
+// servers can check.
+var s3ChecksumAlgorithms = []string{"crc32c", "sha256"}
+
+// s3GetChecksumHeaders copies any base64 x-amz-checksum-* headers into dst as
+// the hex X-Object-Checksum-* headers the object servers check, returning false
+// if one isn't valid base64.
+func s3GetChecksumHeaders(src, dst http.Header) bool {
+	for _, algorithm := range s3ChecksumAlgorithms {
+		if value := src.Get("X-Amz-Checksum-" + algorithm); value != "" {
+			sum, err := base64.StdEncoding.DecodeString(value)
+			if err != nil || len(sum) == 0 {
+				return false
+			}
+			dst.Set(common.ChecksumHeader(algorithm), hex.EncodeToString(sum))
+		}
+	}
+	return true
+}
+
+// s3SetChecksumHeaders adds x-amz-checksum-* headers for the object's
+// checksums.
+func s3SetChecksumHeaders(header http.Header) {
+	for _, algorithm := range s3ChecksumAlgorithms {
+		if sum, err := hex.DecodeString(header.Get(common.ChecksumHeader(algorithm))); err == nil && len(sum) > 0 {
+			header.Set("X-Amz-Checksum-"+algorithm, base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+}
+
 func s3DateString(s string) string {
 	// This is just trimming out some extra precision off our seconds for
 	// the swift s3api func tests.
@@ -477,14 +698,19 @@ func s3DateString(s string) string {
 
 func (s *s3ApiHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	ctx := GetProxyContext(request)
+	bucket := s3HostBucket(request, s.storageDomains)
 	// Check if this is an S3 request
-	if ctx.S3Auth == nil || strings.HasPrefix(strings.ToLower(request.URL.Path), "/v1/") {
+	if ctx.S3Auth == nil || (bucket == "" && strings.HasPrefix(strings.ToLower(request.URL.Path), "/v1/")) {
 		// Not an S3 request
 		s.next.ServeHTTP(writer, request)
 		return
 	}
 
-	s.container, s.object = s3PathSplit(request.URL.Path)
+	if bucket != "" {
+		s.container, s.object = bucket, strings.TrimPrefix(request.URL.Path, "/")
+	} else {
+		s.container, s.object = s3PathSplit(request.URL.Path)
+	}
 	s.account = ctx.S3Auth.Account
 
 	if s.container != "" {
@@ -521,6 +747,15 @@ func (s *s3ApiHandler) handleObjectRequest(writer http.ResponseWriter, request *
 	ctx := GetProxyContext(request)
 	request.ParseForm()
 
+	if _, ok := request.Form["tagging"]; ok {
+		s.handleObjectTagging(writer, request)
+		return
+	}
+	if _, ok := request.Form["acl"]; ok {
+		s.handleACL(writer, request)
+		return
+	}
+
 	if request.Method == "GET" || request.Method == "HEAD" {
 		if uploadId := request.Form.Get("uploadId"); uploadId != "" {
 			newReq, err := ctx.newSubrequest("GET", fmt.Sprintf("/v1/AUTH_%s/%s+segments?prefix=%s-%s/", common.Urlencode(s.account),
@@ -582,7 +817,16 @@ func (s *s3ApiHandler) handleObjectRequest(writer http.ResponseWriter, request *
 		newReq.Header.Set("If-None-Match", request.Header.Get("If-None-Match"))
 		newReq.Header.Set("If-Modified-Since", request.Header.Get("If-Modified-Since"))
 		newReq.Header.Set("If-UnModified-Since", request.Header.Get("If-UnModified-Since"))
-		ctx.serveHTTPSubrequest(writer, newReq)
+		checksumMode := strings.EqualFold(request.Header.Get("X-Amz-Checksum-Mode"), "ENABLED")
+		ctx.serveHTTPSubrequest(srv.NewCustomWriter(writer, func(w http.ResponseWriter, status int) int {
+			if tags, err := url.ParseQuery(w.Header().Get(s3TaggingSysmeta)); err == nil && len(tags) > 0 {
+				w.Header().Set("X-Amz-Tagging-Count", strconv.Itoa(len(tags)))
+			}
+			if checksumMode {
+				s3SetChecksumHeaders(w.Header())
+			}
+			return status
+		}), newReq)
 		return
 	}
 
@@ -651,6 +895,15 @@ func (s *s3ApiHandler) handleObjectRequest(writer http.ResponseWriter, request *
 					common.Urlencode(s.container), common.Urlencode(uploadId), common.Urlencode(s.object), partNumber)
 			}
 		}
+		tagging := ""
+		if v := request.Header.Get("X-Amz-Tagging"); v != "" {
+			tags, err := url.ParseQuery(v)
+			if err != nil || !validS3Tags(tags) {
+				InvalidTagResponse(writer, request)
+				return
+			}
+			tagging = tags.Encode()
+		}
 		method := "PUT"
 		dest := ""
 		// Check to see if this is a copy request
@@ -676,8 +929,19 @@ func (s *s3ApiHandler) handleObjectRequest(writer http.ResponseWriter, request *
 		}
 		newReq.Header.Set("Content-Length", request.Header.Get("Content-Length"))
 		newReq.Header.Set("Content-Type", request.Header.Get("Content-Type"))
+		if tagging != "" {
+			newReq.Header.Set(s3TaggingSysmeta, tagging)
+		}
+		if copySource == "" && !s3GetChecksumHeaders(request.Header, newReq.Header) {
+			InvalidArgumentResponse(writer, request)
+			return
+		}
 		cap := NewCaptureWriter()
 		ctx.serveHTTPSubrequest(cap, newReq)
+		if cap.status == 422 {
+			BadDigestResponse(writer, request)
+			return
+		}
 		if cap.status/100 != 2 {
 			srv.StandardResponse(writer, cap.status)
 			return
@@ -788,6 +1052,18 @@ func (s *s3ApiHandler) handleObjectRequest(writer http.ResponseWriter, request *
 				srv.StandardResponse(writer, c.status)
 				return
 			}
+			// The parts now belong to the manifest, so drop the upload's
+			// marker; otherwise aborting stale uploads would delete them.
+			c, err = s.subrequest(request, "DELETE", fmt.Sprintf("/v1/AUTH_%s/%s+segments/%s-%s", common.Urlencode(s.account),
+				common.Urlencode(s.container), common.Urlencode(uploadId), common.Urlencode(s.object)), nil)
+			if err != nil {
+				srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if c.status/100 != 2 && c.status != 404 {
+				srv.StandardResponse(writer, c.status)
+				return
+			}
 
 			output, err := xml.MarshalIndent(s3CompleteMultipartUploadResult{
 				Xmlns:    s3Xmlns,
@@ -821,6 +1097,31 @@ func (s *s3ApiHandler) handleContainerRequest(writer http.ResponseWriter, reques
 
 	writer.Header().Set("Location", "/"+s.container)
 
+	if _, ok := request.Form["versioning"]; ok {
+		s.handleBucketVersioning(writer, request)
+		return
+	}
+	if _, ok := request.Form["location"]; ok {
+		s.handleBucketLocation(writer, request)
+		return
+	}
+	if _, ok := request.Form["acl"]; ok {
+		s.handleACL(writer, request)
+		return
+	}
+	if _, ok := request.Form["lifecycle"]; ok {
+		s.handleBucketLifecycle(writer, request)
+		return
+	}
+	if _, ok := request.Form["delete"]; ok && request.Method == "POST" {
+		s.handleMultiDelete(writer, request)
+		return
+	}
+	if _, ok := request.Form["uploads"]; ok && request.Method == "DELETE" {
+		s.handleAbortUploads(writer, request)
+		return
+	}
+
 	if request.Method == "HEAD" {
 		newReq, err := ctx.newSubrequest("HEAD", s.path, http.NoBody, request, "s3api")
 		if err != nil {
@@ -861,10 +1162,18 @@ func (s *s3ApiHandler) handleContainerRequest(writer http.ResponseWriter, reques
 	}
 
 	if request.Method == "PUT" {
+		read, ok := s3CannedACLs[common.GetDefault(request.Header, "X-Amz-Acl", "private")]
+		if !ok {
+			NotImplementedResponse(writer, request)
+			return
+		}
 		newReq, err := ctx.newSubrequest("PUT", s.path, http.NoBody, request, "s3api")
 		if err != nil {
 			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
 		}
+		if read != "" {
+			newReq.Header.Set("X-Container-Read", read)
+		}
 		cap := NewCaptureWriter()
 		ctx.serveHTTPSubrequest(cap, newReq)
 		/* Can't overwrite a bucket in s3, so we'll lie about it here. */
@@ -907,7 +1216,11 @@ func (s *s3ApiHandler) handleContainerRequest(writer http.ResponseWriter, reques
 				Bucket: s.container,
 			}
 			for _, obj := range objectListing {
-				ops := strings.SplitN(obj.Name, "-", 1)
+				if obj.Name == "" {
+					// a subdir of parts
+					continue
+				}
+				ops := strings.SplitN(obj.Name, "-", 2)
 				if len(ops) != 2 {
 					srv.StandardResponse(writer, http.StatusInternalServerError)
 					return
@@ -970,6 +1283,13 @@ func (s *s3ApiHandler) handleContainerRequest(writer http.ResponseWriter, reques
 		if delimiter != "" {
 			nq.Set("delimiter", delimiter)
 		}
+		// Swift's reverse, end_marker and path listing parameters pass
+		// straight through to the container listing.
+		for _, key := range []string{"reverse", "end_marker", "path"} {
+			if v, ok := q[key]; ok && len(v) > 0 {
+				nq.Set(key, v[0])
+			}
+		}
 		cap := NewCaptureWriter()
 		newReq.URL.RawQuery = nq.Encode()
 		ctx.serveHTTPSubrequest(cap, newReq)
@@ -1031,7 +1351,11 @@ func (s *s3ApiHandler) handleContainerRequest(writer http.ResponseWriter, reques
 			objectList.SetObjects(append(objectList.GetObjects(), obj))
 		}
 		if len(prefixes) > 0 {
-			sort.Strings(prefixes)
+			if common.LooksTrue(q.Get("reverse")) {
+				sort.Sort(sort.Reverse(sort.StringSlice(prefixes)))
+			} else {
+				sort.Strings(prefixes)
+			}
 			for _, prefix := range prefixes {
 				objectList.SetPrefixes(append(objectList.GetPrefixes(), s3Prefix{Prefix: prefix}))
 			}
@@ -1104,6 +1428,741 @@ func (s *s3ApiHandler) handleAccountRequest(writer http.ResponseWriter, request
 	srv.StandardResponse(writer, http.StatusMethodNotAllowed)
 }
 
+var (
+	s3CannedACLs = map[string]string{"private": "", "public-read": s3PublicReadACL}
+	s3PartName   = regexp.MustCompile(`/[0-9]{8}$`)
+)
+
+// validS3Tags checks a tag set against S3's limits.
+func validS3Tags(tags url.Values) bool {
+	if len(tags) > s3MaxTags {
+		return false
+	}
+	for k, v := range tags {
+		if k == "" || len(k) > 128 || strings.HasPrefix(k, "aws:") || len(v) != 1 || len(v[0]) > 256 {
+			return false
+		}
+	}
+	return true
+}
+
+func writeS3XML(writer http.ResponseWriter, v interface{}) {
+	output, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	output = []byte(xml.Header + string(output))
+	headers := writer.Header()
+	headers.Set("Content-Type", "application/xml; charset=utf-8")
+	headers.Set("Content-Length", strconv.Itoa(len(output)))
+	writer.WriteHeader(200)
+	writer.Write(output)
+}
+
+func readS3XML(request *http.Request, limit int64, v interface{}) error {
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		return fmt.Errorf("body longer than %d", limit)
+	}
+	return xml.Unmarshal(body, v)
+}
+
+// subrequest makes a bodyless request to the swift api and captures the
+// response.
+func (s *s3ApiHandler) subrequest(request *http.Request, method, path string, header http.Header) (*captureWriter, error) {
+	ctx := GetProxyContext(request)
+	newReq, err := ctx.newSubrequest(method, path, http.NoBody, request, "s3api")
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		newReq.Header[k] = v
+	}
+	c := NewCaptureWriter()
+	ctx.serveHTTPSubrequest(c, newReq)
+	return c, nil
+}
+
+// headBucket returns the bucket's container headers, or writes an error
+// response and returns nil.
+func (s *s3ApiHandler) headBucket(writer http.ResponseWriter, request *http.Request) http.Header {
+	c, err := s.subrequest(request, "HEAD", fmt.Sprintf("/v1/AUTH_%s/%s", common.Urlencode(s.account), common.Urlencode(s.container)), nil)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if c.status == 404 {
+		NoSuchBucketResponse(writer, request)
+		return nil
+	}
+	if c.status/100 != 2 {
+		srv.StandardResponse(writer, c.status)
+		return nil
+	}
+	return c.header
+}
+
+// headObject returns the object's headers, or writes an error response and
+// returns nil.
+func (s *s3ApiHandler) headObject(writer http.ResponseWriter, request *http.Request) http.Header {
+	c, err := s.subrequest(request, "HEAD", fmt.Sprintf("/v1/AUTH_%s/%s/%s", common.Urlencode(s.account),
+		common.Urlencode(s.container), common.Urlencode(s.object)), nil)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if c.status == 404 {
+		NoSuchKeyResponse(writer, request)
+		return nil
+	}
+	if c.status/100 != 2 {
+		srv.StandardResponse(writer, c.status)
+		return nil
+	}
+	return c.header
+}
+
+// listAll returns every entry in a container listing, following markers.
+func (s *s3ApiHandler) listAll(request *http.Request, path string) ([]ObjectListingRecord, int) {
+	var listing []ObjectListingRecord
+	marker := ""
+	for {
+		c, err := s.subrequest(request, "GET", path+"?marker="+url.QueryEscape(marker), http.Header{"Accept": {"application/json"}})
+		if err != nil {
+			return nil, http.StatusInternalServerError
+		}
+		if c.status/100 != 2 {
+			return nil, c.status
+		}
+		if len(c.body) == 0 {
+			return listing, http.StatusOK
+		}
+		page := []ObjectListingRecord{}
+		if err := json.Unmarshal(c.body, &page); err != nil {
+			return nil, http.StatusInternalServerError
+		}
+		if len(page) == 0 {
+			return listing, http.StatusOK
+		}
+		listing = append(listing, page...)
+		marker = page[len(page)-1].Name
+	}
+}
+
+// handleMultiDelete implements POST ?delete, deleting up to 1000 keys.
+func (s *s3ApiHandler) handleMultiDelete(writer http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, s3DeleteBodyLimit+1))
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	if len(body) > s3DeleteBodyLimit {
+		MalformedXMLResponse(writer, request)
+		return
+	}
+	if contentMD5 := request.Header.Get("Content-Md5"); contentMD5 != "" {
+		sum := md5.Sum(body)
+		if contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			BadDigestResponse(writer, request)
+			return
+		}
+	}
+	del := s3Delete{}
+	if err := xml.Unmarshal(body, &del); err != nil || len(del.Objects) == 0 || len(del.Objects) > s3DeleteMaxKeys {
+		MalformedXMLResponse(writer, request)
+		return
+	}
+	if s.headBucket(writer, request) == nil {
+		return
+	}
+	result := s3DeleteResult{Xmlns: s3Xmlns}
+	for _, obj := range del.Objects {
+		status := http.StatusInternalServerError
+		c, err := s.subrequest(request, "DELETE", fmt.Sprintf("/v1/AUTH_%s/%s/%s", common.Urlencode(s.account),
+			common.Urlencode(s.container), common.Urlencode(obj.Key)), nil)
+		if err == nil {
+			status = c.status
+		}
+		// Deleting a key that isn't there counts as deleting it.
+		if status/100 == 2 || status == 404 {
+			if !del.Quiet {
+				result.Deleted = append(result.Deleted, s3Deleted{Key: obj.Key})
+			}
+			continue
+		}
+		if status == 401 {
+			status = 403
+		}
+		resp, ok := s3Responses[status]
+		if !ok {
+			resp = s3Responses[500]
+		}
+		result.Errors = append(result.Errors, s3DeleteError{Key: obj.Key, Code: resp.Code, Message: resp.Message})
+	}
+	writeS3XML(writer, result)
+}
+
+// handleBucketVersioning maps bucket versioning onto versioned_writes' history
+// mode, keeping old versions in the bucket's "+versions" container.
+func (s *s3ApiHandler) handleBucketVersioning(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET":
+		header := s.headBucket(writer, request)
+		if header == nil {
+			return
+		}
+		config := s3VersioningConfiguration{Xmlns: s3Xmlns, Status: header.Get(s3VersioningSysmeta)}
+		if config.Status == "" && (header.Get(CLIENT_HISTORY_LOC) != "" || header.Get(CLIENT_VERSIONS_LOC) != "") {
+			config.Status = "Enabled"
+		}
+		writeS3XML(writer, config)
+	case "PUT":
+		config := s3VersioningConfiguration{}
+		if err := readS3XML(request, s3ConfigBodyLimit, &config); err != nil {
+			MalformedXMLResponse(writer, request)
+			return
+		}
+		if config.Status != "Enabled" && config.Status != "Suspended" {
+			MalformedXMLResponse(writer, request)
+			return
+		}
+		if s.headBucket(writer, request) == nil {
+			return
+		}
+		header := http.Header{s3VersioningSysmeta: {config.Status}}
+		if config.Status == "Enabled" {
+			versions := s.container + "+versions"
+			c, err := s.subrequest(request, "PUT", fmt.Sprintf("/v1/AUTH_%s/%s", common.Urlencode(s.account), common.Urlencode(versions)),
+				http.Header{"Content-Length": {"0"}})
+			if err != nil {
+				srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if c.status/100 != 2 {
+				srv.StandardResponse(writer, c.status)
+				return
+			}
+			header.Set(CLIENT_HISTORY_LOC, versions)
+		} else {
+			header.Set("X-Remove-History-Location", "x")
+		}
+		c, err := s.subrequest(request, "POST", fmt.Sprintf("/v1/AUTH_%s/%s", common.Urlencode(s.account), common.Urlencode(s.container)), header)
+		if err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if c.status/100 != 2 {
+			srv.StandardResponse(writer, c.status)
+			return
+		}
+		writer.WriteHeader(200)
+	default:
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *s3ApiHandler) handleBucketLocation(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+		return
+	}
+	if s.headBucket(writer, request) == nil {
+		return
+	}
+	// S3 reports the default region as an empty location.
+	location := s.region
+	if location == "us-east-1" {
+		location = ""
+	}
+	writeS3XML(writer, s3LocationConstraint{Xmlns: s3Xmlns, Location: location})
+}
+
+// s3LifecycleRules converts S3 lifecycle rules to the container's, returning
+// the S3 error status if they can't be.
+func s3LifecycleRules(config *s3LifecycleConfiguration) ([]lifecycle.Rule, int) {
+	var rules []lifecycle.Rule
+	for _, r := range config.Rules {
+		rule := lifecycle.Rule{ID: r.ID}
+		switch r.Status {
+		case "Enabled":
+		case "Disabled":
+			rule.Disabled = true
+		default:
+			return nil, 40004
+		}
+		if len(r.Transitions) > 0 || len(r.NoncurrentTransitions) > 0 {
+			return nil, http.StatusNotImplemented
+		}
+		if r.Filter != nil {
+			if r.Prefix != nil {
+				return nil, 40004
+			}
+			if r.Filter.Tag != nil || r.Filter.And != nil {
+				return nil, http.StatusNotImplemented
+			}
+			rule.Prefix = r.Filter.Prefix
+		} else if r.Prefix != nil {
+			rule.Prefix = *r.Prefix
+		}
+		if r.Expiration != nil {
+			if r.Expiration.Date != nil || r.Expiration.ExpiredObjectDeleteMarker != nil {
+				return nil, http.StatusNotImplemented
+			}
+			if r.Expiration.Days <= 0 {
+				return nil, 40007
+			}
+			rule.ExpirationDays = r.Expiration.Days
+		}
+		if r.NoncurrentVersionExpiration != nil {
+			if r.NoncurrentVersionExpiration.NoncurrentDays <= 0 {
+				return nil, 40007
+			}
+			rule.NoncurrentDays = r.NoncurrentVersionExpiration.NoncurrentDays
+		}
+		if r.AbortIncompleteMultipartUpload != nil {
+			if r.AbortIncompleteMultipartUpload.DaysAfterInitiation <= 0 {
+				return nil, 40007
+			}
+			rule.AbortUploadDays = r.AbortIncompleteMultipartUpload.DaysAfterInitiation
+		}
+		rules = append(rules, rule)
+	}
+	if lifecycle.Validate(rules) != nil {
+		return nil, 40004
+	}
+	return rules, 0
+}
+
+// s3LifecycleConfig converts the container's lifecycle rules to S3's.
+func s3LifecycleConfig(rules []lifecycle.Rule) *s3LifecycleConfiguration {
+	config := &s3LifecycleConfiguration{Xmlns: s3Xmlns}
+	for _, rule := range rules {
+		r := s3LifecycleRule{ID: rule.ID, Status: "Enabled", Filter: &s3LifecycleFilter{Prefix: rule.Prefix}}
+		if rule.Disabled {
+			r.Status = "Disabled"
+		}
+		if rule.ExpirationDays > 0 {
+			r.Expiration = &s3LifecycleExpiration{Days: rule.ExpirationDays}
+		}
+		if rule.NoncurrentDays > 0 {
+			r.NoncurrentVersionExpiration = &s3NoncurrentVersionExpiration{NoncurrentDays: rule.NoncurrentDays}
+		}
+		if rule.AbortUploadDays > 0 {
+			r.AbortIncompleteMultipartUpload = &s3AbortIncompleteMultipartUpload{DaysAfterInitiation: rule.AbortUploadDays}
+		}
+		config.Rules = append(config.Rules, r)
+	}
+	return config
+}
+
+// s3LifecycleEncryptionWarning warns that the container-lifecycle daemon,
+// which can't re-encrypt an object under its archived name, leaves encrypted
+// objects in versioned buckets in place rather than expire them.
+const s3LifecycleEncryptionWarning = `299 - "Expiration skips encrypted objects in versioned buckets"`
+
+// warnLifecycleEncryption adds s3LifecycleEncryptionWarning to the response if
+// the bucket is versioned and the rules expire objects.
+func warnLifecycleEncryption(writer http.ResponseWriter, bucket http.Header, rules []lifecycle.Rule) {
+	if bucket.Get(CLIENT_HISTORY_LOC) == "" && bucket.Get(CLIENT_VERSIONS_LOC) == "" {
+		return
+	}
+	for _, rule := range rules {
+		if !rule.Disabled && rule.ExpirationDays > 0 {
+			writer.Header().Set("Warning", s3LifecycleEncryptionWarning)
+			return
+		}
+	}
+}
+
+// handleBucketLifecycle keeps the bucket's lifecycle rules in the container's
+// lifecycle sysmeta, where the container-lifecycle daemon applies them.
+func (s *s3ApiHandler) handleBucketLifecycle(writer http.ResponseWriter, request *http.Request) {
+	bucketPath := fmt.Sprintf("/v1/AUTH_%s/%s", common.Urlencode(s.account), common.Urlencode(s.container))
+	switch request.Method {
+	case "GET":
+		header := s.headBucket(writer, request)
+		if header == nil {
+			return
+		}
+		rules, err := lifecycle.Parse(header.Get(lifecycle.Sysmeta))
+		if err != nil {
+			NoSuchLifecycleConfigurationResponse(writer, request)
+			return
+		}
+		warnLifecycleEncryption(writer, header, rules)
+		writeS3XML(writer, s3LifecycleConfig(rules))
+	case "PUT", "DELETE":
+		header := http.Header{lifecycle.Sysmeta: {""}}
+		var rules []lifecycle.Rule
+		if request.Method == "PUT" {
+			body, err := ioutil.ReadAll(io.LimitReader(request.Body, s3ConfigBodyLimit+1))
+			if err != nil {
+				srv.StandardResponse(writer, http.StatusInternalServerError)
+				return
+			}
+			if len(body) > s3ConfigBodyLimit {
+				MalformedXMLResponse(writer, request)
+				return
+			}
+			if contentMD5 := request.Header.Get("Content-Md5"); contentMD5 != "" {
+				sum := md5.Sum(body)
+				if contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+					BadDigestResponse(writer, request)
+					return
+				}
+			}
+			config := s3LifecycleConfiguration{}
+			if err := xml.Unmarshal(body, &config); err != nil {
+				MalformedXMLResponse(writer, request)
+				return
+			}
+			var status int
+			rules, status = s3LifecycleRules(&config)
+			if status != 0 {
+				writer.WriteHeader(status)
+				writer.Write(nil)
+				return
+			}
+			header.Set(lifecycle.Sysmeta, lifecycle.Format(rules))
+		}
+		bucket := s.headBucket(writer, request)
+		if bucket == nil {
+			return
+		}
+		c, err := s.subrequest(request, "POST", bucketPath, header)
+		if err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if c.status/100 != 2 {
+			srv.StandardResponse(writer, c.status)
+			return
+		}
+		warnLifecycleEncryption(writer, bucket, rules)
+		if request.Method == "DELETE" {
+			writer.WriteHeader(204)
+		} else {
+			writer.WriteHeader(200)
+		}
+	default:
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+	}
+}
+
+// handleACL maps the private and public-read canned ACLs onto the bucket's
+// X-Container-Read. Objects have their bucket's ACL.
+func (s *s3ApiHandler) handleACL(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	switch request.Method {
+	case "GET":
+		if s.object != "" && s.headObject(writer, request) == nil {
+			return
+		}
+		header := s.headBucket(writer, request)
+		if header == nil {
+			return
+		}
+		owner := s3Owner{ID: ctx.S3Auth.Account, DisplayName: ctx.S3Auth.Account}
+		policy := s3AccessControlPolicy{
+			Xmlns: s3Xmlns,
+			Owner: owner,
+			Grants: []s3Grant{{
+				Grantee: s3Grantee{
+					XmlnsXsi:    "http://www.w3.org/2001/XMLSchema-instance",
+					Type:        "CanonicalUser",
+					ID:          owner.ID,
+					DisplayName: owner.DisplayName,
+				},
+				Permission: "FULL_CONTROL",
+			}},
+		}
+		if strings.Contains(header.Get("X-Container-Read"), ".r:*") {
+			policy.Grants = append(policy.Grants, s3Grant{
+				Grantee: s3Grantee{
+					XmlnsXsi: "http://www.w3.org/2001/XMLSchema-instance",
+					Type:     "Group",
+					URI:      s3AllUsers,
+				},
+				Permission: "READ",
+			})
+		}
+		writeS3XML(writer, policy)
+	case "PUT":
+		acl := request.Header.Get("X-Amz-Acl")
+		if acl == "" {
+			policy := s3AccessControlPolicy{}
+			if err := readS3XML(request, s3ConfigBodyLimit, &policy); err != nil {
+				MalformedXMLResponse(writer, request)
+				return
+			}
+			acl = "private"
+			for _, grant := range policy.Grants {
+				if grant.Grantee.URI == s3AllUsers {
+					if grant.Permission != "READ" {
+						NotImplementedResponse(writer, request)
+						return
+					}
+					acl = "public-read"
+				}
+			}
+		}
+		read, ok := s3CannedACLs[acl]
+		if !ok {
+			NotImplementedResponse(writer, request)
+			return
+		}
+		if s.object != "" {
+			if s.headObject(writer, request) == nil {
+				return
+			}
+			header := s.headBucket(writer, request)
+			if header == nil {
+				return
+			}
+			if strings.Contains(header.Get("X-Container-Read"), ".r:*") != (read != "") {
+				NotImplementedResponse(writer, request)
+				return
+			}
+			writer.WriteHeader(200)
+			return
+		}
+		c, err := s.subrequest(request, "POST", fmt.Sprintf("/v1/AUTH_%s/%s", common.Urlencode(s.account), common.Urlencode(s.container)),
+			http.Header{"X-Container-Read": {read}})
+		if err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if c.status == 404 {
+			NoSuchBucketResponse(writer, request)
+			return
+		}
+		if c.status/100 != 2 {
+			srv.StandardResponse(writer, c.status)
+			return
+		}
+		writer.WriteHeader(200)
+	default:
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+	}
+}
+
+// s3PostHeaders are what an object POST replaces along with the user metadata.
+var s3PostHeaders = []string{"Content-Disposition", "Content-Encoding", "X-Delete-At", "X-Object-Manifest"}
+
+// setObjectTagging replaces an object's tags with a POST of the tagging
+// sysmeta, which the object server keeps along with the rest of the object's
+// sysmeta. The POST replaces the user metadata too, so the object's current
+// metadata from header is sent back with it.
+func (s *s3ApiHandler) setObjectTagging(request *http.Request, header http.Header, tagging string) (int, error) {
+	postHeader := http.Header{s3TaggingSysmeta: {tagging}}
+	for k, v := range header {
+		if strings.HasPrefix(k, "X-Object-Meta-") {
+			postHeader[k] = v
+		}
+	}
+	for _, k := range s3PostHeaders {
+		if v := header.Get(k); v != "" {
+			postHeader.Set(k, v)
+		}
+	}
+	c, err := s.subrequest(request, "POST", fmt.Sprintf("/v1/AUTH_%s/%s/%s", common.Urlencode(s.account),
+		common.Urlencode(s.container), common.Urlencode(s.object)), postHeader)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return c.status, nil
+}
+
+func (s *s3ApiHandler) handleObjectTagging(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET":
+		header := s.headObject(writer, request)
+		if header == nil {
+			return
+		}
+		tags, err := url.ParseQuery(header.Get(s3TaggingSysmeta))
+		if err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		tagging := s3Tagging{Xmlns: s3Xmlns}
+		for _, k := range keys {
+			tagging.TagSet.Tags = append(tagging.TagSet.Tags, s3Tag{Key: k, Value: tags.Get(k)})
+		}
+		writeS3XML(writer, tagging)
+	case "PUT", "DELETE":
+		encoded := ""
+		if request.Method == "PUT" {
+			tagging := s3Tagging{}
+			if err := readS3XML(request, s3ConfigBodyLimit, &tagging); err != nil {
+				MalformedXMLResponse(writer, request)
+				return
+			}
+			tags := url.Values{}
+			for _, tag := range tagging.TagSet.Tags {
+				tags.Add(tag.Key, tag.Value)
+			}
+			if !validS3Tags(tags) {
+				InvalidTagResponse(writer, request)
+				return
+			}
+			encoded = tags.Encode()
+		}
+		header := s.headObject(writer, request)
+		if header == nil {
+			return
+		}
+		status, err := s.setObjectTagging(request, header, encoded)
+		if err != nil {
+			srv.SimpleErrorResponse(writer, status, err.Error())
+			return
+		}
+		if status == 404 {
+			NoSuchKeyResponse(writer, request)
+			return
+		}
+		if status/100 != 2 {
+			srv.StandardResponse(writer, status)
+			return
+		}
+		if request.Method == "DELETE" {
+			writer.WriteHeader(204)
+		} else {
+			writer.WriteHeader(200)
+		}
+	default:
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadCompleted reports whether the upload with the marker object name in
+// the bucket's "+segments" container was completed, leaving its parts in use
+// by the SLO manifest of the upload's key. Uploads completed before their
+// markers were deleted on completion still have them.
+func (s *s3ApiHandler) uploadCompleted(request *http.Request, name string) (bool, int) {
+	dash := strings.Index(name, "-")
+	if dash < 0 {
+		return false, http.StatusOK
+	}
+	path := fmt.Sprintf("/v1/AUTH_%s/%s/%s?multipart-manifest=get", common.Urlencode(s.account),
+		common.Urlencode(s.container), common.Urlencode(name[dash+1:]))
+	c, err := s.subrequest(request, "HEAD", path, nil)
+	if err != nil {
+		return false, http.StatusInternalServerError
+	}
+	if c.status == 404 {
+		return false, http.StatusOK
+	}
+	if c.status/100 != 2 {
+		return false, c.status
+	}
+	if !common.LooksTrue(c.header.Get("X-Static-Large-Object")) {
+		return false, http.StatusOK
+	}
+	if c, err = s.subrequest(request, "GET", path, nil); err != nil {
+		return false, http.StatusInternalServerError
+	}
+	if c.status == 404 {
+		return false, http.StatusOK
+	}
+	if c.status/100 != 2 {
+		return false, c.status
+	}
+	var manifest []segItem
+	if err := json.Unmarshal(c.body, &manifest); err != nil {
+		return false, http.StatusInternalServerError
+	}
+	prefix := "/" + s.container + "+segments/" + name + "/"
+	for _, seg := range manifest {
+		segName, err := url.PathUnescape(seg.Name)
+		if err != nil {
+			segName = seg.Name
+		}
+		if strings.HasPrefix(segName, prefix) {
+			return true, http.StatusOK
+		}
+	}
+	return false, http.StatusOK
+}
+
+// handleAbortUploads aborts the bucket's incomplete multipart uploads. With
+// older-than=<seconds> only uploads initiated longer ago than that are
+// aborted.
+func (s *s3ApiHandler) handleAbortUploads(writer http.ResponseWriter, request *http.Request) {
+	cutoff := time.Now()
+	if v := request.Form.Get("older-than"); v != "" {
+		age, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || age < 0 {
+			InvalidArgumentResponse(writer, request)
+			return
+		}
+		cutoff = cutoff.Add(-time.Duration(age) * time.Second)
+	}
+	if s.headBucket(writer, request) == nil {
+		return
+	}
+	segments := fmt.Sprintf("/v1/AUTH_%s/%s+segments", common.Urlencode(s.account), common.Urlencode(s.container))
+	listing, status := s.listAll(request, segments)
+	if status == 404 {
+		writer.WriteHeader(204)
+		return
+	}
+	if status/100 != 2 {
+		srv.StandardResponse(writer, status)
+		return
+	}
+	// Each upload is a marker object named <uploadId>-<key>, with its parts
+	// under <uploadId>-<key>/<part number>.
+	aborted := map[string]bool{}
+	var parts, markers []string
+	for _, obj := range listing {
+		if s3PartName.MatchString(obj.Name) {
+			continue
+		}
+		initiated, err := time.ParseInLocation("2006-01-02T15:04:05.999999", obj.LastModified, common.GMT)
+		if err != nil || !initiated.Before(cutoff) {
+			continue
+		}
+		completed, status := s.uploadCompleted(request, obj.Name)
+		if status/100 != 2 {
+			srv.StandardResponse(writer, status)
+			return
+		}
+		if !completed {
+			aborted[obj.Name] = true
+			markers = append(markers, obj.Name)
+		}
+	}
+	for _, obj := range listing {
+		if s3PartName.MatchString(obj.Name) && aborted[obj.Name[:len(obj.Name)-9]] {
+			parts = append(parts, obj.Name)
+		}
+	}
+	// Delete the parts first, so a failure doesn't leave parts behind
+	// without their upload.
+	for _, name := range append(parts, markers...) {
+		c, err := s.subrequest(request, "DELETE", segments+"/"+common.Urlencode(name), nil)
+		if err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if c.status/100 != 2 && c.status != 404 {
+			srv.StandardResponse(writer, c.status)
+			return
+		}
+	}
+	writer.WriteHeader(204)
+}
+
 func NewS3Api(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
 	enabled, ok := config.Section["enabled"]
 	if !ok || strings.Compare(strings.ToLower(enabled), "false") == 0 {
@@ -1115,13 +2174,24 @@ func NewS3Api(config conf.Section, metricsScope tally.Scope) (func(http.Handler)
 		}, nil
 	}
 	RegisterInfo("s3api", map[string]interface{}{})
-	return s3Api(metricsScope.Counter("s3Api_requests")), nil
+	return s3Api(config.GetDefault("location", "us-east-1"), s3StorageDomains(config), metricsScope.Counter("s3Api_requests")), nil
+}
+
+// s3StorageDomains returns the storage_domain list from the s3api config;
+// requests to subdomains of them are taken to be virtual-hosted-style, with
+// the bucket in the Host rather than the path.
+func s3StorageDomains(config conf.Section) []string {
+	domains := splitConfigList(strings.ToLower(config.GetDefault("storage_domain", "")))
+	for i, domain := range domains {
+		domains[i] = strings.Trim(domain, ".")
+	}
+	return domains
 }
 
-func s3Api(requestsMetric tally.Counter) func(next http.Handler) http.Handler {
+func s3Api(region string, storageDomains []string, requestsMetric tally.Counter) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			(&s3ApiHandler{next: next, requestsMetric: requestsMetric}).ServeHTTP(writer, request)
+			(&s3ApiHandler{next: next, region: region, storageDomains: storageDomains, requestsMetric: requestsMetric}).ServeHTTP(writer, request)
 		})
 	}
 }
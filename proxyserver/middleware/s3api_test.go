@@ -1,9 +1,23 @@
 package middleware
 
 import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/lifecycle"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
 )
 
 func TestValidBucketName(t *testing.T) {
@@ -28,3 +42,382 @@ func TestS3DateString(t *testing.T) {
 	// Doesn't index out of range.
 	assert.Equal(t, "no", s3DateString("no"))
 }
+
+type s3TestBackend struct {
+	requests []*http.Request
+	status   map[string]int
+	header   http.Header
+}
+
+func (b *s3TestBackend) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	b.requests = append(b.requests, request)
+	for k, v := range b.header {
+		writer.Header()[k] = v
+	}
+	status, ok := b.status[request.Method+" "+request.URL.Path]
+	if !ok {
+		status = 204
+	}
+	writer.WriteHeader(status)
+}
+
+func newS3TestRequest(method, path string, body string, backend http.Handler) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{next: backend},
+		Logger:                 zap.NewNop(),
+		S3Auth:                 &S3AuthInfo{Account: "test"},
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+}
+
+func serveS3Test(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s3Api("us-east-1", nil, tally.NoopScope.Counter("test"))(nil).ServeHTTP(newS3ResponseWriterWrapper(w, r), r)
+	return w
+}
+
+func TestValidS3Tags(t *testing.T) {
+	assert.True(t, validS3Tags(url.Values{"a": {"b"}}))
+	assert.True(t, validS3Tags(url.Values{}))
+	assert.False(t, validS3Tags(url.Values{"a": {"b", "c"}}))
+	assert.False(t, validS3Tags(url.Values{"": {"b"}}))
+	assert.False(t, validS3Tags(url.Values{"aws:x": {"b"}}))
+	assert.False(t, validS3Tags(url.Values{"a": {strings.Repeat("b", 257)}}))
+	tags := url.Values{}
+	for i := 0; i < 11; i++ {
+		tags.Set(strconv.Itoa(i), "x")
+	}
+	assert.False(t, validS3Tags(tags))
+}
+
+func TestS3MultiDelete(t *testing.T) {
+	backend := &s3TestBackend{status: map[string]int{
+		"DELETE /v1/AUTH_test/bucket/o2": 404,
+		"DELETE /v1/AUTH_test/bucket/o3": 403,
+	}}
+	body := `<Delete><Object><Key>o1</Key></Object><Object><Key>o2</Key></Object><Object><Key>o3</Key></Object></Delete>`
+	w := serveS3Test(newS3TestRequest("POST", "/bucket?delete", body, backend))
+	require.Equal(t, 200, w.Code)
+	result := s3DeleteResult{}
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &result))
+	require.Equal(t, []s3Deleted{{Key: "o1"}, {Key: "o2"}}, result.Deleted)
+	require.Equal(t, 1, len(result.Errors))
+	require.Equal(t, "o3", result.Errors[0].Key)
+	require.Equal(t, "AccessDenied", result.Errors[0].Code)
+
+	r := newS3TestRequest("POST", "/bucket?delete", body, backend)
+	r.Header.Set("Content-MD5", "nope")
+	w = serveS3Test(r)
+	require.Equal(t, 400, w.Code)
+	require.Contains(t, w.Body.String(), "BadDigest")
+
+	w = serveS3Test(newS3TestRequest("POST", "/bucket?delete", "<Delete>", backend))
+	require.Equal(t, 400, w.Code)
+	require.Contains(t, w.Body.String(), "MalformedXML")
+}
+
+func TestS3BucketVersioning(t *testing.T) {
+	backend := &s3TestBackend{}
+	w := serveS3Test(newS3TestRequest("PUT", "/bucket?versioning",
+		`<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`, backend))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 3, len(backend.requests))
+	require.Equal(t, "PUT", backend.requests[1].Method)
+	require.Equal(t, "/v1/AUTH_test/bucket+versions", backend.requests[1].URL.Path)
+	require.Equal(t, "POST", backend.requests[2].Method)
+	require.Equal(t, "bucket+versions", backend.requests[2].Header.Get(CLIENT_HISTORY_LOC))
+	require.Equal(t, "Enabled", backend.requests[2].Header.Get(s3VersioningSysmeta))
+
+	backend = &s3TestBackend{header: http.Header{s3VersioningSysmeta: {"Suspended"}}}
+	w = serveS3Test(newS3TestRequest("GET", "/bucket?versioning", "", backend))
+	require.Equal(t, 200, w.Code)
+	config := s3VersioningConfiguration{}
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &config))
+	require.Equal(t, "Suspended", config.Status)
+
+	backend = &s3TestBackend{status: map[string]int{"HEAD /v1/AUTH_test/bucket": 404}}
+	w = serveS3Test(newS3TestRequest("GET", "/bucket?versioning", "", backend))
+	require.Equal(t, 404, w.Code)
+	require.Contains(t, w.Body.String(), "NoSuchBucket")
+}
+
+func TestS3ObjectTagging(t *testing.T) {
+	backend := &s3TestBackend{header: http.Header{"X-Object-Meta-Owner": {"bob"}, "Content-Encoding": {"gzip"}, "Etag": {"abc"}}}
+	w := serveS3Test(newS3TestRequest("PUT", "/bucket/obj?tagging",
+		`<Tagging><TagSet><Tag><Key>color</Key><Value>blue</Value></Tag></TagSet></Tagging>`, backend))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 2, len(backend.requests))
+	require.Equal(t, "HEAD", backend.requests[0].Method)
+	// The tags are POSTed, with the user metadata the POST would otherwise drop.
+	require.Equal(t, "POST", backend.requests[1].Method)
+	require.Equal(t, "/v1/AUTH_test/bucket/obj", backend.requests[1].URL.Path)
+	require.Equal(t, "color=blue", backend.requests[1].Header.Get(s3TaggingSysmeta))
+	require.Equal(t, "bob", backend.requests[1].Header.Get("X-Object-Meta-Owner"))
+	require.Equal(t, "gzip", backend.requests[1].Header.Get("Content-Encoding"))
+	require.Equal(t, "", backend.requests[1].Header.Get("Etag"))
+
+	backend = &s3TestBackend{}
+	w = serveS3Test(newS3TestRequest("DELETE", "/bucket/obj?tagging", "", backend))
+	require.Equal(t, 204, w.Code)
+	values, ok := backend.requests[1].Header[s3TaggingSysmeta]
+	require.True(t, ok)
+	require.Equal(t, []string{""}, values)
+
+	backend = &s3TestBackend{status: map[string]int{"HEAD /v1/AUTH_test/bucket/obj": 404}}
+	w = serveS3Test(newS3TestRequest("DELETE", "/bucket/obj?tagging", "", backend))
+	require.Equal(t, 404, w.Code)
+	require.Contains(t, w.Body.String(), "NoSuchKey")
+	require.Equal(t, 1, len(backend.requests))
+
+	backend = &s3TestBackend{header: http.Header{s3TaggingSysmeta: {"color=blue&size=big"}}}
+	w = serveS3Test(newS3TestRequest("GET", "/bucket/obj?tagging", "", backend))
+	require.Equal(t, 200, w.Code)
+	tagging := s3Tagging{}
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &tagging))
+	require.Equal(t, []s3Tag{{"color", "blue"}, {"size", "big"}}, tagging.TagSet.Tags)
+
+	w = serveS3Test(newS3TestRequest("PUT", "/bucket/obj?tagging",
+		`<Tagging><TagSet><Tag><Key>a</Key><Value>1</Value></Tag><Tag><Key>a</Key><Value>2</Value></Tag></TagSet></Tagging>`, backend))
+	require.Equal(t, 400, w.Code)
+	require.Contains(t, w.Body.String(), "InvalidTag")
+}
+
+func TestS3BucketLocationAndACL(t *testing.T) {
+	backend := &s3TestBackend{}
+	w := httptest.NewRecorder()
+	r := newS3TestRequest("GET", "/bucket?location", "", backend)
+	s3Api("eu-west-1", nil, tally.NoopScope.Counter("test"))(nil).ServeHTTP(newS3ResponseWriterWrapper(w, r), r)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), ">eu-west-1</LocationConstraint>")
+
+	backend = &s3TestBackend{header: http.Header{"X-Container-Read": {s3PublicReadACL}}}
+	w = serveS3Test(newS3TestRequest("GET", "/bucket?acl", "", backend))
+	require.Equal(t, 200, w.Code)
+	policy := s3AccessControlPolicy{}
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &policy))
+	require.Equal(t, 2, len(policy.Grants))
+	require.Equal(t, s3AllUsers, policy.Grants[1].Grantee.URI)
+
+	backend = &s3TestBackend{}
+	r = newS3TestRequest("PUT", "/bucket?acl", "", backend)
+	r.Header.Set("X-Amz-Acl", "public-read")
+	w = serveS3Test(r)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, s3PublicReadACL, backend.requests[0].Header.Get("X-Container-Read"))
+
+	backend = &s3TestBackend{}
+	r = newS3TestRequest("PUT", "/bucket?acl", "", backend)
+	r.Header.Set("X-Amz-Acl", "authenticated-read")
+	w = serveS3Test(r)
+	require.Equal(t, 501, w.Code)
+	require.Contains(t, w.Body.String(), "<Code>NotImplemented</Code>")
+	require.Equal(t, 0, len(backend.requests))
+}
+
+func TestS3CompleteMultipartUpload(t *testing.T) {
+	backend := &s3TestBackend{}
+	w := serveS3Test(newS3TestRequest("POST", "/bucket/key?uploadId=1", `<CompleteMultipartUpload>`+
+		`<Part><PartNumber>1</PartNumber><ETag>x</ETag></Part></CompleteMultipartUpload>`, backend))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 2, len(backend.requests))
+	require.Equal(t, "PUT", backend.requests[0].Method)
+	require.Equal(t, "/v1/AUTH_test/bucket/key", backend.requests[0].URL.Path)
+	require.Equal(t, "DELETE", backend.requests[1].Method)
+	require.Equal(t, "/v1/AUTH_test/bucket+segments/1-key", backend.requests[1].URL.Path)
+
+	backend = &s3TestBackend{status: map[string]int{"PUT /v1/AUTH_test/bucket/key": 400}}
+	w = serveS3Test(newS3TestRequest("POST", "/bucket/key?uploadId=1", `<CompleteMultipartUpload>`+
+		`<Part><PartNumber>1</PartNumber><ETag>x</ETag></Part></CompleteMultipartUpload>`, backend))
+	require.Equal(t, 400, w.Code)
+	require.Equal(t, 1, len(backend.requests))
+}
+
+func TestS3AbortUploads(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).In(common.GMT).Format("2006-01-02T15:04:05.000000")
+	recent := time.Now().In(common.GMT).Format("2006-01-02T15:04:05.000000")
+	// 3-c was completed into c's manifest before completing deleted markers.
+	listing := fmt.Sprintf(`[{"name":"1-a","last_modified":"%s"},{"name":"1-a/00000001","last_modified":"%s"},`+
+		`{"name":"2-b","last_modified":"%s"},{"name":"2-b/00000001","last_modified":"%s"},`+
+		`{"name":"3-c","last_modified":"%s"},{"name":"3-c/00000001","last_modified":"%s"}]`, old, old, recent, recent, old, old)
+	var deleted []string
+	backend := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch {
+		case request.URL.Path == "/v1/AUTH_test/bucket/a":
+			writer.WriteHeader(404)
+		case request.URL.Path == "/v1/AUTH_test/bucket/c":
+			writer.Header().Set("X-Static-Large-Object", "True")
+			writer.WriteHeader(200)
+			if request.Method == "GET" {
+				writer.Write([]byte(`[{"name":"/bucket%2Bsegments/3-c/00000001","bytes":5}]`))
+			}
+		case request.Method == "GET":
+			writer.WriteHeader(200)
+			if request.URL.Query().Get("marker") == "" {
+				writer.Write([]byte(listing))
+			} else {
+				writer.Write([]byte("[]"))
+			}
+		case request.Method == "DELETE":
+			deleted = append(deleted, request.URL.Path)
+			writer.WriteHeader(204)
+		default:
+			writer.WriteHeader(204)
+		}
+	})
+	w := serveS3Test(newS3TestRequest("DELETE", "/bucket?uploads&older-than=3600", "", backend))
+	require.Equal(t, 204, w.Code)
+	require.Equal(t, []string{"/v1/AUTH_test/bucket+segments/1-a/00000001", "/v1/AUTH_test/bucket+segments/1-a"}, deleted)
+
+	w = serveS3Test(newS3TestRequest("DELETE", "/bucket?uploads&older-than=soon", "", backend))
+	require.Equal(t, 400, w.Code)
+}
+
+func TestS3BucketLifecycle(t *testing.T) {
+	backend := &s3TestBackend{}
+	w := serveS3Test(newS3TestRequest("PUT", "/bucket?lifecycle", `<LifecycleConfiguration><Rule><ID>logs</ID>`+
+		`<Filter><Prefix>logs/</Prefix></Filter><Status>Enabled</Status><Expiration><Days>30</Days></Expiration>`+
+		`<AbortIncompleteMultipartUpload><DaysAfterInitiation>1</DaysAfterInitiation></AbortIncompleteMultipartUpload>`+
+		`</Rule></LifecycleConfiguration>`, backend))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 2, len(backend.requests))
+	require.Equal(t, "POST", backend.requests[1].Method)
+	require.Equal(t, "/v1/AUTH_test/bucket", backend.requests[1].URL.Path)
+	require.Equal(t, `[{"id":"logs","prefix":"logs/","expiration_days":30,"abort_upload_days":1}]`,
+		backend.requests[1].Header.Get(lifecycle.Sysmeta))
+
+	backend = &s3TestBackend{header: http.Header{lifecycle.Sysmeta: {`[{"prefix":"tmp/","expiration_days":2,"disabled":true}]`}}}
+	w = serveS3Test(newS3TestRequest("GET", "/bucket?lifecycle", "", backend))
+	require.Equal(t, 200, w.Code)
+	config := s3LifecycleConfiguration{}
+	require.Nil(t, xml.Unmarshal(w.Body.Bytes(), &config))
+	require.Equal(t, 1, len(config.Rules))
+	require.Equal(t, "Disabled", config.Rules[0].Status)
+	require.Equal(t, "tmp/", config.Rules[0].Filter.Prefix)
+	require.Equal(t, 2, config.Rules[0].Expiration.Days)
+	require.Equal(t, "", w.Header().Get("Warning"))
+
+	backend = &s3TestBackend{header: http.Header{lifecycle.Sysmeta: {`[{"prefix":"tmp/","expiration_days":2}]`},
+		"X-History-Location": {"bucket+versions"}}}
+	w = serveS3Test(newS3TestRequest("GET", "/bucket?lifecycle", "", backend))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, s3LifecycleEncryptionWarning, w.Header().Get("Warning"))
+	w = serveS3Test(newS3TestRequest("PUT", "/bucket?lifecycle", `<LifecycleConfiguration><Rule><Status>Enabled</Status>`+
+		`<Expiration><Days>1</Days></Expiration></Rule></LifecycleConfiguration>`, backend))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, s3LifecycleEncryptionWarning, w.Header().Get("Warning"))
+
+	backend = &s3TestBackend{}
+	w = serveS3Test(newS3TestRequest("GET", "/bucket?lifecycle", "", backend))
+	require.Equal(t, 404, w.Code)
+	require.Contains(t, w.Body.String(), "NoSuchLifecycleConfiguration")
+
+	w = serveS3Test(newS3TestRequest("DELETE", "/bucket?lifecycle", "", backend))
+	require.Equal(t, 204, w.Code)
+	values, ok := backend.requests[len(backend.requests)-1].Header[lifecycle.Sysmeta]
+	require.True(t, ok)
+	require.Equal(t, []string{""}, values)
+
+	w = serveS3Test(newS3TestRequest("PUT", "/bucket?lifecycle", `<LifecycleConfiguration><Rule><Status>Enabled</Status>`+
+		`<Transition><Days>1</Days><StorageClass>GLACIER</StorageClass></Transition></Rule></LifecycleConfiguration>`, backend))
+	require.Equal(t, 501, w.Code)
+	w = serveS3Test(newS3TestRequest("PUT", "/bucket?lifecycle", `<LifecycleConfiguration><Rule><Status>Enabled</Status>`+
+		`<Expiration><Days>0</Days></Expiration></Rule></LifecycleConfiguration>`, backend))
+	require.Equal(t, 400, w.Code)
+	require.Contains(t, w.Body.String(), "InvalidArgument")
+	w = serveS3Test(newS3TestRequest("PUT", "/bucket?lifecycle", `<LifecycleConfiguration><Rule><Status>Maybe</Status>`+
+		`<Expiration><Days>1</Days></Expiration></Rule></LifecycleConfiguration>`, backend))
+	require.Equal(t, 400, w.Code)
+	require.Contains(t, w.Body.String(), "MalformedXML")
+}
+
+func TestS3Checksums(t *testing.T) {
+	backend := &s3TestBackend{}
+	r := newS3TestRequest("PUT", "/bucket/obj", "testcontents", backend)
+	r.Header.Set("X-Amz-Checksum-Sha256", "cJeoKhCOeNofCmuZTO+7P5fRTPWBc0YZw40uuO9PLmA=")
+	w := serveS3Test(r)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "7097a82a108e78da1f0a6b994cefbb3f97d14cf581734619c38d2eb8ef4f2e60", backend.requests[0].Header.Get("X-Object-Checksum-Sha256"))
+
+	backend = &s3TestBackend{status: map[string]int{"PUT /v1/AUTH_test/bucket/obj": 422}}
+	r = newS3TestRequest("PUT", "/bucket/obj", "testcontents", backend)
+	r.Header.Set("X-Amz-Checksum-Crc32c", "AAAAAA==")
+	w = serveS3Test(r)
+	require.Equal(t, 400, w.Code)
+	require.Contains(t, w.Body.String(), "BadDigest")
+
+	r = newS3TestRequest("PUT", "/bucket/obj", "testcontents", backend)
+	r.Header.Set("X-Amz-Checksum-Crc32c", "not base64!")
+	w = serveS3Test(r)
+	require.Equal(t, 400, w.Code)
+	require.Contains(t, w.Body.String(), "InvalidArgument")
+
+	backend = &s3TestBackend{status: map[string]int{"HEAD /v1/AUTH_test/bucket/obj": 200},
+		header: http.Header{"X-Object-Checksum-Crc32c": {"51ee8ed0"}}}
+	w = serveS3Test(newS3TestRequest("HEAD", "/bucket/obj", "", backend))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "", w.Header().Get("X-Amz-Checksum-Crc32c"))
+	r = newS3TestRequest("HEAD", "/bucket/obj", "", backend)
+	r.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	w = serveS3Test(r)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "Ue6O0A==", w.Header().Get("X-Amz-Checksum-Crc32c"))
+}
+
+func TestS3ListingParams(t *testing.T) {
+	var query url.Values
+	backend := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query = request.URL.Query()
+		writer.WriteHeader(200)
+		writer.Write([]byte(`[{"subdir":"a/"},{"name":"b"},{"subdir":"c/"}]`))
+	})
+	w := serveS3Test(newS3TestRequest("GET", "/bucket?list-type=2&reverse=on&end_marker=a&prefix=p", "", backend))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "on", query.Get("reverse"))
+	require.Equal(t, "a", query.Get("end_marker"))
+	require.Equal(t, "p", query.Get("prefix"))
+	require.Equal(t, "", query.Get("path"))
+	body := w.Body.String()
+	require.True(t, strings.Index(body, "<Prefix>c/</Prefix>") < strings.Index(body, "<Prefix>a/</Prefix>"))
+
+	w = serveS3Test(newS3TestRequest("GET", "/bucket?path=dir", "", backend))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "dir", query.Get("path"))
+	require.Equal(t, "", query.Get("reverse"))
+}
+
+func TestS3VirtualHostedStyle(t *testing.T) {
+	backend := &s3TestBackend{}
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s3Api("us-east-1", []string{"s3.example.com"}, tally.NoopScope.Counter("test"))(nil).ServeHTTP(newS3ResponseWriterWrapper(w, r), r)
+		return w
+	}
+	r := newS3TestRequest("HEAD", "/dir/obj", "", backend)
+	r.Host = "Bucket.S3.example.com:8080"
+	require.Equal(t, 204, serve(r).Code)
+	require.Equal(t, "/v1/AUTH_test/bucket/dir/obj", backend.requests[len(backend.requests)-1].URL.Path)
+
+	// Keys that look like swift paths are still keys.
+	r = newS3TestRequest("HEAD", "/v1/obj", "", backend)
+	r.Host = "bucket.s3.example.com"
+	require.Equal(t, 204, serve(r).Code)
+	require.Equal(t, "/v1/AUTH_test/bucket/v1/obj", backend.requests[len(backend.requests)-1].URL.Path)
+
+	r = newS3TestRequest("HEAD", "/", "", backend)
+	r.Host = "my.bucket.s3.example.com"
+	require.Equal(t, 200, serve(r).Code)
+	require.Equal(t, "/v1/AUTH_test/my.bucket", backend.requests[len(backend.requests)-1].URL.Path)
+
+	r = newS3TestRequest("HEAD", "/", "", backend)
+	r.Host = "b.s3.example.com"
+	require.Equal(t, 400, serve(r).Code)
+
+	// Path-style requests, to the storage domain or anywhere else, still work.
+	for _, host := range []string{"s3.example.com", "localhost:8080"} {
+		r = newS3TestRequest("HEAD", "/bucket/dir/obj", "", backend)
+		r.Host = host
+		require.Equal(t, 204, serve(r).Code)
+		require.Equal(t, "/v1/AUTH_test/bucket/dir/obj", backend.requests[len(backend.requests)-1].URL.Path)
+	}
+}
@@ -16,24 +16,63 @@
 package middleware
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
 	"github.com/uber-go/tally"
 )
 
+const (
+	s3V4Algorithm          = "AWS4-HMAC-SHA256"
+	s3V4ChunkAlgorithm     = "AWS4-HMAC-SHA256-PAYLOAD"
+	s3V4StreamingPayload   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3V4UnsignedPayload    = "UNSIGNED-PAYLOAD"
+	s3V4EmptyPayloadHash   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3V4DateFormat         = "20060102T150405Z"
+	s3V4ScopeTerminator    = "aws4_request"
+	s3V4Service            = "s3"
+	s3V4MaxRequestSkew     = 15 * time.Minute
+	s3V4MaxPresignedExpiry = 7 * 24 * 60 * 60
+	s3V4MaxChunkSize       = 16 * 1024 * 1024
+)
+
+var (
+	errS3ChunkSignature = errors.New("aws-chunked chunk signature does not match")
+	errS3ChunkFormat    = errors.New("malformed aws-chunked body")
+	errS3ContentSHA256  = errors.New("x-amz-content-sha256 does not match the request body")
+)
+
 type S3AuthInfo struct {
 	Key          string
 	Signature    string
 	StringToSign string
 	Account      string
+	// Bucket is the bucket named by the Host of a virtual-hosted-style
+	// request, or "" for a path-style one.
+	Bucket string
+	// The following are only set for V4 signatures
+	Version    int
+	Date       string
+	Region     string
+	Service    string
+	signingKey []byte
 }
 
 var S3Subresources = map[string]bool{
@@ -65,6 +104,9 @@ var S3Subresources = map[string]bool{
 }
 
 func (s *S3AuthInfo) validateSignature(secret []byte) bool {
+	if s.Version == 4 {
+		return s.validateSignatureV4(secret)
+	}
 	// S3 Auth signature V2 Validation
 	mac := hmac.New(sha1.New, secret)
 	mac.Write([]byte(s.StringToSign))
@@ -77,9 +119,336 @@ func (s *S3AuthInfo) validateSignature(secret []byte) bool {
 	return hmac.Equal(sig1, sig2)
 }
 
+func (s *S3AuthInfo) validateSignatureV4(secret []byte) bool {
+	// S3 Auth signature V4 Validation
+	key := s3V4SigningKey(secret, s.Date, s.Region, s.Service)
+	sig1 := s3HmacSHA256(key, []byte(s.StringToSign))
+	sig2, err := hex.DecodeString(s.Signature)
+	if err != nil {
+		return false
+	}
+	if !hmac.Equal(sig1, sig2) {
+		return false
+	}
+	s.signingKey = key
+	return true
+}
+
+// setSecret records the signing key for a request whose signature was
+// validated elsewhere (e.g. by keystone), so that streaming chunk signatures
+// can still be verified.
+func (s *S3AuthInfo) setSecret(secret []byte) {
+	if s.Version == 4 {
+		s.signingKey = s3V4SigningKey(secret, s.Date, s.Region, s.Service)
+	}
+}
+
+func (s *S3AuthInfo) scope() string {
+	return strings.Join([]string{s.Date, s.Region, s.Service, s3V4ScopeTerminator}, "/")
+}
+
+func s3HmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func s3SHA256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func s3V4SigningKey(secret []byte, date, region, service string) []byte {
+	key := s3HmacSHA256(append([]byte("AWS4"), secret...), []byte(date))
+	key = s3HmacSHA256(key, []byte(region))
+	key = s3HmacSHA256(key, []byte(service))
+	return s3HmacSHA256(key, []byte(s3V4ScopeTerminator))
+}
+
+// s3V4Escape URI encodes a string the way AWS expects in canonical requests;
+// only the unreserved characters are left alone.
+func s3V4Escape(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func s3V4CanonicalQuery(query url.Values, skip string) string {
+	var parts []string
+	for k, vs := range query {
+		if k == skip {
+			continue
+		}
+		for _, v := range vs {
+			parts = append(parts, s3V4Escape(k, true)+"="+s3V4Escape(v, true))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+func s3V4CanonicalHeaders(request *http.Request, signedHeaders []string) string {
+	var buf bytes.Buffer
+	for _, h := range signedHeaders {
+		var value string
+		if h == "host" {
+			value = request.Host
+		} else {
+			value = strings.Join(request.Header[http.CanonicalHeaderKey(h)], ",")
+		}
+		buf.WriteString(h)
+		buf.WriteString(":")
+		buf.WriteString(strings.Join(strings.Fields(value), " "))
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// s3V4StringToSign builds the canonical request and wraps it in the string to
+// sign for the given credential scope.
+func s3V4StringToSign(request *http.Request, amzDate, scope string, signedHeaders []string, query url.Values, skipQuery, payloadHash string) string {
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3V4Escape(request.URL.Path, false),
+		s3V4CanonicalQuery(query, skipQuery),
+		s3V4CanonicalHeaders(request, signedHeaders),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	return strings.Join([]string{s3V4Algorithm, amzDate, scope, s3SHA256Hex([]byte(canonicalRequest))}, "\n")
+}
+
+// s3V4Request holds the pieces of a V4 signed request, whether they came from
+// the Authorization header or from presigned query parameters.
+type s3V4Request struct {
+	credential    string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	expires       int
+	presigned     bool
+}
+
+func parseS3V4Header(authStr string) (*s3V4Request, bool) {
+	v4 := &s3V4Request{}
+	for _, part := range strings.Split(strings.TrimPrefix(authStr, s3V4Algorithm), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, false
+		}
+		switch kv[0] {
+		case "Credential":
+			v4.credential = kv[1]
+		case "SignedHeaders":
+			v4.signedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			v4.signature = kv[1]
+		}
+	}
+	if v4.credential == "" || len(v4.signedHeaders) == 0 || v4.signature == "" {
+		return nil, false
+	}
+	return v4, true
+}
+
+func parseS3V4Query(query url.Values) (*s3V4Request, bool) {
+	v4 := &s3V4Request{
+		credential: query.Get("X-Amz-Credential"),
+		signature:  query.Get("X-Amz-Signature"),
+		amzDate:    query.Get("X-Amz-Date"),
+		presigned:  true,
+	}
+	if sh := query.Get("X-Amz-SignedHeaders"); sh != "" {
+		v4.signedHeaders = strings.Split(sh, ";")
+	}
+	var err error
+	if v4.expires, err = strconv.Atoi(query.Get("X-Amz-Expires")); err != nil || v4.expires < 0 || v4.expires > s3V4MaxPresignedExpiry {
+		return nil, false
+	}
+	if v4.credential == "" || len(v4.signedHeaders) == 0 || v4.signature == "" || v4.amzDate == "" {
+		return nil, false
+	}
+	return v4, true
+}
+
+// authInfo validates the credential scope and time window of the request and
+// builds the S3AuthInfo to be checked by the auth middleware.
+func (v4 *s3V4Request) authInfo(request *http.Request, query url.Values, region string, now time.Time) (*S3AuthInfo, int) {
+	malformed := 40002
+	if v4.presigned {
+		malformed = 40003
+	}
+	cred := strings.Split(v4.credential, "/")
+	if len(cred) < 5 {
+		return nil, malformed
+	}
+	n := len(cred)
+	info := &S3AuthInfo{
+		Key:       strings.Join(cred[:n-4], "/"),
+		Signature: v4.signature,
+		Version:   4,
+		Date:      cred[n-4],
+		Region:    cred[n-3],
+		Service:   cred[n-2],
+	}
+	if cred[n-1] != s3V4ScopeTerminator || info.Service != s3V4Service || info.Region != region || info.Key == "" {
+		return nil, malformed
+	}
+	amzDate := v4.amzDate
+	if amzDate == "" {
+		amzDate = request.Header.Get("X-Amz-Date")
+	}
+	var reqTime time.Time
+	var err error
+	if amzDate != "" {
+		reqTime, err = time.Parse(s3V4DateFormat, amzDate)
+	} else if date := request.Header.Get("Date"); date != "" {
+		reqTime, err = http.ParseTime(date)
+		amzDate = reqTime.UTC().Format(s3V4DateFormat)
+	} else {
+		return nil, http.StatusForbidden
+	}
+	if err != nil || amzDate[:8] != info.Date {
+		return nil, malformed
+	}
+	if v4.presigned {
+		if now.After(reqTime.Add(time.Duration(v4.expires) * time.Second)) {
+			return nil, 40302
+		}
+	} else if now.Sub(reqTime) > s3V4MaxRequestSkew || reqTime.Sub(now) > s3V4MaxRequestSkew {
+		return nil, 40301
+	}
+	hasHost := false
+	for _, h := range v4.signedHeaders {
+		if h == "host" {
+			hasHost = true
+		}
+	}
+	if !hasHost {
+		return nil, malformed
+	}
+	payloadHash := request.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = s3V4UnsignedPayload
+	}
+	skipQuery := ""
+	if v4.presigned {
+		skipQuery = "X-Amz-Signature"
+	}
+	info.StringToSign = s3V4StringToSign(request, amzDate, info.scope(), v4.signedHeaders, query, skipQuery, payloadHash)
+	return info, 0
+}
+
+// s3ChunkedReader decodes an aws-chunked request body, verifying the
+// signature of every chunk before handing its data on.
+type s3ChunkedReader struct {
+	auth    *S3AuthInfo
+	amzDate string
+	prevSig string
+	body    io.ReadCloser
+	r       *bufio.Reader
+	buf     []byte
+	done    bool
+	err     error
+}
+
+func newS3ChunkedReader(body io.ReadCloser, auth *S3AuthInfo, amzDate string) *s3ChunkedReader {
+	return &s3ChunkedReader{auth: auth, amzDate: amzDate, prevSig: auth.Signature, body: body, r: bufio.NewReader(body)}
+}
+
+func (c *s3ChunkedReader) readChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	parts := strings.SplitN(line, ";", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "chunk-signature=") {
+		return errS3ChunkFormat
+	}
+	size, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || size < 0 || size > s3V4MaxChunkSize {
+		return errS3ChunkFormat
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return errS3ChunkFormat
+	}
+	data = data[:size]
+	if c.auth.signingKey == nil {
+		return errS3ChunkSignature
+	}
+	stringToSign := strings.Join([]string{s3V4ChunkAlgorithm, c.amzDate, c.auth.scope(), c.prevSig,
+		s3V4EmptyPayloadHash, s3SHA256Hex(data)}, "\n")
+	sig := hex.EncodeToString(s3HmacSHA256(c.auth.signingKey, []byte(stringToSign)))
+	if !hmac.Equal([]byte(sig), []byte(strings.TrimPrefix(parts[1], "chunk-signature="))) {
+		return errS3ChunkSignature
+	}
+	c.prevSig = sig
+	c.buf = data
+	c.done = size == 0
+	return nil
+}
+
+func (c *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+		c.err = c.readChunk()
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *s3ChunkedReader) Close() error {
+	return c.body.Close()
+}
+
+// s3HashingReader checks the body against the x-amz-content-sha256 the client
+// signed once the whole body has been read.
+type s3HashingReader struct {
+	body     io.ReadCloser
+	h        hash.Hash
+	expected string
+}
+
+func (h *s3HashingReader) Read(p []byte) (int, error) {
+	n, err := h.body.Read(p)
+	h.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.h.Sum(nil)) != h.expected {
+		return n, errS3ContentSHA256
+	}
+	return n, err
+}
+
+func (h *s3HashingReader) Close() error {
+	return h.body.Close()
+}
+
 type s3AuthHandler struct {
 	next           http.Handler
 	ctx            *ProxyContext
+	region         string
+	storageDomains []string
 	requestsMetric tally.Counter
 }
 
@@ -88,6 +457,10 @@ func (s *s3AuthHandler) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 	// Check if this is an S3 request
 	var key, signature string
 	authStr := request.Header.Get("Authorization")
+	if ctx.S3Auth == nil && (strings.HasPrefix(authStr, s3V4Algorithm+" ") || request.URL.Query().Get("X-Amz-Algorithm") == s3V4Algorithm) {
+		s.serveV4(writer, request)
+		return
+	}
 	if authStr == "" {
 		authStr = request.Form.Get("AWSAccessKeyId")
 	}
@@ -150,6 +523,11 @@ func (s *s3AuthHandler) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 	}
 	// NOTE: The following is for V2 Auth
 
+	// Virtual-hosted-style requests sign the bucket as if it were in the path.
+	bucket := s3HostBucket(request, s.storageDomains)
+	if bucket != "" {
+		buf.WriteString("/" + bucket)
+	}
 	buf.WriteString(request.URL.Path)
 	if request.URL.RawQuery != "" {
 
@@ -169,10 +547,68 @@ func (s *s3AuthHandler) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 		StringToSign: buf.String(),
 		Key:          key,
 		Signature:    signature,
+		Bucket:       bucket,
 	}
 
-	// TODO: Handle V4 signature validation
+	s.next.ServeHTTP(writer, request)
+}
 
+func (s *s3AuthHandler) serveV4(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	// Wrap the writer so that we can capture errors and send correct S3 style responses
+	writer = newS3ResponseWriterWrapper(writer, request)
+	query := request.URL.Query()
+	var v4 *s3V4Request
+	var ok bool
+	if authStr := request.Header.Get("Authorization"); authStr != "" {
+		v4, ok = parseS3V4Header(authStr)
+		if !ok {
+			writer.WriteHeader(40002)
+			writer.Write(nil)
+			return
+		}
+	} else if v4, ok = parseS3V4Query(query); !ok {
+		writer.WriteHeader(40003)
+		writer.Write(nil)
+		return
+	}
+	auth, status := v4.authInfo(request, query, s.region, time.Now())
+	if status != 0 {
+		writer.WriteHeader(status)
+		writer.Write(nil)
+		return
+	}
+	auth.Bucket = s3HostBucket(request, s.storageDomains)
+	ctx.S3Auth = auth
+	payloadHash := request.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == s3V4StreamingPayload {
+		decodedLength := request.Header.Get("X-Amz-Decoded-Content-Length")
+		length, err := strconv.ParseInt(decodedLength, 10, 64)
+		if err != nil || length < 0 {
+			srv.StandardResponse(writer, http.StatusLengthRequired)
+			return
+		}
+		amzDate := v4.amzDate
+		if amzDate == "" {
+			amzDate = request.Header.Get("X-Amz-Date")
+		}
+		request.Body = newS3ChunkedReader(request.Body, auth, amzDate)
+		request.ContentLength = length
+		request.Header.Set("Content-Length", decodedLength)
+		var encodings []string
+		for _, e := range strings.Split(request.Header.Get("Content-Encoding"), ",") {
+			if e = strings.TrimSpace(e); e != "" && e != "aws-chunked" {
+				encodings = append(encodings, e)
+			}
+		}
+		if len(encodings) > 0 {
+			request.Header.Set("Content-Encoding", strings.Join(encodings, ","))
+		} else {
+			request.Header.Del("Content-Encoding")
+		}
+	} else if payloadHash != "" && payloadHash != s3V4UnsignedPayload && request.Body != nil && request.Body != http.NoBody {
+		request.Body = &s3HashingReader{body: request.Body, h: sha256.New(), expected: strings.ToLower(payloadHash)}
+	}
 	s.next.ServeHTTP(writer, request)
 }
 
@@ -186,14 +622,15 @@ func NewS3Auth(config conf.Section, metricsScope tally.Scope) (func(http.Handler
 			})
 		}, nil
 	}
-	RegisterInfo("s3Auth", map[string]interface{}{})
-	return s3Auth(metricsScope.Counter("s3Auth_requests")), nil
+	region := config.GetDefault("location", "us-east-1")
+	RegisterInfo("s3Auth", map[string]interface{}{"signature_versions": []int{2, 4}, "location": region})
+	return s3Auth(region, s3StorageDomains(config), metricsScope.Counter("s3Auth_requests")), nil
 }
 
-func s3Auth(requestsMetric tally.Counter) func(next http.Handler) http.Handler {
+func s3Auth(region string, storageDomains []string, requestsMetric tally.Counter) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			(&s3AuthHandler{next: next, requestsMetric: requestsMetric}).ServeHTTP(writer, request)
+			(&s3AuthHandler{next: next, region: region, storageDomains: storageDomains, requestsMetric: requestsMetric}).ServeHTTP(writer, request)
 		})
 	}
 }
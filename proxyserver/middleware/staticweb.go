@@ -147,6 +147,12 @@ func (s *staticWebHandler) handleObject(writer http.ResponseWriter, request *htt
 	s.handleDirectory(writer, request)
 }
 
+// clientPath is the request's path as the client sent it, before any domain
+// remapping.
+func (s *staticWebHandler) clientPath(request *http.Request) string {
+	return strings.TrimPrefix(request.URL.Path, s.ctx.remappedPrefix)
+}
+
 func (s *staticWebHandler) handleDirectory(writer http.ResponseWriter, request *http.Request) {
 	if s.webIndex == "" && !s.webListings {
 		s.handleError(writer, request, http.StatusNotFound, nil)
@@ -163,14 +169,14 @@ func (s *staticWebHandler) handleDirectory(writer http.ResponseWriter, request *
 			s.ctx.serveHTTPSubrequest(subrec, subreq)
 			subresp := subrec.Result()
 			if subresp.StatusCode >= 200 && subresp.StatusCode <= 399 {
-				writer.Header().Set("Location", request.URL.Path+"/")
+				writer.Header().Set("Location", s.clientPath(request)+"/")
 				srv.StandardResponse(writer, http.StatusMovedPermanently)
 				return
 			}
 		}
 		if s.webListings {
 			if s.object == "" {
-				writer.Header().Set("Location", request.URL.Path+"/")
+				writer.Header().Set("Location", s.clientPath(request)+"/")
 				srv.StandardResponse(writer, http.StatusMovedPermanently)
 				return
 			}
@@ -199,7 +205,7 @@ func (s *staticWebHandler) handleDirectory(writer http.ResponseWriter, request *
 				s.handleError(writer, request, http.StatusNotFound, nil)
 				return
 			}
-			writer.Header().Set("Location", request.URL.Path+"/")
+			writer.Header().Set("Location", s.clientPath(request)+"/")
 			srv.StandardResponse(writer, http.StatusMovedPermanently)
 			return
 		}
@@ -231,7 +237,7 @@ func (s *staticWebHandler) handleDirectory(writer http.ResponseWriter, request *
 			return
 		}
 	}
-	label := request.URL.Path
+	label := s.clientPath(request)
 	if s.webListingsLabel != "" {
 		label = s.webListingsLabel + "/" + s.object
 	}
@@ -263,6 +269,13 @@ func (s *staticWebHandler) handleDirectory(writer http.ResponseWriter, request *
 	if s.object != "" {
 		listingPath += fmt.Sprintf("&prefix=%s", url.QueryEscape(s.object))
 	}
+	// Web listings can be paged and reversed like any other listing.
+	query := request.URL.Query()
+	for _, key := range []string{"marker", "end_marker", "limit", "reverse"} {
+		if v := query.Get(key); v != "" {
+			listingPath += fmt.Sprintf("&%s=%s", key, url.QueryEscape(v))
+		}
+	}
 	subreq, err := s.ctx.newSubrequest("GET", listingPath, nil, request, "staticweb")
 	if err != nil {
 		s.handleError(writer, request, http.StatusInternalServerError, err)
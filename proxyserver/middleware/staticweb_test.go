@@ -17,6 +17,7 @@ import (
 	"github.com/RocFang/hummingbird/common/srv"
 	"github.com/RocFang/hummingbird/common/test"
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
 )
 
 type testNext struct {
@@ -368,6 +369,33 @@ func TestStaticWebGetContainer(t *testing.T) {
 	}
 }
 
+func TestStaticWebGetContainerListingParams(t *testing.T) {
+	next := &testNext{}
+	s, _ := newTestStaticWebHandler(next)
+	request, err := http.NewRequest("GET", "/v1/a/c/?reverse=on&end_marker=m&path=ignored", nil)
+	require.Nil(t, err)
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	request = request.WithContext(context.WithValue(request.Context(), "proxycontext", &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{next: s},
+		Logger:                 zap.NewNop(),
+		C: f.NewRequestClient(nil, map[string]*client.ContainerInfo{"container/a/c": {Metadata: map[string]string{
+			"Web-Listings": "true",
+		}}}, zap.NewNop()),
+		accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+	}))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, request)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, 1, len(next.requests))
+	query := next.requests[0].URL.Query()
+	require.Equal(t, "on", query.Get("reverse"))
+	require.Equal(t, "m", query.Get("end_marker"))
+	require.Equal(t, "", query.Get("path"))
+	require.Equal(t, "/", query.Get("delimiter"))
+}
+
 func TestStaticWebGetWithWebIndex(t *testing.T) {
 	next := &testNext{}
 	s, _ := newTestStaticWebHandler(next)
@@ -772,3 +800,28 @@ func TestStaticWebNoContainerInfo(t *testing.T) {
 		t.Fatal(next.requests[i].Method + " " + next.requests[i].URL.Path)
 	}
 }
+
+func TestStaticWebGetSubdirRedirectRemapped(t *testing.T) {
+	next := &testNext{}
+	s, _ := newTestStaticWebHandler(next)
+	request, err := http.NewRequest("GET", "/v1/a/c/s001", nil)
+	require.Nil(t, err)
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	request = request.WithContext(context.WithValue(request.Context(), "proxycontext", &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{next: staticWeb(tally.NoopScope)(next)},
+		Logger:                 zap.NewNop(),
+		C: f.NewRequestClient(nil, map[string]*client.ContainerInfo{"container/a/c": {Metadata: map[string]string{
+			"Web-Listings": "true",
+		}}}, zap.NewNop()),
+		accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+		remappedPrefix:   "/v1/a/c",
+	}))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, request)
+	resp := rec.Result()
+	require.Equal(t, 301, resp.StatusCode)
+	// The client asked for /s001 at the container's own domain.
+	require.Equal(t, "/s001/", resp.Header.Get("Location"))
+}
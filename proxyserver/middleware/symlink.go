@@ -0,0 +1,299 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/RocFang/hummingbird/common"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+const (
+	symlinkTarget               = "X-Symlink-Target"
+	symlinkTargetAccount        = "X-Symlink-Target-Account"
+	symlinkTargetEtag           = "X-Symlink-Target-Etag"
+	symlinkTargetBytes          = "X-Symlink-Target-Bytes"
+	symlinkSysmetaTarget        = "X-Object-Sysmeta-Symlink-Target"
+	symlinkSysmetaTargetAccount = "X-Object-Sysmeta-Symlink-Target-Account"
+	symlinkSysmetaTargetEtag    = "X-Object-Sysmeta-Symlink-Target-Etag"
+	symlinkSysmetaTargetBytes   = "X-Object-Sysmeta-Symlink-Target-Bytes"
+	symlinkContentType          = "application/symlink"
+	defaultSymlinkLoopLimit     = 2
+)
+
+type symlinkMiddleware struct {
+	next      http.Handler
+	loopLimit int
+}
+
+// symlinkWriter passes an object response through unless it's another
+// symlink, in which case it just remembers where that link points.
+type symlinkWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	location    string
+	etag        string
+	wroteHeader bool
+	swallow     bool
+	target      string
+	account     string
+	targetEtag  string
+}
+
+func newSymlinkWriter(w http.ResponseWriter, location, etag string) *symlinkWriter {
+	return &symlinkWriter{ResponseWriter: w, header: http.Header{}, location: location, etag: etag}
+}
+
+func (w *symlinkWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *symlinkWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	if w.etag != "" && status/100 == 2 && strings.Trim(w.header.Get("Etag"), "\"") != w.etag {
+		w.swallow = true
+		w.ResponseWriter.Header().Set("Content-Location", w.location)
+		srv.SimpleErrorResponse(w.ResponseWriter, http.StatusConflict, fmt.Sprintf(
+			"Object Etag %q does not match X-Symlink-Target-Etag header %q", strings.Trim(w.header.Get("Etag"), "\""), w.etag))
+		return
+	}
+	if target := w.header.Get(symlinkSysmetaTarget); target != "" {
+		w.swallow = true
+		w.target = target
+		w.account = w.header.Get(symlinkSysmetaTargetAccount)
+		w.targetEtag = w.header.Get(symlinkSysmetaTargetEtag)
+		return
+	}
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+	if w.location != "" {
+		w.ResponseWriter.Header().Set("Content-Location", w.location)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *symlinkWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.swallow {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// symlinkListingContentType adds the target to the content type the
+// container lists for a symlink.
+func symlinkListingContentType(contentType, target, etag, size string) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+	params["symlink_target"] = target
+	if etag != "" {
+		params["symlink_target_etag"] = etag
+		params["symlink_target_bytes"] = size
+	}
+	return mime.FormatMediaType(mediaType, params), nil
+}
+
+func (s *symlinkMiddleware) handlePut(writer http.ResponseWriter, request *http.Request, account, container, obj string) {
+	ctx := GetProxyContext(request)
+	if request.ContentLength > 0 {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Symlink requests require a zero byte body")
+		return
+	}
+	target, err := url.QueryUnescape(request.Header.Get(symlinkTarget))
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusPreconditionFailed, "X-Symlink-Target header must be URL encoded")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(target, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		srv.SimpleErrorResponse(writer, http.StatusPreconditionFailed,
+			"X-Symlink-Target header must be of the form <container name>/<object name>")
+		return
+	}
+	target = common.Urlencode(parts[0] + "/" + parts[1])
+	request.Header.Set(symlinkSysmetaTarget, target)
+	targetAccount := account
+	if v := request.Header.Get(symlinkTargetAccount); v != "" {
+		if targetAccount, err = common.CheckNameFormat(request, v, "Account"); err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusPreconditionFailed, fmt.Sprintf("Invalid %s: %s", symlinkTargetAccount, err))
+			return
+		}
+		request.Header.Set(symlinkSysmetaTargetAccount, common.Urlencode(targetAccount))
+	}
+	if targetAccount == account && parts[0] == container && parts[1] == obj {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Symlink cannot target itself")
+		return
+	}
+
+	etag, size := strings.Trim(request.Header.Get(symlinkTargetEtag), "\""), ""
+	if etag != "" {
+		// Static links are checked against the target when they're made,
+		// as well as each time they're followed.
+		subreq, err := ctx.newSubrequest("HEAD", "/v1/"+common.Urlencode(targetAccount)+"/"+target, nil, request, "symlink")
+		if err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+			return
+		}
+		cw := NewCaptureWriter()
+		ctx.serveHTTPSubrequest(cw, subreq)
+		if cw.status == http.StatusNotFound {
+			srv.SimpleErrorResponse(writer, http.StatusConflict, fmt.Sprintf("X-Symlink-Target-Etag headers require an existing target: %s", target))
+			return
+		} else if cw.status/100 != 2 {
+			srv.StandardResponse(writer, cw.status)
+			return
+		}
+		if actual := strings.Trim(cw.header.Get("Etag"), "\""); actual != etag {
+			srv.SimpleErrorResponse(writer, http.StatusConflict, fmt.Sprintf(
+				"Object Etag %q does not match X-Symlink-Target-Etag header %q", actual, etag))
+			return
+		}
+		size = cw.header.Get("Content-Length")
+		request.Header.Set(symlinkSysmetaTargetEtag, etag)
+		request.Header.Set(symlinkSysmetaTargetBytes, size)
+	}
+
+	if request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", symlinkContentType)
+	}
+	listed, err := symlinkListingContentType(request.Header.Get("Content-Type"), common.Urlencode(targetAccount)+"/"+target, etag, size)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid Content-Type")
+		return
+	}
+	request.Header.Set("X-Object-Sysmeta-Container-Update-Override-Content-Type", listed)
+	request.Header.Del(symlinkTarget)
+	request.Header.Del(symlinkTargetAccount)
+	request.Header.Del(symlinkTargetEtag)
+	request.Header.Del(symlinkTargetBytes)
+	if etag != "" {
+		writer.Header().Set(symlinkTargetEtag, etag)
+		writer.Header().Set(symlinkTargetBytes, size)
+	}
+	s.next.ServeHTTP(writer, request)
+}
+
+// handleGet follows a symlink to its target, and the target's target, up to
+// the loop limit.
+func (s *symlinkMiddleware) handleGet(writer http.ResponseWriter, request *http.Request, account string) {
+	ctx := GetProxyContext(request)
+	request.Header.Set("X-Backend-Ignore-Range-If-Metadata-Present", symlinkSysmetaTarget)
+	sw := newSymlinkWriter(writer, "", "")
+	s.next.ServeHTTP(sw, request)
+	visited := map[string]bool{request.URL.Path: true}
+	for links := 0; sw.target != ""; links++ {
+		if links >= s.loopLimit {
+			srv.SimpleErrorResponse(writer, http.StatusConflict, fmt.Sprintf(
+				"Too many levels of symbolic links, maximum allowed is %d", s.loopLimit))
+			return
+		}
+		if sw.account != "" {
+			if a, err := url.PathUnescape(sw.account); err == nil {
+				account = a
+			}
+		}
+		location := "/v1/" + common.Urlencode(account) + "/" + sw.target
+		subreq, err := ctx.newSubrequest(request.Method, location, nil, request, "symlink")
+		if err != nil {
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		if visited[subreq.URL.Path] {
+			srv.SimpleErrorResponse(writer, http.StatusConflict, "Symlink loop detected")
+			return
+		}
+		visited[subreq.URL.Path] = true
+		CopyItems(subreq.Header, request.Header)
+		sw = newSymlinkWriter(writer, location, sw.targetEtag)
+		ctx.serveHTTPSubrequest(sw, subreq)
+	}
+}
+
+// showSymlink returns the link itself, with its target in the headers.
+func (s *symlinkMiddleware) showSymlink(writer http.ResponseWriter, request *http.Request) {
+	request.Header.Set("X-Backend-Ignore-Range-If-Metadata-Present", symlinkSysmetaTarget)
+	s.next.ServeHTTP(srv.NewCustomWriter(writer, func(w http.ResponseWriter, status int) int {
+		h := w.Header()
+		if target := h.Get(symlinkSysmetaTarget); target != "" {
+			h.Set(symlinkTarget, target)
+			if account := h.Get(symlinkSysmetaTargetAccount); account != "" {
+				h.Set(symlinkTargetAccount, account)
+			}
+			if etag := h.Get(symlinkSysmetaTargetEtag); etag != "" {
+				h.Set(symlinkTargetEtag, etag)
+				h.Set(symlinkTargetBytes, h.Get(symlinkSysmetaTargetBytes))
+			}
+		}
+		return status
+	}), request)
+}
+
+func (s *symlinkMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiReq, account, container, obj := getPathParts(request)
+	ctx := GetProxyContext(request)
+	// Versioned writes keeps links as links, and links found while following
+	// one are followed by the request that found them.
+	if !apiReq || account == "" || container == "" || obj == "" || ctx == nil || ctx.Source == "VW" || ctx.Source == "symlink" {
+		s.next.ServeHTTP(writer, request)
+		return
+	}
+	switch request.Method {
+	case "PUT":
+		if request.Header.Get(symlinkTarget) != "" {
+			s.handlePut(writer, request, account, container, obj)
+			return
+		}
+		if request.Header.Get(symlinkTargetAccount) != "" || request.Header.Get(symlinkTargetEtag) != "" {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, fmt.Sprintf("%s header is required", symlinkTarget))
+			return
+		}
+	case "POST":
+		if request.Header.Get(symlinkTarget) != "" {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "A PUT request is required to set a symlink target")
+			return
+		}
+	case "GET", "HEAD":
+		if request.URL.Query().Get("symlink") == "get" {
+			s.showSymlink(writer, request)
+		} else {
+			s.handleGet(writer, request, account)
+		}
+		return
+	}
+	s.next.ServeHTTP(writer, request)
+}
+
+// NewSymlink returns the middleware that makes and follows symlinks, objects
+// that stand in for another object, perhaps in another container or account.
+func NewSymlink(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	loopLimit := int(config.GetInt("symlink_loop_limit", defaultSymlinkLoopLimit))
+	RegisterInfo("symlink", map[string]interface{}{"symlink_loop_limit": loopLimit, "static_links": true})
+	return func(next http.Handler) http.Handler {
+		return &symlinkMiddleware{next: next, loopLimit: loopLimit}
+	}, nil
+}
@@ -0,0 +1,192 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeSymlinkObject struct {
+	header http.Header
+	body   []byte
+}
+
+// fakeObjectStore keeps objects by path, like a very small cluster.
+type fakeObjectStore struct {
+	objects map[string]*fakeSymlinkObject
+}
+
+func (s *fakeObjectStore) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(request.Body)
+		obj := &fakeSymlinkObject{header: http.Header{}, body: body}
+		for k, v := range request.Header {
+			obj.header[k] = v
+		}
+		sum := md5.Sum(body)
+		obj.header.Set("Etag", hex.EncodeToString(sum[:]))
+		obj.header.Set("Content-Length", strconv.Itoa(len(body)))
+		s.objects[request.URL.Path] = obj
+		writer.WriteHeader(201)
+	case "GET", "HEAD":
+		obj, ok := s.objects[request.URL.Path]
+		if !ok {
+			writer.WriteHeader(404)
+			return
+		}
+		for k, v := range obj.header {
+			writer.Header()[k] = v
+		}
+		writer.WriteHeader(200)
+		if request.Method == "GET" {
+			writer.Write(obj.body)
+		}
+	}
+}
+
+func newSymlinkTest(loopLimit int) (*fakeObjectStore, func(method, path, body string, header map[string]string) *httptest.ResponseRecorder) {
+	store := &fakeObjectStore{objects: map[string]*fakeSymlinkObject{}}
+	handler := &symlinkMiddleware{next: store, loopLimit: loopLimit}
+	return store, func(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		ctx := &ProxyContext{
+			ProxyContextMiddleware: &ProxyContextMiddleware{next: handler},
+			Logger:                 zap.NewNop(),
+		}
+		r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+}
+
+func TestSymlinkPutGet(t *testing.T) {
+	store, do := newSymlinkTest(2)
+	require.Equal(t, 201, do("PUT", "/v1/a/c/target", "hello", nil).Code)
+	w := do("PUT", "/v1/a/c/link", "", map[string]string{symlinkTarget: "c2/x"})
+	require.Equal(t, 201, w.Code)
+	link := store.objects["/v1/a/c/link"]
+	require.Equal(t, "c2/x", link.header.Get(symlinkSysmetaTarget))
+	require.Equal(t, "", link.header.Get(symlinkTarget))
+	require.Equal(t, symlinkContentType, link.header.Get("Content-Type"))
+	require.Equal(t, `application/symlink; symlink_target="a/c2/x"`,
+		link.header.Get("X-Object-Sysmeta-Container-Update-Override-Content-Type"))
+
+	require.Equal(t, 201, do("PUT", "/v1/a/c/link", "", map[string]string{symlinkTarget: "c/target"}).Code)
+	w = do("GET", "/v1/a/c/link", "", nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "hello", w.Body.String())
+	require.Equal(t, "/v1/a/c/target", w.Header().Get("Content-Location"))
+	require.Equal(t, "", w.Header().Get(symlinkSysmetaTarget))
+
+	w = do("HEAD", "/v1/a/c/link", "", nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "5", w.Header().Get("Content-Length"))
+
+	w = do("GET", "/v1/a/c/link?symlink=get", "", nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "", w.Body.String())
+	require.Equal(t, "c/target", w.Header().Get(symlinkTarget))
+
+	// a dangling link is a 404, but says where it was looking
+	require.Equal(t, 201, do("PUT", "/v1/a/c/dangling", "", map[string]string{symlinkTarget: "c/nope", symlinkTargetAccount: "b"}).Code)
+	w = do("GET", "/v1/a/c/dangling", "", nil)
+	require.Equal(t, 404, w.Code)
+	require.Equal(t, "/v1/b/c/nope", w.Header().Get("Content-Location"))
+}
+
+func TestSymlinkPutErrors(t *testing.T) {
+	_, do := newSymlinkTest(2)
+	require.Equal(t, 400, do("PUT", "/v1/a/c/link", "data", map[string]string{symlinkTarget: "c/o"}).Code)
+	require.Equal(t, 412, do("PUT", "/v1/a/c/link", "", map[string]string{symlinkTarget: "c"}).Code)
+	require.Equal(t, 412, do("PUT", "/v1/a/c/link", "", map[string]string{symlinkTarget: "c/"}).Code)
+	require.Equal(t, 400, do("PUT", "/v1/a/c/link", "", map[string]string{symlinkTarget: "c/link"}).Code)
+	require.Equal(t, 400, do("PUT", "/v1/a/c/link", "", map[string]string{symlinkTargetAccount: "a"}).Code)
+	require.Equal(t, 400, do("POST", "/v1/a/c/link", "", map[string]string{symlinkTarget: "c/o"}).Code)
+}
+
+func TestSymlinkLoops(t *testing.T) {
+	store, do := newSymlinkTest(2)
+	require.Equal(t, 201, do("PUT", "/v1/a/c/target", "hello", nil).Code)
+	require.Equal(t, 201, do("PUT", "/v1/a/c/l1", "", map[string]string{symlinkTarget: "c/target"}).Code)
+	require.Equal(t, 201, do("PUT", "/v1/a/c/l2", "", map[string]string{symlinkTarget: "c/l1"}).Code)
+	require.Equal(t, 201, do("PUT", "/v1/a/c/l3", "", map[string]string{symlinkTarget: "c/l2"}).Code)
+	require.Equal(t, "hello", do("GET", "/v1/a/c/l2", "", nil).Body.String())
+	w := do("GET", "/v1/a/c/l3", "", nil)
+	require.Equal(t, 409, w.Code)
+	require.Contains(t, w.Body.String(), "maximum allowed is 2")
+
+	// l1 -> l2 -> l1
+	store.objects["/v1/a/c/l1"].header.Set(symlinkSysmetaTarget, "c/l2")
+	w = do("GET", "/v1/a/c/l1", "", nil)
+	require.Equal(t, 409, w.Code)
+	require.Contains(t, w.Body.String(), "loop")
+}
+
+func TestSymlinkStatic(t *testing.T) {
+	store, do := newSymlinkTest(2)
+	require.Equal(t, 201, do("PUT", "/v1/a/c/target", "hello", nil).Code)
+	etag := store.objects["/v1/a/c/target"].header.Get("Etag")
+	require.Equal(t, 409, do("PUT", "/v1/a/c/link", "", map[string]string{symlinkTarget: "c/target", symlinkTargetEtag: "nope"}).Code)
+	require.Equal(t, 409, do("PUT", "/v1/a/c/link", "", map[string]string{symlinkTarget: "c/missing", symlinkTargetEtag: etag}).Code)
+
+	w := do("PUT", "/v1/a/c/link", "", map[string]string{symlinkTarget: "c/target", symlinkTargetEtag: `"` + etag + `"`})
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, etag, w.Header().Get(symlinkTargetEtag))
+	link := store.objects["/v1/a/c/link"]
+	require.Equal(t, etag, link.header.Get(symlinkSysmetaTargetEtag))
+	require.Equal(t, "5", link.header.Get(symlinkSysmetaTargetBytes))
+	require.Contains(t, link.header.Get("X-Object-Sysmeta-Container-Update-Override-Content-Type"), "symlink_target_etag="+etag)
+
+	require.Equal(t, "hello", do("GET", "/v1/a/c/link", "", nil).Body.String())
+	w = do("HEAD", "/v1/a/c/link?symlink=get", "", nil)
+	require.Equal(t, etag, w.Header().Get(symlinkTargetEtag))
+	require.Equal(t, "5", w.Header().Get(symlinkTargetBytes))
+
+	// the target changed under the link
+	require.Equal(t, 201, do("PUT", "/v1/a/c/target", "goodbye", nil).Code)
+	w = do("GET", "/v1/a/c/link", "", nil)
+	require.Equal(t, 409, w.Code)
+	require.NotContains(t, w.Body.String(), "goodbye")
+}
+
+func TestSymlinkVersionedWritesPassthrough(t *testing.T) {
+	store := &fakeObjectStore{objects: map[string]*fakeSymlinkObject{
+		"/v1/a/c/link": {header: http.Header{symlinkSysmetaTarget: {"c/target"}}},
+	}}
+	handler := &symlinkMiddleware{next: store, loopLimit: 2}
+	r := httptest.NewRequest("GET", "/v1/a/c/link", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{Logger: zap.NewNop(), Source: "VW"}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "c/target", w.Header().Get(symlinkSysmetaTarget))
+}
@@ -18,10 +18,16 @@ package middleware
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
+	"net"
 	"net/http"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -74,24 +80,112 @@ func (w *tuWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
-func checkhmac(key, sig []byte, method, path string, expires time.Time) bool {
+// tempurlDigests are the digests tempurl and formpost signatures can be made
+// with.
+var tempurlDigests = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// tempurlHexDigests are the digests hex signatures are taken to be, by length.
+var tempurlHexDigests = map[int]string{40: "sha1", 64: "sha256", 128: "sha512"}
+
+// parseAllowedDigests returns the digests named in the config's
+// allowed_digests, which defaults to all of them.
+func parseAllowedDigests(config conf.Section) (map[string]func() hash.Hash, error) {
+	names := strings.Fields(config.GetDefault("allowed_digests", "sha1 sha256 sha512"))
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No allowed_digests")
+	}
+	digests := map[string]func() hash.Hash{}
+	for _, name := range names {
+		digest, ok := tempurlDigests[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown digest %q in allowed_digests", name)
+		}
+		digests[name] = digest
+	}
+	return digests, nil
+}
+
+func digestNames(digests map[string]func() hash.Hash) []string {
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseSignature decodes a signature, which is either hex, with the digest
+// going by its length, or the digest's name, a colon and base64, like
+// "sha512:<base64>". The signature is nil if it can't be decoded, and the
+// digest is nil if it isn't allowed or doesn't fit the signature.
+func parseSignature(sig string, allowed map[string]func() hash.Hash) (func() hash.Hash, []byte) {
+	var name string
+	var sigb []byte
+	var err error
+	if i := strings.Index(sig, ":"); i >= 0 {
+		name = sig[:i]
+		encoded := strings.TrimRight(sig[i+1:], "=")
+		// URL-safe base64 is allowed too, since "+" and "/" are awkward in
+		// query strings.
+		if strings.ContainsAny(encoded, "-_") {
+			sigb, err = base64.RawURLEncoding.DecodeString(encoded)
+		} else {
+			sigb, err = base64.RawStdEncoding.DecodeString(encoded)
+		}
+	} else {
+		name = tempurlHexDigests[len(sig)]
+		sigb, err = hex.DecodeString(sig)
+	}
+	if err != nil || len(sigb) == 0 {
+		return nil, nil
+	}
+	digest, ok := allowed[name]
+	if !ok || len(sigb) != digest().Size() {
+		return nil, sigb
+	}
+	return digest, sigb
+}
+
+// tempurlIPAllowed returns whether the client's address is in ipRange, a
+// CIDR or a single address.
+func tempurlIPAllowed(ipRange string, request *http.Request) bool {
+	ip := net.ParseIP(remoteHost(request))
+	if ip == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(ipRange); err == nil {
+		return network.Contains(ip)
+	}
+	allowed := net.ParseIP(ipRange)
+	return allowed != nil && allowed.Equal(ip)
+}
+
+func checkhmac(digest func() hash.Hash, key, sig []byte, method, path, ipRange string, expires time.Time) bool {
+	sign := func(method string) []byte {
+		mac := hmac.New(digest, key)
+		if ipRange != "" {
+			fmt.Fprintf(mac, "ip=%s\n", ipRange)
+		}
+		fmt.Fprintf(mac, "%s\n%d\n%s", method, expires.Unix(), path)
+		return mac.Sum(nil)
+	}
 	if method == "HEAD" {
 		for _, meth := range []string{"HEAD", "GET", "POST", "PUT"} {
-			mac := hmac.New(sha1.New, key)
-			fmt.Fprintf(mac, "%s\n%d\n%s", meth, expires.Unix(), path)
-			if hmac.Equal(sig, mac.Sum(nil)) {
+			if hmac.Equal(sig, sign(meth)) {
 				return true
 			}
 		}
 		return false
 	} else {
-		mac := hmac.New(sha1.New, key)
-		fmt.Fprintf(mac, "%s\n%d\n%s", method, expires.Unix(), path)
-		return hmac.Equal(sig, mac.Sum(nil))
+		return hmac.Equal(sig, sign(method))
 	}
 }
 
-func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
+func tempurl(requestsMetric tally.Counter, digests map[string]func() hash.Hash) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			if request.Method == "OPTIONS" {
@@ -124,8 +218,14 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 				return
 			}
 
-			sigb, err := hex.DecodeString(sig)
-			if err != nil {
+			digest, sigb := parseSignature(sig, digests)
+			if sigb == nil {
+				srv.StandardResponse(writer, 401)
+				return
+			}
+
+			ipRange := q.Get("temp_url_ip_range")
+			if ipRange != "" && !tempurlIPAllowed(ipRange, request) {
 				srv.StandardResponse(writer, 401)
 				return
 			}
@@ -154,15 +254,18 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 			}
 
 			scope := SCOPE_INVALID
-			if ai, err := ctx.GetAccountInfo(request.Context(), account); err == nil {
-				if key, ok := ai.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
+			if digest == nil {
+				srv.StandardResponse(writer, 401)
+				return
+			} else if ai, err := ctx.GetAccountInfo(request.Context(), account); err == nil {
+				if key, ok := ai.Metadata["Temp-Url-Key"]; ok && checkhmac(digest, []byte(key), sigb, request.Method, path, ipRange, expires) {
 					scope = SCOPE_ACCOUNT
-				} else if key, ok := ai.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
+				} else if key, ok := ai.Metadata["Temp-Url-Key-2"]; ok && checkhmac(digest, []byte(key), sigb, request.Method, path, ipRange, expires) {
 					scope = SCOPE_ACCOUNT
 				} else if ci, err := ctx.C.GetContainerInfo(request.Context(), account, container); err == nil {
-					if key, ok := ci.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
+					if key, ok := ci.Metadata["Temp-Url-Key"]; ok && checkhmac(digest, []byte(key), sigb, request.Method, path, ipRange, expires) {
 						scope = SCOPE_CONTAINER
-					} else if key, ok := ci.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
+					} else if key, ok := ci.Metadata["Temp-Url-Key-2"]; ok && checkhmac(digest, []byte(key), sigb, request.Method, path, ipRange, expires) {
 						scope = SCOPE_CONTAINER
 					}
 				}
@@ -196,12 +299,17 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 }
 
 func NewTempURL(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	digests, err := parseAllowedDigests(config)
+	if err != nil {
+		return nil, err
+	}
 	RegisterInfo("tempurl", map[string]interface{}{
+		"allowed_digests":         digestNames(digests),
 		"methods":                 []string{"GET", "HEAD", "PUT", "POST", "DELETE"},
 		"incoming_remove_headers": []string{"x-timestamp"},
 		"incoming_allow_headers":  []string{},
 		"outgoing_remove_headers": []string{"x-object-meta-*"}, "outgoing_allow_headers": []string{"x-object-meta-public-*"},
 	})
 	requestsMetric := metricsScope.Counter("tempurl_requests")
-	return tempurl(requestsMetric), nil
+	return tempurl(requestsMetric, digests), nil
 }
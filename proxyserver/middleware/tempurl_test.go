@@ -17,7 +17,15 @@ package middleware
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -54,20 +62,20 @@ func TestCheckHmac(t *testing.T) {
 	// test cases generated by example python code
 	sig, err := hex.DecodeString("6deb0c7da21f396f1368681dc0bd57df0d1c4369")
 	require.Nil(t, err)
-	require.True(t, checkhmac([]byte("mykey"), sig, "GET",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.True(t, checkhmac(sha1.New, []byte("mykey"), sig, "GET",
+		"/v1/AUTH_account/container/object", "", time.Unix(1493709631, 0).In(time.UTC)))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1ad2301fcc4e525ee0167298c0fbb426e90fb3b1")
 	require.Nil(t, err)
-	require.True(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.True(t, checkhmac(sha1.New, []byte("mykey"), sig, "HEAD",
+		"/v1/AUTH_account/container/object", "", time.Unix(1493709631, 0).In(time.UTC)))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1111111111111111111111111111111111111111")
 	require.Nil(t, err)
-	require.False(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.False(t, checkhmac(sha1.New, []byte("mykey"), sig, "HEAD",
+		"/v1/AUTH_account/container/object", "", time.Unix(1493709631, 0).In(time.UTC)))
 }
 
 func TestTuWriter(t *testing.T) {
@@ -105,7 +113,7 @@ func TestTempurlMiddlewarePassOptions(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -125,7 +133,7 @@ func TestTempurlMiddlewarePassAlreadyAuthorized(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -140,7 +148,7 @@ func TestTempurlMiddlewarePassNoQuery(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -150,7 +158,7 @@ func TestTempurlMiddleware401OnlySig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -160,7 +168,7 @@ func TestTempurlMiddleware401Expired(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -170,7 +178,7 @@ func TestTempurlMiddleware401BadSig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -180,7 +188,7 @@ func TestTempurlMiddleware401NoContainer(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -191,7 +199,7 @@ func TestTempurlMiddleware400PuttingManifest(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 400, w.Result().StatusCode)
 }
@@ -212,7 +220,7 @@ func TestTempurlMiddleware401NoKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -233,7 +241,7 @@ func TestTempurlMiddleware401WrongKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -265,7 +273,7 @@ func TestTempurlMiddlewareContainerKey(t *testing.T) {
 		require.True(t, ok)
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -291,7 +299,7 @@ func TestTempurlMiddlewarePath(t *testing.T) {
 		require.True(t, ok)
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -324,7 +332,119 @@ func TestTempurlMiddlewareAccountKey(t *testing.T) {
 		require.False(t, ok)
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), tempurlDigests)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
+
+func TestParseSignature(t *testing.T) {
+	mac := hmac.New(sha512.New, []byte("mykey"))
+	mac.Write([]byte("hello"))
+	raw := mac.Sum(nil)
+	for _, sig := range []string{
+		hex.EncodeToString(raw),
+		"sha512:" + base64.StdEncoding.EncodeToString(raw),
+		"sha512:" + base64.RawURLEncoding.EncodeToString(raw),
+	} {
+		digest, sigb := parseSignature(sig, tempurlDigests)
+		require.NotNil(t, digest, sig)
+		require.Equal(t, 64, digest().Size())
+		require.Equal(t, raw, sigb)
+	}
+	digest, sigb := parseSignature("6deb0c7da21f396f1368681dc0bd57df0d1c4369", tempurlDigests)
+	require.Equal(t, 20, digest().Size())
+	require.Equal(t, 20, len(sigb))
+
+	for _, sig := range []string{
+		"sha256:" + base64.StdEncoding.EncodeToString(raw),
+		"md5:" + base64.StdEncoding.EncodeToString(raw[:16]),
+		"6deb0c7da21f396f1368681dc0bd57df0d1c43",
+	} {
+		digest, sigb := parseSignature(sig, tempurlDigests)
+		require.Nil(t, digest, sig)
+		require.NotNil(t, sigb, sig)
+	}
+	for _, sig := range []string{"sha512:not base64!", "zzeb0c7da21f396f1368681dc0bd57df0d1c4369", ""} {
+		_, sigb := parseSignature(sig, tempurlDigests)
+		require.Nil(t, sigb, sig)
+	}
+	digest, _ = parseSignature(hex.EncodeToString(raw), map[string]func() hash.Hash{"sha256": sha256.New})
+	require.Nil(t, digest)
+}
+
+func TestParseAllowedDigests(t *testing.T) {
+	config, err := conf.StringConfig("[filter:tempurl]\nallowed_digests = sha256 sha512\n")
+	require.Nil(t, err)
+	digests, err := parseAllowedDigests(config.GetSection("filter:tempurl"))
+	require.Nil(t, err)
+	require.Equal(t, []string{"sha256", "sha512"}, digestNames(digests))
+	digests, err = parseAllowedDigests(conf.Section{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"sha1", "sha256", "sha512"}, digestNames(digests))
+
+	config, err = conf.StringConfig("[filter:tempurl]\nallowed_digests = sha256 md5\n")
+	require.Nil(t, err)
+	_, err = NewTempURL(config.GetSection("filter:tempurl"), common.NewTestScope())
+	require.NotNil(t, err)
+
+	config, err = conf.StringConfig("[filter:tempurl]\nallowed_digests = sha512\n")
+	require.Nil(t, err)
+	_, err = NewTempURL(config.GetSection("filter:tempurl"), common.NewTestScope())
+	require.Nil(t, err)
+	data, err := serverInfoDump()
+	require.Nil(t, err)
+	var info map[string]map[string]interface{}
+	require.Nil(t, json.Unmarshal(data, &info))
+	require.Equal(t, []interface{}{"sha512"}, info["tempurl"]["allowed_digests"])
+}
+
+func TestTempurlMiddlewareIPRange(t *testing.T) {
+	mac := hmac.New(sha512.New, []byte("mykey"))
+	fmt.Fprintf(mac, "ip=10.0.0.0/8\nGET\n9999999999\n/v1/a/c/o")
+	sig := "sha512:" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(200)
+	})
+	for _, tc := range []struct {
+		remoteAddr, ipRange string
+		digests             map[string]func() hash.Hash
+		status              int
+	}{
+		{"10.1.2.3:5555", "10.0.0.0/8", tempurlDigests, 200},
+		{"192.168.1.1:5555", "10.0.0.0/8", tempurlDigests, 401},
+		// The range is part of the signature, so it can't be changed...
+		{"192.168.1.1:5555", "192.168.0.0/16", tempurlDigests, 401},
+		// ...or left off.
+		{"10.1.2.3:5555", "", tempurlDigests, 401},
+		{"10.1.2.3:5555", "10.0.0.0/8", map[string]func() hash.Hash{"sha256": sha256.New}, 401},
+	} {
+		path := "/v1/a/c/o?temp_url_sig=" + sig + "&temp_url_expires=9999999999"
+		if tc.ipRange != "" {
+			path += "&temp_url_ip_range=" + tc.ipRange
+		}
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = tc.remoteAddr
+		ctx := &ProxyContext{
+			C: f.NewRequestClient(nil, map[string]*client.ContainerInfo{
+				"container/a/c": {Metadata: map[string]string{"Temp-Url-Key": "mykey"}},
+			}, zap.NewNop()),
+			accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+		}
+		r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+		w := httptest.NewRecorder()
+		tempurl(common.NewTestScope().Counter("test_tempurl"), tc.digests)(handler).ServeHTTP(w, r)
+		require.Equal(t, tc.status, w.Result().StatusCode, fmt.Sprintf("%+v", tc))
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.1.2.3:5555"
+	require.True(t, tempurlIPAllowed("10.1.2.3", r))
+	require.False(t, tempurlIPAllowed("10.1.2.4", r))
+	require.False(t, tempurlIPAllowed("nope", r))
+	r.RemoteAddr = "[2001:db8::1]:5555"
+	require.True(t, tempurlIPAllowed("2001:db8::/32", r))
+	require.False(t, tempurlIPAllowed("10.0.0.0/8", r))
+}
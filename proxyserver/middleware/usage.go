@@ -0,0 +1,150 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+// The usage middleware counts each account's requests, by method, and bytes
+// transferred, by storage policy, and logs them for "hummingbird usage
+// aggregate". It's configured in the [filter:usage] section:
+//
+//   usage_log_dir = /var/log/hummingbird/usage
+//   usage_log_prefix = transfer
+//   flush_interval = 60
+//   keep_hours = 168
+//
+// and does nothing without a usage_log_dir. Every flush_interval seconds a
+// record for each account and policy used since the last flush is appended to
+// <usage_log_dir>/<usage_log_prefix>-YYYYMMDDHH.log, and log files older than
+// keep_hours are removed. Subrequests aren't counted, only what the client
+// asked for.
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/RocFang/hummingbird/common/usage"
+	"github.com/uber-go/tally"
+)
+
+type usageKey struct {
+	account string
+	policy  int
+}
+
+type usageRecorder struct {
+	lock   sync.Mutex
+	start  time.Time
+	usage  map[usageKey]*usage.Record
+	log    *usage.LogWriter
+	errors tally.Counter
+}
+
+func (u *usageRecorder) add(account string, policy int, method string, bytesIn, bytesOut int64) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	key := usageKey{account: account, policy: policy}
+	record := u.usage[key]
+	if record == nil {
+		record = &usage.Record{Kind: usage.KindTransfer, Account: account, Policy: policy, Requests: map[string]int64{}}
+		u.usage[key] = record
+	}
+	record.Requests[method]++
+	record.BytesIn += bytesIn
+	record.BytesOut += bytesOut
+}
+
+// flush logs the usage since the last flush and starts counting again.
+func (u *usageRecorder) flush(now time.Time) error {
+	u.lock.Lock()
+	start, current := u.start, u.usage
+	u.start, u.usage = now, map[usageKey]*usage.Record{}
+	u.lock.Unlock()
+	records := make([]*usage.Record, 0, len(current))
+	for _, record := range current {
+		record.Time = start.Unix()
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Account != records[j].Account {
+			return records[i].Account < records[j].Account
+		}
+		return records[i].Policy < records[j].Policy
+	})
+	return u.log.Write(records, now)
+}
+
+func (u *usageRecorder) run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := u.flush(now); err != nil {
+			u.errors.Inc(1)
+		}
+	}
+}
+
+// usagePolicy is the storage policy the request was to, or -1 for requests
+// that aren't to one.
+func usagePolicy(e *accessLogEntry) int {
+	policy, ok := accessLogFields["policy_index"](e).(string)
+	if !ok {
+		return -1
+	}
+	index, err := strconv.Atoi(policy)
+	if err != nil {
+		return -1
+	}
+	return index
+}
+
+func (u *usageRecorder) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := GetProxyContext(request)
+		if ctx.Source != "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		newWriter := &srv.WebWriter{ResponseWriter: writer, Status: 500}
+		newReader := &srv.CountingReadCloser{ReadCloser: request.Body}
+		request.Body = newReader
+		next.ServeHTTP(newWriter, request)
+		e := &accessLogEntry{request: request, ctx: ctx, writer: newWriter, reader: newReader}
+		if account, _, _ := e.path(); account != "" {
+			u.add(account, usagePolicy(e), request.Method, int64(newReader.ByteCount), int64(newWriter.ByteCount))
+		}
+	})
+}
+
+func NewUsage(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	dir := config.GetDefault("usage_log_dir", "")
+	if dir == "" {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	log, err := usage.NewLogWriter(dir, config.GetDefault("usage_log_prefix", "transfer"), time.Duration(config.GetInt("keep_hours", 168))*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	u := &usageRecorder{
+		start:  time.Now(),
+		usage:  map[usageKey]*usage.Record{},
+		log:    log,
+		errors: metricsScope.Counter("usage_log_errors"),
+	}
+	go u.run(time.Duration(config.GetInt("flush_interval", 60)) * time.Second)
+	return u.handler, nil
+}
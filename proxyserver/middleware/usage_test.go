@@ -0,0 +1,83 @@
+//  Copyright (c) 2015 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RocFang/hummingbird/common/usage"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+func TestUsageRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	log, err := usage.NewLogWriter(dir, "transfer", 0)
+	require.Nil(t, err)
+	start := time.Unix(1500000000, 0)
+	u := &usageRecorder{start: start, usage: map[usageKey]*usage.Record{}, log: log, errors: tally.NoopScope.Counter("errors")}
+	handler := u.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if strings.Contains(r.URL.Path, "/c/") {
+			w.Header().Set("X-Backend-Storage-Policy-Index", "1")
+		}
+		w.WriteHeader(200)
+		w.Write([]byte("hello"))
+	}))
+	for _, req := range []struct {
+		method, path, body, source string
+	}{
+		{"PUT", "/v1/a/c/o", "some data", ""},
+		{"GET", "/v1/a/c/o", "", ""},
+		{"GET", "/v1/a/c/o2", "", ""},
+		{"GET", "/v1/a/c/o", "", "SLO"},
+		{"HEAD", "/v1/a", "", ""},
+		{"GET", "/info", "", ""},
+		{"PUT", "/v1/b/c/o", "x", ""},
+	} {
+		request := httptest.NewRequest(req.method, req.path, strings.NewReader(req.body))
+		request = request.WithContext(context.WithValue(request.Context(), "proxycontext", &ProxyContext{Logger: zap.NewNop(), Source: req.source}))
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	require.Nil(t, u.flush(start.Add(time.Minute)))
+	require.Nil(t, u.flush(start.Add(2*time.Minute)))
+	require.Nil(t, log.Close())
+
+	f, err := os.Open(filepath.Join(dir, "transfer-2017071402.log"))
+	require.Nil(t, err)
+	defer f.Close()
+	var records []*usage.Record
+	require.Nil(t, usage.ReadLog(f, func(r *usage.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	require.Equal(t, []*usage.Record{
+		{Kind: usage.KindTransfer, Time: 1500000000, Account: "a", Policy: -1, Requests: map[string]int64{"HEAD": 1}, BytesOut: 5},
+		{Kind: usage.KindTransfer, Time: 1500000000, Account: "a", Policy: 1, Requests: map[string]int64{"PUT": 1, "GET": 2}, BytesIn: 9, BytesOut: 15},
+		{Kind: usage.KindTransfer, Time: 1500000000, Account: "b", Policy: 1, Requests: map[string]int64{"PUT": 1}, BytesIn: 1, BytesOut: 5},
+	}, records)
+}
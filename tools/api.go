@@ -0,0 +1,245 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RocFang/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+type apiQueuedReplication struct {
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+	Type         string    `json:"type"`
+	Policy       int       `json:"policy"`
+	Partition    int       `json:"partition"`
+	Reason       string    `json:"reason"`
+	FromDeviceID int       `json:"from_device"`
+	ToDeviceID   int       `json:"to_device"`
+}
+
+type apiDispersionScanFailure struct {
+	Time      time.Time `json:"time"`
+	Partition int       `json:"partition"`
+	Service   string    `json:"service,omitempty"`
+	DeviceID  int       `json:"device"`
+}
+
+type apiProcessPass struct {
+	Process              string     `json:"process"`
+	Type                 string     `json:"type"`
+	Policy               int        `json:"policy"`
+	StartDate            *time.Time `json:"start_date"`
+	ProgressDate         *time.Time `json:"progress_date"`
+	Progress             string     `json:"progress"`
+	CompleteDate         *time.Time `json:"complete_date"`
+	PreviousProgress     string     `json:"previous_progress"`
+	PreviousCompleteDate *time.Time `json:"previous_complete_date"`
+}
+
+type apiRingLogEntry struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+type apiStateEntry struct {
+	Recorded time.Time `json:"recorded"`
+	Up       bool      `json:"up"`
+	Size     int64     `json:"size,omitempty"`
+	Used     int64     `json:"used,omitempty"`
+}
+
+// apiTime gives nil for the zero times the database uses for "never".
+func apiTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (server *AutoAdmin) apiRespond(writer http.ResponseWriter, request *http.Request, v interface{}, err error) {
+	if err != nil {
+		server.logger.Error("andrewd api error", zap.String("path", request.URL.Path), zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		server.logger.Error("Error marshaling api response", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(data)
+}
+
+// apiTypePolicy returns the ring type and policy from the path, or false
+// after writing a 400 if they aren't valid.
+func apiTypePolicy(writer http.ResponseWriter, typ, policy string) (string, int, bool) {
+	if typ != "account" && typ != "container" && typ != "object" {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid type: "+typ)
+		return "", 0, false
+	}
+	p, err := strconv.Atoi(policy)
+	if err != nil || p < 0 {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid policy: "+policy)
+		return "", 0, false
+	}
+	return typ, p, true
+}
+
+func (server *AutoAdmin) listReplicationsHandler(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	policy := -1
+	if v := query.Get("policy"); v != "" {
+		var err error
+		if policy, err = strconv.Atoi(v); err != nil || policy < 0 {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid policy: "+v)
+			return
+		}
+	}
+	qrs, err := server.db.queuedReplications(query.Get("type"), policy, query.Get("reason"))
+	entries := []*apiQueuedReplication{}
+	for _, qr := range qrs {
+		entries = append(entries, &apiQueuedReplication{
+			Created:      qr.created,
+			Updated:      qr.updated,
+			Type:         qr.typ,
+			Policy:       qr.policy,
+			Partition:    qr.partition,
+			Reason:       qr.reason,
+			FromDeviceID: qr.fromDeviceID,
+			ToDeviceID:   qr.toDeviceID,
+		})
+	}
+	server.apiRespond(writer, request, entries, err)
+}
+
+func (server *AutoAdmin) cancelReplicationsHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	typ, policy, ok := apiTypePolicy(writer, vars["type"], vars["policy"])
+	if !ok {
+		return
+	}
+	query := request.URL.Query()
+	partition := int64(-1)
+	if v := query.Get("partition"); v != "" {
+		var err error
+		if partition, err = strconv.ParseInt(v, 10, 64); err != nil || partition < 0 {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid partition: "+v)
+			return
+		}
+	}
+	cancelled, err := server.db.cancelQueuedReplications(typ, policy, partition, query.Get("reason"))
+	if err == nil {
+		server.logger.Info("Cancelled queued replications", zap.String("type", typ), zap.Int("policy", policy),
+			zap.Int64("partition", partition), zap.String("reason", query.Get("reason")), zap.Int64("cancelled", cancelled))
+	}
+	server.apiRespond(writer, request, map[string]int64{"cancelled": cancelled}, err)
+}
+
+func (server *AutoAdmin) dispersionFailuresHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	typ, policy, ok := apiTypePolicy(writer, vars["type"], vars["policy"])
+	if !ok {
+		return
+	}
+	dsfs, err := server.db.dispersionScanFailures(typ, policy)
+	entries := []*apiDispersionScanFailure{}
+	for _, dsf := range dsfs {
+		entries = append(entries, &apiDispersionScanFailure{Time: dsf.time, Partition: dsf.partition, Service: dsf.service, DeviceID: dsf.deviceID})
+	}
+	server.apiRespond(writer, request, entries, err)
+}
+
+func (server *AutoAdmin) processPassesHandler(writer http.ResponseWriter, request *http.Request) {
+	ppds, err := server.db.processPasses()
+	entries := []*apiProcessPass{}
+	for _, ppd := range ppds {
+		entries = append(entries, &apiProcessPass{
+			Process:              ppd.process,
+			Type:                 ppd.rtype,
+			Policy:               ppd.policy,
+			StartDate:            apiTime(ppd.startDate),
+			ProgressDate:         apiTime(ppd.progressDate),
+			Progress:             ppd.progress,
+			CompleteDate:         apiTime(ppd.completeDate),
+			PreviousProgress:     ppd.previousProgress,
+			PreviousCompleteDate: apiTime(ppd.previousCompleteDate),
+		})
+	}
+	server.apiRespond(writer, request, entries, err)
+}
+
+func (server *AutoAdmin) ringLogHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	typ, policy, ok := apiTypePolicy(writer, vars["type"], vars["policy"])
+	if !ok {
+		return
+	}
+	rles, err := server.db.ringLogs(typ, policy)
+	entries := []*apiRingLogEntry{}
+	for _, rle := range rles {
+		entries = append(entries, &apiRingLogEntry{Time: rle.Time, Reason: rle.Reason})
+	}
+	server.apiRespond(writer, request, entries, err)
+}
+
+func apiStates(states []*stateEntry) []*apiStateEntry {
+	entries := []*apiStateEntry{}
+	for _, state := range states {
+		entries = append(entries, &apiStateEntry{Recorded: state.recorded, Up: state.state, Size: state.size, Used: state.used})
+	}
+	return entries
+}
+
+func (server *AutoAdmin) serverStatesHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	port, err := strconv.Atoi(vars["port"])
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid port: "+vars["port"])
+		return
+	}
+	states, err := server.db.serverStates(vars["ip"], port)
+	server.apiRespond(writer, request, apiStates(states), err)
+}
+
+func (server *AutoAdmin) deviceStatesHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	port, err := strconv.Atoi(vars["port"])
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid port: "+vars["port"])
+		return
+	}
+	states, err := server.db.deviceStates(vars["ip"], port, vars["device"])
+	server.apiRespond(writer, request, apiStates(states), err)
+}
+
+func (server *AutoAdmin) ringScanHandler(writer http.ResponseWriter, request *http.Request) {
+	select {
+	case server.fastRingScan <- struct{}{}:
+	default:
+		// Plenty of fast scans are already waiting.
+	}
+	srv.StandardResponse(writer, http.StatusAccepted)
+}
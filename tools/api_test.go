@@ -0,0 +1,127 @@
+//  Copyright (c) 2018 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RocFang/hummingbird/common/srv"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newAPITestAdmin(t *testing.T, name string) *AutoAdmin {
+	db, err := newDB(nil, dbTestName(name))
+	require.Nil(t, err)
+	return &AutoAdmin{logger: zap.NewNop(), db: db, fastRingScan: make(chan struct{}, 1)}
+}
+
+func apiTestRequest(method, path string, vars map[string]string) *http.Request {
+	return srv.SetVars(httptest.NewRequest(method, path, nil), vars)
+}
+
+func TestAPIReplications(t *testing.T) {
+	aa := newAPITestAdmin(t, "TestAPIReplications")
+	require.Nil(t, aa.db.queuePartitionReplication("object", 0, 1, "ring", -1, 2))
+	require.Nil(t, aa.db.queuePartitionReplication("object", 0, 2, "dispersion", -1, 3))
+	require.Nil(t, aa.db.queuePartitionReplication("container", 0, 1, "ring", -1, 2))
+
+	w := httptest.NewRecorder()
+	aa.listReplicationsHandler(w, apiTestRequest("GET", "/replications?type=object", nil))
+	require.Equal(t, 200, w.Code)
+	var qrs []*apiQueuedReplication
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &qrs))
+	require.Equal(t, 2, len(qrs))
+	require.Equal(t, "object", qrs[0].Type)
+
+	w = httptest.NewRecorder()
+	aa.cancelReplicationsHandler(w, apiTestRequest("DELETE", "/replications/object/0?partition=2", map[string]string{"type": "object", "policy": "0"}))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, `{"cancelled":1}`, w.Body.String())
+	qrsLeft, err := aa.db.queuedReplications("", -1, "")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(qrsLeft))
+
+	w = httptest.NewRecorder()
+	aa.cancelReplicationsHandler(w, apiTestRequest("DELETE", "/replications/nope/0", map[string]string{"type": "nope", "policy": "0"}))
+	require.Equal(t, 400, w.Code)
+	w = httptest.NewRecorder()
+	aa.listReplicationsHandler(w, apiTestRequest("GET", "/replications?policy=x", nil))
+	require.Equal(t, 400, w.Code)
+}
+
+func TestAPIProcessPassesAndRingLog(t *testing.T) {
+	aa := newAPITestAdmin(t, "TestAPIProcessPassesAndRingLog")
+	require.Nil(t, aa.db.startProcessPass("dispersion scan", "object", 0))
+	require.Nil(t, aa.db.progressProcessPass("dispersion scan", "object", 0, "5 of 10"))
+	require.Nil(t, aa.db.addRingLog("object", 0, "rebalanced"))
+
+	w := httptest.NewRecorder()
+	aa.processPassesHandler(w, apiTestRequest("GET", "/process-passes", nil))
+	require.Equal(t, 200, w.Code)
+	var pps []*apiProcessPass
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &pps))
+	require.Equal(t, 1, len(pps))
+	require.Equal(t, "5 of 10", pps[0].Progress)
+	require.NotNil(t, pps[0].StartDate)
+	require.Nil(t, pps[0].CompleteDate)
+
+	w = httptest.NewRecorder()
+	aa.ringLogHandler(w, apiTestRequest("GET", "/ring-log/object/0", map[string]string{"type": "object", "policy": "0"}))
+	require.Equal(t, 200, w.Code)
+	var rles []*apiRingLogEntry
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &rles))
+	require.Equal(t, 1, len(rles))
+	require.Equal(t, "rebalanced", rles[0].Reason)
+}
+
+func TestAPIStates(t *testing.T) {
+	aa := newAPITestAdmin(t, "TestAPIStates")
+	retention := time.Now().Add(-time.Hour)
+	require.Nil(t, aa.db.addDeviceState("1.2.3.4", 6000, "sda", true, retention, 100, 10))
+	require.Nil(t, aa.db.addServerState("1.2.3.4", 6000, false, retention))
+
+	w := httptest.NewRecorder()
+	aa.deviceStatesHandler(w, apiTestRequest("GET", "/device-states/1.2.3.4/6000/sda", map[string]string{"ip": "1.2.3.4", "port": "6000", "device": "sda"}))
+	require.Equal(t, 200, w.Code)
+	var states []*apiStateEntry
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &states))
+	require.Equal(t, 1, len(states))
+	require.True(t, states[0].Up)
+	require.Equal(t, int64(10), states[0].Used)
+
+	w = httptest.NewRecorder()
+	aa.serverStatesHandler(w, apiTestRequest("GET", "/server-states/1.2.3.4/6000", map[string]string{"ip": "1.2.3.4", "port": "6000"}))
+	require.Equal(t, 200, w.Code)
+	states = nil
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &states))
+	require.Equal(t, 1, len(states))
+	require.False(t, states[0].Up)
+}
+
+func TestAPIRingScan(t *testing.T) {
+	aa := newAPITestAdmin(t, "TestAPIRingScan")
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		aa.ringScanHandler(w, apiTestRequest("POST", "/ring-scan", nil))
+		require.Equal(t, 202, w.Code)
+	}
+	require.Equal(t, 1, len(aa.fastRingScan))
+}
@@ -289,6 +289,31 @@ func (db *dbInstance) clearQueuedReplication(qr *queuedReplication) error {
 	return err
 }
 
+// cancelQueuedReplications removes the queued replications for the ring type
+// and policy index, returning how many there were. You can set partition < 0
+// for all partitions and reason == "" for all reasons.
+func (db *dbInstance) cancelQueuedReplications(typ string, policy int, partition int64, reason string) (int64, error) {
+	query := `
+        DELETE FROM replication_queue
+        WHERE rtype = ?
+          AND policy = ?
+    `
+	args := []interface{}{typ, policy}
+	if partition >= 0 {
+		query += " AND partition = ?"
+		args = append(args, partition)
+	}
+	if reason != "" {
+		query += " AND reason = ?"
+		args = append(args, reason)
+	}
+	result, err := db.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 func (db *dbInstance) clearDispersionScanFailures(typ string, policy int) error {
 	_, err := db.db.Exec(`
         DELETE FROM dispersion_scan_failure
@@ -658,6 +658,15 @@ func (server *AutoAdmin) GetHandler(config conf.Config, metricsPrefix string) ht
 	router.Get("/loglevel", server.logLevel)
 	router.Put("/loglevel", server.logLevel)
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
+	// The management API over the state andrewd keeps in its database.
+	router.Get("/replications", commonHandlers.ThenFunc(server.listReplicationsHandler))
+	router.Delete("/replications/:type/:policy", commonHandlers.ThenFunc(server.cancelReplicationsHandler))
+	router.Get("/dispersion-failures/:type/:policy", commonHandlers.ThenFunc(server.dispersionFailuresHandler))
+	router.Get("/process-passes", commonHandlers.ThenFunc(server.processPassesHandler))
+	router.Get("/ring-log/:type/:policy", commonHandlers.ThenFunc(server.ringLogHandler))
+	router.Get("/server-states/:ip/:port", commonHandlers.ThenFunc(server.serverStatesHandler))
+	router.Get("/device-states/:ip/:port/:device", commonHandlers.ThenFunc(server.deviceStatesHandler))
+	router.Post("/ring-scan", commonHandlers.ThenFunc(server.ringScanHandler))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
 	return alice.New(middleware.Metrics(metricsScope)).Then(router)
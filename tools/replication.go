@@ -169,6 +169,12 @@ func (r *replication) handleQueuedReplication(ctx *replicationContext, qr *queue
 		logger.Error("programming error; the to-device is invalid")
 		return
 	}
+	if ring.NextPartPower(ryng) != 0 {
+		// The servers won't replicate until the increase is finished, so
+		// the job is left queued for a later pass.
+		logger.Debug("skipping as a partition power increase is in progress")
+		return
+	}
 	toDev := ryng.AllDevices()[qr.toDeviceID]
 	if toDev != nil && !toDev.Active() {
 		toDev = nil
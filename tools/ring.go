@@ -18,14 +18,22 @@ package tools
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/RocFang/hummingbird/common/ring"
+	"github.com/RocFang/hummingbird/objectserver"
 	"github.com/gholt/brimtext"
 )
 
@@ -41,6 +49,285 @@ func PrintDevs(devs []*ring.RingBuilderDevice) {
 	fmt.Println(brimtext.Align(data, brimtext.NewSimpleAlignOptions()))
 }
 
+// builderPolicy gives the storage policy of an object ring or ring builder,
+// based on its file name: object.builder is policy 0 and object-N.builder is
+// policy N.
+func builderPolicy(pth string) (int, error) {
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(pth), ".builder"), ".ring.gz")
+	if name == "object" {
+		return 0, nil
+	}
+	if !strings.HasPrefix(name, "object-") {
+		return 0, fmt.Errorf("%s is not an object ring", pth)
+	}
+	policy, err := strconv.Atoi(strings.TrimPrefix(name, "object-"))
+	if err != nil || policy < 0 {
+		return 0, fmt.Errorf("%s is not an object ring", pth)
+	}
+	return policy, nil
+}
+
+// partPowers gives the current and next part power from either a ring
+// builder or, since object servers usually only have those, a ring file.
+func partPowers(pth string, debug bool) (int, int, error) {
+	if strings.HasSuffix(pth, ".ring.gz") {
+		r, err := ring.LoadRingMD5(pth, "", "")
+		if err != nil {
+			return 0, 0, err
+		}
+		return bits.Len64(r.PartitionCount() - 1), ring.NextPartPower(r), nil
+	}
+	builder, err := ring.NewRingBuilderFromFile(pth, debug)
+	if err != nil {
+		return 0, 0, err
+	}
+	return builder.PartPower, builder.NextPartPower, nil
+}
+
+// relinkDevices runs the relink or cleanup step of a partition power
+// increase over the local devices.
+func relinkDevices(pth, cmd, devices, device string, debug bool) error {
+	policy, err := builderPolicy(pth)
+	if err != nil {
+		return err
+	}
+	partPower, nextPartPower, err := partPowers(pth, debug)
+	if err != nil {
+		return err
+	}
+	if nextPartPower == 0 {
+		return errors.New("No partition power increase in progress.")
+	}
+	if cmd == "relink" && nextPartPower != partPower+1 {
+		return errors.New("Partition power already increased; run cleanup instead.")
+	}
+	if cmd == "cleanup" && nextPartPower != partPower {
+		return errors.New("Partition power not increased yet; run relink and increase_partition_power first.")
+	}
+	var deviceNames []string
+	if device != "" {
+		deviceNames = []string{device}
+	} else {
+		fis, err := ioutil.ReadDir(devices)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				deviceNames = append(deviceNames, fi.Name())
+			}
+		}
+	}
+	failed := false
+	for _, name := range deviceNames {
+		var stats *objectserver.RelinkStats
+		if cmd == "relink" {
+			stats, err = objectserver.RelinkDevice(filepath.Join(devices, name), policy, uint(nextPartPower))
+		} else {
+			stats, err = objectserver.CleanupDevice(filepath.Join(devices, name), policy, uint(partPower))
+		}
+		if err != nil {
+			fmt.Printf("%s: %s\n", name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: %d hash dirs, %d linked, %d removed, %d errors\n", name, stats.HashDirs, stats.Linked, stats.Removed, stats.Errors)
+		if stats.Errors > 0 {
+			failed = true
+		}
+	}
+	if failed {
+		return fmt.Errorf("%s did not complete cleanly; run it again.", cmd)
+	}
+	return nil
+}
+
+var errDeviceFormat = errors.New("Invalid device format")
+
+// parseDevice parses a device of the form
+// [r<region>]z<zone>[s<scheme>]-<ip>:<port>[R<r_ip>:<r_port>]/<device_name>_<meta>
+// returning errDeviceFormat if it doesn't match.
+func parseDevice(deviceStr string) (*ring.RingBuilderDevice, error) {
+	var err error
+	dev := &ring.RingBuilderDevice{Id: -1}
+	rx := regexp.MustCompile(`^(?:r(?P<region>\d+))?z(?P<zone>\d+)(?:s(?P<scheme>http|https))?-(?P<ip>[\d\.]+):(?P<port>\d+)(?:R(?P<replication_ip>[\d\.]+):(?P<replication_port>\d+))?\/(?P<device>[^_]+)(?:_(?P<metadata>.+))?$`)
+	matches := rx.FindAllStringSubmatch(deviceStr, -1)
+	if len(matches) == 0 {
+		return nil, errDeviceFormat
+	}
+	if matches[0][1] != "" {
+		if dev.Region, err = strconv.ParseInt(matches[0][1], 0, 64); err != nil {
+			return nil, err
+		}
+	}
+	if dev.Zone, err = strconv.ParseInt(matches[0][2], 0, 64); err != nil {
+		return nil, err
+	}
+	dev.Scheme = "http"
+	if matches[0][3] != "" {
+		dev.Scheme = matches[0][3]
+	}
+	dev.Ip = matches[0][4]
+	if dev.Port, err = strconv.ParseInt(matches[0][5], 0, 64); err != nil {
+		return nil, err
+	}
+	if matches[0][6] != "" {
+		dev.ReplicationIp = matches[0][6]
+		if dev.ReplicationPort, err = strconv.ParseInt(matches[0][7], 0, 64); err != nil {
+			return nil, err
+		}
+	}
+	dev.Device = matches[0][8]
+	dev.Meta = matches[0][9]
+	return dev, nil
+}
+
+// parseSimulatedChanges parses a list of changes like
+// add <device> <weight> set_weight <id> <weight> remove <id>
+func parseSimulatedChanges(args []string) ([]*ring.SimulatedChange, error) {
+	var changes []*ring.SimulatedChange
+	for len(args) > 0 {
+		change := &ring.SimulatedChange{Op: args[0]}
+		var err error
+		switch args[0] {
+		case "add":
+			if len(args) < 3 {
+				return nil, errors.New("add needs a device and a weight")
+			}
+			if change.Dev, err = parseDevice(args[1]); err != nil {
+				return nil, fmt.Errorf("%s: %s", args[1], err)
+			}
+			if change.Dev.Weight, err = strconv.ParseFloat(args[2], 64); err != nil {
+				return nil, err
+			}
+			args = args[3:]
+		case "set_weight":
+			if len(args) < 3 {
+				return nil, errors.New("set_weight needs a device id and a weight")
+			}
+			if change.DevId, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return nil, err
+			}
+			if change.Weight, err = strconv.ParseFloat(args[2], 64); err != nil {
+				return nil, err
+			}
+			args = args[3:]
+		case "remove":
+			if len(args) < 2 {
+				return nil, errors.New("remove needs a device id")
+			}
+			if change.DevId, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return nil, err
+			}
+			args = args[2:]
+		default:
+			return nil, fmt.Errorf("Unknown change %q", args[0])
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// reconBytesPerPart estimates the size of a partition replica on each
+// device from the used space the servers report to recon. The used space
+// covers everything on the drive, so it overestimates for drives shared
+// between rings.
+func reconBytesPerPart(builder *ring.RingBuilder) map[int64]float64 {
+	type reconData struct {
+		Device  string
+		Mounted bool
+		Used    int64
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	servers := map[string][]*ring.RingBuilderDevice{}
+	for _, dev := range builder.Devs {
+		if dev != nil && dev.Parts > 0 {
+			url := fmt.Sprintf("%s://%s:%d/recon/diskusage", dev.Scheme, dev.Ip, dev.Port)
+			servers[url] = append(servers[url], dev)
+		}
+	}
+	bytesPerPart := map[int64]float64{}
+	for url, devs := range servers {
+		resp, err := client.Get(url)
+		if err != nil {
+			fmt.Printf("Could not get disk usage from %s: %s\n", url, err)
+			continue
+		}
+		var rData []*reconData
+		err = json.NewDecoder(resp.Body).Decode(&rData)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Printf("Could not parse disk usage from %s: %s\n", url, err)
+			continue
+		}
+		for _, rd := range rData {
+			if !rd.Mounted {
+				continue
+			}
+			for _, dev := range devs {
+				if dev.Device == rd.Device {
+					bytesPerPart[dev.Id] = float64(rd.Used) / float64(dev.Parts)
+				}
+			}
+		}
+	}
+	return bytesPerPart
+}
+
+// printSimulationReport prints what a simulated change would do.
+func printSimulationReport(pth string, changes int, report *ring.SimulationReport) {
+	fmt.Printf("Simulated %d changes to %s\n", changes, pth)
+	for i, round := range report.Rounds {
+		fmt.Printf("Rebalance %d: %d partition replicas moved, %d devices removed, balance %.2f, dispersion %.2f\n", i+1, round.Moved, round.Removed, round.Balance, round.Dispersion)
+	}
+	if len(report.Rounds) > 0 {
+		wait := time.Duration(report.MinPartHours*(len(report.Rounds)-1)) * time.Hour
+		fmt.Printf("%d rebalances needed, taking at least %v with min_part_hours of %d\n", len(report.Rounds), wait, report.MinPartHours)
+	}
+	if !report.Converged {
+		fmt.Printf("Partitions were still moving after %d rebalances\n", len(report.Rounds))
+	}
+	fmt.Printf("%d partition replicas moved in total; final balance %.2f, dispersion %.2f\n", report.Moved, report.Balance, report.Dispersion)
+	if report.BytesUnknown > 0 {
+		fmt.Printf("Estimated %d bytes to move, plus %d partition replicas of unknown size\n", report.BytesToMove, report.BytesUnknown)
+	} else {
+		fmt.Printf("Estimated %d bytes to move\n", report.BytesToMove)
+	}
+	var ids []int
+	for id := range report.MovedByDevice {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	data := [][]string{{"ID", "REGION", "ZONE", "IP ADDRESS", "PORT", "NAME", "WEIGHT", "PARTS IN", "PARTS OUT"}, nil}
+	for _, id := range ids {
+		dev := report.Devices[int64(id)]
+		moves := report.MovedByDevice[int64(id)]
+		data = append(data, []string{strconv.Itoa(id), strconv.FormatInt(dev.Region, 10), strconv.FormatInt(dev.Zone, 10), dev.Ip, strconv.FormatInt(dev.Port, 10), dev.Device, strconv.FormatFloat(dev.Weight, 'f', -1, 64), strconv.Itoa(moves.In), strconv.Itoa(moves.Out)})
+	}
+	fmt.Println(brimtext.Align(data, brimtext.NewSimpleAlignOptions()))
+	var zones []string
+	for zone := range report.MovedByZone {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	data = [][]string{{"ZONE", "PARTS IN", "PARTS OUT"}, nil}
+	for _, zone := range zones {
+		data = append(data, []string{zone, strconv.Itoa(report.MovedByZone[zone].In), strconv.Itoa(report.MovedByZone[zone].Out)})
+	}
+	fmt.Println(brimtext.Align(data, brimtext.NewSimpleAlignOptions()))
+	var regions []int
+	for region := range report.MovedByRegion {
+		regions = append(regions, int(region))
+	}
+	sort.Ints(regions)
+	data = [][]string{{"REGION", "PARTS IN", "PARTS OUT"}, nil}
+	for _, region := range regions {
+		moves := report.MovedByRegion[int64(region)]
+		data = append(data, []string{strconv.Itoa(region), strconv.Itoa(moves.In), strconv.Itoa(moves.Out)})
+	}
+	fmt.Println(brimtext.Align(data, brimtext.NewSimpleAlignOptions()))
+}
+
 func RingBuildCmd(flags *flag.FlagSet) {
 	args := flags.Args()
 	if len(args) < 1 || args[0] == "help" {
@@ -51,7 +338,9 @@ func RingBuildCmd(flags *flag.FlagSet) {
 	jsonOut := flags.Lookup("json").Value.String() == "true"
 	pth := args[0]
 	cmd := ""
-	if len(args) == 1 {
+	if len(args) == 1 && strings.HasSuffix(pth, ".composite") {
+		cmd = "compose_info"
+	} else if len(args) == 1 {
 		cmd = "info"
 	} else {
 		cmd = args[1]
@@ -107,6 +396,139 @@ func RingBuildCmd(flags *flag.FlagSet) {
 		ring.PretendMinPartHoursPassed(pth)
 		return
 
+	case "prepare_increase_partition_power":
+		if err := ring.PreparePartPowerIncrease(pth); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Next partition power set; push the ring out, then relink every object server.")
+		return
+
+	case "increase_partition_power":
+		if err := ring.IncreasePartPower(pth); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Partition power increased; push the ring out, then clean up every object server.")
+		return
+
+	case "finish_increase_partition_power":
+		if err := ring.FinishPartPowerIncrease(pth); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Partition power increase finished; push the ring out.")
+		return
+
+	case "simulate":
+		simulateFlags := flag.NewFlagSet("simulate", flag.ExitOnError)
+		rounds := simulateFlags.Int("rounds", 10, "The most rebalances to simulate.")
+		recon := simulateFlags.Bool("recon", false, "Estimate the bytes to move from the servers' recon disk usage.")
+		if err := simulateFlags.Parse(args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		changes, err := parseSimulatedChanges(simulateFlags.Args())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		builder, err := ring.NewRingBuilderFromFile(pth, debug)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		bytesPerPart := map[int64]float64{}
+		if *recon {
+			bytesPerPart = reconBytesPerPart(builder)
+		}
+		report, err := builder.Simulate(changes, *rounds, bytesPerPart)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if jsonOut {
+			b, err := json.Marshal(report)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			os.Stdout.Write(b)
+			os.Stdout.Write([]byte("\n"))
+			return
+		}
+		printSimulationReport(pth, len(changes), report)
+		return
+
+	case "compose":
+		composeFlags := flag.NewFlagSet("compose", flag.ExitOnError)
+		force := composeFlags.Bool("force", false, "Compose even if the result is incompatible with the existing composite ring.")
+		if err := composeFlags.Parse(args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if composeFlags.NArg() < 2 {
+			flags.Usage()
+			os.Exit(1)
+		}
+		cr, err := ring.Compose(pth, composeFlags.Args(), *force)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Composed version %d with %d replicas from %d components.\n", cr.Version, cr.Replicas, len(cr.Components))
+		return
+
+	case "compose_info":
+		cr, err := ring.LoadCompositeRing(pth)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if jsonOut {
+			b, err := json.Marshal(cr)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			os.Stdout.Write(b)
+			os.Stdout.Write([]byte("\n"))
+			return
+		}
+		fmt.Printf("%s, composite version %d, composed %s, %d partitions, %d replicas\n", pth, cr.Version, time.Unix(cr.ComposeTime, 0).UTC().Format(time.RFC3339), 1<<uint(cr.PartPower), cr.Replicas)
+		data := [][]string{{"BUILDER", "VERSION", "REPLICAS", "REGIONS", "DEVICE IDS"}, nil}
+		for _, component := range cr.Components {
+			regions := make([]string, len(component.Regions))
+			for i, region := range component.Regions {
+				regions[i] = strconv.Itoa(region)
+			}
+			data = append(data, []string{component.BuilderFile, strconv.Itoa(component.Version), strconv.Itoa(component.Replicas), strings.Join(regions, ","), fmt.Sprintf("%d-%d", component.DevOffset, component.DevOffset+component.DevCount-1)})
+		}
+		fmt.Println(brimtext.Align(data, brimtext.NewSimpleAlignOptions()))
+		return
+
+	case "compose_validate":
+		if err := ring.ValidateComposite(pth); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("Composite ring is valid.")
+		return
+
+	case "relink", "cleanup":
+		relinkFlags := flag.NewFlagSet(cmd, flag.ExitOnError)
+		devices := relinkFlags.String("devices", "/srv/node", "Directory the devices are mounted under.")
+		device := relinkFlags.String("device", "", "Only process this device.")
+		if err := relinkFlags.Parse(args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := relinkDevices(pth, cmd, *devices, *device, debug); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+
 	case "search":
 		searchFlags := flag.NewFlagSet("search", flag.ExitOnError)
 		region := searchFlags.Int64("region", -1, "Device region.")
@@ -319,71 +741,29 @@ func RingBuildCmd(flags *flag.FlagSet) {
 	case "add":
 		// TODO: Add config option version of add function
 		// TODO: Add support for multiple adds in a single command
-		var err error
-		var region, zone, port, replicationPort int64
-		var ip, replicationIp, device, scheme string
-		var weight float64
-
 		if len(args) < 4 {
 			flags.Usage()
 			os.Exit(1)
 		}
-		deviceStr := args[2]
-		rx := regexp.MustCompile(`^(?:r(?P<region>\d+))?z(?P<zone>\d+)(?:s(?P<scheme>http|https))?-(?P<ip>[\d\.]+):(?P<port>\d+)(?:R(?P<replication_ip>[\d\.]+):(?P<replication_port>\d+))?\/(?P<device>[^_]+)(?:_(?P<metadata>.+))?$`)
-		matches := rx.FindAllStringSubmatch(deviceStr, -1)
-		if len(matches) == 0 {
+		dev, err := parseDevice(args[2])
+		if err == errDeviceFormat {
 			flags.Usage()
 			os.Exit(1)
-		}
-		if matches[0][1] != "" {
-			region, err = strconv.ParseInt(matches[0][1], 0, 64)
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-		} else {
-			region = 0
-		}
-		zone, err = strconv.ParseInt(matches[0][2], 0, 64)
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		if matches[0][3] != "" {
-			scheme = matches[0][3]
-		} else {
-			scheme = "http"
-		}
-		ip = matches[0][4]
-		port, err = strconv.ParseInt(matches[0][5], 0, 64)
-		if err != nil {
+		} else if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-
-		if matches[0][6] != "" {
-			replicationIp = matches[0][6]
-			replicationPort, err = strconv.ParseInt(matches[0][7], 0, 64)
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-		} else {
-			replicationIp = ""
-			replicationPort = 0
-		}
-		device = matches[0][8]
-		weight, err = strconv.ParseFloat(args[3], 64)
+		weight, err := strconv.ParseFloat(args[3], 64)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-		id, err := ring.AddDevice(pth, -1, region, zone, scheme, ip, port, replicationIp, replicationPort, device, weight, debug)
+		id, err := ring.AddDevice(pth, -1, dev.Region, dev.Zone, dev.Scheme, dev.Ip, dev.Port, dev.ReplicationIp, dev.ReplicationPort, dev.Device, weight, debug)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		} else {
-			fmt.Printf("Device %s with %.2f weight added with id %d\n", device, weight, id)
+			fmt.Printf("Device %s with %.2f weight added with id %d\n", dev.Device, weight, id)
 		}
 	case "load":
 		builder, err := ring.NewRingBuilderFromFile(pth, debug)
@@ -429,6 +809,9 @@ func RingBuildCmd(flags *flag.FlagSet) {
 			fmt.Printf("%s, build version %d, %d partitions, %.6f replicas, %d regions, %d zones, %d devices, %.02f balance\n", pth, builder.Version, builder.Parts, builder.Replicas, regions, zones, devCount, balance)
 			fmt.Printf("The minimum number of hours before a partition can be reassigned is %v (%v remaining)\n", builder.MinPartHours, time.Duration(builder.MinPartSecondsLeft())*time.Second)
 			fmt.Printf("The overload factor is %0.2f%% (%.6f)\n", builder.Overload*100, builder.Overload)
+			if builder.NextPartPower != 0 {
+				fmt.Printf("Partition power increase to %d in progress (current part power %d)\n", builder.NextPartPower, builder.PartPower)
+			}
 
 			// Compare ring file against builder file
 			// TODO: Figure out how to do ring comparisons
@@ -0,0 +1,86 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/RocFang/hummingbird/common/ring"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDevice(t *testing.T) {
+	dev, err := parseDevice("r1z2shttps-1.2.3.4:6000R5.6.7.8:6500/sdb_fast")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), dev.Region)
+	require.Equal(t, int64(2), dev.Zone)
+	require.Equal(t, "https", dev.Scheme)
+	require.Equal(t, "1.2.3.4", dev.Ip)
+	require.Equal(t, int64(6000), dev.Port)
+	require.Equal(t, "5.6.7.8", dev.ReplicationIp)
+	require.Equal(t, int64(6500), dev.ReplicationPort)
+	require.Equal(t, "sdb", dev.Device)
+	require.Equal(t, "fast", dev.Meta)
+	require.Equal(t, int64(-1), dev.Id)
+	dev, err = parseDevice("z2-1.2.3.4:6000/sdb")
+	require.Nil(t, err)
+	require.Equal(t, "http", dev.Scheme)
+	require.Equal(t, int64(0), dev.Region)
+	_, err = parseDevice("1.2.3.4:6000/sdb")
+	require.Equal(t, errDeviceFormat, err)
+}
+
+func TestParseSimulatedChanges(t *testing.T) {
+	changes, err := parseSimulatedChanges([]string{"add", "z1-1.2.3.4:6000/sdb", "100", "set_weight", "3", "50.5", "remove", "7"})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(changes))
+	require.Equal(t, "add", changes[0].Op)
+	require.Equal(t, 100.0, changes[0].Dev.Weight)
+	require.Equal(t, "set_weight", changes[1].Op)
+	require.Equal(t, int64(3), changes[1].DevId)
+	require.Equal(t, 50.5, changes[1].Weight)
+	require.Equal(t, "remove", changes[2].Op)
+	require.Equal(t, int64(7), changes[2].DevId)
+	for _, args := range [][]string{{"add", "z1-1.2.3.4:6000/sdb"}, {"set_weight", "x", "1"}, {"remove"}, {"grow", "1"}} {
+		_, err = parseSimulatedChanges(args)
+		require.NotNil(t, err, args)
+	}
+}
+
+func TestReconBytesPerPart(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/recon/diskusage", r.URL.Path)
+		w.Write([]byte(`[{"device": "sda", "mounted": true, "used": 1000}, {"device": "sdb", "mounted": false, "used": 0}]`))
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	host, ports, err := net.SplitHostPort(u.Host)
+	require.Nil(t, err)
+	port, err := strconv.ParseInt(ports, 10, 64)
+	require.Nil(t, err)
+	builder := &ring.RingBuilder{Devs: []*ring.RingBuilderDevice{
+		{Id: 0, Scheme: "http", Ip: host, Port: port, Device: "sda", Parts: 10},
+		{Id: 1, Scheme: "http", Ip: host, Port: port, Device: "sdb", Parts: 10},
+		{Id: 2, Scheme: "http", Ip: host, Port: port, Device: "sdc", Parts: 0},
+	}}
+	require.Equal(t, map[int64]float64{0: 100}, reconBytesPerPart(builder))
+}
@@ -0,0 +1,286 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/RocFang/hummingbird/accountserver"
+	"github.com/RocFang/hummingbird/common/conf"
+	"github.com/RocFang/hummingbird/common/usage"
+)
+
+// UsageSnapshot logs what every account on this account server is storing,
+// once or every -interval.
+func UsageSnapshot(flags *flag.FlagSet) error {
+	configFile := flags.Lookup("c").Value.(flag.Getter).Get().(string)
+	serverconf, err := conf.LoadConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load %q: %v", configFile, err)
+	}
+	deviceRoot := serverconf.GetDefault("app:account-server", "devices", "/srv/node")
+	w, err := usage.NewLogWriter(flags.Lookup("dir").Value.(flag.Getter).Get().(string), "storage",
+		time.Duration(flags.Lookup("keep-hours").Value.(flag.Getter).Get().(int))*time.Hour)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	interval := flags.Lookup("interval").Value.(flag.Getter).Get().(time.Duration)
+	for {
+		start := time.Now()
+		if err := accountserver.UsageSnapshot(deviceRoot, w); err != nil {
+			if interval <= 0 {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "Usage snapshot:", err)
+		}
+		if interval <= 0 {
+			return nil
+		}
+		time.Sleep(interval - time.Since(start))
+	}
+}
+
+// usageHour is a line of the aggregated usage: an account's requests and
+// bandwidth in a storage policy for the hour, along with the last snapshot
+// of what it was storing there.
+type usageHour struct {
+	Hour           time.Time        `json:"hour"`
+	Account        string           `json:"account"`
+	Policy         int              `json:"policy"`
+	Requests       map[string]int64 `json:"requests"`
+	BytesIn        int64            `json:"bytes_in"`
+	BytesOut       int64            `json:"bytes_out"`
+	ContainerCount int64            `json:"container_count"`
+	ObjectCount    int64            `json:"object_count"`
+	BytesUsed      int64            `json:"bytes_used"`
+}
+
+type usageKey struct {
+	account string
+	policy  int
+}
+
+type usageAggregator struct {
+	transfers map[int64]map[usageKey]*usageHour
+	snapshots map[usageKey][]*usage.Record
+	first     int64
+	last      int64
+}
+
+func newUsageAggregator() *usageAggregator {
+	return &usageAggregator{transfers: map[int64]map[usageKey]*usageHour{}, snapshots: map[usageKey][]*usage.Record{}}
+}
+
+func (a *usageAggregator) add(r *usage.Record) error {
+	key := usageKey{account: r.Account, policy: r.Policy}
+	hour := r.Time - r.Time%3600
+	switch r.Kind {
+	case usage.KindTransfer:
+		if a.transfers[hour] == nil {
+			a.transfers[hour] = map[usageKey]*usageHour{}
+		}
+		h := a.transfers[hour][key]
+		if h == nil {
+			h = &usageHour{Account: r.Account, Policy: r.Policy, Requests: map[string]int64{}}
+			a.transfers[hour][key] = h
+		}
+		for method, count := range r.Requests {
+			h.Requests[method] += count
+		}
+		h.BytesIn += r.BytesIn
+		h.BytesOut += r.BytesOut
+	case usage.KindStorage:
+		a.snapshots[key] = append(a.snapshots[key], r)
+	default:
+		return fmt.Errorf("Unknown usage record kind %q", r.Kind)
+	}
+	if a.first == 0 || hour < a.first {
+		a.first = hour
+	}
+	if hour > a.last {
+		a.last = hour
+	}
+	return nil
+}
+
+// hours returns the usage for each hour from start up to end, or for all the
+// hours seen if they're zero. Storage is taken from the latest snapshot up to
+// the end of the hour, but not one older than maxAge, so accounts stop
+// showing up once they're deleted.
+func (a *usageAggregator) hours(start, end int64, maxAge time.Duration) []*usageHour {
+	if start == 0 {
+		start = a.first
+	}
+	if end == 0 {
+		end = a.last + 3600
+	}
+	keys := map[usageKey]bool{}
+	for key, snapshots := range a.snapshots {
+		keys[key] = true
+		sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time < snapshots[j].Time })
+	}
+	for _, transfers := range a.transfers {
+		for key := range transfers {
+			keys[key] = true
+		}
+	}
+	var hours []*usageHour
+	for hour := start - start%3600; hour < end; hour += 3600 {
+		for key := range keys {
+			h := a.transfers[hour][key]
+			if h == nil {
+				h = &usageHour{Account: key.account, Policy: key.policy, Requests: map[string]int64{}}
+			}
+			snapshots := a.snapshots[key]
+			i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].Time >= hour+3600 }) - 1
+			if i >= 0 && snapshots[i].Time >= hour+3600-int64(maxAge/time.Second) {
+				h.ContainerCount = snapshots[i].ContainerCount
+				h.ObjectCount = snapshots[i].ObjectCount
+				h.BytesUsed = snapshots[i].BytesUsed
+			} else if a.transfers[hour][key] == nil {
+				continue
+			}
+			h.Hour = time.Unix(hour, 0).UTC()
+			hours = append(hours, h)
+		}
+	}
+	sort.Slice(hours, func(i, j int) bool {
+		if !hours[i].Hour.Equal(hours[j].Hour) {
+			return hours[i].Hour.Before(hours[j].Hour)
+		}
+		if hours[i].Account != hours[j].Account {
+			return hours[i].Account < hours[j].Account
+		}
+		return hours[i].Policy < hours[j].Policy
+	})
+	return hours
+}
+
+var usageCSVMethods = []string{"GET", "HEAD", "PUT", "POST", "DELETE"}
+
+func writeUsageCSV(w io.Writer, hours []*usageHour) error {
+	out := csv.NewWriter(w)
+	header := []string{"hour", "account", "policy"}
+	for _, method := range usageCSVMethods {
+		header = append(header, method+"_requests")
+	}
+	header = append(header, "other_requests", "bytes_in", "bytes_out", "container_count", "object_count", "bytes_used")
+	out.Write(header)
+	for _, h := range hours {
+		row := []string{h.Hour.Format(time.RFC3339), h.Account, strconv.Itoa(h.Policy)}
+		other := int64(0)
+		for _, count := range h.Requests {
+			other += count
+		}
+		for _, method := range usageCSVMethods {
+			row = append(row, strconv.FormatInt(h.Requests[method], 10))
+			other -= h.Requests[method]
+		}
+		for _, v := range []int64{other, h.BytesIn, h.BytesOut, h.ContainerCount, h.ObjectCount, h.BytesUsed} {
+			row = append(row, strconv.FormatInt(v, 10))
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func writeUsageJSON(w io.Writer, hours []*usageHour) error {
+	encoder := json.NewEncoder(w)
+	for _, h := range hours {
+		if err := encoder.Encode(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseUsageTime takes a time like 2006-01-02T15, 2006-01-02 or RFC 3339 and
+// returns it as a Unix time; "" is 0.
+func parseUsageTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid time %q", s)
+}
+
+// UsageAggregate reads the proxies' transfer logs and the account servers'
+// storage logs named on the command line and writes hourly usage per account
+// and policy as CSV or JSON.
+func UsageAggregate(flags *flag.FlagSet) error {
+	start, err := parseUsageTime(flags.Lookup("start").Value.(flag.Getter).Get().(string))
+	if err != nil {
+		return err
+	}
+	end, err := parseUsageTime(flags.Lookup("end").Value.(flag.Getter).Get().(string))
+	if err != nil {
+		return err
+	}
+	write := writeUsageCSV
+	switch format := flags.Lookup("format").Value.(flag.Getter).Get().(string); format {
+	case "csv":
+	case "json":
+		write = writeUsageJSON
+	default:
+		return fmt.Errorf("Unknown format %q", format)
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("No usage logs given")
+	}
+	a := newUsageAggregator()
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = usage.ReadLog(f, func(r *usage.Record) error {
+			// Records from hours ending before start can still be the latest
+			// snapshots.
+			if end != 0 && r.Time >= end {
+				return nil
+			}
+			return a.add(r)
+		})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	out := io.Writer(os.Stdout)
+	if output := flags.Lookup("o").Value.(flag.Getter).Get().(string); output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return write(out, a.hours(start, end, flags.Lookup("max-snapshot-age").Value.(flag.Getter).Get().(time.Duration)))
+}
@@ -0,0 +1,102 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RocFang/hummingbird/common/usage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageAggregator(t *testing.T) {
+	hour := int64(1500000000 - 1500000000%3600)
+	a := newUsageAggregator()
+	for _, r := range []*usage.Record{
+		{Kind: usage.KindStorage, Time: hour - 600, Account: "AUTH_a", Policy: 0, ObjectCount: 1, BytesUsed: 10},
+		{Kind: usage.KindTransfer, Time: hour + 60, Account: "AUTH_a", Policy: 0, Requests: map[string]int64{"PUT": 2}, BytesIn: 100},
+		{Kind: usage.KindTransfer, Time: hour + 120, Account: "AUTH_a", Policy: 0, Requests: map[string]int64{"PUT": 1, "GET": 1}, BytesIn: 50, BytesOut: 50},
+		{Kind: usage.KindTransfer, Time: hour + 120, Account: "AUTH_a", Policy: -1, Requests: map[string]int64{"HEAD": 1}},
+		{Kind: usage.KindStorage, Time: hour + 1800, Account: "AUTH_a", Policy: 0, ObjectCount: 3, BytesUsed: 160},
+		// Another replica's snapshot, taken a little earlier.
+		{Kind: usage.KindStorage, Time: hour + 1790, Account: "AUTH_a", Policy: 0, ObjectCount: 2, BytesUsed: 110},
+		{Kind: usage.KindTransfer, Time: hour + 3*3600, Account: "AUTH_b", Policy: 1, Requests: map[string]int64{"COPY": 1}},
+	} {
+		require.Nil(t, a.add(r))
+	}
+	require.NotNil(t, a.add(&usage.Record{Kind: "nope"}))
+
+	hours := a.hours(0, 0, 2*time.Hour)
+	require.Equal(t, 5, len(hours))
+	require.Equal(t, &usageHour{Hour: time.Unix(hour-3600, 0).UTC(), Account: "AUTH_a", Policy: 0, Requests: map[string]int64{},
+		ObjectCount: 1, BytesUsed: 10}, hours[0])
+	require.Equal(t, &usageHour{Hour: time.Unix(hour, 0).UTC(), Account: "AUTH_a", Policy: -1, Requests: map[string]int64{"HEAD": 1}}, hours[1])
+	require.Equal(t, &usageHour{Hour: time.Unix(hour, 0).UTC(), Account: "AUTH_a", Policy: 0, Requests: map[string]int64{"PUT": 3, "GET": 1},
+		BytesIn: 150, BytesOut: 50, ObjectCount: 3, BytesUsed: 160}, hours[2])
+	// The last snapshot carries on until it's too old.
+	require.Equal(t, time.Unix(hour+3600, 0).UTC(), hours[3].Hour)
+	require.Equal(t, int64(160), hours[3].BytesUsed)
+	require.Equal(t, &usageHour{Hour: time.Unix(hour+3*3600, 0).UTC(), Account: "AUTH_b", Policy: 1, Requests: map[string]int64{"COPY": 1}}, hours[4])
+
+	hours = a.hours(hour, hour+3600, 2*time.Hour)
+	require.Equal(t, 2, len(hours))
+
+	var buf bytes.Buffer
+	require.Nil(t, writeUsageCSV(&buf, hours))
+	require.Equal(t, "hour,account,policy,GET_requests,HEAD_requests,PUT_requests,POST_requests,DELETE_requests,other_requests,"+
+		"bytes_in,bytes_out,container_count,object_count,bytes_used\n"+
+		"2017-07-14T02:00:00Z,AUTH_a,-1,0,1,0,0,0,0,0,0,0,0,0\n"+
+		"2017-07-14T02:00:00Z,AUTH_a,0,1,0,3,0,0,0,150,50,0,3,160\n", buf.String())
+}
+
+func TestUsageAggregate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	w, err := usage.NewLogWriter(dir, "transfer", 0)
+	require.Nil(t, err)
+	require.Nil(t, w.Write([]*usage.Record{
+		{Kind: usage.KindTransfer, Time: 1500000000, Account: "AUTH_a", Policy: 0, Requests: map[string]int64{"GET": 1}, BytesOut: 5},
+		{Kind: usage.KindTransfer, Time: 1500010000, Account: "AUTH_a", Policy: 0, Requests: map[string]int64{"GET": 1}, BytesOut: 5},
+	}, time.Unix(1500000000, 0)))
+	require.Nil(t, w.Close())
+	output := filepath.Join(dir, "usage.json")
+
+	flags := flag.NewFlagSet("usage aggregate", flag.ContinueOnError)
+	flags.String("format", "csv", "")
+	flags.String("o", "", "")
+	flags.String("start", "", "")
+	flags.String("end", "", "")
+	flags.Duration("max-snapshot-age", 3*time.Hour, "")
+	require.Nil(t, flags.Parse([]string{"-format", "json", "-o", output, "-end", "2017-07-14T03", filepath.Join(dir, "transfer-2017071402.log")}))
+	require.Nil(t, UsageAggregate(flags))
+	data, err := ioutil.ReadFile(output)
+	require.Nil(t, err)
+	require.Equal(t, `{"hour":"2017-07-14T02:00:00Z","account":"AUTH_a","policy":0,"requests":{"GET":1},"bytes_in":0,"bytes_out":5,`+
+		`"container_count":0,"object_count":0,"bytes_used":0}`, strings.TrimSpace(string(data)))
+
+	require.Nil(t, flags.Parse([]string{"-format", "xml", filepath.Join(dir, "transfer-2017071402.log")}))
+	require.NotNil(t, UsageAggregate(flags))
+	require.Nil(t, flags.Parse([]string{"-format", "csv", "-start", "yesterday", filepath.Join(dir, "transfer-2017071402.log")}))
+	require.NotNil(t, UsageAggregate(flags))
+}